@@ -4,23 +4,32 @@ import (
 	"bufio"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/dustin/go-humanize"
 	"github.com/howeyc/gopass"
 	"github.com/spf13/cobra"
 )
 
 var flagLocale string
+var flagFallbackLocales []string
 var flagTimezone string
 var flagEmail string
 var flagApps []string
+var flagDiskQuota string
+var flagTrashName string
 var flagDev bool
+var flagWindow time.Duration
 
 func validDomain(domain string) bool {
 	return !strings.ContainsAny(domain, " /?#@\t\r\n")
@@ -69,13 +78,25 @@ given domain.
 			dev = "false"
 		}
 
+		var diskQuota uint64
+		if flagDiskQuota != "" {
+			var err error
+			diskQuota, err = humanize.ParseBytes(flagDiskQuota)
+			if err != nil {
+				return err
+			}
+		}
+
 		q := url.Values{
-			"Domain":   {domain},
-			"Apps":     {strings.Join(flagApps, ",")},
-			"Locale":   {flagLocale},
-			"Timezone": {flagTimezone},
-			"Email":    {flagEmail},
-			"Dev":      {dev},
+			"Domain":          {domain},
+			"Apps":            {strings.Join(flagApps, ",")},
+			"Locale":          {flagLocale},
+			"FallbackLocales": {strings.Join(flagFallbackLocales, ",")},
+			"Timezone":        {flagTimezone},
+			"Email":           {flagEmail},
+			"DiskQuota":       {strconv.FormatUint(diskQuota, 10)},
+			"TrashName":       {flagTrashName},
+			"Dev":             {dev},
 		}
 
 		i, err := instancesRequest("POST", "/instances/", q, nil)
@@ -153,15 +174,145 @@ All data associated with this domain will be permanently lost.
 
 		fmt.Println()
 
-		i, err := instancesRequest("DELETE", "/instances/"+domain, nil, nil)
+		var doc struct {
+			Data struct {
+				Attrs instance.DestroyReport `json:"attributes"`
+			} `json:"data"`
+		}
+		err = clientRequestParsed(instancesClient(), "DELETE", "/instances/"+domain, nil, nil, &doc)
 		if err != nil {
 			log.Errorf("Failed to remove instance for domain %s", domain)
 			return err
 		}
+		report := doc.Data.Attrs
 
 		fmt.Println()
 
-		log.Infof("Instance for domain %s has been destroyed with success", i.Attrs.Domain)
+		if !report.Found {
+			log.Infof("No instance for domain %s, nothing to destroy", domain)
+			return nil
+		}
+		log.Infof("Instance for domain %s has been destroyed with success", report.Domain)
+		log.Infof("Removed %d databases, %d files and %d triggers",
+			len(report.Databases), report.Files, report.Triggers)
+		return nil
+	},
+}
+
+var exportInstanceCmd = &cobra.Command{
+	Use:   "export [domain] [archive]",
+	Short: "Export the files of an instance",
+	Long: `
+cozy-stack instances export writes a tar archive with the files of an
+instance and their metadata. It can be imported in another instance with
+cozy-stack instances import.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+		f, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		res, err := clientRequest(instancesClient(), "GET", "/instances/"+args[0]+"/export", nil, nil)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		defer res.Body.Close()
+		if _, err = io.Copy(f, res.Body); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+		// the response has already begun when an error stops the export, and
+		// the archive is then truncated, without its trailer
+		if err = checkExport(args[1]); err != nil {
+			os.Remove(args[1])
+			return fmt.Errorf("The export of %s has failed: %s", args[0], err)
+		}
+		return nil
+	},
+}
+
+
+var importInstanceCmd = &cobra.Command{
+	Use:   "import [domain] [archive]",
+	Short: "Import the files of an archive in an instance",
+	Long: `
+cozy-stack instances import reads an archive made by cozy-stack instances
+export and recreates its files in an instance.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return cmd.Help()
+		}
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var ids map[string]string
+		err = clientRequestParsed(instancesClient(), "POST", "/instances/"+args[0]+"/import", nil, f, &ids)
+		if err != nil {
+			return err
+		}
+		log.Infof("%d files and directories have been imported in %s", len(ids), args[0])
+		return nil
+	},
+}
+
+var rotateOAuthSecretInstanceCmd = &cobra.Command{
+	Use:   "rotate-oauth-secret [domain]",
+	Short: "Generate a new OAuth secret for an instance",
+	Long: `
+cozy-stack instances rotate-oauth-secret generates a new secret to sign the
+OAuth tokens of an instance. The tokens signed with the previous secret are
+still accepted during the window given by the --window flag.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return cmd.Help()
+		}
+		q := url.Values{"Window": {flagWindow.String()}}
+		res, err := clientRequest(instancesClient(), "POST", "/instances/"+args[0]+"/oauth_secret", q, nil)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		log.Infof("The OAuth secret of %s has been rotated", args[0])
+		return nil
+	},
+}
+
+var reindexInstanceCmd = &cobra.Command{
+	Use:   "reindex [domain]",
+	Short: "Define again the indexes of the files of an instance",
+	Long: `
+cozy-stack instances reindex (re)defines the CouchDB indexes and views used by
+the files of an instance, and recreates its root and trash directories if they
+are missing. What already exists is kept.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return cmd.Help()
+		}
+		var report vfs.ReindexReport
+		err := clientRequestParsed(instancesClient(), "POST", "/instances/"+args[0]+"/reindex", nil, nil, &report)
+		if err != nil {
+			return err
+		}
+		for _, index := range report.Indexes {
+			log.Infof("Index on %s of %s: %s", index.Fields, index.Doctype, index.Result)
+		}
+		log.Infof("Views: %s", report.Views)
+		log.Infof("Root directory: %s", report.RootDir)
+		log.Infof("Trash directory: %s", report.TrashDir)
+		log.Infof("Files given their byte_size: %d", report.ByteSizes)
+		log.Infof("Files and directories with their dates converted to UTC: %d", report.UTCDates)
 		return nil
 	},
 }
@@ -221,6 +372,15 @@ type instancesAPIData struct {
 	Data []*instanceData `json:"data"`
 }
 
+func checkExport(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return vfs.CheckExport(f)
+}
+
 func instancesClient() *client {
 	var pass []byte
 
@@ -268,12 +428,20 @@ func init() {
 	instanceCmdGroup.AddCommand(addInstanceCmd)
 	instanceCmdGroup.AddCommand(lsInstanceCmd)
 	instanceCmdGroup.AddCommand(destroyInstanceCmd)
+	instanceCmdGroup.AddCommand(exportInstanceCmd)
+	instanceCmdGroup.AddCommand(importInstanceCmd)
+	instanceCmdGroup.AddCommand(rotateOAuthSecretInstanceCmd)
+	instanceCmdGroup.AddCommand(reindexInstanceCmd)
 	instanceCmdGroup.AddCommand(appTokenInstanceCmd)
 	instanceCmdGroup.AddCommand(oauthTokenInstanceCmd)
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", instance.DefaultLocale, "Locale of the new cozy instance")
+	addInstanceCmd.Flags().StringSliceVar(&flagFallbackLocales, "fallback-locales", nil, "Locales used, by order of preference, for the strings missing in the locale of the instance")
 	addInstanceCmd.Flags().StringVar(&flagTimezone, "tz", "", "The timezone for the user")
 	addInstanceCmd.Flags().StringVar(&flagEmail, "email", "", "The email of the owner")
-	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled")
+	addInstanceCmd.Flags().StringSliceVar(&flagApps, "apps", nil, "Apps to be preinstalled, given by their slug or as slug=source")
+	addInstanceCmd.Flags().StringVar(&flagDiskQuota, "disk-quota", "", "The quota allowed to the instance's VFS, like 5GB (no quota by default)")
+	addInstanceCmd.Flags().StringVar(&flagTrashName, "trash-name", "", "The name of the trash directory (.cozy_trash by default)")
 	addInstanceCmd.Flags().BoolVar(&flagDev, "dev", false, "To create a development instance")
+	rotateOAuthSecretInstanceCmd.Flags().DurationVar(&flagWindow, "window", instance.DefaultOAuthSecretRotationWindow, "How long the tokens signed with the previous secret are still accepted")
 	RootCmd.AddCommand(instanceCmdGroup)
 }
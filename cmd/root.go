@@ -7,6 +7,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -89,6 +90,12 @@ func init() {
 	flags.Bool("mail-disable-tls", false, "disable smtp over tls")
 	checkNoErr(viper.BindPFlag("mail.disable_tls", flags.Lookup("mail-disable-tls")))
 
+	flags.String("mail-mode", "smtp", "how to deliver the mails (can be smtp, file or disabled)")
+	checkNoErr(viper.BindPFlag("mail.mode", flags.Lookup("mail-mode")))
+
+	flags.String("mail-dir", "", "directory where the mails are written in file mode")
+	checkNoErr(viper.BindPFlag("mail.dir", flags.Lookup("mail-dir")))
+
 	flags.String("log-level", "info", "define the log level")
 	checkNoErr(viper.BindPFlag("log.level", flags.Lookup("log-level")))
 }
@@ -130,6 +137,19 @@ func Configure() error {
 	return nil
 }
 
+// watchFlags reloads the feature flags when the config file is modified
+func watchFlags() {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		if err := config.UpdateFlags(viper.GetViper()); err != nil {
+			log.Errorf("Failed to reload the feature flags from %s: %s", e.Name, err)
+		}
+	})
+	viper.WatchConfig()
+}
+
 func checkNoErr(err error) {
 	if err != nil {
 		panic(err)
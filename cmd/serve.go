@@ -1,19 +1,33 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web"
 	"github.com/spf13/cobra"
 )
 
+var flagShutdownTimeout time.Duration
+
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Starts the stack and listens for HTTP calls",
 	Long: `Starts the stack and listens for HTTP calls
 It will accept HTTP requests on localhost:8080 by default.
-Use the --port and --host flags to change the listening option.`,
+Use the --port and --host flags to change the listening option.
+
+On SIGINT or SIGTERM, the stack stops accepting new connections and waits for
+the in-flight requests and the running jobs to finish, for at most the
+duration given by the --shutdown-timeout flag. The unfinished jobs are saved
+to be resumed on the next start.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// The serve method starts all the jobs systems associated with the created
 		// instances.
@@ -29,10 +43,39 @@ Use the --port and --host flags to change the listening option.`,
 				return err
 			}
 		}
-		return web.ListenAndServe()
+
+		watchFlags()
+
+		servers, err := web.ListenAndServe()
+		if err != nil {
+			return err
+		}
+
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		select {
+		case err = <-servers.Wait():
+			return err
+		case <-sigs:
+		}
+
+		fmt.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), flagShutdownTimeout)
+		defer cancel()
+		if err = servers.Shutdown(ctx); err != nil {
+			fmt.Printf("Error while stopping the servers: %s\n", err)
+		}
+		for _, in := range ins {
+			if errj := in.ShutdownJobSystem(ctx); errj != nil {
+				fmt.Printf("Error while stopping the jobs of %s: %s\n", in.Domain, errj)
+				err = errj
+			}
+		}
+		return err
 	},
 }
 
 func init() {
+	serveCmd.Flags().DurationVar(&flagShutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximal duration to wait for the requests and jobs on shutdown")
 	RootCmd.AddCommand(serveCmd)
 }
@@ -1,6 +1,7 @@
 package apps
 
 import (
+	"fmt"
 	"path"
 	"strings"
 
@@ -39,6 +40,14 @@ const (
 	Ready = "ready"
 )
 
+// defaultSourceURL is the source used to install an app given only by its
+// slug, like the default apps of a new instance.
+const defaultSourceURL = "git://github.com/cozy/cozy-%s.git"
+
+func init() {
+	instance.RegisterAppInstaller(installDefaultApp)
+}
+
 // Some well known slugs
 const (
 	OnboardingSlug = "onboarding"
@@ -75,6 +84,7 @@ type Manifest struct {
 	Name        string     `json:"name"`
 	Slug        string     `json:"slug"`
 	Source      string     `json:"source"`
+	Ref         string     `json:"ref,omitempty"`
 	State       State      `json:"state"`
 	Error       string     `json:"error,omitempty"`
 	Icon        string     `json:"icon"`
@@ -92,6 +102,7 @@ type Manifest struct {
 	Routes      Routes           `json:"routes"`
 
 	Instance *instance.Instance `json:"-"` // Used for JSON-API links
+	Plan     *InstallPlan       `json:"-"` // Set by a dry-run installer
 }
 
 // ID returns the manifest identifier - see couchdb.Doc interface
@@ -217,3 +228,35 @@ func (m *Manifest) BuildToken(i *instance.Instance) string {
 	}
 	return token
 }
+
+// installDefaultApp installs an app on a new instance. The app is given by its
+// slug, or by its slug and source, like "mini=git://github.com/cozy/mini.git".
+// It waits for the manifest to be created and finishes the installation in
+// the background: an error during this step is kept in the manifest.
+func installDefaultApp(i *instance.Instance, app string) error {
+	slug, source := app, fmt.Sprintf(defaultSourceURL, app)
+	if parts := strings.SplitN(app, "=", 2); len(parts) == 2 {
+		slug, source = parts[0], parts[1]
+	}
+	inst, err := NewInstaller(i, &InstallerOptions{
+		Slug:      slug,
+		SourceURL: source,
+	})
+	if err != nil {
+		return err
+	}
+
+	go inst.InstallOrUpdate()
+
+	if _, _, err = inst.Poll(); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			if _, done, err := inst.Poll(); err != nil || done {
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -1,6 +1,9 @@
 package apps
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrInvalidSlugName is used when the given slud name is not valid
@@ -14,9 +17,23 @@ var (
 	// ErrSourceNotReachable is used when the given source for
 	// application is not reachable
 	ErrSourceNotReachable = errors.New("Application source is not reachable")
+	// ErrSourceRefNotFound is used when the tag, branch or commit given in
+	// the source URL does not exist in the repository of the application
+	ErrSourceRefNotFound = errors.New("Application source reference is not found")
 	// ErrBadManifest when the manifest is not valid or malformed
 	ErrBadManifest = errors.New("Application manifest is invalid or malformed")
 	// ErrBadState is used when trying to use the application while in a
 	// state that is not appropriate for the given operation.
 	ErrBadState = errors.New("Application is not in valid state to perform this operation")
 )
+
+// ManifestError is used when a field of the manifest of an application is
+// missing or invalid. Field is the name of this field in the manifest.
+type ManifestError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("Application manifest is invalid: %s %s", e.Field, e.Reason)
+}
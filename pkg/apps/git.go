@@ -15,8 +15,10 @@ import (
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	gitFS "srcd.works/go-billy.v1"
 	git "srcd.works/go-git.v4"
+	"srcd.works/go-git.v4/plumbing"
 	gitObj "srcd.works/go-git.v4/plumbing/object"
 	gitSt "srcd.works/go-git.v4/storage/filesystem"
+	gitMem "srcd.works/go-git.v4/storage/memory"
 )
 
 const ghRawManifestURL = "https://raw.githubusercontent.com/%s/%s/%s/%s"
@@ -24,8 +26,12 @@ const ghRawManifestURL = "https://raw.githubusercontent.com/%s/%s/%s/%s"
 // ghURLRegex is used to identify github
 var ghURLRegex = regexp.MustCompile(`/([^/]+)/([^/]+).git`)
 
+// commitReg matches the full identifier of a git commit
+var commitReg = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
 type gitFetcher struct {
-	ctx vfs.Context
+	ctx        vfs.Context
+	onProgress func(progress int)
 }
 
 func newGitFetcher(ctx vfs.Context) *gitFetcher {
@@ -36,6 +42,12 @@ var manifestClient = &http.Client{
 	Timeout: 60 * time.Second,
 }
 
+// OnProgress registers a function called when the progress of the copy of
+// the files ticks.
+func (g *gitFetcher) OnProgress(fn func(progress int)) {
+	g.onProgress = fn
+}
+
 func (g *gitFetcher) FetchManifest(src *url.URL) (io.ReadCloser, error) {
 	var err error
 
@@ -63,7 +75,11 @@ func (g *gitFetcher) Fetch(src *url.URL, appdir string) error {
 	gitdir := path.Join(appdir, ".git")
 	_, err := vfs.Mkdir(ctx, gitdir, nil)
 	if os.IsExist(err) {
-		return g.pull(appdir, gitdir, src)
+		if sourceRef(src) == "" {
+			return g.pull(appdir, gitdir, src)
+		}
+		// a pinned reference can't be pulled: the repository is cloned again
+		err = g.resetAppDir(appdir, gitdir)
 	}
 	if err != nil {
 		return err
@@ -72,8 +88,40 @@ func (g *gitFetcher) Fetch(src *url.URL, appdir string) error {
 	return g.clone(appdir, gitdir, src)
 }
 
+// FileCount clones the repository in memory to count the files of the
+// commit to install, without writing them in the VFS.
+func (g *gitFetcher) FileCount(src *url.URL) (int, error) {
+	rep, err := git.Clone(gitMem.NewStorage(), nil, cloneOptions(src))
+	if err != nil {
+		return 0, err
+	}
+
+	commit, err := resolveCommit(rep, sourceRef(src))
+	if err != nil {
+		return 0, err
+	}
+
+	return countFiles(commit)
+}
+
+// countFiles returns the number of files of a commit.
+func countFiles(commit *gitObj.Commit) (int, error) {
+	files, err := commit.Files()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = files.ForEach(func(f *gitObj.File) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
 // clone creates a new bare git repository and install all the files of the
-// last commit in the application tree.
+// last commit, or of the commit of the pinned reference, in the application
+// tree.
 func (g *gitFetcher) clone(appdir, gitdir string, src *url.URL) error {
 	ctx := g.ctx
 
@@ -82,15 +130,17 @@ func (g *gitFetcher) clone(appdir, gitdir string, src *url.URL) error {
 		return err
 	}
 
-	rep, err := git.Clone(storage, nil, &git.CloneOptions{
-		URL:   src.String(),
-		Depth: 1,
-	})
+	rep, err := git.Clone(storage, nil, cloneOptions(src))
+	if err != nil {
+		return err
+	}
+
+	commit, err := resolveCommit(rep, sourceRef(src))
 	if err != nil {
 		return err
 	}
 
-	return g.copyFiles(appdir, rep)
+	return g.copyFiles(appdir, commit)
 }
 
 // pull will fetch the latest objects from the default remote and if updates
@@ -116,9 +166,43 @@ func (g *gitFetcher) pull(appdir, gitdir string, src *url.URL) error {
 		return err
 	}
 
+	if err = g.trashAppFiles(appdir, gitdir); err != nil {
+		return err
+	}
+
+	commit, err := resolveCommit(rep, "")
+	if err != nil {
+		return err
+	}
+
+	return g.copyFiles(appdir, commit)
+}
+
+// resetAppDir removes the files of the application and empties its git
+// repository, to clone it again.
+func (g *gitFetcher) resetAppDir(appdir, gitdir string) error {
+	ctx := g.ctx
+
+	if err := g.trashAppFiles(appdir, gitdir); err != nil {
+		return err
+	}
+
+	dir, err := vfs.GetDirDocFromPath(ctx, gitdir, false)
+	if err != nil {
+		return err
+	}
+
+	return vfs.DestroyDirContent(ctx, dir)
+}
+
+// trashAppFiles moves the files of the application tree, except the git
+// repository, to the trash.
+func (g *gitFetcher) trashAppFiles(appdir, gitdir string) error {
+	ctx := g.ctx
+
 	// TODO: permanently remove application files instead of moving them to the
 	// trash
-	err = vfs.Walk(ctx, appdir, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+	return vfs.Walk(ctx, appdir, func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
 		if err != nil {
 			return err
 		}
@@ -143,61 +227,131 @@ func (g *gitFetcher) pull(appdir, gitdir string, src *url.URL) error {
 		}
 		return nil
 	})
+}
+
+func (g *gitFetcher) copyFiles(appdir string, commit *gitObj.Commit) error {
+	total, err := countFiles(commit)
+	if err != nil {
+		return err
+	}
+
+	files, err := commit.Files()
 	if err != nil {
 		return err
 	}
 
-	return g.copyFiles(appdir, rep)
+	copied, progress := 0, 0
+	return files.ForEach(func(f *gitObj.File) error {
+		if err := g.copyFile(appdir, f); err != nil {
+			return err
+		}
+		copied++
+		if p := copied * 100 / total; p != progress && g.onProgress != nil {
+			progress = p
+			g.onProgress(progress)
+		}
+		return nil
+	})
 }
 
-func (g *gitFetcher) copyFiles(appdir string, rep *git.Repository) error {
+func (g *gitFetcher) copyFile(appdir string, f *gitObj.File) (err error) {
 	ctx := g.ctx
 
-	ref, err := rep.Head()
+	abs := path.Join(appdir, f.Name)
+	dir := path.Dir(abs)
+
+	_, err = vfs.MkdirAll(ctx, dir, nil)
 	if err != nil {
 		return err
 	}
 
-	commit, err := rep.Commit(ref.Hash())
+	file, err := vfs.Create(ctx, abs)
 	if err != nil {
 		return err
 	}
 
-	files, err := commit.Files()
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+
+	r, err := f.Reader()
 	if err != nil {
 		return err
 	}
 
-	return files.ForEach(func(f *gitObj.File) error {
-		abs := path.Join(appdir, f.Name)
-		dir := path.Dir(abs)
+	defer r.Close()
+	_, err = io.Copy(file, r)
+
+	return err
+}
 
-		_, err := vfs.MkdirAll(ctx, dir, nil)
+// sourceRef returns the git reference (a tag, a branch or the identifier of
+// a commit) given in the fragment or in the ref parameter of the source URL.
+// It is empty when the default branch must be used.
+func sourceRef(src *url.URL) string {
+	if src.Fragment != "" {
+		return src.Fragment
+	}
+	return src.Query().Get("ref")
+}
+
+// cloneOptions returns the options to clone the repository of the source
+// URL. Only the last commit is fetched, except when a reference is pinned:
+// all the branches and tags are fetched to find it.
+func cloneOptions(src *url.URL) *git.CloneOptions {
+	u := *src
+	u.Fragment = ""
+	query := u.Query()
+	query.Del("ref")
+	u.RawQuery = query.Encode()
+
+	opts := &git.CloneOptions{URL: u.String()}
+	if sourceRef(src) == "" {
+		opts.Depth = 1
+	}
+	return opts
+}
+
+// resolveCommit returns the commit of the given reference: a tag, a branch
+// or the identifier of a commit. For an empty reference, the last commit of
+// the default branch is returned.
+func resolveCommit(rep *git.Repository, ref string) (*gitObj.Commit, error) {
+	if ref == "" {
+		head, err := rep.Head()
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return rep.Commit(head.Hash())
+	}
 
-		file, err := vfs.Create(ctx, abs)
+	if commitReg.MatchString(ref) {
+		commit, err := rep.Commit(plumbing.NewHash(ref))
 		if err != nil {
-			return err
+			return nil, ErrSourceRefNotFound
 		}
+		return commit, nil
+	}
 
-		defer func() {
-			if cerr := file.Close(); cerr != nil && err == nil {
-				err = cerr
-			}
-		}()
-
-		r, err := f.Reader()
+	names := []plumbing.ReferenceName{
+		plumbing.ReferenceName("refs/tags/" + ref),
+		plumbing.ReferenceName("refs/remotes/origin/" + ref),
+	}
+	for _, name := range names {
+		r, err := rep.Reference(name, true)
 		if err != nil {
-			return err
+			continue
 		}
-
-		defer r.Close()
-		_, err = io.Copy(file, r)
-
-		return err
-	})
+		if commit, err := rep.Commit(r.Hash()); err == nil {
+			return commit, nil
+		}
+		// an annotated tag points to a tag object, not to the commit
+		if tag, err := rep.Tag(r.Hash()); err == nil {
+			return tag.Commit()
+		}
+	}
+	return nil, ErrSourceRefNotFound
 }
 
 func resolveGithubURL(src *url.URL) (string, error) {
@@ -211,10 +365,8 @@ func resolveGithubURL(src *url.URL) (string, error) {
 	}
 
 	user, project := match[1], match[2]
-	var branch string
-	if src.Fragment != "" {
-		branch = src.Fragment
-	} else {
+	branch := sourceRef(src)
+	if branch == "" {
 		branch = "master"
 	}
 
@@ -3,25 +3,38 @@ package apps
 import (
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"path"
 	"regexp"
+	"strings"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 )
 
 var slugReg = regexp.MustCompile(`^[A-Za-z0-9\-]+$`)
 
+// semverReg matches the versions following the semantic versioning, see
+// http://semver.org/
+var semverReg = regexp.MustCompile(`^(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)` +
+	`(-(0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*)(\.(0|[1-9]\d*|\d*[a-zA-Z-][0-9a-zA-Z-]*))*)?` +
+	`(\+[0-9a-zA-Z-]+(\.[0-9a-zA-Z-]+)*)?$`)
+
 // Installer is used to install or update applications.
 type Installer struct {
 	fetcher Fetcher
 	ctx     vfs.Context
 
-	man  *Manifest
-	src  *url.URL
-	slug string
+	man    *Manifest
+	src    *url.URL
+	slug   string
+	dryRun bool
+	state  State
 
 	err  error
 	errc chan error
@@ -29,10 +42,37 @@ type Installer struct {
 }
 
 // InstallerOptions provides the slug name of the application along with the
-// source URL.
+// source URL. With DryRun, the installer only reports what it would do.
 type InstallerOptions struct {
 	Slug      string
 	SourceURL string
+	DryRun    bool
+}
+
+// InstallPlan describes what an installation or an update would do. It is
+// computed by an installer in dry-run mode, without writing anything.
+type InstallPlan struct {
+	// Version is the version that would be installed
+	Version string
+	// PreviousVersion is the version currently installed, for an update
+	PreviousVersion string
+	// Permissions are the permissions requested by the application
+	Permissions permissions.Set
+	// AddedPermissions and RemovedPermissions are the differences with the
+	// permissions of the installed version, for an update
+	AddedPermissions   permissions.Set
+	RemovedPermissions permissions.Set
+	// FileCount is the number of files of the application
+	FileCount int
+}
+
+// InstallEvent is published on the realtime hub, for the io.cozy.manifests
+// doctype, when the state of an installation changes and when its progress,
+// in percent, ticks.
+type InstallEvent struct {
+	Slug     string `json:"slug"`
+	State    State  `json:"state"`
+	Progress int    `json:"progress"`
 }
 
 // Fetcher interface should be implemented by the underlying transport
@@ -44,6 +84,15 @@ type Fetcher interface {
 	// Fetch should download the application and install it in the given
 	// directory.
 	Fetch(src *url.URL, appDir string) error
+	// FileCount should return the number of files of the application,
+	// without installing them.
+	FileCount(src *url.URL) (int, error)
+}
+
+// progressFetcher is implemented by the fetchers that can report the
+// progress, in percent, of the installation of the files.
+type progressFetcher interface {
+	OnProgress(fn func(progress int))
 }
 
 // NewInstaller creates a new Installer
@@ -84,10 +133,15 @@ func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 		src:     src,
 		slug:    slug,
 		man:     man,
+		dryRun:  opts.DryRun,
 		errc:    make(chan error),
 		manc:    make(chan *Manifest, 1),
 	}
 
+	if pf, ok := fetcher.(progressFetcher); ok {
+		pf.OnProgress(inst.progress)
+	}
+
 	return inst, nil
 }
 
@@ -95,6 +149,11 @@ func NewInstaller(ctx vfs.Context, opts *InstallerOptions) (*Installer, error) {
 // application is already installed, it will try to upgrade it. It will report
 // its progress or error (see Poll method).
 func (i *Installer) InstallOrUpdate() {
+	if i.dryRun {
+		i.plan()
+		return
+	}
+
 	defer i.endOfProc()
 
 	if i.man == nil {
@@ -122,14 +181,31 @@ func (i *Installer) endOfProc() {
 		man.State = Errored
 		man.Error = err.Error()
 		updateManifest(i.ctx, man)
+		i.transition(Errored, 0)
 		i.errc <- err
 		return
 	}
 	man.State = Ready
 	updateManifest(i.ctx, man)
+	i.transition(Ready, 100)
 	i.manc <- i.man
 }
 
+// transition publishes the event of a new state of the installation.
+func (i *Installer) transition(state State, progress int) {
+	i.state = state
+	i.progress(progress)
+}
+
+// progress publishes the progress of the installation, in its current state.
+func (i *Installer) progress(progress int) {
+	realtime.Publish(i.ctx, consts.Manifests, &InstallEvent{
+		Slug:     i.slug,
+		State:    i.state,
+		Progress: progress,
+	})
+}
+
 // install will perform the installation of an application. It returns the
 // freshly fetched manifest from the source along with a possible error in case
 // the installation went wrong.
@@ -142,10 +218,17 @@ func (i *Installer) install() (*Manifest, error) {
 		return nil, err
 	}
 
+	// with a pinned reference, the permissions are only known once the files
+	// of this reference are fetched
+	if man.Ref != "" {
+		man.Permissions = &permissions.Set{}
+	}
+
 	if err := createManifest(i.ctx, man); err != nil {
 		return man, err
 	}
 
+	i.transition(Installing, 0)
 	i.manc <- man
 
 	appdir := i.appDir()
@@ -157,7 +240,7 @@ func (i *Installer) install() (*Manifest, error) {
 		return man, err
 	}
 
-	return man, nil
+	return man, i.resolveManifest(man)
 }
 
 // update will perform the update of an already installed application. It
@@ -168,24 +251,146 @@ func (i *Installer) install() (*Manifest, error) {
 // upgrading.
 func (i *Installer) update() (*Manifest, error) {
 	man := i.man
-	version := man.Version
+	version, ref := man.Version, man.Ref
 
 	if err := i.ReadManifest(Upgrading, man); err != nil {
 		return man, err
 	}
 
-	if man.Version == version {
+	if man.Version == version && man.Ref == ref {
 		return man, nil
 	}
 
+	if man.Ref != "" {
+		man.Permissions = &permissions.Set{}
+	}
+
 	if err := updateManifest(i.ctx, man); err != nil {
 		return man, err
 	}
 
+	i.transition(Upgrading, 0)
 	i.manc <- man
 
-	err := i.fetcher.Fetch(i.src, i.appDir())
-	return man, err
+	if err := i.fetcher.Fetch(i.src, i.appDir()); err != nil {
+		return man, err
+	}
+
+	return man, i.resolveManifest(man)
+}
+
+// resolveManifest reads the manifest of the installed files when a reference
+// is pinned in the source URL: the manifest fetched before the installation
+// may be the one of the default branch. The manifest of the reference is
+// validated, and its fields, like the permissions and the routes, replace the
+// ones fetched before.
+func (i *Installer) resolveManifest(man *Manifest) error {
+	if man.Ref == "" {
+		return nil
+	}
+
+	installed, err := i.readInstalledManifest()
+	if err != nil {
+		// the permissions of another version must not be kept
+		man.Permissions = &permissions.Set{}
+		return err
+	}
+
+	man.Name = installed.Name
+	man.Icon = installed.Icon
+	man.Description = installed.Description
+	man.Developer = installed.Developer
+	man.DefaultLocale = installed.DefaultLocale
+	man.Locales = installed.Locales
+	man.Version = installed.Version
+	man.License = installed.License
+	man.Permissions = installed.Permissions
+	man.Routes = installed.Routes
+	return nil
+}
+
+// readInstalledManifest reads and validates the manifest of the files
+// installed in the directory of the application.
+func (i *Installer) readInstalledManifest() (*Manifest, error) {
+	f, err := vfs.OpenFile(i.ctx, path.Join(i.appDir(), ManifestFilename), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, ErrBadManifest
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, ManifestMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	installed := &Manifest{}
+	if err = json.Unmarshal(data, installed); err != nil {
+		return nil, manifestDecodeError(data)
+	}
+	if err = validateManifest(installed); err != nil {
+		return nil, err
+	}
+	setDefaultRoutes(installed)
+	return installed, nil
+}
+
+// plan reports via Poll the manifest of the application, with the plan of
+// what the installation or the update would do. Nothing is written in the
+// VFS or in CouchDB.
+func (i *Installer) plan() {
+	var state State = Installing
+	if i.man != nil {
+		if i.man.State != Ready && i.man.State != Errored {
+			i.errc <- ErrBadState
+			return
+		}
+		state = Upgrading
+	}
+
+	man := &Manifest{}
+	if err := i.ReadManifest(state, man); err != nil {
+		i.errc <- err
+		return
+	}
+
+	plan := &InstallPlan{Version: man.Version}
+	if man.Permissions != nil {
+		plan.Permissions = *man.Permissions
+	}
+	if i.man != nil {
+		var old permissions.Set
+		if i.man.Permissions != nil {
+			old = *i.man.Permissions
+		}
+		plan.PreviousVersion = i.man.Version
+		plan.AddedPermissions = diffPermissions(plan.Permissions, old)
+		plan.RemovedPermissions = diffPermissions(old, plan.Permissions)
+	}
+
+	count, err := i.fetcher.FileCount(i.src)
+	if err != nil {
+		i.errc <- err
+		return
+	}
+	plan.FileCount = count
+
+	man.Plan = plan
+	i.manc <- man
+}
+
+// diffPermissions returns the rules of a that are not in b.
+func diffPermissions(a, b permissions.Set) permissions.Set {
+	var diff permissions.Set
+	for _, rule := range a {
+		scope, _ := rule.MarshalScopeString()
+		found := b.Some(func(r permissions.Rule) bool {
+			s, _ := r.MarshalScopeString()
+			return s == scope
+		})
+		if !found {
+			diff = append(diff, rule)
+		}
+	}
+	return diff
 }
 
 // ReadManifest will fetch the manifest and read its JSON content into the
@@ -199,15 +404,29 @@ func (i *Installer) ReadManifest(state State, man *Manifest) error {
 	}
 	defer r.Close()
 
-	err = json.NewDecoder(io.LimitReader(r, ManifestMaxSize)).Decode(man)
+	data, err := ioutil.ReadAll(io.LimitReader(r, ManifestMaxSize))
 	if err != nil {
-		return ErrBadManifest
+		return err
+	}
+	if err = json.Unmarshal(data, man); err != nil {
+		return manifestDecodeError(data)
+	}
+
+	if err = validateManifest(man); err != nil {
+		return err
 	}
 
 	man.Slug = i.slug
 	man.Source = i.src.String()
+	man.Ref = sourceRef(i.src)
 	man.State = state
 
+	setDefaultRoutes(man)
+	return nil
+}
+
+// setDefaultRoutes gives the default route to a manifest without routes.
+func setDefaultRoutes(man *Manifest) {
 	if man.Routes == nil {
 		man.Routes = make(Routes)
 		man.Routes["/"] = Route{
@@ -216,7 +435,55 @@ func (i *Installer) ReadManifest(state State, man *Manifest) error {
 			Public: false,
 		}
 	}
+}
+
+// manifestDecodeError returns the error for a manifest that can't be
+// decoded: a ManifestError if the JSON is valid but the permissions don't
+// have the expected shape, or ErrBadManifest.
+func manifestDecodeError(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return ErrBadManifest
+	}
+	if raw, ok := fields["permissions"]; ok {
+		var set permissions.Set
+		if err := json.Unmarshal(raw, &set); err != nil {
+			return &ManifestError{Field: "permissions", Reason: "is not an object of rules"}
+		}
+	}
+	return ErrBadManifest
+}
 
+// validateManifest checks the required fields of a manifest, before
+// anything is installed. It returns a ManifestError for the first field that
+// is missing or invalid.
+func validateManifest(man *Manifest) error {
+	if strings.TrimSpace(man.Name) == "" {
+		return &ManifestError{Field: "name", Reason: "is missing"}
+	}
+	if man.Slug == "" {
+		return &ManifestError{Field: "slug", Reason: "is missing"}
+	}
+	if !slugReg.MatchString(man.Slug) {
+		return &ManifestError{Field: "slug", Reason: "is not a valid slug"}
+	}
+	if man.Version == "" {
+		return &ManifestError{Field: "version", Reason: "is missing"}
+	}
+	if !semverReg.MatchString(man.Version) {
+		return &ManifestError{Field: "version", Reason: "is not a semantic version"}
+	}
+	if man.Permissions == nil {
+		return &ManifestError{Field: "permissions", Reason: "is missing"}
+	}
+	for _, rule := range *man.Permissions {
+		if rule.Type == "" {
+			return &ManifestError{
+				Field:  "permissions." + rule.Title,
+				Reason: "has no type",
+			}
+		}
+	}
 	return nil
 }
 
@@ -224,11 +491,12 @@ func (i *Installer) appDir() string {
 	return path.Join(vfs.AppsDirName, i.slug)
 }
 
-// Poll should be used to monitor the progress of the Installer.
+// Poll should be used to monitor the progress of the Installer. In dry-run
+// mode, the manifest is reported only once, with its Plan field.
 func (i *Installer) Poll() (*Manifest, bool, error) {
 	select {
 	case man := <-i.manc:
-		done := man.State == Ready
+		done := man.State == Ready || i.dryRun
 		return man, done, nil
 	case err := <-i.errc:
 		return nil, false, err
@@ -237,17 +505,12 @@ func (i *Installer) Poll() (*Manifest, bool, error) {
 
 func updateManifest(db couchdb.Database, man *Manifest) error {
 
-	err := permissions.Destroy(db, man.Slug)
-	if err != nil && !couchdb.IsNotFoundError(err) {
-		return err
-	}
-
-	err = couchdb.UpdateDoc(db, man)
+	err := couchdb.UpdateDoc(db, man)
 	if err != nil {
 		return err
 	}
 
-	_, err = permissions.Create(db, man.Slug, *man.Permissions)
+	_, err = permissions.UpdateForApp(db, man.Slug, *man.Permissions)
 	return err
 }
 
@@ -1,6 +1,7 @@
 package apps
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"testing"
 	"time"
@@ -17,7 +19,9 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -62,7 +66,8 @@ func serveGitRep() {
 echo '` + manifest() + `' > manifest.webapp && \
 git init . && \
 git add . && \
-git commit -m "Initial commit"`
+git commit -m "Initial commit" && \
+git tag v` + localVersion
 	cmd := exec.Command("sh", "-c", args)
 	cmd.Dir = localGitDir
 	if err := cmd.Run(); err != nil {
@@ -90,6 +95,22 @@ git commit -am "Upgrade commit"`
 	}
 }
 
+// tagRef commits the given manifest in the git repository, tags this
+// commit, and restores the manifest of the default branch.
+func tagRef(t *testing.T, tag, content string) {
+	args := `
+echo '` + content + `' > manifest.webapp && \
+git commit -am "Tagged commit" && \
+git tag ` + tag + ` && \
+echo '` + manifest() + `' > manifest.webapp && \
+git commit -am "Restore commit"`
+	cmd := exec.Command("sh", "-c", args)
+	cmd.Dir = localGitDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %s", err, out)
+	}
+}
+
 type TestContext struct {
 	prefix string
 	fs     afero.Fs
@@ -146,6 +167,43 @@ func TestInstallBadAppsSource(t *testing.T) {
 	}
 }
 
+func TestValidateManifest(t *testing.T) {
+	manifests := []struct {
+		json  string
+		field string
+	}{
+		{`{"name": "mini", "slug": "mini", "version": "1.2.3-beta.1+build", "permissions": {"files": {"type": "io.cozy.files"}}}`, ""},
+		{`{"slug": "mini", "version": "1.0.0", "permissions": {}}`, "name"},
+		{`{"name": "mini", "version": "1.0.0", "permissions": {}}`, "slug"},
+		{`{"name": "mini", "slug": "mini/", "version": "1.0.0", "permissions": {}}`, "slug"},
+		{`{"name": "mini", "slug": "mini", "permissions": {}}`, "version"},
+		{`{"name": "mini", "slug": "mini", "version": "1.0", "permissions": {}}`, "version"},
+		{`{"name": "mini", "slug": "mini", "version": "01.0.0", "permissions": {}}`, "version"},
+		{`{"name": "mini", "slug": "mini", "version": "1.0.0"}`, "permissions"},
+		{`{"name": "mini", "slug": "mini", "version": "1.0.0", "permissions": {"files": {"description": "no type"}}}`, "permissions.files"},
+	}
+	for _, m := range manifests {
+		var man Manifest
+		if !assert.NoError(t, json.Unmarshal([]byte(m.json), &man)) {
+			continue
+		}
+		err := validateManifest(&man)
+		if m.field == "" {
+			assert.NoError(t, err, m.json)
+			continue
+		}
+		if merr, ok := err.(*ManifestError); assert.True(t, ok, m.json) {
+			assert.Equal(t, m.field, merr.Field, m.json)
+		}
+	}
+
+	err := manifestDecodeError([]byte(`{"name": "mini", "permissions": ["io.cozy.files"]}`))
+	if merr, ok := err.(*ManifestError); assert.True(t, ok) {
+		assert.Equal(t, "permissions", merr.Field)
+	}
+	assert.Equal(t, ErrBadManifest, manifestDecodeError([]byte(`{"name": `)))
+}
+
 func TestInstallSuccessful(t *testing.T) {
 	inst, err := NewInstaller(c, &InstallerOptions{
 		Slug:      "local-cozy-mini",
@@ -287,6 +345,185 @@ func TestInstallWithUpgrade(t *testing.T) {
 	}
 }
 
+func TestInstallPublishesEvents(t *testing.T) {
+	sub := realtime.Subscribe(c, consts.Manifests)
+	defer sub.Close()
+
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "cozy-app-events",
+		SourceURL: "git://localhost/",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.InstallOrUpdate()
+
+	for {
+		_, done, err := inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+
+	var states []State
+	var last *InstallEvent
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		event, ok := e.Doc.(*InstallEvent)
+		if !assert.True(t, ok) || event.Slug != "cozy-app-events" {
+			continue
+		}
+		if last == nil || last.State != event.State {
+			states = append(states, event.State)
+		}
+		last = event
+	}
+	assert.Equal(t, []State{Installing, Ready}, states)
+	if assert.NotNil(t, last) {
+		assert.Equal(t, 100, last.Progress)
+	}
+}
+
+func TestInstallDryRun(t *testing.T) {
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "cozy-app-dry",
+		SourceURL: "git://localhost/",
+		DryRun:    true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.InstallOrUpdate()
+
+	man, done, err := inst.Poll()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, done)
+	assert.EqualValues(t, Installing, man.State)
+	if assert.NotNil(t, man.Plan) {
+		assert.Equal(t, localVersion, man.Plan.Version)
+		assert.Equal(t, "", man.Plan.PreviousVersion)
+		assert.Equal(t, 1, man.Plan.FileCount)
+	}
+
+	_, err = GetBySlug(c, "cozy-app-dry")
+	assert.True(t, couchdb.IsNotFoundError(err))
+	_, err = vfs.GetDirDocFromPath(c, path.Join(vfs.AppsDirName, "cozy-app-dry"), false)
+	assert.Error(t, err)
+}
+
+func TestInstallWithRef(t *testing.T) {
+	inst, err := NewInstaller(c, &InstallerOptions{
+		Slug:      "cozy-app-tag",
+		SourceURL: "git://localhost/#v1.0.0",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.InstallOrUpdate()
+
+	var man *Manifest
+	for {
+		var done bool
+		man, done, err = inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, "v1.0.0", man.Ref)
+	assert.Equal(t, "1.0.0", man.Version)
+
+	man, err = GetBySlug(c, "cozy-app-tag")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "v1.0.0", man.Ref)
+		assert.Equal(t, "1.0.0", man.Version)
+	}
+
+	// the manifest of the reference is used, not the one of the default
+	// branch served over http
+	tagRef(t, "v0.5.0", `{"name": "tagged-app", "slug": "mini", "version": "0.5.0",`+
+		` "permissions": {"contacts": {"type": "io.cozy.contacts", "verbs": ["GET"]}},`+
+		` "routes": {"/admin": {"folder": "/admin", "index": "index.html"}}}`)
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "cozy-app-tagged",
+		SourceURL: "git://localhost/#v0.5.0",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.InstallOrUpdate()
+	for {
+		var done bool
+		man, done, err = inst.Poll()
+		if !assert.NoError(t, err) {
+			return
+		}
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, "tagged-app", man.Name)
+	assert.Equal(t, "0.5.0", man.Version)
+	if assert.NotNil(t, man.Permissions) && assert.Len(t, *man.Permissions, 1) {
+		assert.Equal(t, "io.cozy.contacts", (*man.Permissions)[0].Type)
+	}
+	assert.Contains(t, man.Routes, "/admin")
+	perms, err := permissions.GetForApp(c, "cozy-app-tagged")
+	if assert.NoError(t, err) {
+		assert.Len(t, perms.Permissions, 1)
+	}
+
+	// an invalid manifest of the reference fails the installation
+	tagRef(t, "v0.6.0", `{"slug": "mini", "version": "0.6.0", "permissions": {}}`)
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "cozy-app-tagged-invalid",
+		SourceURL: "git://localhost/#v0.6.0",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	go inst.InstallOrUpdate()
+	for {
+		var done bool
+		_, done, err = inst.Poll()
+		if err != nil || done {
+			break
+		}
+	}
+	if assert.IsType(t, &ManifestError{}, err) {
+		assert.Equal(t, "name", err.(*ManifestError).Field)
+	}
+
+	inst, err = NewInstaller(c, &InstallerOptions{
+		Slug:      "cozy-app-badref",
+		SourceURL: "git://localhost/#v9.9.9",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	go inst.InstallOrUpdate()
+
+	for {
+		var done bool
+		_, done, err = inst.Poll()
+		if err != nil || done {
+			break
+		}
+	}
+	assert.Equal(t, ErrSourceRefNotFound, err)
+}
+
 func TestInstallFromGithub(t *testing.T) {
 	inst, err := NewInstaller(c, &InstallerOptions{
 		Slug:      "github-cozy-mini",
@@ -324,6 +561,42 @@ func TestInstallFromGithub(t *testing.T) {
 	}
 }
 
+func TestInstanceWithDefaultApp(t *testing.T) {
+	domain := "apps-default.cozycloud.cc"
+	instance.Destroy(domain)
+	defer instance.Destroy(domain)
+
+	i, err := instance.Create(&instance.Options{
+		Domain:    domain,
+		DiskQuota: 1 << 30,
+		Apps:      []string{"mini=git://localhost/", "bad slug"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1<<30), i.DiskQuota())
+
+	i, err = instance.Get(domain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(1<<30), i.DiskQuota())
+
+	var man *Manifest
+	for tries := 0; tries < 50; tries++ {
+		man, err = GetBySlug(i, "mini")
+		if !assert.NoError(t, err) {
+			return
+		}
+		if man.State == Ready {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.EqualValues(t, Ready, man.State)
+	assert.Equal(t, "git://localhost/", man.Source)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
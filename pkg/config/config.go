@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/utils"
@@ -52,6 +53,36 @@ const (
 	NestedSubdomains = "nested"
 )
 
+const (
+	// MailSMTP is the mail mode used to send the mails through the SMTP server
+	MailSMTP = "smtp"
+	// MailFile is the mail mode used to write the mails in a local directory
+	// instead of sending them
+	MailFile = "file"
+	// MailDisabled is the mail mode used to drop the mails without sending
+	// them
+	MailDisabled = "disabled"
+)
+
+const (
+	// RestoreRecreate is the restore mode used to re-create the missing
+	// ancestor directories of a file restored from the trash
+	RestoreRecreate = "recreate"
+	// RestoreToRoot is the restore mode used to restore a file from the trash
+	// in the root directory when its original directory does not exist
+	// anymore
+	RestoreToRoot = "root"
+)
+
+const (
+	// HashMD5 is the hash algorithm used by default for the checksums of
+	// the files
+	HashMD5 = "md5"
+	// HashSHA256 is the SHA-256 hash algorithm, that can be used for the
+	// checksums of the files
+	HashSHA256 = "sha256"
+)
+
 // AdminSecretFileName is the name of the file containing the administration
 // hashed passphrase.
 const AdminSecretFileName = "cozy-admin-passphrase" // #nosec
@@ -69,19 +100,156 @@ type Config struct {
 	Fs         Fs
 	CouchDB    CouchDB
 	Mail       *gomail.DialerOptions
+	MailMode   string
+	MailDir    string
+	MailLimits MailLimits
+	BodyLimits BodyLimits
+	Data       Data
+	Jobs       Jobs
+	Previews   Previews
 	Logger     Logger
+
+	// TrustedProxies are the networks of the reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers give the address of the clients
+	TrustedProxies []*net.IPNet
 }
 
 // Fs contains the configuration values of the file-system
 type Fs struct {
-	URL string
+	URL         string
+	Versions    FsVersions
+	RestoreMode string
+	// HashAlgo is the hash algorithm used for the checksums of the new
+	// contents (md5 or sha256)
+	HashAlgo string
+	// DefaultMime is the mime type of the files uploaded without a mime type
+	// that can't be guessed from their name or content
+	DefaultMime string
+}
+
+// FsVersions contains the limits of the versions kept for the files. No
+// version is kept when MaxNumber is zero.
+type FsVersions struct {
+	// MaxNumber is the maximal number of versions kept for a file
+	MaxNumber int
+	// MaxSize is the maximal total size, in bytes, of the versions of a file.
+	// No limit is applied when zero.
+	MaxSize int64
 }
 
 // CouchDB contains the configuration values of the database
 type CouchDB struct {
 	URL string
+	// Timeout is the maximal duration of a request to CouchDB
+	Timeout time.Duration
+	// Retries is the number of times an idempotent request is retried when
+	// the connection to CouchDB fails
+	Retries int
+	// MaxDocSize is the maximal size, in bytes, of the JSON of a document
+	// written in CouchDB. No limit is applied when zero.
+	MaxDocSize int64
+	// AllDocsLimit is the maximal number of rows of an _all_docs request made
+	// through the stack. No limit is applied when zero.
+	AllDocsLimit int
+}
+
+// DefaultCouchTimeout is the timeout of the requests to CouchDB used when
+// none is configured
+const DefaultCouchTimeout = 5 * time.Second
+
+// DefaultCouchRetries is the number of retries of the requests to CouchDB
+// used when none is configured
+const DefaultCouchRetries = 2
+
+// DefaultCouchMaxDocSize is the maximal size of a document written in
+// CouchDB used when none is configured
+const DefaultCouchMaxDocSize = 8 << 20
+
+// DefaultCouchAllDocsLimit is the maximal number of rows of an _all_docs
+// request used when none is configured
+const DefaultCouchAllDocsLimit = 1000
+
+// Data contains the configuration values of the data API
+type Data struct {
+	UniqueConstraints []UniqueConstraint
+}
+
+// UniqueConstraint is a combination of fields that must be unique among the
+// documents of a doctype
+type UniqueConstraint struct {
+	DocType string   `mapstructure:"doctype"`
+	Fields  []string `mapstructure:"fields"`
 }
 
+// Jobs contains the configuration values of the jobs system
+type Jobs struct {
+	Workers map[string]Worker
+}
+
+// Worker contains the limits applied to the jobs of a worker type. A zero
+// value means that the default of the worker is kept.
+type Worker struct {
+	// Concurrency is the maximal number of jobs running at the same time
+	Concurrency uint `mapstructure:"concurrency"`
+	// RateLimit is the maximal number of jobs started per second
+	RateLimit float64 `mapstructure:"rate_limit"`
+}
+
+// Previews contains the configuration values of the rendering of the
+// previews of the documents
+type Previews struct {
+	// Renderer is the command used to render the first page of a document to
+	// a PNG image. It is called with the path of the document and the path of
+	// the image to write. No preview is generated when empty.
+	Renderer string
+	// Timeout is the maximal duration of a rendering
+	Timeout time.Duration
+	// MaxSize is the maximal size, in bytes, of the documents that are
+	// rendered, and of their previews. No limit is applied when zero.
+	MaxSize int64
+}
+
+// MailLimits contains the limits applied to the mails, before sending them,
+// to avoid their rejection by the SMTP relay. No limit is applied when zero.
+type MailLimits struct {
+	// MaxMessageSize is the maximal size, in bytes, of a whole message,
+	// including its encoded attachments
+	MaxMessageSize int64
+	// MaxAttachmentSize is the maximal size, in bytes, of an attached file
+	MaxAttachmentSize int64
+}
+
+// DefaultMailMaxMessageSize is the maximal size of a mail used when none is
+// configured
+const DefaultMailMaxMessageSize = 25 << 20
+
+// DefaultMailMaxAttachmentSize is the maximal size of an attachment used when
+// none is configured
+const DefaultMailMaxAttachmentSize = 10 << 20
+
+// BodyLimits contains the maximal sizes of the bodies of the HTTP requests,
+// checked before reading them. No limit is applied when zero.
+type BodyLimits struct {
+	// MaxBodySize is the maximal size, in bytes, of the body of a request,
+	// except for the uploads of files
+	MaxBodySize int64
+	// MaxUploadSize is the maximal size, in bytes, of the content of an
+	// uploaded file
+	MaxUploadSize int64
+}
+
+// DefaultMaxBodySize is the maximal size of the body of a request used when
+// none is configured
+const DefaultMaxBodySize = 32 << 20
+
+// DefaultPreviewTimeout is the maximal duration of the rendering of a preview
+// used when none is configured
+const DefaultPreviewTimeout = 30 * time.Second
+
+// DefaultPreviewMaxSize is the maximal size of the documents rendered as
+// previews used when none is configured
+const DefaultPreviewMaxSize = 50 << 20
+
 // Logger contains the configuration values of the logger system
 type Logger struct {
 	Level string
@@ -157,6 +325,102 @@ func UseViper(v *viper.Viper) error {
 		return err
 	}
 
+	couchTimeout := v.GetDuration("couchdb.timeout")
+	if couchTimeout <= 0 {
+		couchTimeout = DefaultCouchTimeout
+	}
+	couchRetries := DefaultCouchRetries
+	if v.IsSet("couchdb.retries") {
+		couchRetries = v.GetInt("couchdb.retries")
+	}
+	couchMaxDocSize := int64(DefaultCouchMaxDocSize)
+	if v.IsSet("couchdb.max_doc_size") {
+		couchMaxDocSize = v.GetInt64("couchdb.max_doc_size")
+	}
+	couchAllDocsLimit := DefaultCouchAllDocsLimit
+	if v.IsSet("couchdb.all_docs_limit") {
+		couchAllDocsLimit = v.GetInt("couchdb.all_docs_limit")
+	}
+
+	previewTimeout := v.GetDuration("previews.timeout")
+	if previewTimeout <= 0 {
+		previewTimeout = DefaultPreviewTimeout
+	}
+	previewMaxSize := int64(DefaultPreviewMaxSize)
+	if v.IsSet("previews.max_size") {
+		previewMaxSize = v.GetInt64("previews.max_size")
+	}
+
+	mailMode := v.GetString("mail.mode")
+	switch mailMode {
+	case "":
+		mailMode = MailSMTP
+	case MailSMTP, MailFile, MailDisabled:
+	default:
+		return fmt.Errorf("Unknown mail mode %s", mailMode)
+	}
+
+	mailMaxMessageSize := int64(DefaultMailMaxMessageSize)
+	if v.IsSet("mail.max_message_size") {
+		mailMaxMessageSize = v.GetInt64("mail.max_message_size")
+	}
+	mailMaxAttachmentSize := int64(DefaultMailMaxAttachmentSize)
+	if v.IsSet("mail.max_attachment_size") {
+		mailMaxAttachmentSize = v.GetInt64("mail.max_attachment_size")
+	}
+
+	maxBodySize := int64(DefaultMaxBodySize)
+	if v.IsSet("body_limits.max_body_size") {
+		maxBodySize = v.GetInt64("body_limits.max_body_size")
+	}
+
+	restoreMode := v.GetString("fs.restore_mode")
+	switch restoreMode {
+	case "":
+		restoreMode = RestoreRecreate
+	case RestoreRecreate, RestoreToRoot:
+	default:
+		return fmt.Errorf("Unknown restore mode %s", restoreMode)
+	}
+
+	hashAlgo := v.GetString("fs.hash_algo")
+	switch hashAlgo {
+	case "":
+		hashAlgo = HashMD5
+	case HashMD5, HashSHA256:
+	default:
+		return fmt.Errorf("Unknown hash algorithm %s", hashAlgo)
+	}
+
+	trustedProxies, err := parseNetworks(v.GetStringSlice("trusted_proxies"))
+	if err != nil {
+		return err
+	}
+
+	var uniqueConstraints []UniqueConstraint
+	if err = v.UnmarshalKey("data.unique_constraints", &uniqueConstraints); err != nil {
+		return err
+	}
+	for _, uc := range uniqueConstraints {
+		if uc.DocType == "" || len(uc.Fields) == 0 {
+			return fmt.Errorf("Invalid unique constraint: a doctype and some fields are required")
+		}
+		for _, field := range uc.Fields {
+			if field == "" {
+				return fmt.Errorf("Invalid unique constraint on %s: a field is empty", uc.DocType)
+			}
+		}
+	}
+
+	var workers map[string]Worker
+	if err = v.UnmarshalKey("jobs.workers", &workers); err != nil {
+		return err
+	}
+
+	if err = UpdateFlags(v); err != nil {
+		return err
+	}
+
 	config = &Config{
 		Host:       v.GetString("host"),
 		Port:       v.GetInt("port"),
@@ -164,11 +428,24 @@ func UseViper(v *viper.Viper) error {
 		AdminHost:  v.GetString("admin.host"),
 		AdminPort:  v.GetInt("admin.port"),
 		Assets:     v.GetString("assets"),
+
+		TrustedProxies: trustedProxies,
 		Fs: Fs{
 			URL: fsURL,
+			Versions: FsVersions{
+				MaxNumber: v.GetInt("fs.versions.max_number"),
+				MaxSize:   v.GetInt64("fs.versions.max_size"),
+			},
+			RestoreMode: restoreMode,
+			HashAlgo:    hashAlgo,
+			DefaultMime: v.GetString("fs.default_mime"),
 		},
 		CouchDB: CouchDB{
-			URL: couchURL,
+			URL:          couchURL,
+			Timeout:      couchTimeout,
+			Retries:      couchRetries,
+			MaxDocSize:   couchMaxDocSize,
+			AllDocsLimit: couchAllDocsLimit,
 		},
 		Mail: &gomail.DialerOptions{
 			Host:       v.GetString("mail.host"),
@@ -177,6 +454,27 @@ func UseViper(v *viper.Viper) error {
 			Password:   v.GetString("mail.password"),
 			DisableTLS: v.GetBool("mail.disable_tls"),
 		},
+		MailMode: mailMode,
+		MailDir:  v.GetString("mail.dir"),
+		MailLimits: MailLimits{
+			MaxMessageSize:    mailMaxMessageSize,
+			MaxAttachmentSize: mailMaxAttachmentSize,
+		},
+		BodyLimits: BodyLimits{
+			MaxBodySize:   maxBodySize,
+			MaxUploadSize: v.GetInt64("body_limits.max_upload_size"),
+		},
+		Data: Data{
+			UniqueConstraints: uniqueConstraints,
+		},
+		Jobs: Jobs{
+			Workers: workers,
+		},
+		Previews: Previews{
+			Renderer: v.GetString("previews.renderer"),
+			Timeout:  previewTimeout,
+			MaxSize:  previewMaxSize,
+		},
 		Logger: Logger{
 			Level: v.GetString("log.level"),
 		},
@@ -202,6 +500,28 @@ log:
     level: info
 `
 
+// parseNetworks parses a list of networks in the CIDR notation, or of IP
+// addresses for the networks with a single address.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %s", value)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
 // UseTestFile can be used in a test file to inject a configuration
 // from a cozy.test.* file. If it can not find this file in your
 // $HOME/.cozy directory it will use the default one.
@@ -16,3 +16,123 @@ func TestUseViper(t *testing.T) {
 
 	assert.Equal(t, "http://db:1234/", CouchURL())
 }
+
+func TestUseViperMailMode(t *testing.T) {
+	cfg := viper.New()
+	UseViper(cfg)
+	assert.Equal(t, MailSMTP, GetConfig().MailMode)
+
+	cfg.Set("mail.mode", "file")
+	cfg.Set("mail.dir", "/tmp/mails")
+	UseViper(cfg)
+	assert.Equal(t, MailFile, GetConfig().MailMode)
+	assert.Equal(t, "/tmp/mails", GetConfig().MailDir)
+
+	cfg.Set("mail.mode", "foo")
+	assert.Error(t, UseViper(cfg))
+}
+
+func TestUseViperHashAlgo(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, HashMD5, GetConfig().Fs.HashAlgo)
+
+	cfg.Set("fs.hash_algo", "sha256")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, HashSHA256, GetConfig().Fs.HashAlgo)
+
+	cfg.Set("fs.hash_algo", "sha1")
+	assert.Error(t, UseViper(cfg))
+}
+
+func TestUseViperMailLimits(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, int64(DefaultMailMaxMessageSize), GetConfig().MailLimits.MaxMessageSize)
+	assert.Equal(t, int64(DefaultMailMaxAttachmentSize), GetConfig().MailLimits.MaxAttachmentSize)
+
+	cfg.Set("mail.max_message_size", 1000)
+	cfg.Set("mail.max_attachment_size", 0)
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, int64(1000), GetConfig().MailLimits.MaxMessageSize)
+	assert.Equal(t, int64(0), GetConfig().MailLimits.MaxAttachmentSize)
+}
+
+func TestUseViperBodyLimits(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, int64(DefaultMaxBodySize), GetConfig().BodyLimits.MaxBodySize)
+	assert.Equal(t, int64(0), GetConfig().BodyLimits.MaxUploadSize)
+
+	cfg.Set("body_limits.max_body_size", 1000)
+	cfg.Set("body_limits.max_upload_size", 5000)
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, int64(1000), GetConfig().BodyLimits.MaxBodySize)
+	assert.Equal(t, int64(5000), GetConfig().BodyLimits.MaxUploadSize)
+}
+
+func TestUseViperUniqueConstraints(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Empty(t, GetConfig().Data.UniqueConstraints)
+
+	cfg.Set("data.unique_constraints", []interface{}{
+		map[string]interface{}{
+			"doctype": "io.cozy.settings.preferences",
+			"fields":  []interface{}{"user", "key"},
+		},
+	})
+	assert.NoError(t, UseViper(cfg))
+	if assert.Len(t, GetConfig().Data.UniqueConstraints, 1) {
+		uc := GetConfig().Data.UniqueConstraints[0]
+		assert.Equal(t, "io.cozy.settings.preferences", uc.DocType)
+		assert.Equal(t, []string{"user", "key"}, uc.Fields)
+	}
+
+	cfg.Set("data.unique_constraints", []interface{}{
+		map[string]interface{}{"doctype": "io.cozy.settings.preferences"},
+	})
+	assert.Error(t, UseViper(cfg))
+}
+
+func TestUseViperTrustedProxies(t *testing.T) {
+	cfg := viper.New()
+	assert.NoError(t, UseViper(cfg))
+	assert.Empty(t, GetConfig().TrustedProxies)
+
+	cfg.Set("trusted_proxies", []string{"10.0.0.0/8", "192.0.2.1", "::1"})
+	assert.NoError(t, UseViper(cfg))
+	if assert.Len(t, GetConfig().TrustedProxies, 3) {
+		assert.Equal(t, "10.0.0.0/8", GetConfig().TrustedProxies[0].String())
+		assert.Equal(t, "192.0.2.1/32", GetConfig().TrustedProxies[1].String())
+		assert.Equal(t, "::1/128", GetConfig().TrustedProxies[2].String())
+	}
+
+	cfg.Set("trusted_proxies", []string{"not-an-ip"})
+	assert.Error(t, UseViper(cfg))
+}
+
+func TestUseViperJobsWorkers(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("jobs.workers", map[string]interface{}{
+		"mail": map[string]interface{}{
+			"concurrency": 2,
+			"rate_limit":  0.5,
+		},
+	})
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, uint(2), GetConfig().Jobs.Workers["mail"].Concurrency)
+	assert.Equal(t, 0.5, GetConfig().Jobs.Workers["mail"].RateLimit)
+}
+
+func TestUseViperFlags(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("flags.sharing", true)
+	cfg.Set("flags.thumbnails", "false")
+	assert.NoError(t, UseViper(cfg))
+	assert.Equal(t, map[string]bool{"sharing": true, "thumbnails": false}, Flags())
+
+	cfg.Set("flags.thumbnails", true)
+	assert.NoError(t, UpdateFlags(cfg))
+	assert.True(t, Flags()["thumbnails"])
+}
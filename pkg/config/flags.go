@@ -0,0 +1,39 @@
+package config
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// The feature flags are kept outside of the Config struct as they can be
+// reloaded while the stack is running.
+var (
+	flagsMu sync.RWMutex
+	flags   map[string]bool
+)
+
+// Flags returns the feature flags of the stack, enabled or not. The returned
+// map is a copy that can be modified by the caller.
+func Flags() map[string]bool {
+	flagsMu.RLock()
+	defer flagsMu.RUnlock()
+	m := make(map[string]bool, len(flags))
+	for k, v := range flags {
+		m[k] = v
+	}
+	return m
+}
+
+// UpdateFlags reads the feature flags from the flags section of the viper
+// configuration.
+func UpdateFlags(v *viper.Viper) error {
+	var m map[string]bool
+	if err := v.UnmarshalKey("flags", &m); err != nil {
+		return err
+	}
+	flagsMu.Lock()
+	defer flagsMu.Unlock()
+	flags = m
+	return nil
+}
@@ -6,12 +6,16 @@ const (
 
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesVersions doc type for the previous contents of the files
+	FilesVersions = "io.cozy.files.versions"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
 	// Manifests doc type for application manifests
 	Manifests = "io.cozy.manifests"
 	// Jobs doc type for queued jobs
 	Jobs = "io.cozy.jobs"
+	// DeadLetters doc type for the jobs that have failed after all their tries
+	DeadLetters = "io.cozy.jobs.deadletters"
 	// Queues doc type for jobs queues
 	Queues = "io.cozy.queues"
 	// Settings doc type for settings to customize an instance
@@ -20,6 +24,8 @@ const (
 	Sessions = "io.cozy.sessions"
 	// Triggers doc type for triggers, jobs launchers
 	Triggers = "io.cozy.triggers"
+	// Webhooks doc type for the URLs notified of the changes of a doctype
+	Webhooks = "io.cozy.webhooks"
 
 	// Permissions doc type for permissions identifying a connection
 	Permissions = "io.cozy.permissions"
@@ -49,4 +55,7 @@ const (
 	DiskUsageID = "io.cozy.settings.disk-usage"
 	// InstanceSettingsID is the id of settings document for the instance
 	InstanceSettingsID = "io.cozy.settings.instance"
+	// FlagsSettingsID is the id of the settings JSON-API response for the
+	// feature flags
+	FlagsSettingsID = "io.cozy.settings.flags"
 )
@@ -20,6 +20,9 @@ const (
 	ChangesStyleAllDocs ChangesFeedStyle = "all_docs"
 	// ChangesStyleMainOnly only pass the winning revision
 	ChangesStyleMainOnly ChangesFeedStyle = "main_only"
+	// ChangesFilterSelector is the built-in filter of couchdb for the changes
+	// of the documents matching a mango selector
+	ChangesFilterSelector = "_selector"
 )
 
 // ValidChangesMode convert any string into a ChangesFeedMode or gives an error
@@ -101,6 +104,11 @@ type ChangesRequest struct {
 	// view filter in case if map function emits at least one record for them.
 	// See _view for more info.
 	View string `url:"view,omitempty"`
+	// Selector is a mango selector, used with the _selector filter: only the
+	// changes of the documents matching it are returned. It is sent in the
+	// body of the request, and the filter is set to _selector when it is
+	// given.
+	Selector interface{} `url:"-"`
 }
 
 // A ChangesResponse is the response provided by a GetChanges call
@@ -115,6 +123,7 @@ type Change struct {
 	DocID   string  `json:"id"`
 	Seq     string  `json:"seq"`
 	Doc     JSONDoc `json:"doc"`
+	Deleted bool    `json:"deleted,omitempty"`
 	Changes []struct {
 		Rev string `json:"rev"`
 	} `json:"changes"`
@@ -126,6 +135,14 @@ func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
 		return nil, errors.New("Empty doctype in GetChanges")
 	}
 
+	// couchdb ignores the selector in the body without the _selector filter,
+	// and would return the changes of all the documents
+	if req.Selector != nil && req.Filter != ChangesFilterSelector {
+		filtered := *req
+		filtered.Filter = ChangesFilterSelector
+		req = &filtered
+	}
+
 	v, err := query.Values(req)
 	if err != nil {
 		return nil, err
@@ -133,7 +150,12 @@ func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
 
 	var response ChangesResponse
 	url := makeDBName(db, req.DocType) + "/_changes?" + v.Encode()
-	err = makeRequest("GET", url, nil, &response)
+	if req.Selector != nil {
+		body := map[string]interface{}{"selector": req.Selector}
+		err = makeRequest("POST", url, body, &response)
+	} else {
+		err = makeRequest("GET", url, nil, &response)
+	}
 
 	if err != nil {
 		return nil, err
@@ -2,12 +2,15 @@ package couchdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -145,9 +148,13 @@ func (j JSONDoc) Valid(field, value string) bool {
 	return fmt.Sprintf("%v", j.Get(field)) == value
 }
 
-var couchdbClient = &http.Client{
-	Timeout: 5 * time.Second,
-}
+// couchdbClient is the HTTP client used for the requests to CouchDB. The
+// timeout is given per request, by the configuration.
+var couchdbClient = &http.Client{}
+
+// retryDelay is the delay before retrying a request to CouchDB after a
+// connection failure. It grows linearly with the number of attempts.
+var retryDelay = 100 * time.Millisecond
 
 func escapeCouchdbName(name string) string {
 	name = strings.Replace(name, ".", "-", -1)
@@ -183,38 +190,91 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 			return err
 		}
 	}
+	return sendRequest(method, path, reqjson, resbody)
+}
 
+// makeDocRequest is like makeRequest, for the requests writing a document:
+// the JSON of the document is rejected if it exceeds the maximal size of the
+// configuration.
+func makeDocRequest(method, path string, doc Doc, resbody interface{}) error {
+	reqjson, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err = checkDocSize(int64(len(reqjson))); err != nil {
+		return err
+	}
+	return sendRequest(method, path, reqjson, resbody)
+}
+
+// checkDocSize returns an error if the size of the JSON of a document
+// exceeds the maximal size of the configuration.
+func checkDocSize(size int64) error {
+	max := config.GetConfig().CouchDB.MaxDocSize
+	if max > 0 && size > max {
+		return newDocTooLargeError(size, max)
+	}
+	return nil
+}
+
+func sendRequest(method, path string, reqjson []byte, resbody interface{}) error {
 	if log.GetLevel() == log.DebugLevel {
 		log.Debugf("[couchdb] request: %s %s %s", method, path, string(bytes.TrimSpace(reqjson)))
 	}
 
-	req, err := http.NewRequest(method, config.CouchURL()+path, bytes.NewReader(reqjson))
-	// Possible err = wrong method, unparsable url
-	if err != nil {
-		return newRequestError(err)
-	}
-	if reqbody != nil {
-		req.Header.Add("Content-Type", "application/json")
+	cfg := config.GetConfig().CouchDB
+	retries := 0
+	if isIdempotent(method, path) {
+		retries = cfg.Retries
 	}
-	req.Header.Add("Accept", "application/json")
-	resp, err := couchdbClient.Do(req)
-	// Possible err = mostly connection failure
-	if err != nil {
-		return newConnectionError(err)
+
+	return withRetries(method, path, retries, func() error {
+		return doRequest(cfg, method, path, reqjson, resbody)
+	})
+}
+
+// withRetries calls the given function, and calls it again on connection
+// errors, up to the number of retries.
+func withRetries(method, path string, retries int, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if attempt >= retries || !isConnectionError(err) {
+			return err
+		}
+		log.Debugf("[couchdb] retrying %s %s after: %s", method, path, err)
+		time.Sleep(time.Duration(attempt+1) * retryDelay)
 	}
-	defer resp.Body.Close()
+}
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var body []byte
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			err = newIOReadError(err)
-		} else {
-			err = newCouchdbError(resp.StatusCode, body)
+// isIdempotent returns true for the requests that can be safely sent again
+// to CouchDB: the reads, including the POST used for the queries.
+func isIdempotent(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		if i := strings.Index(path, "?"); i >= 0 {
+			path = path[:i]
 		}
-		log.Debugf("[couchdb] error: %s", err.Error())
+		return strings.HasSuffix(path, "/_find") ||
+			strings.HasSuffix(path, "/_all_docs")
+	}
+	return false
+}
+
+func isConnectionError(err error) bool {
+	if couchErr, ok := err.(*Error); ok {
+		return couchErr.Name == "no_couch" && couchErr.Reason == "cant_connect"
+	}
+	return false
+}
+
+func doRequest(cfg config.CouchDB, method, path string, reqjson []byte, resbody interface{}) error {
+	resp, err := openRequest(cfg, method, path, reqjson, nil)
+	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	if resbody == nil {
 		return nil
@@ -235,17 +295,140 @@ func makeRequest(method, path string, reqbody interface{}, resbody interface{})
 	return err
 }
 
+// openRequest sends a request to CouchDB and returns its response, if it is
+// a success. The body of the response must be closed by the caller. The
+// given headers, if any, are added to the request. The timeout of the
+// configuration covers the whole request, including the reading of the body.
+func openRequest(cfg config.CouchDB, method, path string, reqjson []byte, header http.Header) (*http.Response, error) {
+	req, err := newRequest(cfg, method, path, reqjson, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// the timeout covers the reading of the response body, so the context is
+	// canceled only when the body is closed
+	cancel := context.CancelFunc(func() {})
+	if cfg.Timeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(context.Background(), cfg.Timeout)
+		req = req.WithContext(ctx)
+	}
+	return sendOpenRequest(req, cancel)
+}
+
+// openStreamRequest is like openRequest, but the timeout of the
+// configuration only covers the wait for the headers of the response, and
+// not the reading of its body: the long responses can be streamed to the
+// client for as long as it takes.
+func openStreamRequest(cfg config.CouchDB, method, path string, reqjson []byte) (*http.Response, error) {
+	req, err := newRequest(cfg, method, path, reqjson, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req = req.WithContext(ctx)
+	var timer *time.Timer
+	if cfg.Timeout > 0 {
+		timer = time.AfterFunc(cfg.Timeout, cancel)
+	}
+	resp, err := sendOpenRequest(req, cancel)
+	if timer != nil && !timer.Stop() && err == nil {
+		// the timeout has been reached just after the headers
+		resp.Body.Close()
+		return nil, newConnectionError(context.DeadlineExceeded)
+	}
+	return resp, err
+}
+
+func newRequest(cfg config.CouchDB, method, path string, reqjson []byte, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest(method, cfg.URL+path, bytes.NewReader(reqjson))
+	// Possible err = wrong method, unparsable url
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if reqjson != nil {
+		req.Header.Add("Content-Type", "application/json")
+	}
+	req.Header.Add("Accept", "application/json")
+	return req, nil
+}
+
+// sendOpenRequest sends the request, and returns its response if it is a
+// success. The cancel function is called when the body of the response is
+// closed, or when the request fails.
+func sendOpenRequest(req *http.Request, cancel context.CancelFunc) (*http.Response, error) {
+	resp, err := couchdbClient.Do(req)
+	// Possible err = mostly connection failure, or timeout
+	if err != nil {
+		cancel()
+		return nil, newConnectionError(err)
+	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var body []byte
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			err = newIOReadError(err)
+		} else {
+			err = newCouchdbError(resp.StatusCode, body)
+		}
+		log.Debugf("[couchdb] error: %s", err.Error())
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// cancelOnClose is a body of a response that cancels the context of its
+// request when it is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// wrongDoctypeReason is the reason of the errors for a doctype without
+// database, to distinguish them from the missing documents.
+const wrongDoctypeReason = "wrong_doctype"
+
 func fixErrorNoDatabaseIsWrongDoctype(err error) error {
 	if IsNoDatabaseError(err) {
-		err.(*Error).Reason = "wrong_doctype"
+		err.(*Error).Reason = wrongDoctypeReason
 	}
 	return err
 }
 
-// DBStatus re
+// DBStatus returns the status of the database for the given doctype.
 func DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
-	var out DBStatusResponse
-	return &out, makeRequest("GET", makeDBName(db, doctype), nil, &out)
+	var raw map[string]interface{}
+	if err := makeRequest("GET", makeDBName(db, doctype), nil, &raw); err != nil {
+		return nil, err
+	}
+	out := &DBStatusResponse{Raw: raw}
+	switch seq := raw["update_seq"].(type) {
+	case string:
+		out.Stats.UpdateSeq = seq
+	case float64:
+		out.Stats.UpdateSeq = strconv.FormatFloat(seq, 'f', -1, 64)
+	}
+	if count, ok := raw["doc_count"].(float64); ok {
+		out.Stats.DocCount = int(count)
+	}
+	if count, ok := raw["doc_del_count"].(float64); ok {
+		out.Stats.DocDelCount = int(count)
+	}
+	return out, nil
 }
 
 // GetDoc fetch a document by its docType and ID, out is filled with
@@ -263,6 +446,141 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	return nil
 }
 
+// OpenDoc fetches a document by its doctype and ID, but instead of decoding
+// it, it returns a reader on its JSON representation, as sent by CouchDB, and
+// its size (-1 if unknown). It can be used to stream large documents: the
+// timeout of the requests doesn't apply to the reading. The reader must be
+// closed by the caller.
+func OpenDoc(db Database, doctype, id string) (io.ReadCloser, int64, error) {
+	id, err := validateDocID(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	cfg := config.GetConfig().CouchDB
+	path := docURL(db, doctype, id)
+	if log.GetLevel() == log.DebugLevel {
+		log.Debugf("[couchdb] request: GET %s", path)
+	}
+	var resp *http.Response
+	err = withRetries(http.MethodGet, path, cfg.Retries, func() (err error) {
+		resp, err = openStreamRequest(cfg, http.MethodGet, path, nil)
+		return err
+	})
+	if err != nil {
+		return nil, 0, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// GetDocRev returns the current revision of a document, with a HEAD request,
+// to check its existence without fetching its content.
+func GetDocRev(db Database, doctype, id string) (string, error) {
+	id, err := validateDocID(id)
+	if err != nil {
+		return "", err
+	}
+	cfg := config.GetConfig().CouchDB
+	path := docURL(db, doctype, id)
+	if log.GetLevel() == log.DebugLevel {
+		log.Debugf("[couchdb] request: HEAD %s", path)
+	}
+	var resp *http.Response
+	err = withRetries(http.MethodHead, path, cfg.Retries, func() (err error) {
+		resp, err = openRequest(cfg, http.MethodHead, path, nil, nil)
+		return err
+	})
+	if err != nil {
+		// the responses to HEAD requests have no body to explain the error
+		if coucherr, ok := err.(*Error); ok && coucherr.StatusCode == http.StatusNotFound {
+			return "", &Error{
+				StatusCode: http.StatusNotFound,
+				Name:       "not_found",
+				Reason:     "missing",
+			}
+		}
+		return "", err
+	}
+	resp.Body.Close()
+	return strings.Trim(resp.Header.Get("Etag"), `"`), nil
+}
+
+// GetDocs fetches the documents of the given doctype with the specified
+// identifiers, in a single request. The returned slice has the same length
+// and order than the identifiers, with a nil document for the identifiers
+// without document (missing or deleted).
+func GetDocs(db Database, doctype string, ids []string) ([]*JSONDoc, error) {
+	for _, id := range ids {
+		if _, err := validateDocID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	var response struct {
+		Rows []struct {
+			Key   string          `json:"key"`
+			Error string          `json:"error"`
+			Doc   json.RawMessage `json:"doc"`
+		} `json:"rows"`
+	}
+	url := makeDBName(db, doctype) + "/_all_docs?include_docs=true"
+	req := map[string][]string{"keys": ids}
+	if err := makeRequest("POST", url, &req, &response); err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+
+	docs := make([]*JSONDoc, len(ids))
+	for i, row := range response.Rows {
+		if i >= len(docs) || row.Error != "" || len(row.Doc) == 0 || string(row.Doc) == "null" {
+			continue
+		}
+		doc := &JSONDoc{}
+		if err := json.Unmarshal(row.Doc, doc); err != nil {
+			return nil, err
+		}
+		doc.Type = doctype
+		docs[i] = doc
+	}
+	return docs, nil
+}
+
+// BulkUpdateDocs updates several documents of the same doctype in a single
+// request. The documents must have an id and a revision. The results are in
+// the same order than the documents, and the SetRev method is called for the
+// documents that have been updated.
+func BulkUpdateDocs(db Database, doctype string, docs []Doc) ([]BulkResult, error) {
+	for _, doc := range docs {
+		if _, err := validateDocID(doc.ID()); err != nil {
+			return nil, err
+		}
+		if doc.ID() == "" || doc.Rev() == "" {
+			return nil, fmt.Errorf("BulkUpdateDocs docs should have id and rev")
+		}
+		if config.GetConfig().CouchDB.MaxDocSize > 0 {
+			docjson, err := json.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			if err = checkDocSize(int64(len(docjson))); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var results []BulkResult
+	url := makeDBName(db, doctype) + "/_bulk_docs"
+	req := map[string][]Doc{"docs": docs}
+	if err := makeRequest("POST", url, &req, &results); err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+
+	for i, res := range results {
+		if i < len(docs) && res.Error == "" {
+			docs[i].SetRev(res.Rev)
+		}
+	}
+	return results, nil
+}
+
 // CreateDB creates the necessary database for a doctype
 func CreateDB(db Database, doctype string) error {
 	return makeRequest("PUT", makeDBName(db, doctype), nil, nil)
@@ -274,32 +592,34 @@ func DeleteDB(db Database, doctype string) error {
 }
 
 // DeleteAllDBs will remove all the couchdb doctype databases for
-// a couchdb.DB.
-func DeleteAllDBs(db Database) error {
+// a couchdb.DB. It returns the doctypes of the removed databases.
+func DeleteAllDBs(db Database) ([]string, error) {
 
 	dbprefix := db.Prefix()
 
 	if dbprefix == "" || dbprefix[len(dbprefix)-1] != '/' {
-		return fmt.Errorf("You need to provide the database prefix name ending with /")
+		return nil, fmt.Errorf("You need to provide the database prefix name ending with /")
 	}
 
 	var dbsList []string
 	err := makeRequest("GET", "_all_dbs", nil, &dbsList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var doctypes []string
 	for _, doctypedb := range dbsList {
 		hasPrefix, doctype := dbNameHasPrefix(doctypedb, dbprefix)
 		if !hasPrefix {
 			continue
 		}
 		if err = DeleteDB(db, doctype); err != nil {
-			return err
+			return doctypes, err
 		}
+		doctypes = append(doctypes, doctype)
 	}
 
-	return nil
+	return doctypes, nil
 }
 
 // ResetDB destroy and recreate the database for a doctype
@@ -359,7 +679,7 @@ func UpdateDoc(db Database, doc Doc) error {
 	}
 	url := docURL(db, doctype, id)
 	var res updateResponse
-	err = makeRequest("PUT", url, doc, &res)
+	err = makeDocRequest("PUT", url, doc, &res)
 	if err != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(err)
 	}
@@ -382,7 +702,7 @@ func CreateNamedDoc(db Database, doc Doc) error {
 	}
 	url := docURL(db, doctype, id)
 	var res updateResponse
-	err = makeRequest("PUT", url, doc, &res)
+	err = makeDocRequest("PUT", url, doc, &res)
 	if err != nil {
 		return fixErrorNoDatabaseIsWrongDoctype(err)
 	}
@@ -394,7 +714,7 @@ func CreateNamedDoc(db Database, doc Doc) error {
 // if it does not exist
 func CreateNamedDocWithDB(db Database, doc Doc) error {
 	err := CreateNamedDoc(db, doc)
-	if coucherr, ok := err.(*Error); ok && coucherr.Reason == "wrong_doctype" {
+	if IsNoDatabaseError(err) {
 		err = CreateDB(db, doc.DocType())
 		if err != nil {
 			return err
@@ -404,17 +724,102 @@ func CreateNamedDocWithDB(db Database, doc Doc) error {
 	return err
 }
 
+// CopyResponse is the result of the copy of a document
+type CopyResponse struct {
+	ID  string
+	Rev string
+	// AttachmentsDropped is true when the document has been copied to
+	// another doctype without its attachments, as they were too large
+	AttachmentsDropped bool
+}
+
+// CopyDoc copies a document, with its attachments, to a new document with
+// the target id. In the same doctype, the native COPY of CouchDB is used.
+// For another doctype, the document is fetched with its attachments and
+// created in the target database, which is created if it does not exist.
+// If the document with its attachments exceeds the maximal size of a
+// document, it is copied without them, with a warning. If a revision is
+// given, the copy fails with a conflict when it is not the current revision
+// of the document.
+func CopyDoc(db Database, doctype, id, rev, targetDoctype, targetID string) (*CopyResponse, error) {
+	id, err := validateDocID(id)
+	if err != nil {
+		return nil, err
+	}
+	if targetID, err = validateDocID(targetID); err != nil {
+		return nil, err
+	}
+	if rev != "" {
+		var current struct {
+			Rev string `json:"_rev"`
+		}
+		err = makeRequest("GET", docURL(db, doctype, id), nil, &current)
+		if err != nil {
+			return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+		}
+		if current.Rev != rev {
+			return nil, newConflictError()
+		}
+	}
+	if targetDoctype == doctype {
+		return copyDocInDB(db, doctype, id, targetID)
+	}
+
+	var doc map[string]interface{}
+	err = makeRequest("GET", docURL(db, doctype, id)+"?attachments=true", nil, &doc)
+	if err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	delete(doc, "_rev")
+	doc["_id"] = targetID
+	target := JSONDoc{M: doc, Type: targetDoctype}
+
+	res := &CopyResponse{ID: targetID}
+	err = CreateNamedDocWithDB(db, target)
+	if IsDocTooLargeError(err) && doc["_attachments"] != nil {
+		log.Warnf("[couchdb] attachments of %s/%s not copied to %s: %s",
+			doctype, id, targetDoctype, err)
+		delete(doc, "_attachments")
+		res.AttachmentsDropped = true
+		err = CreateNamedDocWithDB(db, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res.Rev = target.Rev()
+	return res, nil
+}
+
+func copyDocInDB(db Database, doctype, id, targetID string) (*CopyResponse, error) {
+	cfg := config.GetConfig().CouchDB
+	path := docURL(db, doctype, id)
+	if log.GetLevel() == log.DebugLevel {
+		log.Debugf("[couchdb] request: COPY %s to %s", path, targetID)
+	}
+	header := http.Header{"Destination": {targetID}}
+	resp, err := openRequest(cfg, "COPY", path, nil, header)
+	if err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	defer resp.Body.Close()
+	var res updateResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &CopyResponse{ID: res.ID, Rev: res.Rev}, nil
+}
+
 func createDocOrDb(db Database, doc Doc, response interface{}) error {
 	doctype := doc.DocType()
 	dbname := makeDBName(db, doctype)
-	err := makeRequest("POST", dbname, doc, response)
+	err := makeDocRequest("POST", dbname, doc, response)
 	if err == nil || !IsNoDatabaseError(err) {
 		return err
 	}
 
 	err = CreateDB(db, doctype)
 	if err == nil {
-		err = makeRequest("POST", dbname, doc, response)
+		err = makeDocRequest("POST", dbname, doc, response)
 	}
 	return err
 }
@@ -461,6 +866,41 @@ func ExecView(db Database, doctype, view string, results interface{}) error {
 	return makeRequest("GET", url, nil, &results)
 }
 
+// ViewRequest are the parameters of a request on a view. The keys are sent
+// in JSON. When Keys is not empty, only the rows with these keys are
+// returned, and they are sent in the body of a POST request.
+type ViewRequest struct {
+	Group    bool
+	StartKey interface{}
+	EndKey   interface{}
+	Keys     []interface{}
+}
+
+// ExecViewWithRequest executes the specified view function, with the given
+// parameters
+func ExecViewWithRequest(db Database, doctype, view string, req *ViewRequest, results interface{}) error {
+	v := url.Values{}
+	if req.Group {
+		v.Add("group", "true")
+	}
+	for name, key := range map[string]interface{}{"startkey": req.StartKey, "endkey": req.EndKey} {
+		if key == nil {
+			continue
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		v.Add(name, string(k))
+	}
+	u := makeDBName(db, doctype) + "/_design/" + doctype + "/_view/" + view + "?" + v.Encode()
+	if len(req.Keys) > 0 {
+		body := map[string]interface{}{"keys": req.Keys}
+		return makeRequest("POST", u, &body, &results)
+	}
+	return makeRequest("GET", u, nil, &results)
+}
+
 // DefineIndex define the index on the doctype database
 // see query package on how to define an index
 func DefineIndex(db Database, doctype string, index mango.Index) error {
@@ -475,6 +915,36 @@ func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreat
 	return &response, makeRequest("POST", url, &index, &response)
 }
 
+// IndexesResponse is the response from couchdb when we list the indexes
+type IndexesResponse struct {
+	TotalRows int               `json:"total_rows"`
+	Indexes   []json.RawMessage `json:"indexes"`
+}
+
+// ListIndexes returns the indexes defined on the doctype database
+func ListIndexes(db Database, doctype string) (*IndexesResponse, error) {
+	url := makeDBName(db, doctype) + "/_index"
+	var response IndexesResponse
+	err := makeRequest("GET", url, nil, &response)
+	if err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return &response, nil
+}
+
+// DeleteIndex removes the index with the given design document and name
+// from the doctype database. The design document can be given with or
+// without its _design/ prefix.
+func DeleteIndex(db Database, doctype, ddoc, name string) error {
+	ddoc = strings.TrimPrefix(ddoc, "_design/")
+	indexURL := makeDBName(db, doctype) + "/_index/" + url.QueryEscape(ddoc) + "/json/" + url.QueryEscape(name)
+	err := makeRequest("DELETE", indexURL, nil, nil)
+	if err != nil {
+		return fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return nil
+}
+
 // FindDocs returns all documents matching the passed FindRequest
 // documents will be unmarshalled in the provided results slice.
 func FindDocs(db Database, doctype string, req *FindRequest, results interface{}) error {
@@ -498,6 +968,31 @@ func FindDocsRaw(db Database, doctype string, req interface{}, results interface
 	return json.Unmarshal(response.Docs, results)
 }
 
+// explainResponse is the part of the response of _explain with the index
+// chosen by couchdb for a mango query
+type explainResponse struct {
+	Index struct {
+		Type string `json:"type"`
+	} `json:"index"`
+}
+
+// CheckFindIndex asks couchdb the index it would use for a mango query,
+// without running it, and returns the same error as FindDocsRaw if there is no
+// index for it. It can be used before OpenFind, as the warning for a query
+// without index comes only after the documents.
+func CheckFindIndex(db Database, doctype string, req interface{}) error {
+	url := makeDBName(db, doctype) + "/_explain"
+	var response explainResponse
+	if err := makeRequest("POST", url, &req, &response); err != nil {
+		return err
+	}
+	// the special index is _all_docs, used when no index matches the query
+	if response.Index.Type == "special" {
+		return unoptimalError()
+	}
+	return nil
+}
+
 // GetAllDocs returns all documents of a specified doctype. It filters
 // out the possible _design document.
 // TODO: pagination
@@ -531,6 +1026,68 @@ func GetAllDocs(db Database, doctype string, req *AllDocsRequest, results interf
 	return json.Unmarshal(data, results)
 }
 
+// GetAllDocsPage makes a request on _all_docs with the given parameters, as
+// sent by a client, and returns the rows without decoding them.
+func GetAllDocsPage(db Database, doctype string, params url.Values) (*AllDocsPage, error) {
+	var page AllDocsPage
+	u := makeDBName(db, doctype) + "/_all_docs?" + params.Encode()
+	if err := makeRequest("GET", u, nil, &page); err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return &page, nil
+}
+
+// OpenFind sends a mango query and returns the body of the response, to read
+// the documents as they arrive, without buffering them. The body must be
+// closed by the caller. Contrary to FindDocsRaw, the queries without an index
+// are not rejected, as the warning comes after the documents: CheckFindIndex
+// can be used before.
+func OpenFind(db Database, doctype string, req interface{}) (io.ReadCloser, error) {
+	path := makeDBName(db, doctype) + "/_find"
+	return openStream(http.MethodPost, path, req)
+}
+
+// OpenAllDocs is like GetAllDocsPage, but returns the body of the response,
+// to read the rows as they arrive. The rows are restricted to the given keys
+// if there are some. The body must be closed by the caller.
+func OpenAllDocs(db Database, doctype string, params url.Values, keys []string) (io.ReadCloser, error) {
+	path := makeDBName(db, doctype) + "/_all_docs?" + params.Encode()
+	if keys != nil {
+		return openStream(http.MethodPost, path, map[string]interface{}{"keys": keys})
+	}
+	return openStream(http.MethodGet, path, nil)
+}
+
+// openStream is like makeRequest, but returns the body of the response
+// instead of decoding it. The timeout of the requests doesn't apply to the
+// reading of the body, for the long exports.
+func openStream(method, path string, reqbody interface{}) (io.ReadCloser, error) {
+	var reqjson []byte
+	if reqbody != nil {
+		var err error
+		if reqjson, err = json.Marshal(reqbody); err != nil {
+			return nil, err
+		}
+	}
+	if log.GetLevel() == log.DebugLevel {
+		log.Debugf("[couchdb] request: %s %s %s", method, path, string(bytes.TrimSpace(reqjson)))
+	}
+	cfg := config.GetConfig().CouchDB
+	retries := 0
+	if isIdempotent(method, path) {
+		retries = cfg.Retries
+	}
+	var resp *http.Response
+	err := withRetries(method, path, retries, func() (err error) {
+		resp, err = openStreamRequest(cfg, method, path, reqjson)
+		return err
+	})
+	if err != nil {
+		return nil, fixErrorNoDatabaseIsWrongDoctype(err)
+	}
+	return resp.Body, nil
+}
+
 // Proxy generate a httputil.ReverseProxy which forwards the request to the
 // correct route.
 func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
@@ -571,6 +1128,16 @@ type updateResponse struct {
 	Ok  bool   `json:"ok"`
 }
 
+// BulkResult is the result of the modification of a document in a bulk
+// request
+type BulkResult struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Ok     bool   `json:"ok,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
 type findResponse struct {
 	Warning string          `json:"warning"`
 	Docs    json.RawMessage `json:"docs"`
@@ -578,12 +1145,13 @@ type findResponse struct {
 
 // FindRequest is used to build a find request
 type FindRequest struct {
-	Selector mango.Filter  `json:"selector"`
-	UseIndex string        `json:"use_index,omitempty"`
-	Limit    int           `json:"limit,omitempty"`
-	Skip     int           `json:"skip,omitempty"`
-	Sort     *mango.SortBy `json:"sort,omitempty"`
-	Fields   []string      `json:"fields,omitempty"`
+	Selector mango.Filter `json:"selector"`
+	UseIndex string       `json:"use_index,omitempty"`
+	Limit    int          `json:"limit,omitempty"`
+	Skip     int          `json:"skip,omitempty"`
+	Sort     mango.Sort   `json:"sort,omitempty"`
+	Fields   []string     `json:"fields,omitempty"`
+	Bookmark string       `json:"bookmark,omitempty"`
 }
 
 // AllDocsRequest is used to build a _all_docs request
@@ -606,6 +1174,14 @@ type AllDocsResponse struct {
 	} `json:"rows"`
 }
 
+// AllDocsPage is the response of an _all_docs request, with the rows kept
+// as raw JSON
+type AllDocsPage struct {
+	Offset    int               `json:"offset"`
+	TotalRows int               `json:"total_rows"`
+	Rows      []json.RawMessage `json:"rows"`
+}
+
 // ViewResponse is the response we receive when executing a view
 type ViewResponse struct {
 	Rows []struct {
@@ -615,24 +1191,30 @@ type ViewResponse struct {
 	} `json:"rows"`
 }
 
-// DBStatusResponse is the response from DBStatus
+// DBStatusResponse is the response from DBStatus. It contains the
+// informations returned by CouchDB as-is, and some statistics with the same
+// shape for all the versions of CouchDB.
 type DBStatusResponse struct {
-	DBName    string `json:"db_name"`
-	UpdateSeq string `json:"update_seq"`
-	Sizes     struct {
-		File     int `json:"file"`
-		External int `json:"external"`
-		Active   int `json:"active"`
-	} `json:"sizes"`
-	PurgeSeq int `json:"purge_seq"`
-	Other    struct {
-		DataSize int `json:"data_size"`
-	} `json:"other"`
-	DocDelCount       int    `json:"doc_del_count"`
-	DocCount          int    `json:"doc_count"`
-	DiskSize          int    `json:"disk_size"`
-	DiskFormatVersion int    `json:"disk_format_version"`
-	DataSize          int    `json:"data_size"`
-	CompactRunning    bool   `json:"compact_running"`
-	InstanceStartTime string `json:"instance_start_time"`
+	Raw   map[string]interface{}
+	Stats DBStats
+}
+
+// DBStats are the statistics of a database, as given in a DBStatusResponse
+type DBStats struct {
+	// UpdateSeq is the sequence of the last change in the database. It is
+	// always a string, even for the versions of CouchDB using integers.
+	UpdateSeq   string `json:"update_seq"`
+	DocCount    int    `json:"doc_count"`
+	DocDelCount int    `json:"doc_del_count"`
+}
+
+// MarshalJSON implements json.Marshaler: the statistics are added to the raw
+// fields of CouchDB in a stats field.
+func (s *DBStatusResponse) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(s.Raw)+1)
+	for k, v := range s.Raw {
+		m[k] = v
+	}
+	m["stats"] = s.Stats
+	return json.Marshal(m)
 }
@@ -2,8 +2,13 @@ package couchdb
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -229,6 +234,254 @@ func TestChangesSuccess(t *testing.T) {
 	assert.Len(t, response.Results, 2)
 }
 
+func TestChangesWithSelector(t *testing.T) {
+	response, err := GetChanges(TestPrefix, &ChangesRequest{DocType: TestDoctype})
+	if !assert.NoError(t, err) {
+		return
+	}
+	since := response.LastSeq
+
+	matching := &testDoc{Test: "matching"}
+	other := &testDoc{Test: "other"}
+	assert.NoError(t, CreateDoc(TestPrefix, matching))
+	assert.NoError(t, CreateDoc(TestPrefix, other))
+
+	response, err = GetChanges(TestPrefix, &ChangesRequest{
+		DocType:  TestDoctype,
+		Since:    since,
+		Selector: mango.Equal("test", "matching"),
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, response.Results, 1) {
+		assert.Equal(t, matching.ID(), response.Results[0].DocID)
+	}
+}
+
+func TestChangesSelectorSetsFilter(t *testing.T) {
+	var filter, method string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		filter = r.URL.Query().Get("filter")
+		method = r.Method
+		w.Write([]byte(`{"last_seq": "1-abc", "pending": 0, "results": []}`))
+	}
+	withFakeCouch(handler, time.Second, 0, func() {
+		req := &ChangesRequest{
+			DocType:  TestDoctype,
+			Selector: mango.Equal("test", "matching"),
+		}
+		_, err := GetChanges(TestPrefix, req)
+		assert.NoError(t, err)
+		assert.Equal(t, ChangesFilterSelector, filter)
+		assert.Equal(t, "POST", method)
+		assert.Empty(t, req.Filter)
+	})
+}
+
+// withFakeCouch runs the given function with the couchdb requests sent to a
+// fake server, using the handler, and with the given timeout and retries.
+func withFakeCouch(handler http.HandlerFunc, timeout time.Duration, retries int, fn func()) {
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	cfg := config.GetConfig()
+	previous := cfg.CouchDB
+	previousDelay := retryDelay
+	cfg.CouchDB.URL = ts.URL + "/"
+	cfg.CouchDB.Timeout = timeout
+	cfg.CouchDB.Retries = retries
+	retryDelay = time.Millisecond
+	defer func() {
+		cfg.CouchDB = previous
+		retryDelay = previousDelay
+	}()
+
+	fn()
+}
+
+// closeConnection simulates a failure of couchdb by closing the connection
+// without answering
+func closeConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var calls int32
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte(`{"_id": "foo", "_rev": "1-abc", "test": "value"}`))
+	}
+	withFakeCouch(slow, 50*time.Millisecond, 0, func() {
+		start := time.Now()
+		doc := &testDoc{}
+		err := GetDoc(TestPrefix, TestDoctype, "foo", doc)
+		assert.True(t, time.Since(start) < 400*time.Millisecond)
+		if assert.Error(t, err) {
+			couchErr, ok := err.(*Error)
+			if assert.True(t, ok) {
+				assert.Equal(t, "cant_connect", couchErr.Reason)
+			}
+		}
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	})
+}
+
+func TestOpenDocNotCutByTimeout(t *testing.T) {
+	slowBody := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"_id": "foo", "_rev": "1-abc", `))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`"test": "value"}`))
+	}
+	withFakeCouch(slowBody, 100*time.Millisecond, 0, func() {
+		content, _, err := OpenDoc(TestPrefix, TestDoctype, "foo")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer content.Close()
+		body, err := ioutil.ReadAll(content)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"_id": "foo", "_rev": "1-abc", "test": "value"}`, string(body))
+	})
+
+	slowHeaders := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"_id": "foo", "_rev": "1-abc", "test": "value"}`))
+	}
+	withFakeCouch(slowHeaders, 50*time.Millisecond, 0, func() {
+		_, _, err := OpenDoc(TestPrefix, TestDoctype, "foo")
+		assert.Error(t, err)
+	})
+}
+
+func TestOpenFindNotCutByTimeout(t *testing.T) {
+	var calls int32
+	slowBody := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte(`{"docs": [{"_id": "foo"},`))
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"_id": "bar"}]}`))
+	}
+	withFakeCouch(slowBody, 100*time.Millisecond, 0, func() {
+		content, err := OpenFind(TestPrefix, TestDoctype, &FindRequest{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer content.Close()
+		body, err := ioutil.ReadAll(content)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"docs": [{"_id": "foo"},{"_id": "bar"}]}`, string(body))
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	})
+}
+
+func TestCheckFindIndex(t *testing.T) {
+	var path, indexType string
+	explain := func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`{"index": {"ddoc": null, "name": "_all_docs", "type": "` + indexType + `"}}`))
+	}
+	withFakeCouch(explain, time.Second, 0, func() {
+		req := &FindRequest{Selector: mango.Equal("test", "value")}
+		indexType = "special"
+		err := CheckFindIndex(TestPrefix, TestDoctype, req)
+		assert.True(t, IsNoIndexError(err))
+		assert.Contains(t, path, "/_explain")
+
+		indexType = "json"
+		assert.NoError(t, CheckFindIndex(TestPrefix, TestDoctype, req))
+	})
+}
+
+func TestFindDocsWithoutIndex(t *testing.T) {
+	var status int
+	var body string
+	find := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+	withFakeCouch(find, time.Second, 0, func() {
+		req := &FindRequest{Selector: mango.Equal("test", "value")}
+		var results []testDoc
+
+		// the query is run by couchdb on _all_docs, with a warning
+		status = http.StatusOK
+		body = `{"docs": [{"_id": "foo", "test": "value"}],
+			"warning": "no matching index found, create an index to optimize query time"}`
+		err := FindDocs(TestPrefix, TestDoctype, req, &results)
+		assert.True(t, IsNoIndexError(err))
+
+		// no index can be used for the sort
+		status = http.StatusBadRequest
+		body = `{"error": "no_usable_index", "reason": "No index exists for this sort, try indexing by the sort fields."}`
+		err = FindDocs(TestPrefix, TestDoctype, req, &results)
+		assert.True(t, IsNoIndexError(err))
+
+		status = http.StatusOK
+		body = `{"docs": [{"_id": "foo", "test": "value"}]}`
+		err = FindDocs(TestPrefix, TestDoctype, req, &results)
+		assert.NoError(t, err)
+		assert.Len(t, results, 1)
+	})
+}
+
+func TestRequestRetriedOnConnectionError(t *testing.T) {
+	var calls int32
+	flaky := func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			closeConnection(w)
+			return
+		}
+		w.Write([]byte(`{"_id": "foo", "_rev": "1-abc", "test": "value"}`))
+	}
+	withFakeCouch(flaky, time.Second, 2, func() {
+		doc := &testDoc{}
+		err := GetDoc(TestPrefix, TestDoctype, "foo", doc)
+		assert.NoError(t, err)
+		assert.Equal(t, "value", doc.Test)
+		assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+	})
+
+	calls = 0
+	withFakeCouch(flaky, time.Second, 1, func() {
+		doc := &testDoc{}
+		err := GetDoc(TestPrefix, TestDoctype, "foo", doc)
+		assert.Error(t, err)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&calls))
+	})
+}
+
+func TestRequestNotRetried(t *testing.T) {
+	var calls int32
+	notFound := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "not_found", "reason": "missing"}`))
+	}
+	withFakeCouch(notFound, time.Second, 2, func() {
+		err := GetDoc(TestPrefix, TestDoctype, "foo", &testDoc{})
+		assert.True(t, IsNotFoundError(err))
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	})
+
+	// the creation of a document is not idempotent
+	calls = 0
+	failing := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		closeConnection(w)
+	}
+	withFakeCouch(failing, time.Second, 2, func() {
+		err := CreateDoc(TestPrefix, makeTestDoc())
+		assert.Error(t, err)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	})
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -79,7 +79,8 @@ func (e *Error) JSON() map[string]interface{} {
 }
 
 // IsNoDatabaseError checks if the given error is a couch no_db_file
-// error
+// error. It is also true for the not_found errors of the documents of a
+// doctype without database, whose reason is wrong_doctype.
 func IsNoDatabaseError(err error) bool {
 	if err == nil {
 		return false
@@ -89,7 +90,8 @@ func IsNoDatabaseError(err error) bool {
 		return false
 	}
 	return couchErr.Reason == "no_db_file" ||
-		couchErr.Reason == "Database does not exist."
+		couchErr.Reason == "Database does not exist." ||
+		couchErr.Reason == wrongDoctypeReason
 }
 
 // IsNotFoundError checks if the given error is a couch not_found
@@ -117,6 +119,34 @@ func IsConflictError(err error) bool {
 	return couchErr.StatusCode == 409
 }
 
+// IsFileExists checks if the given error is a couch file_exists error, as
+// returned when creating a database that already exists
+func IsFileExists(err error) bool {
+	if err == nil {
+		return false
+	}
+	couchErr, isCouchErr := err.(*Error)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "file_exists"
+}
+
+// IsNoIndexError checks if the given error is the one returned by FindDocs
+// when no index matches the query, for the "no matching index found" warning
+// of couchdb. It is also true for the no_usable_index errors of couchdb,
+// returned when no index can be used for the sort of the query.
+func IsNoIndexError(err error) bool {
+	if err == nil {
+		return false
+	}
+	couchErr, isCouchErr := err.(*Error)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "no_index" || couchErr.Name == "no_usable_index"
+}
+
 func newRequestError(originalError error) error {
 	return &Error{
 		StatusCode: http.StatusServiceUnavailable,
@@ -152,6 +182,32 @@ func newDefinedIDError() error {
 	}
 }
 
+func newConflictError() error {
+	return &Error{
+		StatusCode: http.StatusConflict,
+		Name:       "conflict",
+		Reason:     "Document update conflict.",
+	}
+}
+
+func newDocTooLargeError(size, max int64) error {
+	return &Error{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Name:       "document_too_large",
+		Reason:     fmt.Sprintf("The document is %d bytes, the maximum is %d bytes", size, max),
+	}
+}
+
+// IsDocTooLargeError checks if the given error is an error for a document
+// exceeding the maximal size of the configuration
+func IsDocTooLargeError(err error) bool {
+	coucherr, ok := err.(*Error)
+	if !ok {
+		return false
+	}
+	return coucherr.Name == "document_too_large"
+}
+
 func newBadIDError(id string) error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -26,6 +26,9 @@ const lt ValueOperator = "$lt"
 // Lte ($lte) checks that field <= value
 const lte ValueOperator = "$lte"
 
+// Exists ($exists) checks that the field exists (or not)
+const exists ValueOperator = "$exists"
+
 // LogicOperator is an operator between two filters
 type LogicOperator string
 
@@ -144,6 +147,12 @@ func Lt(field string, value interface{}) Filter { return &valueFilter{field, lt,
 // Lte returns a filter that check if a field <= value
 func Lte(field string, value interface{}) Filter { return &valueFilter{field, lte, value} }
 
+// Exists returns a filter that check if a field exists
+func Exists(field string) Filter { return &valueFilter{field, exists, true} }
+
+// NotExists returns a filter that check if a field doesn't exist
+func NotExists(field string) Filter { return &valueFilter{field, exists, false} }
+
 // Between returns a filter that check if v1 <= field < v2
 func Between(field string, v1 interface{}, v2 interface{}) Filter {
 	return &logicFilter{op: and, filters: []Filter{
@@ -186,6 +195,28 @@ func (s SortBy) MarshalJSON() ([]byte, error) {
 	return json.Marshal(asSlice)
 }
 
+// SortByFields is a sorting rule on several fields, all in the same
+// direction, as couchdb requires for a sort on a compound index.
+type SortByFields struct {
+	Fields    []string
+	Direction SortDirection
+}
+
+// MarshalJSON implements json.Marshaller on SortByFields
+// it will returns a json array [{field1: direction}, {field2: direction}]
+func (s SortByFields) MarshalJSON() ([]byte, error) {
+	asSlice := make([]Map, len(s.Fields))
+	for i, field := range s.Fields {
+		asSlice[i] = makeMap(field, s.Direction)
+	}
+	return json.Marshal(asSlice)
+}
+
+// Sort is the sort of a couchdb.FindRequest: a SortBy or a SortByFields
+type Sort interface {
+	json.Marshaler
+}
+
 // utility function to create a map with a single key
 func makeMap(key string, value interface{}) Map {
 	out := make(Map)
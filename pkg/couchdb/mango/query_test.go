@@ -33,6 +33,9 @@ func TestQueryMarshaling(t *testing.T) {
 
 	q4 := Not(Equal("DirID", "ab123"))
 	DeepEqual(t, q4.ToMango(), M{"$not": M{"DirID": "ab123"}})
+
+	q5 := NotExists("sha256sum")
+	DeepEqual(t, q5.ToMango(), M{"sha256sum": M{"$exists": false}})
 }
 
 func TestSortMarshaling(t *testing.T) {
@@ -41,4 +44,10 @@ func TestSortMarshaling(t *testing.T) {
 	if assert.NoError(t, err) {
 		assert.Equal(t, j1, []byte(`["dir_id","asc"]`))
 	}
+
+	s2 := &SortByFields{[]string{"dir_id", "name"}, Desc}
+	j2, err := json.Marshal(s2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `[{"dir_id":"desc"},{"name":"desc"}]`, string(j2))
+	}
 }
@@ -0,0 +1,136 @@
+// Package i18n is used to resolve the user-facing strings of the stack in
+// the locales preferred by a user. A string missing in a locale is looked up
+// in the next locales of a fallback chain, like fr-CA, then fr, then en.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// DefaultLocale is the locale that ends all the fallback chains
+const DefaultLocale = "en"
+
+var (
+	translationsMu sync.RWMutex
+	translations   = make(map[string]map[string]string)
+)
+
+// LoadLocale registers the strings of a locale, by key. They are added to the
+// strings already registered for this locale.
+func LoadLocale(locale string, values map[string]string) {
+	locale = normalize(locale)
+	translationsMu.Lock()
+	defer translationsMu.Unlock()
+	dict, ok := translations[locale]
+	if !ok {
+		dict = make(map[string]string, len(values))
+		translations[locale] = dict
+	}
+	for key, value := range values {
+		dict[key] = value
+	}
+}
+
+// LoadLocales registers the strings of the locales of a directory: a
+// <locale>.json file by locale, with an object of the strings by key. A
+// missing directory has no locales.
+func LoadLocales(fs http.FileSystem, dir string) error {
+	d, err := fs.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || path.Ext(name) != ".json" {
+			continue
+		}
+		if err = loadLocaleFile(fs, path.Join(dir, name)); err != nil {
+			return fmt.Errorf("Could not load the locale %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func loadLocaleFile(fs http.FileSystem, name string) error {
+	f, err := fs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var values map[string]string
+	if err = json.NewDecoder(f).Decode(&values); err != nil {
+		return err
+	}
+	LoadLocale(strings.TrimSuffix(path.Base(name), ".json"), values)
+	return nil
+}
+
+// Chain returns the fallback chain for the given locales, by order of
+// preference: each locale is followed by its base language, and the default
+// locale ends the chain. For example, fr-CA and de give fr-ca, fr, de and en.
+func Chain(locales ...string) []string {
+	var chain []string
+	seen := make(map[string]bool)
+	add := func(locale string) {
+		if locale != "" && !seen[locale] {
+			seen[locale] = true
+			chain = append(chain, locale)
+		}
+	}
+	for _, locale := range locales {
+		locale = normalize(locale)
+		add(locale)
+		if i := strings.Index(locale, "-"); i > 0 {
+			add(locale[:i])
+		}
+	}
+	add(DefaultLocale)
+	return chain
+}
+
+// Translate returns the string of the given key in the first locale of the
+// chain that has it, or the key itself if no locale has it.
+func Translate(chain []string, key string) string {
+	translationsMu.RLock()
+	defer translationsMu.RUnlock()
+	for _, locale := range chain {
+		if value, ok := translations[locale][key]; ok {
+			return value
+		}
+	}
+	return key
+}
+
+// Translator returns a function that translates a key with the fallback
+// chain of the given locales. The optional arguments are used to format the
+// string, like with fmt.Sprintf. It can be used as a function of a template.
+func Translator(locales ...string) func(key string, args ...interface{}) string {
+	chain := Chain(locales...)
+	return func(key string, args ...interface{}) string {
+		value := Translate(chain, key)
+		if len(args) > 0 {
+			return fmt.Sprintf(value, args...)
+		}
+		return value
+	}
+}
+
+// normalize returns the locale in lower case, with a hyphen between the
+// language and the region: fr_CA and fr-CA are both fr-ca.
+func normalize(locale string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(locale), "_", "-", -1))
+}
@@ -0,0 +1,71 @@
+package i18n
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChain(t *testing.T) {
+	assert.Equal(t, []string{"en"}, Chain())
+	assert.Equal(t, []string{"fr-ca", "fr", "en"}, Chain("fr-CA"))
+	assert.Equal(t, []string{"fr-ca", "fr", "de", "en"}, Chain("fr_CA", "de", "fr"))
+	assert.Equal(t, []string{"en-gb", "en"}, Chain("en-GB", ""))
+}
+
+func TestTranslateWithFallback(t *testing.T) {
+	LoadLocale("en", map[string]string{
+		"Test Hello":   "Hello",
+		"Test Goodbye": "Goodbye",
+		"Test Welcome": "Welcome %s",
+	})
+	LoadLocale("fr", map[string]string{
+		"Test Hello":   "Bonjour",
+		"Test Welcome": "Bienvenue %s",
+	})
+	LoadLocale("fr-CA", map[string]string{
+		"Test Hello": "Allô",
+	})
+
+	chain := Chain("fr-CA")
+	assert.Equal(t, "Allô", Translate(chain, "Test Hello"))
+	// only in the base language
+	assert.Equal(t, "Bienvenue %s", Translate(chain, "Test Welcome"))
+	// only in the default locale
+	assert.Equal(t, "Goodbye", Translate(chain, "Test Goodbye"))
+	// nowhere
+	assert.Equal(t, "Test Unknown", Translate(chain, "Test Unknown"))
+
+	tr := Translator("fr-BE")
+	assert.Equal(t, "Bonjour", tr("Test Hello"))
+	assert.Equal(t, "Bienvenue Alice", tr("Test Welcome", "Alice"))
+}
+
+func TestLoadLocales(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-i18n-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	localesDir := filepath.Join(dir, "locales")
+	assert.NoError(t, os.Mkdir(localesDir, 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(localesDir, "de.json"),
+		[]byte(`{"Test Loaded": "Geladen"}`), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(localesDir, "README"),
+		[]byte(`not a locale`), 0644))
+
+	assert.NoError(t, LoadLocales(http.Dir(dir), "/locales"))
+	assert.Equal(t, "Geladen", Translate(Chain("de"), "Test Loaded"))
+
+	// no locales
+	assert.NoError(t, LoadLocales(http.Dir(dir), "/missing"))
+
+	// an invalid file
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(localesDir, "it.json"),
+		[]byte(`["Test"]`), 0644))
+	assert.Error(t, LoadLocales(http.Dir(dir), "/locales"))
+}
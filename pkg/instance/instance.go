@@ -1,11 +1,14 @@
 package instance
 
 import (
+	"context"
 	"crypto/subtle"
 	"errors"
 	"fmt"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -13,10 +16,12 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/settings"
 	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/pkg/webhooks"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/spf13/afero"
 )
@@ -26,10 +31,15 @@ const (
 	registerTokenLen = 16
 	sessionSecretLen = 64
 	oauthSecretLen   = 128
+	regSecretLen     = 128
 )
 
+// DefaultOAuthSecretRotationWindow is the duration during which the tokens
+// signed with the previous OAuth secret are still accepted after a rotation
+const DefaultOAuthSecretRotationWindow = 7 * 24 * time.Hour
+
 // DefaultLocale is the default locale when creating an instance
-const DefaultLocale = "en"
+const DefaultLocale = i18n.DefaultLocale
 
 var (
 	// ErrNotFound is used when the seeked instance was not found
@@ -38,6 +48,9 @@ var (
 	ErrExists = errors.New("Instance already exists")
 	// ErrIllegalDomain is used when the domain named contains illegal characters
 	ErrIllegalDomain = errors.New("Domain name contains illegal characters")
+	// ErrIllegalTrashName is used when the name of the trash directory
+	// contains illegal characters
+	ErrIllegalTrashName = errors.New("Trash name contains illegal characters")
 	// ErrMissingToken is returned by RegisterPassphrase if token is empty
 	ErrMissingToken = errors.New("Empty register token")
 	// ErrInvalidToken is returned by RegisterPassphrase if token is invalid
@@ -59,6 +72,18 @@ type Instance struct {
 	StorageURL string `json:"storage"`        // Where the binaries are persisted
 	Dev        bool   `json:"dev"`            // Whether or not the instance is for development
 
+	// BytesDiskQuota is the maximal number of bytes that the files of the
+	// instance can use, 0 meaning no quota.
+	BytesDiskQuota int64 `json:"disk_quota,string,omitempty"`
+
+	// FallbackLocales are the locales used, by order of preference, for the
+	// strings missing in the locale of the instance.
+	FallbackLocales []string `json:"fallback_locales,omitempty"`
+
+	// TrashDirName is the name of the trash directory, when it is not the
+	// default one, for example to have a localized trash.
+	TrashDirName string `json:"trash_name,omitempty"`
+
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
 	// see crypto.GenerateFromPassphrase.
 	PassphraseHash []byte `json:"passphrase_hash,omitempty"`
@@ -73,18 +98,49 @@ type Instance struct {
 	SessionSecret []byte `json:"session_secret,omitempty"`
 	// OAuthSecret is used to authenticate OAuth2 token
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
+	// PreviousOAuthSecrets are the OAuth secrets replaced by a rotation. The
+	// tokens signed with them are accepted until they expire.
+	PreviousOAuthSecrets []*PreviousSecret `json:"previous_oauth_secrets,omitempty"`
+	// RegistrationSecret is used to authenticate the registration tokens of
+	// the OAuth clients. These tokens don't expire, so this secret is not
+	// rotated with the OAuth secret.
+	RegistrationSecret []byte `json:"registration_secret,omitempty"`
 
 	storage afero.Fs
 }
 
+// PreviousSecret is a secret that has been replaced by a rotation, but can
+// still be used to check the tokens until it expires.
+type PreviousSecret struct {
+	Secret    []byte    `json:"secret"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // Options holds the parameters to create a new instance.
 type Options struct {
-	Domain   string
-	Locale   string
-	Timezone string
-	Email    string
-	Apps     []string
-	Dev      bool
+	Domain          string
+	Locale          string
+	FallbackLocales []string
+	Timezone        string
+	Email           string
+	DiskQuota       int64
+	TrashName       string
+	Apps            []string
+	Dev             bool
+}
+
+// AppInstaller is a function that installs an application, given its slug,
+// on an instance.
+type AppInstaller func(i *Instance, slug string) error
+
+// appInstaller is used to install the default apps of the new instances. It
+// is registered by the apps package, which depends on this package.
+var appInstaller AppInstaller
+
+// RegisterAppInstaller registers the function used to install the default
+// apps given in the options of Create.
+func RegisterAppInstaller(installer AppInstaller) {
+	appInstaller = installer
 }
 
 // DocType implements couchdb.Doc
@@ -117,17 +173,24 @@ func (i *Instance) Included() []jsonapi.Object {
 	return nil
 }
 
-// settings is a struct used for the settings of an instance
-type instanceSettings struct {
-	Timezone string `json:"tz,omitempty"`
-	Email    string `json:"email,omitempty"`
+// DiskQuota returns the maximal number of bytes that the files of the instance
+// can use, 0 meaning no quota.
+func (i *Instance) DiskQuota() int64 {
+	return i.BytesDiskQuota
 }
 
-func (s *instanceSettings) ID() string      { return consts.InstanceSettingsID }
-func (s *instanceSettings) Rev() string     { return "" }
-func (s *instanceSettings) DocType() string { return consts.Settings }
-func (s *instanceSettings) SetID(_ string)  {}
-func (s *instanceSettings) SetRev(_ string) {}
+// TrashName returns the name of the trash directory of the instance, or an
+// empty string for the default one.
+func (i *Instance) TrashName() string {
+	return i.TrashDirName
+}
+
+// LocaleChain returns the fallback chain of the locales of the instance, to
+// resolve the user-facing strings: its locale, its fallback locales, and
+// the default locale.
+func (i *Instance) LocaleChain() []string {
+	return i18n.Chain(append([]string{i.Locale}, i.FallbackLocales...)...)
+}
 
 // FS returns the afero storage provider where the binaries for
 // the current instance are persisted
@@ -142,16 +205,51 @@ func (i *Instance) FS() afero.Fs {
 
 // StartJobSystem creates all the resources necessary for the instance's job
 // system to work properly.
+//
+// The jobs that were not finished on the last shutdown of the job system are
+// pushed again, and the changes feeds watched by the webhooks are polled.
 func (i *Instance) StartJobSystem() error {
-	broker := jobs.NewMemBroker(i.Domain, jobs.GetWorkersList())
+	broker := jobs.NewMemBroker(i.Domain, jobs.GetWorkersList(), jobs.NewJobCouchStorage(i))
 	scheduler := jobs.NewMemScheduler(i.Domain, jobs.NewTriggerCouchStorage(i))
-	return scheduler.Start(broker)
+	if err := scheduler.Start(broker); err != nil {
+		return err
+	}
+	webhooks.Start(i, broker)
+	return nil
+}
+
+// ShutdownJobSystem gracefully stops the job system associated with the
+// instance. The running jobs are given until the context is done to finish,
+// and the unfinished jobs are resumed on the next start.
+func (i *Instance) ShutdownJobSystem(ctx context.Context) error {
+	webhooks.Stop(i)
+	if scheduler := i.JobsScheduler(); scheduler != nil {
+		if err := scheduler.Shutdown(); err != nil {
+			return err
+		}
+	}
+	if broker := i.JobsBroker(); broker != nil {
+		return broker.Shutdown(ctx)
+	}
+	return nil
 }
 
 // StopJobSystem stops all the resources used by the job system associated with
-// the instance.
+// the instance, without waiting for the running jobs.
 func (i *Instance) StopJobSystem() error {
-	// TODO
+	webhooks.Stop(i)
+	if scheduler := i.JobsScheduler(); scheduler != nil {
+		if err := scheduler.Shutdown(); err != nil {
+			return err
+		}
+	}
+	if broker := i.JobsBroker(); broker != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := broker.Shutdown(ctx); err != nil && err != context.Canceled {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -283,6 +381,12 @@ func (i *Instance) createFSIndexes() error {
 			return err
 		}
 	}
+	if err := couchdb.CreateDB(i, consts.FilesVersions); err != nil {
+		return err
+	}
+	if err := couchdb.DefineIndex(i, consts.FilesVersions, vfs.VersionsIndex); err != nil {
+		return err
+	}
 	return couchdb.DefineViews(i, consts.Files, vfs.Views)
 }
 
@@ -306,6 +410,14 @@ func (i *Instance) createSettings() error {
 	return settings.CreateDefaultTheme(i)
 }
 
+// createJobsDB creates the database and the index needed for the jobs
+func (i *Instance) createJobsDB() error {
+	if err := couchdb.CreateDB(i, consts.Jobs); err != nil {
+		return err
+	}
+	return couchdb.DefineIndex(i, consts.Jobs, jobs.Index)
+}
+
 func (i *Instance) createPermissionsDB() error {
 	err := couchdb.CreateDB(i, consts.Permissions)
 
@@ -335,6 +447,11 @@ func Create(opts *Options) (*Instance, error) {
 		}
 	}
 
+	trashName := opts.TrashName
+	if strings.ContainsAny(trashName, vfs.ForbiddenFilenameChars) || trashName == ".." || trashName == "." {
+		return nil, ErrIllegalTrashName
+	}
+
 	locale := opts.Locale
 	if locale == "" {
 		locale = DefaultLocale
@@ -343,15 +460,19 @@ func Create(opts *Options) (*Instance, error) {
 	i := new(Instance)
 
 	i.Locale = locale
+	i.FallbackLocales = cleanLocales(opts.FallbackLocales)
 	i.Domain = domain
 	i.StorageURL = config.BuildRelFsURL(domain).String()
 
 	i.Dev = opts.Dev
+	i.BytesDiskQuota = opts.DiskQuota
+	i.TrashDirName = trashName
 
 	i.PassphraseHash = nil
 	i.RegisterToken = crypto.GenerateRandomBytes(registerTokenLen)
 	i.SessionSecret = crypto.GenerateRandomBytes(sessionSecretLen)
 	i.OAuthSecret = crypto.GenerateRandomBytes(oauthSecretLen)
+	i.RegistrationSecret = crypto.GenerateRandomBytes(regSecretLen)
 
 	var err error
 	err = i.makeStorageFs()
@@ -389,6 +510,11 @@ func Create(opts *Options) (*Instance, error) {
 		return nil, err
 	}
 
+	err = i.createJobsDB()
+	if err != nil {
+		return nil, err
+	}
+
 	err = i.StartJobSystem()
 	if err != nil {
 		return nil, err
@@ -399,7 +525,7 @@ func Create(opts *Options) (*Instance, error) {
 		return nil, err
 	}
 
-	doc := &instanceSettings{
+	doc := &settingsDoc{
 		Timezone: opts.Timezone,
 		Email:    opts.Email,
 	}
@@ -407,13 +533,39 @@ func Create(opts *Options) (*Instance, error) {
 		return nil, err
 	}
 
+	// The failure of the installation of an app does not prevent the creation
+	// of the instance: the error is only logged, and kept in the manifest of
+	// the app when it has been created.
+	for _, slug := range opts.Apps {
+		if slug == "" {
+			continue
+		}
+		if appInstaller == nil {
+			log.Errorf("[instance] %s: no installer for the app %s", i.Domain, slug)
+			continue
+		}
+		if err = appInstaller(i, slug); err != nil {
+			log.Errorf("[instance] %s: could not install the app %s: %s", i.Domain, slug, err)
+		}
+	}
+
 	// TODO atomicity with defer
 	// TODO figure out what to do with locale
-	// TODO install apps
 
 	return i, nil
 }
 
+// cleanLocales returns the given locales without the empty ones.
+func cleanLocales(locales []string) []string {
+	var cleaned []string
+	for _, locale := range locales {
+		if locale = strings.TrimSpace(locale); locale != "" {
+			cleaned = append(cleaned, locale)
+		}
+	}
+	return cleaned
+}
+
 func (i *Instance) makeStorageFs() error {
 	u, err := url.Parse(i.StorageURL)
 	if err != nil {
@@ -464,39 +616,70 @@ func List() ([]*Instance, error) {
 	return docs, nil
 }
 
+// DestroyReport describes what has been removed when destroying an instance.
+type DestroyReport struct {
+	Domain    string   `json:"domain"`
+	Found     bool     `json:"found"`
+	Databases []string `json:"databases"`
+	Files     int      `json:"files"`
+	Triggers  int      `json:"triggers"`
+}
+
 // Destroy is used to remove the instance. All the data linked to this
-// instance will be permanently deleted.
-func Destroy(domain string) (*Instance, error) {
+// instance will be permanently deleted: the triggers and queued jobs, the
+// CouchDB databases (including the OAuth clients and sessions) and the files.
+// The instance document is removed last, which revokes all its tokens, so
+// that Destroy can be called again if it has failed in the middle.
+//
+// Destroying an instance that does not exist is a no-op.
+func Destroy(domain string) (*DestroyReport, error) {
+	report := &DestroyReport{Domain: domain}
 	i, err := Get(domain)
+	if err == ErrNotFound {
+		return report, nil
+	}
 	if err != nil {
 		return nil, err
 	}
+	report.Found = true
 
-	if err = couchdb.DeleteDoc(couchdb.GlobalDB, i); err != nil {
+	if scheduler := i.JobsScheduler(); scheduler != nil {
+		ts, err := scheduler.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		report.Triggers = len(ts)
+	}
+	if err = i.StopJobSystem(); err != nil {
 		return nil, err
 	}
 
-	if err = couchdb.DeleteAllDBs(i); err != nil {
+	if report.Databases, err = couchdb.DeleteAllDBs(i); err != nil {
 		return nil, err
 	}
 
-	if err = i.StopJobSystem(); err != nil {
+	fs := i.FS()
+	err = afero.Walk(fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			report.Files++
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-
-	rootFsURL := config.BuildAbsFsURL("/")
-	domainURL := config.BuildRelFsURL(i.Domain)
-
-	rootFs, err := createFs(rootFsURL)
-	if err != nil {
+	if err = fs.RemoveAll("/"); err != nil {
 		return nil, err
 	}
 
-	if err = rootFs.RemoveAll(domainURL.Path); err != nil {
+	if err = couchdb.DeleteDoc(couchdb.GlobalDB, i); err != nil {
 		return nil, err
 	}
 
-	return i, nil
+	return report, nil
 }
 
 // RegisterPassphrase replace the instance registerToken by a passphrase
@@ -549,6 +732,54 @@ func (i *Instance) setPassphraseAndSecret(hash []byte) {
 	i.SessionSecret = crypto.GenerateRandomBytes(sessionSecretLen)
 }
 
+// RotateOAuthSecret generates a new OAuth secret for the instance. The new
+// tokens are signed with it, but the tokens signed with the current secret
+// are still accepted during the given window. The previous secrets that have
+// expired are removed. The secret of the registration tokens is not rotated.
+func (i *Instance) RotateOAuthSecret(window time.Duration) error {
+	// The registration tokens of the instances created without a
+	// registration secret have been signed with the current OAuth secret, and
+	// they must stay valid after the rotation.
+	if len(i.RegistrationSecret) == 0 {
+		i.RegistrationSecret = i.OAuthSecret
+	}
+	now := time.Now()
+	previous := []*PreviousSecret{{
+		Secret:    i.OAuthSecret,
+		ExpiresAt: now.Add(window),
+	}}
+	for _, p := range i.PreviousOAuthSecrets {
+		if p.ExpiresAt.After(now) {
+			previous = append(previous, p)
+		}
+	}
+	i.PreviousOAuthSecrets = previous
+	i.OAuthSecret = crypto.GenerateRandomBytes(oauthSecretLen)
+	return couchdb.UpdateDoc(couchdb.GlobalDB, i)
+}
+
+// OAuthSecrets returns the secrets that can be used to check an OAuth token:
+// the current secret first, then the previous ones that have not expired.
+func (i *Instance) OAuthSecrets() [][]byte {
+	now := time.Now()
+	secrets := [][]byte{i.OAuthSecret}
+	for _, p := range i.PreviousOAuthSecrets {
+		if p.ExpiresAt.After(now) {
+			secrets = append(secrets, p.Secret)
+		}
+	}
+	return secrets
+}
+
+// RegistrationTokenSecret returns the secret used to sign and check the
+// registration tokens of the OAuth clients.
+func (i *Instance) RegistrationTokenSecret() []byte {
+	if len(i.RegistrationSecret) == 0 {
+		return i.OAuthSecret
+	}
+	return i.RegistrationSecret
+}
+
 // CheckPassphrase confirm an instance passport
 func (i *Instance) CheckPassphrase(pass []byte) error {
 	if len(pass) == 0 {
@@ -581,7 +812,7 @@ func (i *Instance) CheckPassphrase(pass []byte) error {
 func createFs(u *url.URL) (fs afero.Fs, err error) {
 	switch u.Scheme {
 	case "file":
-		fs = afero.NewBasePathFs(afero.NewOsFs(), u.Path)
+		fs = vfs.NewPrefixFs(afero.NewOsFs(), u.Path)
 	case "mem":
 		fs = afero.NewMemMapFs()
 	default:
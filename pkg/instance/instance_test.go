@@ -2,8 +2,11 @@ package instance
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -67,6 +70,75 @@ func TestCreateInstanceWithSettings(t *testing.T) {
 	assert.Equal(t, "alice@example.com", doc.M["email"].(string))
 }
 
+func TestCreateInstanceWithTrashName(t *testing.T) {
+	_, err := Create(&Options{
+		Domain:    "test4.cozycloud.cc",
+		Locale:    "fr",
+		TrashName: "foo/bar",
+	})
+	assert.Equal(t, ErrIllegalTrashName, err)
+
+	instance, err := Create(&Options{
+		Domain:    "test4.cozycloud.cc",
+		Locale:    "fr",
+		TrashName: "Corbeille",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	instance, err = Get("test4.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/Corbeille", vfs.TrashPath(instance))
+
+	trash, err := vfs.GetDirDoc(instance, consts.TrashDirID, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Corbeille", trash.Name)
+		assert.Equal(t, "/Corbeille", trash.Fullpath)
+	}
+
+	dir, err := vfs.NewDirDoc("totrash", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, vfs.CreateDir(instance, dir)) {
+		return
+	}
+	trashed, err := vfs.TrashDir(instance, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "/Corbeille/totrash", trashed.Fullpath)
+	exists, err := afero.DirExists(instance.FS(), "/Corbeille/totrash")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	_, err = vfs.TrashDir(instance, trashed)
+	assert.Equal(t, vfs.ErrFileInTrash, err)
+
+	restored, err := vfs.RestoreDir(instance, trashed)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/totrash", restored.Fullpath)
+	}
+	_, err = vfs.RestoreDir(instance, restored)
+	assert.Equal(t, vfs.ErrFileNotInTrash, err)
+}
+
+func TestCreateInstanceWithDiskQuota(t *testing.T) {
+	instance, err := Create(&Options{
+		Domain:    "test3.cozycloud.cc",
+		Locale:    "en",
+		DiskQuota: 5 << 20,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(5<<20), instance.DiskQuota())
+
+	instance, err = Get("test3.cozycloud.cc")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(5<<20), instance.DiskQuota())
+	}
+}
+
 func TestCreateInstanceBadDomain(t *testing.T) {
 	_, err := Create(&Options{
 		Domain: "..",
@@ -112,6 +184,29 @@ func TestInstancehasOAuthSecret(t *testing.T) {
 	}
 }
 
+func TestRotateOAuthSecret(t *testing.T) {
+	instance, err := Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	previous := instance.OAuthSecret
+	registration := instance.RegistrationTokenSecret()
+	instance.PreviousOAuthSecrets = []*PreviousSecret{
+		{Secret: []byte("expired"), ExpiresAt: time.Now().Add(-time.Hour)},
+	}
+	err = instance.RotateOAuthSecret(time.Hour)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, previous, instance.OAuthSecret)
+	assert.Len(t, instance.OAuthSecret, oauthSecretLen)
+	if assert.Len(t, instance.PreviousOAuthSecrets, 1) {
+		assert.Equal(t, previous, instance.PreviousOAuthSecrets[0].Secret)
+	}
+	assert.Equal(t, [][]byte{instance.OAuthSecret, previous}, instance.OAuthSecrets())
+	assert.Equal(t, registration, instance.RegistrationTokenSecret())
+}
+
 func TestInstanceHasRootDir(t *testing.T) {
 	var root vfs.DirDoc
 	prefix := getDB(t, "test.cozycloud.cc")
@@ -244,16 +339,60 @@ func TestInstanceDestroy(t *testing.T) {
 		return
 	}
 
-	inst, err := Destroy("test.cozycloud.cc")
+	report, err := Destroy("test.cozycloud.cc")
 	if assert.NoError(t, err) {
-		assert.NotNil(t, inst)
+		assert.True(t, report.Found)
+		assert.Contains(t, report.Databases, "io-cozy-files")
+	}
+
+	report, err = Destroy("test.cozycloud.cc")
+	if assert.NoError(t, err) {
+		assert.False(t, report.Found)
+		assert.Empty(t, report.Databases)
+	}
+}
+
+func TestInstanceDestroyWithFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "cozy-stack")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	cfg := config.GetConfig()
+	was := cfg.Fs.URL
+	cfg.Fs.URL = fmt.Sprintf("file://localhost%s", tempdir)
+	defer func() { cfg.Fs.URL = was }()
+
+	domain := "test-destroy.cozycloud.cc"
+	instance, err := Create(&Options{Domain: domain})
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = afero.WriteFile(instance.FS(), "/foo.txt", []byte("foo"), 0644)
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.NotNil(t, instance.JobsScheduler())
 
-	inst, err = Destroy("test.cozycloud.cc")
-	if assert.Error(t, err) {
-		assert.Equal(t, ErrNotFound, err)
-		assert.Nil(t, inst)
+	report, err := Destroy(domain)
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.True(t, report.Found)
+	assert.Equal(t, 1, report.Files)
+
+	_, err = Get(domain)
+	assert.Equal(t, ErrNotFound, err)
+
+	var root vfs.DirDoc
+	err = couchdb.GetDoc(instance, consts.Files, consts.RootDirID, &root)
+	assert.True(t, couchdb.IsNoDatabaseError(err))
+
+	_, err = os.Stat(filepath.Join(tempdir, domain))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, instance.JobsScheduler())
+	assert.Nil(t, instance.JobsBroker())
 }
 
 func TestGetFs(t *testing.T) {
@@ -285,6 +424,8 @@ func TestMain(m *testing.M) {
 	}
 	Destroy("test.cozycloud.cc")
 	Destroy("test2.cozycloud.cc")
+	Destroy("test3.cozycloud.cc")
+	Destroy("test4.cozycloud.cc")
 	Destroy("test.cozycloud.cc.duplicate")
 
 	os.RemoveAll("/usr/local/var/cozy2/")
@@ -293,6 +434,8 @@ func TestMain(m *testing.M) {
 
 	Destroy("test.cozycloud.cc")
 	Destroy("test2.cozycloud.cc")
+	Destroy("test3.cozycloud.cc")
+	Destroy("test4.cozycloud.cc")
 	Destroy("test.cozycloud.cc.duplicate")
 
 	os.Exit(res)
@@ -0,0 +1,177 @@
+package instance
+
+import (
+	"math"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// Settings is the typed view of the settings of an instance. Most of them are
+// in the io.cozy.settings.instance document, but the locales and the disk
+// quota are kept in the instance document, as the stack needs them for every
+// request.
+type Settings struct {
+	Locale          string
+	FallbackLocales []string
+	DiskQuota       int64
+	Timezone        string
+	Email           string
+	PublicName      string
+}
+
+// SettingError is returned when a setting has a value of the wrong type
+type SettingError struct {
+	Name   string
+	Reason string
+}
+
+func (e *SettingError) Error() string {
+	return "Invalid value for the setting " + e.Name + ": " + e.Reason
+}
+
+// settingsDoc is the document used to create the settings of an instance
+type settingsDoc struct {
+	Timezone string `json:"tz,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+func (s *settingsDoc) ID() string      { return consts.InstanceSettingsID }
+func (s *settingsDoc) Rev() string     { return "" }
+func (s *settingsDoc) DocType() string { return consts.Settings }
+func (s *settingsDoc) SetID(_ string)  {}
+func (s *settingsDoc) SetRev(_ string) {}
+
+// Settings returns the current settings of the instance.
+func (i *Instance) Settings() (*Settings, error) {
+	doc, err := i.SettingsDocument()
+	if err != nil {
+		return nil, err
+	}
+	s := &Settings{
+		Locale:          i.Locale,
+		FallbackLocales: i.FallbackLocales,
+		DiskQuota:       i.BytesDiskQuota,
+	}
+	s.Timezone, _ = doc.M["tz"].(string)
+	s.Email, _ = doc.M["email"].(string)
+	s.PublicName, _ = doc.M["public_name"].(string)
+	return s, nil
+}
+
+// SettingsDocument returns the io.cozy.settings.instance document, with the
+// settings kept in the instance document.
+func (i *Instance) SettingsDocument() (*couchdb.JSONDoc, error) {
+	doc := &couchdb.JSONDoc{}
+	err := couchdb.GetDoc(i, consts.Settings, consts.InstanceSettingsID, doc)
+	if err != nil {
+		return nil, err
+	}
+	doc.Type = consts.Settings
+	i.fillSettingsDocument(doc)
+	return doc, nil
+}
+
+// UpdateSettings checks the types of the known settings in the given
+// document, and saves it. The settings kept in the instance document are
+// updated too, so that the next requests use their new values.
+func (i *Instance) UpdateSettings(doc *couchdb.JSONDoc) error {
+	for _, name := range []string{"locale", "tz", "email", "public_name"} {
+		if value, ok := doc.M[name]; ok {
+			if _, ok := value.(string); !ok {
+				return &SettingError{name, "it should be a string"}
+			}
+		}
+	}
+
+	updated := false
+	locale, hasLocale := doc.M["locale"].(string)
+	if hasLocale {
+		updated = true
+	}
+	var locales []string
+	value, hasLocales := doc.M["fallback_locales"]
+	if hasLocales {
+		var err error
+		if locales, err = parseLocales(value); err != nil {
+			return err
+		}
+		updated = true
+	}
+	var quota int64
+	value, hasQuota := doc.M["disk_quota"]
+	if hasQuota {
+		var err error
+		if quota, err = parseQuota(value); err != nil {
+			return err
+		}
+		updated = true
+	}
+
+	delete(doc.M, "locale")
+	delete(doc.M, "fallback_locales")
+	delete(doc.M, "disk_quota")
+	if err := couchdb.UpdateDoc(i, doc); err != nil {
+		return err
+	}
+
+	if updated {
+		if hasLocale {
+			i.Locale = locale
+		}
+		if hasLocales {
+			i.FallbackLocales = locales
+		}
+		if hasQuota {
+			i.BytesDiskQuota = quota
+		}
+		if err := couchdb.UpdateDoc(couchdb.GlobalDB, i); err != nil {
+			return err
+		}
+	}
+
+	i.fillSettingsDocument(doc)
+	return nil
+}
+
+// fillSettingsDocument puts the settings kept in the instance document in
+// the settings document.
+func (i *Instance) fillSettingsDocument(doc *couchdb.JSONDoc) {
+	doc.M["locale"] = i.Locale
+	if len(i.FallbackLocales) > 0 {
+		doc.M["fallback_locales"] = i.FallbackLocales
+	}
+	if i.BytesDiskQuota > 0 {
+		doc.M["disk_quota"] = i.BytesDiskQuota
+	}
+}
+
+// parseLocales returns the list of locales of the fallback_locales setting.
+func parseLocales(value interface{}) ([]string, error) {
+	list, ok := value.([]interface{})
+	if !ok && value != nil {
+		return nil, &SettingError{"fallback_locales", "it should be a list of locales"}
+	}
+	var locales []string
+	for _, item := range list {
+		locale, ok := item.(string)
+		if !ok {
+			return nil, &SettingError{"fallback_locales", "it should be a list of locales"}
+		}
+		locales = append(locales, locale)
+	}
+	return cleanLocales(locales), nil
+}
+
+// parseQuota returns the number of bytes of the disk_quota setting, 0 (or
+// null) meaning no quota.
+func parseQuota(value interface{}) (int64, error) {
+	if value == nil {
+		return 0, nil
+	}
+	quota, ok := value.(float64)
+	if !ok || quota < 0 || quota != math.Trunc(quota) {
+		return 0, &SettingError{"disk_quota", "it should be a positive number of bytes"}
+	}
+	return int64(quota), nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 )
 
 type triggerDoc struct {
@@ -51,7 +52,129 @@ func (s *CouchStorage) Add(trigger Trigger) error {
 	return couchdb.CreateDoc(s.db, &triggerDoc{trigger})
 }
 
+// Update implements the Update method of the TriggerStorage.
+func (s *CouchStorage) Update(trigger Trigger) error {
+	return couchdb.UpdateDoc(s.db, &triggerDoc{trigger})
+}
+
 // Delete implements the Delete method of the TriggerStorage.
 func (s *CouchStorage) Delete(trigger Trigger) error {
 	return couchdb.DeleteDoc(s.db, &triggerDoc{trigger})
 }
+
+type jobDoc struct {
+	*JobInfos
+	DocID   string `json:"_id,omitempty"`
+	DocRev  string `json:"_rev,omitempty"`
+	doctype string
+}
+
+func (j *jobDoc) ID() string        { return j.DocID }
+func (j *jobDoc) Rev() string       { return j.DocRev }
+func (j *jobDoc) DocType() string   { return j.doctype }
+func (j *jobDoc) SetID(id string)   { j.DocID = id }
+func (j *jobDoc) SetRev(rev string) { j.DocRev = rev }
+
+// JobCouchStorage implements the JobStorage interface and uses CouchDB as the
+// underlying storage for jobs. The jobs that have failed after all their tries
+// are moved to the dead-letters doctype.
+type JobCouchStorage struct {
+	db couchdb.Database
+}
+
+// Index is the necessary index for the jobs storage, used in instance creation
+var Index = mango.IndexOnFields("state")
+
+// NewJobCouchStorage returns a new instance of JobCouchStorage using the
+// specified database.
+func NewJobCouchStorage(db couchdb.Database) *JobCouchStorage {
+	return &JobCouchStorage{db}
+}
+
+func (s *JobCouchStorage) get(doctype, id string) (*jobDoc, error) {
+	doc := &jobDoc{doctype: doctype}
+	if err := couchdb.GetDoc(s.db, doctype, id, doc); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrNotFoundJob
+		}
+		return nil, err
+	}
+	doc.JobInfos.ID = doc.DocID
+	return doc, nil
+}
+
+// Get implements the Get method of the JobStorage. The jobs in the
+// dead-letters are also returned.
+func (s *JobCouchStorage) Get(id string) (*JobInfos, error) {
+	doc, err := s.get(consts.Jobs, id)
+	if err == ErrNotFoundJob {
+		doc, err = s.get(consts.DeadLetters, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.JobInfos, nil
+}
+
+// pendingBatchSize is the number of jobs fetched by request when looking for
+// the pending jobs.
+const pendingBatchSize = 100
+
+// GetPending implements the GetPending method of the JobStorage. All the
+// pending jobs are returned, fetched by batches.
+func (s *JobCouchStorage) GetPending() ([]*JobInfos, error) {
+	var infos []*JobInfos
+	for _, state := range []State{Queued, Running} {
+		for skip := 0; ; skip += pendingBatchSize {
+			var docs []*jobDoc
+			req := &couchdb.FindRequest{
+				Selector: mango.Equal("state", state),
+				Limit:    pendingBatchSize,
+				Skip:     skip,
+			}
+			if err := couchdb.FindDocs(s.db, consts.Jobs, req, &docs); err != nil {
+				if couchdb.IsNoDatabaseError(err) {
+					return infos, nil
+				}
+				return nil, err
+			}
+			for _, doc := range docs {
+				doc.JobInfos.ID = doc.DocID
+				infos = append(infos, doc.JobInfos)
+			}
+			if len(docs) < pendingBatchSize {
+				break
+			}
+		}
+	}
+	return infos, nil
+}
+
+// Add implements the Add method of the JobStorage.
+func (s *JobCouchStorage) Add(job *JobInfos) error {
+	doc := &jobDoc{JobInfos: job, DocID: job.ID, doctype: consts.Jobs}
+	return couchdb.CreateNamedDocWithDB(s.db, doc)
+}
+
+// Update implements the Update method of the JobStorage.
+func (s *JobCouchStorage) Update(job *JobInfos) error {
+	old, err := s.get(consts.Jobs, job.ID)
+	if err != nil {
+		return err
+	}
+	doc := &jobDoc{JobInfos: job, DocID: job.ID, DocRev: old.DocRev, doctype: consts.Jobs}
+	return couchdb.UpdateDoc(s.db, doc)
+}
+
+// MoveToDeadLetter implements the MoveToDeadLetter method of the JobStorage.
+func (s *JobCouchStorage) MoveToDeadLetter(job *JobInfos) error {
+	old, err := s.get(consts.Jobs, job.ID)
+	if err != nil {
+		return err
+	}
+	doc := &jobDoc{JobInfos: job, DocID: job.ID, doctype: consts.DeadLetters}
+	if err = couchdb.CreateNamedDocWithDB(s.db, doc); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(s.db, old)
+}
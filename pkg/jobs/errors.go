@@ -13,4 +13,9 @@ var (
 	ErrUnknownTrigger = errors.New("Unknown trigger type")
 	// ErrNotFoundTrigger is used when the trigger was not found
 	ErrNotFoundTrigger = errors.New("Trigger with specified ID does not exist")
+	// ErrIntervalTooShort is used when the interval of an @interval trigger
+	// is smaller than a second
+	ErrIntervalTooShort = errors.New("Interval should be at least a second")
+	// ErrNotFoundJob is used when the job was not found
+	ErrNotFoundJob = errors.New("Job with specified ID does not exist")
 )
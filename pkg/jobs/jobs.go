@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"time"
 
@@ -50,6 +51,15 @@ type (
 		// QueueLen returns the total element in the queue of the specified worker
 		// type.
 		QueueLen(workerType string) (int, error)
+
+		// GetJobInfos returns the informations about the job with the specified
+		// ID, from the broker's storage.
+		GetJobInfos(id string) (*JobInfos, error)
+
+		// Shutdown stops the workers of the broker. The running jobs are given
+		// until the context is done to finish. The unfinished jobs are left in
+		// the broker's storage, to be resumed on the next start.
+		Shutdown(ctx context.Context) error
 	}
 
 	// Job interface represents a job.
@@ -66,6 +76,9 @@ type (
 		// an error has happened during its processing. The error passed will be
 		// used to inform in more detail about the error that happened.
 		Nack(error) error
+		// Retry should be used to tell that an execution of the job has failed
+		// with the specified error, and that it will be executed again.
+		Retry(error) error
 		// Marshal allows you to define how the job should be marshalled when put
 		// into the queue.
 		Marshal() ([]byte, error)
@@ -93,7 +106,8 @@ type (
 		State      State       `json:"state"`
 		QueuedAt   time.Time   `json:"queued_at"`
 		StartedAt  time.Time   `json:"started_at"`
-		Error      error       `json:"error"`
+		TryCount   uint        `json:"try_count"`
+		Error      string      `json:"error,omitempty"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -120,6 +134,9 @@ type (
 		MaxExecTime  time.Duration `json:"max_exec_time"`
 		Timeout      time.Duration `json:"timeout"`
 		RetryDelay   time.Duration `json:"retry_delay"`
+		// RateLimit is the maximal number of jobs started per second. No limit
+		// is applied when zero.
+		RateLimit float64 `json:"rate_limit"`
 	}
 
 	// Scheduler interface is used to represent a scheduler that is responsible
@@ -130,6 +147,11 @@ type (
 		Get(id string) (Trigger, error)
 		Delete(id string) error
 		GetAll() ([]Trigger, error)
+		// Enable and Disable respectively resume and pause the scheduling of
+		// a trigger, while keeping it in the storage.
+		Enable(id string) error
+		Disable(id string) error
+		Shutdown() error
 	}
 
 	// Trigger interface is used to represent a trigger.
@@ -149,9 +171,24 @@ type (
 	TriggerStorage interface {
 		GetAll() ([]*TriggerInfos, error)
 		Add(trigger Trigger) error
+		Update(trigger Trigger) error
 		Delete(trigger Trigger) error
 	}
 
+	// JobStorage interface is used to represent a persistent layer on which
+	// jobs are stored, so that their state can be queried and the unfinished
+	// ones can be resumed after a restart.
+	JobStorage interface {
+		Get(id string) (*JobInfos, error)
+		// GetPending returns the jobs that are queued or running.
+		GetPending() ([]*JobInfos, error)
+		Add(job *JobInfos) error
+		Update(job *JobInfos) error
+		// MoveToDeadLetter removes a job that has failed after all its tries
+		// from the queue, and keeps it in the dead-letter storage.
+		MoveToDeadLetter(job *JobInfos) error
+	}
+
 	// TriggerInfos is a struct containing all the options of a trigger.
 	TriggerInfos struct {
 		ID         string      `json:"_id,omitempty"`
@@ -161,6 +198,9 @@ type (
 		Arguments  string      `json:"arguments"`
 		Options    *JobOptions `json:"options"`
 		Message    *Message    `json:"message"`
+		// LastRun is the last time the trigger has pushed a job
+		LastRun  time.Time `json:"last_run"`
+		Disabled bool      `json:"disabled,omitempty"`
 	}
 )
 
@@ -172,6 +212,10 @@ func NewTrigger(infos *TriggerInfos) (Trigger, error) {
 		return NewAtTrigger(infos)
 	case "@in":
 		return NewInTrigger(infos)
+	case "@cron":
+		return NewCronTrigger(infos)
+	case "@interval":
+		return NewIntervalTrigger(infos)
 	default:
 		return nil, ErrUnknownTrigger
 	}
@@ -227,5 +271,6 @@ func (w *WorkerConfig) clone() *WorkerConfig {
 		MaxExecTime:  w.MaxExecTime,
 		Timeout:      w.Timeout,
 		RetryDelay:   w.RetryDelay,
+		RateLimit:    w.RateLimit,
 	}
 }
@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -9,6 +10,10 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// MemJobsTTL is the duration for which the jobs that are done or errored are
+// kept in the in-memory storage, so that their state can still be queried.
+const MemJobsTTL = 1 * time.Hour
+
 var (
 	memBrokers   map[string]*MemBroker
 	memBrokersMu sync.RWMutex
@@ -22,9 +27,11 @@ type (
 	MemQueue struct {
 		MaxCapacity int
 
-		jobs *list.List
-		run  bool
-		jmu  sync.RWMutex
+		jobs   *list.List
+		run    bool
+		closed bool
+		jmu    sync.RWMutex
+		sendwg sync.WaitGroup
 
 		ch chan Job
 		cl chan bool
@@ -32,13 +39,32 @@ type (
 
 	// MemBroker is an in-memory broker implementation of the Broker interface.
 	MemBroker struct {
-		domain string
-		queues map[string]*MemQueue
+		domain  string
+		queues  map[string]*MemQueue
+		workers []*Worker
+		storage JobStorage
+	}
+
+	// MemJobStorage is an in-memory implementation of the JobStorage
+	// interface. The jobs that are done or errored are evicted from the
+	// storage after MemJobsTTL.
+	MemJobStorage struct {
+		jobs  map[string]*JobInfos
+		dead  map[string]*JobInfos
+		ended *list.List // of *endedJob, ordered by their end
+		ttl   time.Duration
+		mu    sync.RWMutex
+	}
+
+	endedJob struct {
+		id      string
+		endedAt time.Time
 	}
 
 	// MemScheduler is a centralized scheduler of many triggers. It stars all of
 	// them and schedules jobs accordingly.
 	MemScheduler struct {
+		domain  string
 		broker  Broker
 		storage TriggerStorage
 
@@ -48,9 +74,10 @@ type (
 
 	// MemJob struct contains all the parameters of a job.
 	MemJob struct {
-		infos *JobInfos
-		infmu sync.RWMutex
-		jobch chan *JobInfos
+		infos   *JobInfos
+		infmu   sync.RWMutex
+		jobch   chan *JobInfos
+		storage JobStorage
 	}
 )
 
@@ -67,15 +94,20 @@ func NewMemQueue(domain, workerType string) *MemQueue {
 func (q *MemQueue) Enqueue(job Job) error {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
 	q.jobs.PushBack(job)
 	if !q.run {
 		q.run = true
+		q.sendwg.Add(1)
 		go q.send()
 	}
 	return nil
 }
 
 func (q *MemQueue) send() {
+	defer q.sendwg.Done()
 	for {
 		q.jmu.Lock()
 		e := q.jobs.Front()
@@ -90,6 +122,11 @@ func (q *MemQueue) send() {
 		case q.ch <- e.Value.(Job):
 			continue
 		case <-q.cl:
+			// the job was not consumed, it is kept in the queue to be drained
+			q.jmu.Lock()
+			q.jobs.PushFront(e.Value)
+			q.run = false
+			q.jmu.Unlock()
 			return
 		}
 	}
@@ -114,14 +151,28 @@ func (q *MemQueue) Len() int {
 
 // Close closes the queue
 func (q *MemQueue) Close() {
+	q.jmu.Lock()
+	q.closed = true
+	q.jmu.Unlock()
 	close(q.cl)
 }
 
-// NewMemBroker creates a new in-memory broker system.
+// drain empties a closed queue. The jobs left in the queue are still queued in
+// the storage of the broker.
+func (q *MemQueue) drain() {
+	q.sendwg.Wait()
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	q.jobs.Init()
+}
+
+// NewMemBroker creates a new in-memory broker system. The jobs are persisted
+// in the given storage, or only kept in memory if it is nil.
 //
 // The in-memory implementation of the job system has the specifity that
-// workers are actually launched by the broker at its creation.
-func NewMemBroker(domain string, ws WorkersList) Broker {
+// workers are actually launched by the broker at its creation. The jobs of the
+// storage that are still queued or running are pushed again in the queues.
+func NewMemBroker(domain string, ws WorkersList, storage JobStorage) Broker {
 	memBrokersMu.Lock()
 	defer memBrokersMu.Unlock()
 	if memBrokers == nil {
@@ -131,7 +182,11 @@ func NewMemBroker(domain string, ws WorkersList) Broker {
 	if ok {
 		return b
 	}
+	if storage == nil {
+		storage = NewMemJobStorage()
+	}
 	queues := make(map[string]*MemQueue)
+	workers := make([]*Worker, 0, len(ws))
 	for workerType, conf := range ws {
 		q := NewMemQueue(domain, workerType)
 		queues[workerType] = q
@@ -141,21 +196,58 @@ func NewMemBroker(domain string, ws WorkersList) Broker {
 			Conf:   conf,
 		}
 		w.Start(q)
+		workers = append(workers, w)
 	}
 	b = &MemBroker{
-		domain: domain,
-		queues: queues,
+		domain:  domain,
+		queues:  queues,
+		workers: workers,
+		storage: storage,
 	}
 	memBrokers[domain] = b
+	b.resume()
 	return b
 }
 
+// resume pushes again the jobs of the storage that were not finished.
+func (b *MemBroker) resume() {
+	pending, err := b.storage.GetPending()
+	if err != nil {
+		log.Errorf("[jobs] broker %s: Could not load the pending jobs: %s",
+			b.domain, err.Error())
+		return
+	}
+	for _, infos := range pending {
+		q, ok := b.queues[infos.WorkerType]
+		if !ok {
+			log.Errorf("[jobs] broker %s: Could not resume the job %s: %s",
+				b.domain, infos.ID, ErrUnknownWorker.Error())
+			continue
+		}
+		job := *infos
+		job.State = Queued
+		j := &MemJob{
+			infos:   &job,
+			jobch:   make(chan *JobInfos, 2),
+			storage: b.storage,
+		}
+		if err = q.Enqueue(j); err != nil {
+			log.Errorf("[jobs] broker %s: Could not resume the job %s: %s",
+				b.domain, infos.ID, err.Error())
+		}
+	}
+}
+
 // GetMemBroker returns the in-memory broker associated with the specified
 // domain.
 func GetMemBroker(domain string) Broker {
 	memBrokersMu.RLock()
 	defer memBrokersMu.RUnlock()
-	return memBrokers[domain]
+	b, ok := memBrokers[domain]
+	if !ok {
+		return nil
+	}
+	return b
 }
 
 // Domain returns the broker's domain
@@ -174,8 +266,12 @@ func (b *MemBroker) PushJob(req *JobRequest) (*JobInfos, <-chan *JobInfos, error
 	jobch := make(chan *JobInfos, 2)
 	infos := NewJobInfos(req)
 	j := &MemJob{
-		infos: infos,
-		jobch: jobch,
+		infos:   infos,
+		jobch:   jobch,
+		storage: b.storage,
+	}
+	if err := b.storage.Add(infos); err != nil {
+		return nil, nil, err
 	}
 	if err := q.Enqueue(j); err != nil {
 		return nil, nil, err
@@ -183,6 +279,11 @@ func (b *MemBroker) PushJob(req *JobRequest) (*JobInfos, <-chan *JobInfos, error
 	return infos, jobch, nil
 }
 
+// GetJobInfos returns the informations about the job with the specified ID.
+func (b *MemBroker) GetJobInfos(id string) (*JobInfos, error) {
+	return b.storage.Get(id)
+}
+
 // QueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *MemBroker) QueueLen(workerType string) (int, error) {
@@ -193,6 +294,37 @@ func (b *MemBroker) QueueLen(workerType string) (int, error) {
 	return q.Len(), nil
 }
 
+// Shutdown stops the workers of the broker and waits for their running jobs to
+// finish, until the context is done. The broker is also unregistered, so that
+// a new one can be created for the same domain.
+//
+// The jobs still in the queues, and the ones that were still running when the
+// context was done, are left in the storage as queued or running.
+func (b *MemBroker) Shutdown(ctx context.Context) error {
+	memBrokersMu.Lock()
+	if memBrokers[b.domain] == b {
+		delete(memBrokers, b.domain)
+	}
+	memBrokersMu.Unlock()
+
+	for _, w := range b.workers {
+		w.Stop()
+	}
+
+	var errw error
+	for _, w := range b.workers {
+		if err := w.Wait(ctx); err != nil {
+			errw = err
+		}
+	}
+
+	for _, q := range b.queues {
+		q.drain()
+	}
+
+	return errw
+}
+
 // Infos returns the associated job infos
 func (j *MemJob) Infos() *JobInfos {
 	j.infmu.RLock()
@@ -209,6 +341,9 @@ func (j *MemJob) AckConsumed() error {
 	job.State = Running
 	j.infos = &job
 	j.infmu.Unlock()
+	if err := j.storage.Update(&job); err != nil {
+		return err
+	}
 	return j.asyncSend(&job, false)
 }
 
@@ -218,21 +353,44 @@ func (j *MemJob) Ack() error {
 	j.infmu.Lock()
 	job := *j.infos
 	job.State = Done
+	job.TryCount++
 	j.infos = &job
 	j.infmu.Unlock()
-	return j.asyncSend(&job, true)
+	errs := j.storage.Update(&job)
+	if err := j.asyncSend(&job, true); err != nil {
+		return err
+	}
+	return errs
 }
 
 // Nack sets the job infos state to Errored, set the specified error has the
-// error field and sends the new job infos on the channel.
+// error field and sends the new job infos on the channel. The job is moved to
+// the dead-letters of the storage.
 func (j *MemJob) Nack(err error) error {
 	j.infmu.Lock()
 	job := *j.infos
 	job.State = Errored
-	job.Error = err
+	job.TryCount++
+	job.Error = err.Error()
+	j.infos = &job
+	j.infmu.Unlock()
+	errs := j.storage.MoveToDeadLetter(&job)
+	if err := j.asyncSend(&job, true); err != nil {
+		return err
+	}
+	return errs
+}
+
+// Retry increments the try count of the job and saves the specified error in
+// the storage. The job stays in the Running state.
+func (j *MemJob) Retry(err error) error {
+	j.infmu.Lock()
+	job := *j.infos
+	job.TryCount++
+	job.Error = err.Error()
 	j.infos = &job
 	j.infmu.Unlock()
-	return j.asyncSend(&job, true)
+	return j.storage.Update(&job)
 }
 
 func (j *MemJob) asyncSend(job *JobInfos, closed bool) error {
@@ -256,6 +414,102 @@ func (j *MemJob) Unmarshal() error {
 	return errors.New("should not be unmarshaled")
 }
 
+// NewMemJobStorage creates a new in-memory storage for jobs.
+func NewMemJobStorage() *MemJobStorage {
+	return &MemJobStorage{
+		jobs:  make(map[string]*JobInfos),
+		dead:  make(map[string]*JobInfos),
+		ended: list.New(),
+		ttl:   MemJobsTTL,
+	}
+}
+
+// markEnded records the end of a job, to evict it later.
+func (s *MemJobStorage) markEnded(id string) {
+	s.ended.PushBack(&endedJob{id: id, endedAt: time.Now()})
+}
+
+// evict removes the jobs that have ended for more than the TTL of the
+// storage. The lock must be held by the caller.
+func (s *MemJobStorage) evict() {
+	limit := time.Now().Add(-s.ttl)
+	for e := s.ended.Front(); e != nil; e = s.ended.Front() {
+		ended := e.Value.(*endedJob)
+		if ended.endedAt.After(limit) {
+			return
+		}
+		s.ended.Remove(e)
+		if job, ok := s.jobs[ended.id]; ok && job.State == Done {
+			delete(s.jobs, ended.id)
+		}
+		delete(s.dead, ended.id)
+	}
+}
+
+// Get implements the Get method of the JobStorage.
+func (s *MemJobStorage) Get(id string) (*JobInfos, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if job, ok := s.jobs[id]; ok {
+		return job, nil
+	}
+	if job, ok := s.dead[id]; ok {
+		return job, nil
+	}
+	return nil, ErrNotFoundJob
+}
+
+// GetPending implements the GetPending method of the JobStorage.
+func (s *MemJobStorage) GetPending() ([]*JobInfos, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var pending []*JobInfos
+	for _, job := range s.jobs {
+		if job.State == Queued || job.State == Running {
+			pending = append(pending, job)
+		}
+	}
+	return pending, nil
+}
+
+// Add implements the Add method of the JobStorage.
+func (s *MemJobStorage) Add(job *JobInfos) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	s.jobs[job.ID] = job
+	return nil
+}
+
+// Update implements the Update method of the JobStorage.
+func (s *MemJobStorage) Update(job *JobInfos) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.ID]; !ok {
+		return ErrNotFoundJob
+	}
+	s.jobs[job.ID] = job
+	if job.State == Done {
+		s.markEnded(job.ID)
+	}
+	s.evict()
+	return nil
+}
+
+// MoveToDeadLetter implements the MoveToDeadLetter method of the JobStorage.
+func (s *MemJobStorage) MoveToDeadLetter(job *JobInfos) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[job.ID]; !ok {
+		return ErrNotFoundJob
+	}
+	delete(s.jobs, job.ID)
+	s.dead[job.ID] = job
+	s.markEnded(job.ID)
+	s.evict()
+	return nil
+}
+
 // NewMemScheduler creates a new in-memory scheduler that will load all
 // registered triggers and schedule their work.
 func NewMemScheduler(domain string, storage TriggerStorage) *MemScheduler {
@@ -265,6 +519,7 @@ func NewMemScheduler(domain string, storage TriggerStorage) *MemScheduler {
 		memSchedulers = make(map[string]*MemScheduler)
 	}
 	s := &MemScheduler{
+		domain:  domain,
 		storage: storage,
 		ts:      make(map[string]Trigger),
 	}
@@ -277,7 +532,11 @@ func NewMemScheduler(domain string, storage TriggerStorage) *MemScheduler {
 func GetMemScheduler(domain string) Scheduler {
 	memSchedulersMu.Lock()
 	defer memSchedulersMu.Unlock()
-	return memSchedulers[domain]
+	s, ok := memSchedulers[domain]
+	if !ok {
+		return nil
+	}
+	return s
 }
 
 // Start will start the scheduler by actually loading all triggers from the
@@ -300,7 +559,9 @@ func (s *MemScheduler) Start(b Broker) error {
 			continue
 		}
 		s.ts[infos.ID] = t
-		go s.schedule(t)
+		if !infos.Disabled {
+			go s.schedule(t)
+		}
 	}
 	return nil
 }
@@ -346,6 +607,56 @@ func (s *MemScheduler) Delete(id string) error {
 	return nil
 }
 
+// Enable resumes the scheduling of a disabled trigger.
+func (s *MemScheduler) Enable(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.ts[id]
+	if !ok {
+		return ErrNotFoundTrigger
+	}
+	infos := t.Infos()
+	if !infos.Disabled {
+		return nil
+	}
+	infos.Disabled = false
+	if err := s.storage.Update(t); err != nil {
+		infos.Disabled = true
+		return err
+	}
+	go s.schedule(t)
+	return nil
+}
+
+// Disable stops the scheduling of a trigger, without removing it from the
+// storage.
+func (s *MemScheduler) Disable(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.ts[id]
+	if !ok {
+		return ErrNotFoundTrigger
+	}
+	infos := t.Infos()
+	if infos.Disabled {
+		return nil
+	}
+	// A trigger can be scheduled only once: it is replaced by a new instance
+	// that will be scheduled when the trigger is enabled again.
+	nt, err := NewTrigger(infos)
+	if err != nil {
+		return err
+	}
+	infos.Disabled = true
+	if err = s.storage.Update(t); err != nil {
+		infos.Disabled = false
+		return err
+	}
+	s.ts[id] = nt
+	t.Unschedule()
+	return nil
+}
+
 // GetAll returns all the running in-memory triggers.
 func (s *MemScheduler) GetAll() ([]Trigger, error) {
 	s.mu.RLock()
@@ -357,23 +668,67 @@ func (s *MemScheduler) GetAll() ([]Trigger, error) {
 	return v, nil
 }
 
+// Shutdown unschedules all the triggers, without removing them from the
+// storage: they will be scheduled again on the next start.
+func (s *MemScheduler) Shutdown() error {
+	memSchedulersMu.Lock()
+	if memSchedulers[s.domain] == s {
+		delete(memSchedulers, s.domain)
+	}
+	memSchedulersMu.Unlock()
+
+	s.mu.Lock()
+	ts := s.ts
+	s.ts = make(map[string]Trigger)
+	s.mu.Unlock()
+	for _, t := range ts {
+		t.Unschedule()
+	}
+	return nil
+}
+
 func (s *MemScheduler) schedule(t Trigger) {
 	log.Debugf("[jobs] trigger %s(%s): Starting trigger", t.Type(), t.Infos().ID)
 	for req := range t.Schedule() {
 		log.Debugf("[jobs] trigger %s(%s): Pushing new job", t.Type(), t.Infos().ID)
 		if _, _, err := s.broker.PushJob(req); err != nil {
 			log.Errorf("[jobs] trigger %s(%s): Could not schedule a new job: %s", t.Type(), t.Infos().ID, err.Error())
+			continue
 		}
+		s.updateLastRun(t)
 	}
 	log.Debugf("[jobs] trigger %s(%s): Closing trigger", t.Type(), t.Infos().ID)
+	s.mu.RLock()
+	cur, ok := s.ts[t.Infos().ID]
+	s.mu.RUnlock()
+	if !ok || cur != t {
+		// the trigger was already deleted, disabled or unscheduled by a
+		// shutdown
+		return
+	}
 	if err := s.Delete(t.Infos().ID); err != nil {
 		log.Errorf("[jobs] trigger %s(%s): Could not delete trigger: %s", t.Type(), t.Infos().ID, err.Error())
 	}
 }
 
+// updateLastRun saves the time of the last job pushed by the trigger, so that
+// the missed runs can be caught up after a restart.
+func (s *MemScheduler) updateLastRun(t Trigger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.ts[t.Infos().ID]; !ok || cur != t {
+		return
+	}
+	t.Infos().LastRun = time.Now()
+	if err := s.storage.Update(t); err != nil {
+		log.Errorf("[jobs] trigger %s(%s): Could not save the last run: %s", t.Type(), t.Infos().ID, err.Error())
+	}
+}
+
 var (
-	_ Queue     = &MemQueue{}
-	_ Broker    = &MemBroker{}
-	_ Job       = &MemJob{}
-	_ Scheduler = &MemScheduler{}
+	_ Queue      = &MemQueue{}
+	_ Broker     = &MemBroker{}
+	_ JobStorage = &MemJobStorage{}
+	_ Job        = &MemJob{}
+	_ Scheduler  = &MemScheduler{}
 )
@@ -2,10 +2,12 @@ package jobs
 
 import (
 	"context"
+	"errors"
 	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -50,7 +52,7 @@ func TestInMemoryJobs(t *testing.T) {
 	w.Add(2)
 
 	go func() {
-		broker := NewMemBroker("cozy.local", workersTestList)
+		broker := NewMemBroker("cozy.local", workersTestList, nil)
 		for i := 0; i < n; i++ {
 			w.Add(1)
 			msg, _ := NewMessage(JSONEncoding, "a-"+strconv.Itoa(i+1))
@@ -65,7 +67,7 @@ func TestInMemoryJobs(t *testing.T) {
 	}()
 
 	go func() {
-		broker := NewMemBroker("cozy.local", workersTestList)
+		broker := NewMemBroker("cozy.local", workersTestList, nil)
 		for i := 0; i < n; i++ {
 			w.Add(1)
 			msg, _ := NewMessage(JSONEncoding, "b-"+strconv.Itoa(i+1))
@@ -82,8 +84,72 @@ func TestInMemoryJobs(t *testing.T) {
 	w.Wait()
 }
 
+func TestWorkerConcurrency(t *testing.T) {
+	var running, maxRunning int32
+	var w sync.WaitGroup
+	broker := NewMemBroker("concurrency.io", WorkersList{
+		"mail": {
+			Concurrency: 2,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				defer w.Done()
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			},
+		},
+	}, nil)
+
+	// the jobs exceeding the concurrency are queued, not dropped
+	for i := 0; i < 10; i++ {
+		w.Add(1)
+		msg, _ := NewMessage(JSONEncoding, "mail-"+strconv.Itoa(i))
+		_, _, err := broker.PushJob(&JobRequest{
+			WorkerType: "mail",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+	}
+	w.Wait()
+	assert.True(t, atomic.LoadInt32(&maxRunning) <= 2, "no more than 2 mail jobs should run simultaneously")
+}
+
+func TestWorkerRateLimit(t *testing.T) {
+	var w sync.WaitGroup
+	broker := NewMemBroker("ratelimit.io", WorkersList{
+		"mail": {
+			Concurrency: 4,
+			RateLimit:   20,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				w.Done()
+				return nil
+			},
+		},
+	}, nil)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		w.Add(1)
+		msg, _ := NewMessage(JSONEncoding, "mail-"+strconv.Itoa(i))
+		_, _, err := broker.PushJob(&JobRequest{
+			WorkerType: "mail",
+			Message:    msg,
+		})
+		assert.NoError(t, err)
+	}
+	w.Wait()
+	// 5 jobs at 20 jobs per second: the last one starts after 200ms
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+}
+
 func TestUnknownWorkerError(t *testing.T) {
-	broker := NewMemBroker("baz.quz", WorkersList{})
+	broker := NewMemBroker("baz.quz", WorkersList{}, nil)
 	_, _, err := broker.PushJob(&JobRequest{
 		WorkerType: "nope",
 		Message:    nil,
@@ -107,7 +173,7 @@ func TestUnknownMessageType(t *testing.T) {
 				return nil
 			},
 		},
-	})
+	}, nil)
 
 	w.Add(1)
 	_, _, err := broker.PushJob(&JobRequest{
@@ -136,7 +202,7 @@ func TestTimeout(t *testing.T) {
 				return ctx.Err()
 			},
 		},
-	})
+	}, nil)
 
 	w.Add(1)
 	_, _, err := broker.PushJob(&JobRequest{
@@ -151,6 +217,181 @@ func TestTimeout(t *testing.T) {
 	w.Wait()
 }
 
+func TestShutdownWaitsForRunningJobs(t *testing.T) {
+	started := make(chan bool)
+	var finished int32
+
+	storage := NewMemJobStorage()
+	broker := NewMemBroker("shutdown.cozy", WorkersList{
+		"long": {
+			Concurrency: 1,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				started <- true
+				time.Sleep(200 * time.Millisecond)
+				atomic.StoreInt32(&finished, 1)
+				return nil
+			},
+		},
+	}, storage)
+
+	msg, _ := NewMessage(JSONEncoding, "long")
+	_, jobch, err := broker.PushJob(&JobRequest{WorkerType: "long", Message: msg})
+	assert.NoError(t, err)
+	second, _, err := broker.PushJob(&JobRequest{WorkerType: "long", Message: msg})
+	assert.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = broker.Shutdown(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finished))
+
+	// the second job was still in the queue
+	pending, err := storage.GetPending()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, 1) {
+		assert.Equal(t, second.ID, pending[0].ID)
+		assert.Equal(t, Queued, pending[0].State)
+	}
+
+	var last *JobInfos
+	for job := range jobch {
+		last = job
+	}
+	if assert.NotNil(t, last) {
+		assert.Equal(t, State(Done), last.State)
+	}
+
+	assert.Nil(t, GetMemBroker("shutdown.cozy"))
+	_, _, err = broker.PushJob(&JobRequest{WorkerType: "long", Message: msg})
+	assert.Equal(t, ErrQueueClosed, err)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	storage := NewMemJobStorage()
+	broker := NewMemBroker("shutdown-timeout.cozy", WorkersList{
+		"stuck": {
+			Concurrency: 1,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				started <- true
+				<-release
+				return nil
+			},
+		},
+	}, storage)
+	defer close(release)
+
+	msg, _ := NewMessage(JSONEncoding, "stuck")
+	infos, _, err := broker.PushJob(&JobRequest{WorkerType: "stuck", Message: msg})
+	assert.NoError(t, err)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = broker.Shutdown(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the job is resumed by a new broker with the same storage
+	resumed := make(chan string)
+	broker = NewMemBroker("shutdown-timeout.cozy", WorkersList{
+		"stuck": {
+			Concurrency: 1,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				var msg string
+				err := m.Unmarshal(&msg)
+				resumed <- msg
+				return err
+			},
+		},
+	}, storage)
+	assert.Equal(t, "stuck", <-resumed)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, broker.Shutdown(ctx))
+	job, err := broker.GetJobInfos(infos.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, State(Done), job.State)
+}
+
+func TestRetryThenSuccess(t *testing.T) {
+	var count int32
+	storage := NewMemJobStorage()
+	broker := NewMemBroker("retry-success.cozy", WorkersList{
+		"flaky": {
+			Concurrency:  1,
+			MaxExecCount: 3,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				if atomic.AddInt32(&count, 1) <= 2 {
+					return errors.New("flaky")
+				}
+				return nil
+			},
+		},
+	}, storage)
+
+	msg, _ := NewMessage(JSONEncoding, "flaky")
+	infos, jobch, err := broker.PushJob(&JobRequest{WorkerType: "flaky", Message: msg})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for range jobch {
+	}
+
+	job, err := broker.GetJobInfos(infos.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, State(Done), job.State)
+	assert.Equal(t, uint(3), job.TryCount)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	pending, err := storage.GetPending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 0)
+}
+
+func TestRetryToDeadLetter(t *testing.T) {
+	var count int32
+	storage := NewMemJobStorage()
+	broker := NewMemBroker("deadletter.cozy", WorkersList{
+		"failing": {
+			Concurrency:  1,
+			MaxExecCount: 3,
+			RetryDelay:   1 * time.Millisecond,
+			WorkerFunc: func(ctx context.Context, _ *Message) error {
+				atomic.AddInt32(&count, 1)
+				return errors.New("failing")
+			},
+		},
+	}, storage)
+
+	msg, _ := NewMessage(JSONEncoding, "failing")
+	infos, jobch, err := broker.PushJob(&JobRequest{WorkerType: "failing", Message: msg})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for range jobch {
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+	job, err := broker.GetJobInfos(infos.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, State(Errored), job.State)
+	assert.Equal(t, uint(3), job.TryCount)
+	assert.Equal(t, "failing", job.Error)
+
+	storage.mu.RLock()
+	_, inQueue := storage.jobs[infos.ID]
+	_, inDeadLetter := storage.dead[infos.ID]
+	storage.mu.RUnlock()
+	assert.False(t, inQueue)
+	assert.True(t, inDeadLetter)
+}
+
 func TestRetry(t *testing.T) {
 	var w sync.WaitGroup
 
@@ -173,7 +414,7 @@ func TestRetry(t *testing.T) {
 				return nil
 			},
 		},
-	})
+	}, nil)
 
 	w.Add(maxExecCount)
 	_, _, err := broker.PushJob(&JobRequest{
@@ -200,7 +441,7 @@ func TestPanicRetried(t *testing.T) {
 				panic("oops")
 			},
 		},
-	})
+	}, nil)
 
 	w.Add(maxExecCount)
 	_, _, err := broker.PushJob(&JobRequest{
@@ -235,7 +476,7 @@ func TestPanic(t *testing.T) {
 				return nil
 			},
 		},
-	})
+	}, nil)
 	w.Add(2)
 	var err error
 	_, _, err = broker.PushJob(&JobRequest{WorkerType: "panic2", Message: odd})
@@ -263,7 +504,7 @@ func TestInfoChan(t *testing.T) {
 				return ctx.Err()
 			},
 		},
-	})
+	}, nil)
 
 	w.Add(1)
 	job, done, err := broker.PushJob(&JobRequest{
@@ -295,6 +536,7 @@ type storage struct {
 
 func (s *storage) GetAll() ([]*TriggerInfos, error) { return s.ts, nil }
 func (s *storage) Add(trigger Trigger) error        { return nil }
+func (s *storage) Update(trigger Trigger) error     { return nil }
 func (s *storage) Delete(trigger Trigger) error     { return nil }
 
 func TestTriggersBadArguments(t *testing.T) {
@@ -321,6 +563,20 @@ func TestTriggersBadArguments(t *testing.T) {
 	if assert.Error(t, err) {
 		assert.Equal(t, ErrUnknownTrigger, err)
 	}
+
+	_, err = NewTrigger(&TriggerInfos{
+		ID:        utils.RandomString(10),
+		Type:      "@cron",
+		Arguments: "garbage",
+	})
+	assert.Error(t, err)
+
+	_, err = NewTrigger(&TriggerInfos{
+		ID:        utils.RandomString(10),
+		Type:      "@interval",
+		Arguments: "100ms",
+	})
+	assert.Error(t, err)
 }
 
 func TestMemSchedulerWithTimeTriggers(t *testing.T) {
@@ -345,7 +601,7 @@ func TestMemSchedulerWithTimeTriggers(t *testing.T) {
 				return nil
 			},
 		},
-	})
+	}, nil)
 
 	msg1, _ := NewMessage("json", "@at")
 	msg2, _ := NewMessage("json", "@in")
@@ -415,3 +671,121 @@ func TestMemSchedulerWithTimeTriggers(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, ErrNotFoundTrigger, err)
 }
+
+func TestMemSchedulerWithCronTriggers(t *testing.T) {
+	var count int32
+	NewMemBroker("test.cron.io", WorkersList{
+		"worker": {
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      1 * time.Second,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				atomic.AddInt32(&count, 1)
+				return nil
+			},
+		},
+	}, nil)
+
+	msg, _ := NewMessage("json", "@cron")
+	cronID := utils.RandomString(10)
+	infos := &TriggerInfos{
+		ID:         cronID,
+		Type:       "@cron",
+		Arguments:  "@every 1s",
+		WorkerType: "worker",
+		Message:    msg,
+	}
+	NewMemScheduler("test.cron.io", &storage{[]*TriggerInfos{infos}})
+	sch := GetMemScheduler("test.cron.io")
+	assert.NoError(t, sch.Start(GetMemBroker("test.cron.io")))
+	defer sch.Shutdown()
+
+	time.Sleep(2500 * time.Millisecond)
+	fired := atomic.LoadInt32(&count)
+	assert.True(t, fired >= 2, "the trigger should have fired at least twice")
+
+	assert.NoError(t, sch.Disable(cronID))
+	trigger, err := sch.Get(cronID)
+	assert.NoError(t, err)
+	assert.True(t, trigger.Infos().Disabled)
+	fired = atomic.LoadInt32(&count)
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, fired, atomic.LoadInt32(&count))
+
+	assert.NoError(t, sch.Enable(cronID))
+	time.Sleep(1500 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&count) > fired)
+
+	assert.Equal(t, ErrNotFoundTrigger, sch.Disable("unknown"))
+}
+
+func TestMemSchedulerCatchUpMissedRuns(t *testing.T) {
+	var count int32
+	NewMemBroker("test.catchup.io", WorkersList{
+		"worker": {
+			Concurrency:  1,
+			MaxExecCount: 1,
+			Timeout:      1 * time.Second,
+			WorkerFunc: func(ctx context.Context, m *Message) error {
+				atomic.AddInt32(&count, 1)
+				return nil
+			},
+		},
+	}, nil)
+
+	msg, _ := NewMessage("json", "@interval")
+	lastRun := time.Now().Add(-5 * time.Hour)
+	infos := &TriggerInfos{
+		ID:         utils.RandomString(10),
+		Type:       "@interval",
+		Arguments:  "1h",
+		WorkerType: "worker",
+		Message:    msg,
+		LastRun:    lastRun,
+	}
+	NewMemScheduler("test.catchup.io", &storage{[]*TriggerInfos{infos}})
+	sch := GetMemScheduler("test.catchup.io")
+	assert.NoError(t, sch.Start(GetMemBroker("test.catchup.io")))
+	defer sch.Shutdown()
+
+	// the five missed runs are caught up only once
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+}
+
+func TestMemJobStorageEviction(t *testing.T) {
+	storage := NewMemJobStorage()
+	storage.ttl = 50 * time.Millisecond
+
+	done := &JobInfos{ID: "done", State: Queued}
+	errored := &JobInfos{ID: "errored", State: Queued}
+	running := &JobInfos{ID: "running", State: Queued}
+	for _, job := range []*JobInfos{done, errored, running} {
+		assert.NoError(t, storage.Add(job))
+	}
+
+	assert.NoError(t, storage.Update(&JobInfos{ID: "done", State: Done}))
+	assert.NoError(t, storage.MoveToDeadLetter(&JobInfos{ID: "errored", State: Errored}))
+	assert.NoError(t, storage.Update(&JobInfos{ID: "running", State: Running}))
+
+	// the ended jobs can still be queried before the TTL
+	_, err := storage.Get("done")
+	assert.NoError(t, err)
+	_, err = storage.Get("errored")
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, storage.Add(&JobInfos{ID: "new", State: Queued}))
+
+	_, err = storage.Get("done")
+	assert.Equal(t, ErrNotFoundJob, err)
+	_, err = storage.Get("errored")
+	assert.Equal(t, ErrNotFoundJob, err)
+	job, err := storage.Get("running")
+	assert.NoError(t, err)
+	assert.EqualValues(t, Running, job.State)
+
+	pending, err := storage.GetPending()
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+}
@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/robfig/cron"
+)
+
+// CronTrigger implements the @cron and @interval trigger types. It schedules
+// recurring jobs, at the times given by a crontab-like specification or at a
+// fixed interval.
+type CronTrigger struct {
+	sched cron.Schedule
+	in    *TriggerInfos
+	done  chan struct{}
+}
+
+// NewCronTrigger returns a new instance of CronTrigger given the specified
+// options. The arguments use the six fields syntax of cron (with the
+// seconds), or a descriptor like "@every 1h" or "@daily".
+func NewCronTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	sched, err := cron.Parse(infos.Arguments)
+	if err != nil {
+		return nil, jsonapi.BadRequest(err)
+	}
+	return &CronTrigger{
+		sched: sched,
+		in:    infos,
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// NewIntervalTrigger returns a new instance of CronTrigger that schedules a
+// job every given duration.
+func NewIntervalTrigger(infos *TriggerInfos) (*CronTrigger, error) {
+	d, err := time.ParseDuration(infos.Arguments)
+	if err != nil {
+		return nil, jsonapi.BadRequest(err)
+	}
+	if d < time.Second {
+		return nil, jsonapi.BadRequest(ErrIntervalTooShort)
+	}
+	return &CronTrigger{
+		sched: cron.Every(d),
+		in:    infos,
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Type implements the Type method of the Trigger interface.
+func (c *CronTrigger) Type() string {
+	return c.in.Type
+}
+
+// Schedule implements the Schedule method of the Trigger interface. If some
+// runs were missed since the last one (when the stack was stopped for
+// example), a single job is pushed right away to catch up.
+func (c *CronTrigger) Schedule() <-chan *JobRequest {
+	lastRun := c.in.LastRun
+	ch := make(chan *JobRequest)
+	go func() {
+		defer close(ch)
+		now := time.Now()
+		if !lastRun.IsZero() && !c.sched.Next(lastRun).After(now) {
+			if !c.trigger(ch) {
+				return
+			}
+		}
+		for {
+			next := c.sched.Next(time.Now())
+			select {
+			case <-time.After(-time.Since(next)):
+				if !c.trigger(ch) {
+					return
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (c *CronTrigger) trigger(ch chan *JobRequest) bool {
+	req := &JobRequest{
+		WorkerType: c.in.WorkerType,
+		Message:    c.in.Message,
+		Options:    c.in.Options,
+	}
+	select {
+	case ch <- req:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Unschedule implements the Unschedule method of the Trigger interface.
+func (c *CronTrigger) Unschedule() {
+	close(c.done)
+}
+
+// Infos implements the Infos method of the Trigger interface.
+func (c *CronTrigger) Infos() *TriggerInfos {
+	return c.in
+}
+
+var _ Trigger = &CronTrigger{}
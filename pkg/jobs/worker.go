@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -38,7 +39,9 @@ type (
 		Conf   *WorkerConfig
 
 		jobs    Queue
+		limiter *rateLimiter
 		started int32
+		wg      sync.WaitGroup
 	}
 )
 
@@ -53,14 +56,25 @@ func (w *Worker) Start(q Queue) {
 		return
 	}
 	w.jobs = q
-	for i := 0; i < int(w.Conf.Concurrency); i++ {
+	if w.Conf.RateLimit > 0 {
+		w.limiter = newRateLimiter(w.Conf.RateLimit)
+	}
+	// the jobs exceeding the concurrency wait in the queue for a free
+	// goroutine
+	concurrency := w.Conf.Concurrency
+	if concurrency == 0 {
+		concurrency = uint(defaultConcurrency)
+	}
+	for i := 0; i < int(concurrency); i++ {
 		name := fmt.Sprintf("%s/%s/%d", w.Domain, w.Type, i)
+		w.wg.Add(1)
 		go w.work(name)
 	}
 }
 
 func (w *Worker) work(workerID string) {
 	// TODO: err handling and persistence
+	defer w.wg.Done()
 	parentCtx := NewWorkerContext(w.Domain)
 	for {
 		job, err := w.jobs.Consume()
@@ -71,6 +85,9 @@ func (w *Worker) work(workerID string) {
 			}
 			return
 		}
+		if w.limiter != nil {
+			w.limiter.wait()
+		}
 		infos := job.Infos()
 		if err = job.AckConsumed(); err != nil {
 			log.Errorf("[job] %s: error acking consume job %s (%s)",
@@ -79,6 +96,7 @@ func (w *Worker) work(workerID string) {
 		}
 		t := &task{
 			ctx:   parentCtx,
+			job:   job,
 			infos: infos,
 			conf:  w.defaultedConf(infos.Options),
 		}
@@ -137,8 +155,53 @@ func (w *Worker) Stop() {
 	w.jobs.Close()
 }
 
+// Wait waits for the running jobs of a stopped worker to finish, until the
+// context is done. In this case, it returns the error of the context.
+func (w *Worker) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimiter spaces out the start of the jobs of a worker, shared by all
+// its goroutines, so that no more than a given number of jobs are started
+// per second.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next job can be started.
+func (r *rateLimiter) wait() {
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	delay := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
 type task struct {
 	ctx   context.Context
+	job   Job
 	infos *JobInfos
 	conf  *WorkerConfig
 
@@ -156,6 +219,10 @@ func (t *task) run() (err error) {
 		}
 		if err != nil {
 			log.Warnf("[job] %s: %s (retry in %s)", t.infos.ID, err.Error(), delay)
+			if errr := t.job.Retry(err); errr != nil {
+				log.Errorf("[job] %s: error while saving the retry (%s)",
+					t.infos.ID, errr.Error())
+			}
 		}
 		if delay > 0 {
 			time.Sleep(delay)
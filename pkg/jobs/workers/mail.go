@@ -3,22 +3,35 @@ package workers
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	htmlTemplate "html/template"
+	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	textTemplate "text/template"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
-	"github.com/cozy/cozy-stack/pkg/consts"
-	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/gomail"
 )
 
+// MailWorkerType is the type of the jobs sending mails
+const MailWorkerType = "sendmail"
+
 func init() {
-	jobs.AddWorker("sendmail", &jobs.WorkerConfig{
+	jobs.AddWorker(MailWorkerType, &jobs.WorkerConfig{
 		Concurrency:  4,
 		MaxExecCount: 3,
 		Timeout:      10 * time.Second,
@@ -26,6 +39,9 @@ func init() {
 	})
 }
 
+// noReplyName is the display name used for the noreply sender address.
+const noReplyName = "Cozy"
+
 // MailAddress contains the name and mail of a mail recipient.
 type MailAddress struct {
 	Name  string `json:"name"`
@@ -44,15 +60,83 @@ type MailOptions struct {
 	Date           *time.Time            `json:"date"`
 	Parts          []*MailPart           `json:"parts"`
 	TemplateValues interface{}           `json:"template_values"`
+	// PartsOrder is the list of the content types of the parts, in the order
+	// they are written in the multipart/alternative body. The clients prefer
+	// the last part they can display. The default is plain before html.
+	PartsOrder []string `json:"parts_order,omitempty"`
+	// Preamble is an optional text written before the first part of a
+	// multipart/alternative body. It is displayed by the clients that don't
+	// understand MIME.
+	Preamble string `json:"preamble,omitempty"`
+	// Boundary is an optional fixed boundary for the multipart/alternative
+	// body, to generate reproducible messages. A random one is used when it
+	// is empty.
+	Boundary string `json:"boundary,omitempty"`
+	// Sender is the address of the account that actually submits the mail,
+	// when it is sent on behalf of the From address. It is used for the
+	// Sender header and for the envelope of the SMTP transaction.
+	Sender *MailAddress `json:"sender,omitempty"`
+	// Locales are the locales used, by order of preference, by the t
+	// function of the templates. The locales of the instance are used when
+	// empty.
+	Locales []string `json:"locales,omitempty"`
+	// Attachments are the files attached to the mail
+	Attachments []*MailAttachment `json:"attachments,omitempty"`
+}
+
+// MailAttachment is a file attached to a mail. Its content is either given in
+// the options, encoded in base64 in JSON, or read from a file of the VFS of
+// the instance.
+type MailAttachment struct {
+	Filename string `json:"filename"`
+	Content  []byte `json:"content,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+
+	// the file of the VFS, and its size, when the attachment has a file_id
+	fs   vfs.Context
+	file *vfs.FileDoc
+	size int64
 }
 
+// ErrMailTooLarge is used when the size of a mail, with its encoded
+// attachments, exceeds the limit of the configuration
+var ErrMailTooLarge = errors.New("The mail exceeds the maximal size of a message")
+
+// ErrAttachmentTooLarge is used when the size of an attached file exceeds the
+// limit of the configuration
+var ErrAttachmentTooLarge = errors.New("An attachment of the mail exceeds the maximal size")
+
+// defaultPartsOrder is the order of the parts when none is given in the mail
+// options.
+var defaultPartsOrder = []string{"text/plain", "text/html"}
+
 // MailPart represent a part of the content of the mail. It has a type
 // specifying the content type of the part, and a body.
 type MailPart struct {
 	Type string `json:"type"`
 	Body string `json:"body"`
+	// Charset is the charset of the part, for the legacy mail clients: UTF-8
+	// (default), US-ASCII or ISO-8859-1. The body is converted to it.
+	Charset string `json:"charset,omitempty"`
+	// Encoding is the content transfer encoding of the part:
+	// quoted-printable (default), base64 or 7bit.
+	Encoding string `json:"encoding,omitempty"`
 }
 
+// The charsets and the content transfer encodings of the parts of a mail
+const (
+	charsetUTF8    = "UTF-8"
+	charsetASCII   = "US-ASCII"
+	charsetLatin1  = "ISO-8859-1"
+	encodingQP     = "quoted-printable"
+	encodingBase64 = "base64"
+	encoding7Bit   = "7bit"
+)
+
+// maxLineLength is the maximal length of a line, without the CRLF, in a part
+// encoded in 7bit (RFC 5322)
+const maxLineLength = 998
+
 // SendMail is the sendmail worker function.
 func SendMail(ctx context.Context, m *jobs.Message) error {
 	opts := &MailOptions{}
@@ -68,55 +152,298 @@ func SendMail(ctx context.Context, m *jobs.Message) error {
 			return err
 		}
 		opts.To = []*MailAddress{toAddr}
-		opts.From = &MailAddress{Email: "noreply@" + domain}
+		opts.From = &MailAddress{
+			Name:  noReplyName,
+			Email: "noreply@" + domain,
+		}
 	case "from":
 		fromAddr, err := addressFromDomain(domain)
 		if err != nil {
 			return err
 		}
+		if fromAddr.Name == "" {
+			fromAddr.Name = domain
+		}
 		opts.From = fromAddr
 	default:
 		return fmt.Errorf("Mail sent with unknown mode %s", opts.Mode)
 	}
+	if len(opts.Locales) == 0 || len(opts.Attachments) > 0 {
+		in, err := instance.Get(domain)
+		if err != nil {
+			return err
+		}
+		if len(opts.Locales) == 0 {
+			opts.Locales = in.LocaleChain()
+		}
+		if err = statAttachments(in, opts.Attachments); err != nil {
+			return err
+		}
+	}
 	return sendMail(ctx, opts)
 }
 
+// statAttachments finds the files of the VFS attached to the mail, and checks
+// their size before reading them.
+func statAttachments(c vfs.Context, attachments []*MailAttachment) error {
+	max := config.GetConfig().MailLimits.MaxAttachmentSize
+	for _, attachment := range attachments {
+		if attachment.FileID == "" {
+			continue
+		}
+		doc, err := vfs.GetFileDoc(c, attachment.FileID)
+		if err != nil {
+			return err
+		}
+		fullpath, err := doc.Path(c)
+		if err != nil {
+			return err
+		}
+		infos, err := vfs.Stat(c, fullpath)
+		if err != nil {
+			return err
+		}
+		if max > 0 && infos.Size() > max {
+			return ErrAttachmentTooLarge
+		}
+		if attachment.Filename == "" {
+			attachment.Filename = doc.Name
+		}
+		attachment.fs = c
+		attachment.file = doc
+		attachment.size = infos.Size()
+	}
+	return nil
+}
+
 func addressFromDomain(domain string) (*MailAddress, error) {
 	in, err := instance.Get(domain)
 	if err != nil {
 		return nil, err
 	}
-	doc := &couchdb.JSONDoc{}
-	err = couchdb.GetDoc(in, consts.Settings, consts.InstanceSettingsID, doc)
+	settings, err := in.Settings()
 	if err != nil {
 		return nil, err
 	}
-	email, ok := doc.M["email"].(string)
-	if !ok {
+	if settings.Email == "" {
 		return nil, fmt.Errorf("Domain %s has no email in its settings", domain)
 	}
-	publicName, _ := doc.M["public_name"].(string)
 	return &MailAddress{
-		Name:  publicName,
-		Email: email,
+		Name:  settings.PublicName,
+		Email: settings.Email,
 	}, nil
 }
 
 func doSendMail(ctx context.Context, opts *MailOptions) error {
+	mail, err := buildMail(opts)
+	if err != nil {
+		return err
+	}
+	switch config.GetConfig().MailMode {
+	case config.MailDisabled:
+		return nil
+	case config.MailFile:
+		return writeMailFile(mail)
+	}
+	return newDialer(ctx, opts).DialAndSend(mail)
+}
+
+// newDialer returns the dialer to the SMTP server of the options, or of the
+// configuration if the options have none.
+func newDialer(ctx context.Context, opts *MailOptions) *gomail.Dialer {
+	dialerOptions := opts.Dialer
+	if dialerOptions == nil {
+		dialerOptions = config.GetConfig().Mail
+	}
+	dialer := gomail.NewDialer(dialerOptions)
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.SetDeadline(deadline)
+	}
+	return dialer
+}
+
+// BatchRecipient is a recipient of a batch of mails, with the values used to
+// render the templates of the subject and of the parts of its mail.
+type BatchRecipient struct {
+	To             *MailAddress `json:"to"`
+	TemplateValues interface{}  `json:"template_values"`
+}
+
+// BatchResult is the result of the sending of the mail of a recipient of a
+// batch: Err is nil if the mail has been sent.
+type BatchResult struct {
+	To  *MailAddress
+	Err error
+}
+
+// SendBatch sends the same templated mail to several recipients. The subject
+// and the parts of the base options are rendered with the template values of
+// each recipient, and all the mails are sent on a single connection to the
+// SMTP server. The returned error is only for a failure that prevents the
+// sending of the whole batch: the errors for a recipient are in its result.
+func SendBatch(ctx context.Context, base *MailOptions, recipients []*BatchRecipient) ([]*BatchResult, error) {
+	results := make([]*BatchResult, len(recipients))
+	mails := make([]*gomail.Message, len(recipients))
+	for i, recipient := range recipients {
+		results[i] = &BatchResult{To: recipient.To}
+		mails[i], results[i].Err = buildBatchMail(base, recipient)
+	}
+
+	mode := config.GetConfig().MailMode
+	if mode == config.MailDisabled {
+		return results, nil
+	}
+
+	var dialer *gomail.Dialer
+	var sender gomail.SendCloser
+	var dialErr error
+	if mode != config.MailFile {
+		var err error
+		dialer = newDialer(ctx, base)
+		sender, err = dialer.Dial()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			if sender != nil {
+				sender.Close()
+			}
+		}()
+	}
+
+	for i, mail := range mails {
+		if results[i].Err != nil {
+			continue
+		}
+		if mode == config.MailFile {
+			results[i].Err = writeMailFile(mail)
+			continue
+		}
+		if sender == nil {
+			results[i].Err = dialErr
+			continue
+		}
+		results[i].Err = gomail.Send(sender, mail)
+		if results[i].Err != nil {
+			sender, dialErr = resetSession(sender, dialer)
+		}
+	}
+	return results, nil
+}
+
+// resetSession is called after a failed sending, for example when the SMTP
+// server has rejected a recipient: the transaction of this mail is still
+// opened, and must be aborted with a RSET before the connection is reused
+// for the next mail. The senders of gomail don't expose this command, so for
+// them the connection is closed and a new one is opened, which starts a new
+// session too.
+func resetSession(sender gomail.SendCloser, dialer *gomail.Dialer) (gomail.SendCloser, error) {
+	if r, ok := sender.(interface {
+		Reset() error
+	}); ok {
+		if err := r.Reset(); err == nil {
+			return sender, nil
+		}
+	}
+	sender.Close()
+	return dialer.Dial()
+}
+
+// buildBatchMail returns the mail of a recipient of a batch, with the subject
+// and the parts rendered with its template values.
+func buildBatchMail(base *MailOptions, recipient *BatchRecipient) (*gomail.Message, error) {
+	if recipient.To == nil {
+		return nil, errors.New("Missing mail recipient")
+	}
+	opts := *base
+	opts.To = []*MailAddress{recipient.To}
+	opts.TemplateValues = recipient.TemplateValues
+	if opts.TemplateValues != nil {
+		t, err := textTemplate.New("subject").
+			Funcs(textTemplate.FuncMap{"t": i18n.Translator(opts.Locales...)}).
+			Parse(base.Subject)
+		if err != nil {
+			return nil, err
+		}
+		b := new(bytes.Buffer)
+		if err = t.Execute(b, opts.TemplateValues); err != nil {
+			return nil, err
+		}
+		opts.Subject = b.String()
+	}
+	return buildMail(&opts)
+}
+
+// checkMailSize returns an error if an attachment, or the whole mail with its
+// parts and its attachments encoded in base64, exceeds the limits of the
+// configuration. It is called before connecting to the SMTP server.
+func checkMailSize(parts []*MailPart, attachments []*MailAttachment) error {
+	limits := config.GetConfig().MailLimits
+	var total int64
+	for _, part := range parts {
+		total += int64(len(part.Body))
+	}
+	for _, attachment := range attachments {
+		size := attachment.size
+		if attachment.file == nil {
+			size = int64(len(attachment.Content))
+		}
+		if limits.MaxAttachmentSize > 0 && size > limits.MaxAttachmentSize {
+			return ErrAttachmentTooLarge
+		}
+		// base64 with lines of 76 characters
+		encoded := (size + 2) / 3 * 4
+		total += encoded + encoded/76*2
+	}
+	if limits.MaxMessageSize > 0 && total > limits.MaxMessageSize {
+		return ErrMailTooLarge
+	}
+	return nil
+}
+
+// attach adds the attachments to the mail. The files of the VFS are read only
+// when the mail is written.
+func attach(mail *gomail.Message, attachments []*MailAttachment) error {
+	for _, attachment := range attachments {
+		if attachment.Filename == "" {
+			return errors.New("Missing filename for a mail attachment")
+		}
+		if attachment.FileID != "" && attachment.file == nil {
+			return fmt.Errorf("Mail attachment %s can't be read", attachment.FileID)
+		}
+		a := attachment
+		mail.Attach(a.Filename, gomail.SetCopyFunc(func(w io.Writer) error {
+			if a.file == nil {
+				_, err := w.Write(a.Content)
+				return err
+			}
+			f, err := vfs.Open(a.fs, a.file)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(w, f)
+			if errc := f.Close(); err == nil {
+				err = errc
+			}
+			return err
+		}))
+	}
+	return nil
+}
+
+// buildMail returns the message for the given options, with its headers and
+// its parts.
+func buildMail(opts *MailOptions) (*gomail.Message, error) {
 	if opts.Subject == "" {
-		return errors.New("Missing mail subject")
+		return nil, errors.New("Missing mail subject")
 	}
 	if len(opts.To) == 0 {
-		return errors.New("Missing mail recipient")
+		return nil, errors.New("Missing mail recipient")
 	}
 	if opts.From == nil {
-		return errors.New("Missing mail sender")
+		return nil, errors.New("Missing mail sender")
 	}
 	mail := gomail.NewMessage()
-	dialerOptions := opts.Dialer
-	if dialerOptions == nil {
-		dialerOptions = config.GetConfig().Mail
-	}
 	var date time.Time
 	if opts.Date == nil {
 		date = time.Now()
@@ -132,51 +459,261 @@ func doSendMail(ctx context.Context, opts *MailOptions) error {
 		"To":      toAddresses,
 		"Subject": {opts.Subject},
 	})
+	// gomail uses the Sender header, if present, for the envelope sender
+	if opts.Sender != nil && opts.Sender.Email != opts.From.Email {
+		mail.SetHeader("Sender", mail.FormatAddress(opts.Sender.Email, opts.Sender.Name))
+	}
 	mail.SetDateHeader("Date", date)
-	for _, part := range opts.Parts {
-		if err := addPart(mail, part, opts.TemplateValues); err != nil {
+
+	order := opts.PartsOrder
+	if len(order) == 0 {
+		order = defaultPartsOrder
+	}
+	parts := make([]*MailPart, len(opts.Parts))
+	for i, part := range opts.Parts {
+		body, err := renderPart(part, opts.TemplateValues, opts.Locales)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = &MailPart{
+			Type:     part.Type,
+			Body:     body,
+			Charset:  part.Charset,
+			Encoding: part.Encoding,
+		}
+	}
+	sort.Stable(&partsSorter{parts, order})
+
+	if err := checkMailSize(parts, opts.Attachments); err != nil {
+		return nil, err
+	}
+	if err := attach(mail, opts.Attachments); err != nil {
+		return nil, err
+	}
+
+	// gomail writes all the parts in UTF-8 and quoted-printable, so the body
+	// is written by the stack when a part needs another charset or encoding,
+	// even for a single part.
+	custom := false
+	for _, part := range parts {
+		if part.Charset != "" || part.Encoding != "" {
+			custom = true
+		}
+	}
+	if custom || (opts.Preamble != "" || opts.Boundary != "") && len(parts) > 1 {
+		if err := setAlternativeBody(mail, parts, opts.Preamble, opts.Boundary); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, part := range parts {
+			mail.AddAlternative(part.Type, part.Body)
+		}
+	}
+	return mail, nil
+}
+
+// partsSorter sorts the parts of a mail by the position of their content type
+// in the given order. The parts with a content type not in the order are put
+// at the end.
+type partsSorter struct {
+	parts []*MailPart
+	order []string
+}
+
+func (s *partsSorter) Len() int      { return len(s.parts) }
+func (s *partsSorter) Swap(i, j int) { s.parts[i], s.parts[j] = s.parts[j], s.parts[i] }
+func (s *partsSorter) Less(i, j int) bool {
+	return s.rank(s.parts[i]) < s.rank(s.parts[j])
+}
+
+func (s *partsSorter) rank(part *MailPart) int {
+	for i, contentType := range s.order {
+		if contentType == part.Type {
+			return i
+		}
+	}
+	return len(s.order)
+}
+
+// setAlternativeBody writes the multipart/alternative body of the mail with
+// a preamble, a fixed boundary, or parts with their own charset and
+// encoding, as gomail has no support for them: the parts are encoded, and
+// the whole body is given unencoded to gomail.
+func setAlternativeBody(mail *gomail.Message, parts []*MailPart, preamble, boundary string) error {
+	bodies := make([][]byte, len(parts))
+	for i, part := range parts {
+		body, err := encodePart(part)
+		if err != nil {
 			return err
 		}
+		bodies[i] = body
 	}
-	dialer := gomail.NewDialer(dialerOptions)
-	if deadline, ok := ctx.Deadline(); ok {
-		dialer.SetDeadline(deadline)
+
+	buf := new(bytes.Buffer)
+	if preamble != "" {
+		preamble = strings.Replace(preamble, "\r\n", "\n", -1)
+		buf.WriteString(strings.Replace(preamble, "\n", "\r\n", -1) + "\r\n")
+	}
+	mw := multipart.NewWriter(buf)
+	if boundary != "" {
+		if err := mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+	}
+	for i, part := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.Type + "; charset=" + part.Charset},
+			"Content-Transfer-Encoding": {part.Encoding},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(bodies[i]); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
 	}
-	return dialer.DialAndSend(mail)
+	mail.SetBody("multipart/alternative; boundary="+mw.Boundary(), buf.String(),
+		gomail.SetPartEncoding(gomail.Unencoded))
+	return nil
 }
 
-func addPart(mail *gomail.Message, part *MailPart, templateValues interface{}) error {
+// encodePart converts the body of the part to its charset, and encodes it
+// with its content transfer encoding. The default charset and encoding are
+// set on the part. An error is returned for an unknown charset or encoding,
+// or if the body can't be represented with them.
+func encodePart(part *MailPart) ([]byte, error) {
+	if part.Charset == "" {
+		part.Charset = charsetUTF8
+	}
+	if part.Encoding == "" {
+		part.Encoding = encodingQP
+	}
+	part.Charset = strings.ToUpper(part.Charset)
+	part.Encoding = strings.ToLower(part.Encoding)
+
+	var body []byte
+	switch part.Charset {
+	case charsetUTF8:
+		body = []byte(part.Body)
+	case charsetASCII, charsetLatin1:
+		max := rune(0x7f)
+		if part.Charset == charsetLatin1 {
+			max = 0xff
+		}
+		body = make([]byte, 0, len(part.Body))
+		for _, r := range part.Body {
+			if r > max {
+				return nil, fmt.Errorf("Mail part can't be encoded in %s", part.Charset)
+			}
+			body = append(body, byte(r))
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mail part charset %s", part.Charset)
+	}
+
+	buf := new(bytes.Buffer)
+	switch part.Encoding {
+	case encodingQP:
+		qp := quotedprintable.NewWriter(buf)
+		if _, err := qp.Write(body); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	case encodingBase64:
+		encoded := base64.StdEncoding.EncodeToString(body)
+		for len(encoded) > 76 {
+			buf.WriteString(encoded[:76] + "\r\n")
+			encoded = encoded[76:]
+		}
+		buf.WriteString(encoded)
+	case encoding7Bit:
+		lines := strings.Split(strings.Replace(string(body), "\r\n", "\n", -1), "\n")
+		for i, line := range lines {
+			if len(line) > maxLineLength {
+				return nil, errors.New("Mail part has a too long line for 7bit")
+			}
+			for j := 0; j < len(line); j++ {
+				if line[j] >= 0x80 || line[j] == 0 || line[j] == '\r' {
+					return nil, errors.New("Mail part has 8-bit characters for 7bit")
+				}
+			}
+			if i > 0 {
+				buf.WriteString("\r\n")
+			}
+			buf.WriteString(line)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown mail part encoding %s", part.Encoding)
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMailFile writes the full RFC822 message in the mail directory of the
+// configuration, so that developers can inspect it.
+func writeMailFile(mail *gomail.Message) error {
+	dir := config.GetConfig().MailDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "cozy-mails")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml",
+		time.Now().UTC().Format("20060102150405"), utils.RandomString(8))
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = mail.WriteTo(f)
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	return err
+}
+
+// renderPart returns the body of a part. When there are template values, the
+// body is a template rendered with them, and the t function translates a key
+// in the given locales.
+func renderPart(part *MailPart, templateValues interface{}, locales []string) (string, error) {
 	contentType := part.Type
 	var body string
 	if contentType != "text/plain" && contentType != "text/html" {
-		return fmt.Errorf("Unknown body content-type %s", contentType)
+		return "", fmt.Errorf("Unknown body content-type %s", contentType)
 	}
 	if templateValues != nil {
 		b := new(bytes.Buffer)
 		switch contentType {
 		case "text/html":
-			t, err := htmlTemplate.New("mail").Parse(part.Body)
+			t, err := htmlTemplate.New("mail").
+				Funcs(htmlTemplate.FuncMap{"t": i18n.Translator(locales...)}).
+				Parse(part.Body)
 			if err != nil {
-				return err
+				return "", err
 			}
 			if err = t.Execute(b, templateValues); err != nil {
-				return err
+				return "", err
 			}
 		case "text/plain":
-			t, err := textTemplate.New("mail").Parse(part.Body)
+			t, err := textTemplate.New("mail").
+				Funcs(textTemplate.FuncMap{"t": i18n.Translator(locales...)}).
+				Parse(part.Body)
 			if err != nil {
-				return err
+				return "", err
 			}
 			if err = t.Execute(b, templateValues); err != nil {
-				return err
+				return "", err
 			}
 		}
 		body = b.String()
 	} else {
 		body = part.Body
 	}
-	mail.AddAlternative(contentType, body)
-	return nil
+	return body, nil
 }
 
 // var for testability
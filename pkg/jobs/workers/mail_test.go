@@ -4,16 +4,23 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net"
+	netmail "net/mail"
 	"net/textproto"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/gomail"
@@ -75,6 +82,109 @@ QUIT
 	})
 }
 
+func TestMailSendWithDisplayName(t *testing.T) {
+	clientString := `EHLO localhost
+HELO localhost
+MAIL FROM:<noreply@me>
+RCPT TO:<you1@you>
+DATA
+Hey !!!
+.
+QUIT
+`
+
+	expectedHeaders := map[string]string{
+		"From":    `"Cozy" <noreply@me>`,
+		"To":      `"You" <you1@you>`,
+		"Subject": "Up?",
+		"Date":    "Mon, 01 Jan 0001 00:00:00 +0000",
+		"Content-Transfer-Encoding": "quoted-printable",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Mime-Version":              "1.0",
+	}
+
+	mailServer(t, serverString, clientString, expectedHeaders, func(host string, port int) error {
+		msg := &MailOptions{
+			From: &MailAddress{Name: "Cozy", Email: "noreply@me"},
+			To: []*MailAddress{
+				&MailAddress{Name: "You", Email: "you1@you"},
+			},
+			Date:    &time.Time{},
+			Subject: "Up?",
+			Dialer: &gomail.DialerOptions{
+				Host:       host,
+				Port:       port,
+				DisableTLS: true,
+			},
+			Parts: []*MailPart{
+				&MailPart{
+					Body: "Hey !!!",
+					Type: "text/plain",
+				},
+			},
+		}
+		return sendMail(context.Background(), msg)
+	})
+}
+
+func TestMailSendOnBehalf(t *testing.T) {
+	clientString := `EHLO localhost
+HELO localhost
+MAIL FROM:<relay@me>
+RCPT TO:<you1@you>
+DATA
+Hey !!!
+.
+QUIT
+`
+
+	expectedHeaders := map[string]string{
+		"From":    `"Alice" <alice@me>`,
+		"Sender":  `"Relay" <relay@me>`,
+		"To":      "you1@you",
+		"Subject": "Up?",
+		"Date":    "Mon, 01 Jan 0001 00:00:00 +0000",
+		"Content-Transfer-Encoding": "quoted-printable",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Mime-Version":              "1.0",
+	}
+
+	mailServer(t, serverString, clientString, expectedHeaders, func(host string, port int) error {
+		msg := &MailOptions{
+			From:   &MailAddress{Name: "Alice", Email: "alice@me"},
+			Sender: &MailAddress{Name: "Relay", Email: "relay@me"},
+			To: []*MailAddress{
+				&MailAddress{Email: "you1@you"},
+			},
+			Date:    &time.Time{},
+			Subject: "Up?",
+			Dialer: &gomail.DialerOptions{
+				Host:       host,
+				Port:       port,
+				DisableTLS: true,
+			},
+			Parts: []*MailPart{
+				&MailPart{
+					Body: "Hey !!!",
+					Type: "text/plain",
+				},
+			},
+		}
+		return sendMail(context.Background(), msg)
+	})
+}
+
+func TestMailSenderSameAsFrom(t *testing.T) {
+	mail, err := buildMail(&MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		Sender:  &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you@you"}},
+		Subject: "Up?",
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, mail.GetHeader("Sender"))
+}
+
 func TestMailSendTemplateMail(t *testing.T) {
 	clientString := `EHLO localhost
 HELO localhost
@@ -150,6 +260,292 @@ QUIT
 	})
 }
 
+func TestMailSendPartsOrder(t *testing.T) {
+	expectedHeaders := map[string]string{
+		"From":         "me@me",
+		"To":           "you1@you",
+		"Subject":      "Up?",
+		"Date":         "Mon, 01 Jan 0001 00:00:00 +0000",
+		"Content-Type": "multipart/alternative;",
+		"Mime-Version": "1.0",
+	}
+
+	send := func(order []string) func(host string, port int) error {
+		return func(host string, port int) error {
+			msg := &MailOptions{
+				From:    &MailAddress{Email: "me@me"},
+				To:      []*MailAddress{&MailAddress{Email: "you1@you"}},
+				Date:    &time.Time{},
+				Subject: "Up?",
+				Dialer: &gomail.DialerOptions{
+					Host:       host,
+					Port:       port,
+					DisableTLS: true,
+				},
+				Parts: []*MailPart{
+					&MailPart{Type: "text/html", Body: "<b>Hey</b>"},
+					&MailPart{Type: "text/plain", Body: "Hey"},
+				},
+				PartsOrder: order,
+			}
+			return sendMail(context.Background(), msg)
+		}
+	}
+
+	// plain before html by default
+	clientString := `EHLO localhost
+HELO localhost
+MAIL FROM:<me@me>
+RCPT TO:<you1@you>
+DATA
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/plain; charset=UTF-8
+Hey
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/html; charset=UTF-8
+<b>Hey</b>
+.
+QUIT
+`
+	mailServer(t, serverString, clientString, expectedHeaders, send(nil))
+
+	// html before plain when asked
+	clientString = `EHLO localhost
+HELO localhost
+MAIL FROM:<me@me>
+RCPT TO:<you1@you>
+DATA
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/html; charset=UTF-8
+<b>Hey</b>
+Content-Transfer-Encoding: quoted-printable
+Content-Type: text/plain; charset=UTF-8
+Hey
+.
+QUIT
+`
+	mailServer(t, serverString, clientString, expectedHeaders, send([]string{"text/html", "text/plain"}))
+}
+
+func TestMailPreamble(t *testing.T) {
+	mail, err := buildMail(&MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you1@you"}},
+		Subject: "Up?",
+		Parts: []*MailPart{
+			&MailPart{Type: "text/html", Body: "<b>Hey</b>"},
+			&MailPart{Type: "text/plain", Body: "Hey"},
+		},
+		Preamble: "This is a multi-part message in MIME format.",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := new(bytes.Buffer)
+	_, err = mail.WriteTo(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	msg, err := netmail.ReadMessage(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	body, err := ioutil.ReadAll(msg.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(body), "This is a multi-part message in MIME format.\r\n--"+params["boundary"]))
+
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var types, bodies []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		bodies = append(bodies, string(content))
+	}
+	assert.Equal(t, []string{"text/plain; charset=UTF-8", "text/html; charset=UTF-8"}, types)
+	assert.Equal(t, []string{"Hey", "<b>Hey</b>"}, bodies)
+}
+
+func TestMailFixedBoundary(t *testing.T) {
+	opts := &MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you1@you"}},
+		Date:    &time.Time{},
+		Subject: "Up?",
+		Parts: []*MailPart{
+			&MailPart{Type: "text/html", Body: "<b>Hey</b>"},
+			&MailPart{Type: "text/plain", Body: "Hey"},
+		},
+		Boundary: "cozy-fixed-boundary",
+	}
+	write := func() string {
+		mail, err := buildMail(opts)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		buf := new(bytes.Buffer)
+		_, err = mail.WriteTo(buf)
+		assert.NoError(t, err)
+		return buf.String()
+	}
+
+	data := write()
+	assert.Contains(t, data, "boundary=cozy-fixed-boundary")
+	assert.Contains(t, data, "\r\n--cozy-fixed-boundary\r\n")
+	assert.Contains(t, data, "\r\n--cozy-fixed-boundary--")
+	// the headers are written by gomail in a random order, but the body is
+	// the same
+	body := func(data string) string {
+		return data[strings.Index(data, "\r\n\r\n"):]
+	}
+	assert.Equal(t, body(data), body(write()))
+
+	msg, err := netmail.ReadMessage(strings.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	assert.Equal(t, "cozy-fixed-boundary", params["boundary"])
+
+	opts.Boundary = "invalid boundary "
+	_, err = buildMail(opts)
+	assert.Error(t, err)
+}
+
+func TestMailPartCharsetAndEncoding(t *testing.T) {
+	opts := &MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you1@you"}},
+		Subject: "Up?",
+		Parts: []*MailPart{
+			&MailPart{
+				Type:     "text/plain",
+				Body:     "Hé, ça va ?",
+				Charset:  "ISO-8859-1",
+				Encoding: "base64",
+			},
+		},
+	}
+	mail, err := buildMail(opts)
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := new(bytes.Buffer)
+	_, err = mail.WriteTo(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	msg, err := netmail.ReadMessage(buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	p, err := mr.NextPart()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "base64", p.Header.Get("Content-Transfer-Encoding"))
+	assert.Equal(t, "text/plain; charset=ISO-8859-1", p.Header.Get("Content-Type"))
+	content, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("H\xe9, \xe7a va ?"), content)
+
+	// invalid combinations
+	invalid := []*MailPart{
+		&MailPart{Type: "text/plain", Body: "Hé", Encoding: "7bit"},
+		&MailPart{Type: "text/plain", Body: "Hé", Charset: "US-ASCII"},
+		&MailPart{Type: "text/plain", Body: "€", Charset: "ISO-8859-1"},
+		&MailPart{Type: "text/plain", Body: "Hey", Charset: "KOI8-R"},
+		&MailPart{Type: "text/plain", Body: "Hey", Encoding: "uuencode"},
+	}
+	for _, part := range invalid {
+		opts.Parts = []*MailPart{part}
+		_, err = buildMail(opts)
+		assert.Error(t, err, "%s in %s", part.Encoding, part.Charset)
+	}
+
+	opts.Parts = []*MailPart{
+		&MailPart{Type: "text/plain", Body: "Hey", Charset: "US-ASCII", Encoding: "7bit"},
+	}
+	_, err = buildMail(opts)
+	assert.NoError(t, err)
+}
+
+func TestMailAttachment(t *testing.T) {
+	mail, err := buildMail(&MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you1@you"}},
+		Subject: "Up?",
+		Parts: []*MailPart{
+			&MailPart{Type: "text/plain", Body: "Hey"},
+		},
+		Attachments: []*MailAttachment{
+			&MailAttachment{Filename: "hello.txt", Content: []byte("Hello world")},
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	buf := new(bytes.Buffer)
+	_, err = mail.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `Content-Disposition: attachment; filename="hello.txt"`)
+	assert.Contains(t, buf.String(), base64.StdEncoding.EncodeToString([]byte("Hello world")))
+}
+
+func TestMailTooLarge(t *testing.T) {
+	limits := &config.GetConfig().MailLimits
+	defer func(saved config.MailLimits) { *limits = saved }(*limits)
+	limits.MaxAttachmentSize = 100
+	limits.MaxMessageSize = 200
+
+	msg := &MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you@you"}},
+		Subject: "Up?",
+		// the limits are checked before connecting to this server
+		Dialer: &gomail.DialerOptions{
+			Host: "this.host.does.not.exist",
+			Port: 25,
+		},
+		Parts: []*MailPart{
+			&MailPart{Type: "text/plain", Body: "Hey"},
+		},
+		Attachments: []*MailAttachment{
+			&MailAttachment{Filename: "big.bin", Content: make([]byte, 101)},
+		},
+	}
+	err := sendMail(context.Background(), msg)
+	assert.Equal(t, ErrAttachmentTooLarge, err)
+
+	// each attachment is under the limit, but not the whole message
+	msg.Attachments = []*MailAttachment{
+		&MailAttachment{Filename: "one.bin", Content: make([]byte, 90)},
+		&MailAttachment{Filename: "two.bin", Content: make([]byte, 90)},
+	}
+	err = sendMail(context.Background(), msg)
+	assert.Equal(t, ErrMailTooLarge, err)
+
+	msg.Attachments = nil
+	msg.Parts[0].Body = strings.Repeat("Hey ", 60)
+	err = sendMail(context.Background(), msg)
+	assert.Equal(t, ErrMailTooLarge, err)
+}
+
 func TestMailMissingSubject(t *testing.T) {
 	msg := &MailOptions{
 		From: &MailAddress{Email: "me@me"},
@@ -277,6 +673,258 @@ QUIT
 	})
 }
 
+func TestMailFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cozy-mails")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.GetConfig()
+	cfg.MailMode = config.MailFile
+	cfg.MailDir = dir
+	defer func() {
+		cfg.MailMode = config.MailSMTP
+		cfg.MailDir = ""
+	}()
+
+	msg := &MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		To:      []*MailAddress{&MailAddress{Email: "you@you"}},
+		Date:    &time.Time{},
+		Subject: "Up?",
+		Dialer: &gomail.DialerOptions{
+			Host: "this.host.does.not.exist",
+			Port: 25,
+		},
+		Parts: []*MailPart{
+			&MailPart{
+				Type: "text/plain",
+				Body: "Hey !!!",
+			},
+		},
+	}
+	err = sendMail(context.Background(), msg)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if !assert.NoError(t, err) || !assert.Len(t, files, 1) {
+		return
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "From: me@me\r\n")
+	assert.Contains(t, string(content), "To: you@you\r\n")
+	assert.Contains(t, string(content), "Subject: Up?\r\n")
+	assert.Contains(t, string(content), "Hey !!!")
+}
+
+func TestMailSendBatch(t *testing.T) {
+	serverString := `220 hello world
+502 EH?
+250 smtp.me at your service
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+221 Goodbye
+`
+	clientString := `EHLO localhost
+HELO localhost
+MAIL FROM:<me@me>
+RCPT TO:<alice@you>
+DATA
+Hey Alice, you have 1 message
+.
+MAIL FROM:<me@me>
+RCPT TO:<bob@you>
+DATA
+Hey Bob, you have 2 messages
+.
+MAIL FROM:<me@me>
+RCPT TO:<carol@you>
+DATA
+Hey Carol, you have 3 messages
+.
+QUIT
+`
+
+	// the headers are the ones of the last mail
+	expectedHeaders := map[string]string{
+		"From":    "me@me",
+		"To":      "carol@you",
+		"Subject": "Hello Carol",
+		"Date":    "Mon, 01 Jan 0001 00:00:00 +0000",
+		"Content-Transfer-Encoding": "quoted-printable",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Mime-Version":              "1.0",
+	}
+
+	mailServer(t, serverString, clientString, expectedHeaders, func(host string, port int) error {
+		base := &MailOptions{
+			From:    &MailAddress{Email: "me@me"},
+			Date:    &time.Time{},
+			Subject: "Hello {{.Name}}",
+			Dialer: &gomail.DialerOptions{
+				Host:       host,
+				Port:       port,
+				DisableTLS: true,
+			},
+			Parts: []*MailPart{
+				&MailPart{
+					Body: "Hey {{.Name}}, you have {{.Count}} message{{if gt .Count 1}}s{{end}}",
+					Type: "text/plain",
+				},
+			},
+		}
+		recipients := []*BatchRecipient{
+			{To: &MailAddress{Email: "alice@you"}, TemplateValues: map[string]interface{}{"Name": "Alice", "Count": 1}},
+			{To: &MailAddress{Email: "bob@you"}, TemplateValues: map[string]interface{}{"Name": "Bob", "Count": 2}},
+			{To: &MailAddress{Email: "carol@you"}, TemplateValues: map[string]interface{}{"Name": "Carol", "Count": 3}},
+		}
+		results, err := SendBatch(context.Background(), base, recipients)
+		if err != nil {
+			return err
+		}
+		if assert.Len(t, results, 3) {
+			for i, res := range results {
+				assert.Equal(t, recipients[i].To, res.To)
+				assert.NoError(t, res.Err)
+			}
+		}
+		return nil
+	})
+}
+
+func TestMailSendBatchInvalidRecipient(t *testing.T) {
+	mailServer(t, `220 hello world
+502 EH?
+250 smtp.me at your service
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+221 Goodbye
+`, `EHLO localhost
+HELO localhost
+MAIL FROM:<me@me>
+RCPT TO:<alice@you>
+DATA
+Hey Alice
+.
+QUIT
+`, map[string]string{
+		"From":    "me@me",
+		"To":      "alice@you",
+		"Subject": "Hello Alice",
+		"Date":    "Mon, 01 Jan 0001 00:00:00 +0000",
+		"Content-Transfer-Encoding": "quoted-printable",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Mime-Version":              "1.0",
+	}, func(host string, port int) error {
+		base := &MailOptions{
+			From:    &MailAddress{Email: "me@me"},
+			Date:    &time.Time{},
+			Subject: "Hello {{.Name}}",
+			Dialer: &gomail.DialerOptions{
+				Host:       host,
+				Port:       port,
+				DisableTLS: true,
+			},
+			Parts: []*MailPart{
+				&MailPart{Body: "Hey {{.Name}}", Type: "text/plain"},
+			},
+		}
+		results, err := SendBatch(context.Background(), base, []*BatchRecipient{
+			{To: &MailAddress{Email: "alice@you"}, TemplateValues: map[string]string{"Name": "Alice"}},
+			{To: nil, TemplateValues: map[string]string{"Name": "Nobody"}},
+		})
+		if err != nil {
+			return err
+		}
+		if assert.Len(t, results, 2) {
+			assert.NoError(t, results[0].Err)
+			assert.Error(t, results[1].Err)
+		}
+		return nil
+	})
+}
+
+func TestMailSendBatchRejectedRecipient(t *testing.T) {
+	mailServer(t, `220 hello world
+502 EH?
+250 smtp.me at your service
+250 Sender ok
+550 No such user
+221 Goodbye
+220 hello world
+502 EH?
+250 smtp.me at your service
+250 Sender ok
+250 Receiver ok
+354 Go ahead
+250 Data ok
+221 Goodbye
+`, `EHLO localhost
+HELO localhost
+MAIL FROM:<me@me>
+RCPT TO:<bob@you>
+QUIT
+EHLO localhost
+HELO localhost
+MAIL FROM:<me@me>
+RCPT TO:<carol@you>
+DATA
+Hey Carol
+.
+QUIT
+`, map[string]string{
+		"From":    "me@me",
+		"To":      "carol@you",
+		"Subject": "Hello Carol",
+		"Date":    "Mon, 01 Jan 0001 00:00:00 +0000",
+		"Content-Transfer-Encoding": "quoted-printable",
+		"Content-Type":              "text/plain; charset=UTF-8",
+		"Mime-Version":              "1.0",
+	}, func(host string, port int) error {
+		base := &MailOptions{
+			From:    &MailAddress{Email: "me@me"},
+			Date:    &time.Time{},
+			Subject: "Hello {{.Name}}",
+			Dialer: &gomail.DialerOptions{
+				Host:       host,
+				Port:       port,
+				DisableTLS: true,
+			},
+			Parts: []*MailPart{
+				&MailPart{Body: "Hey {{.Name}}", Type: "text/plain"},
+			},
+		}
+		results, err := SendBatch(context.Background(), base, []*BatchRecipient{
+			{To: &MailAddress{Email: "bob@you"}, TemplateValues: map[string]string{"Name": "Bob"}},
+			{To: &MailAddress{Email: "carol@you"}, TemplateValues: map[string]string{"Name": "Carol"}},
+		})
+		if err != nil {
+			return err
+		}
+		if assert.Len(t, results, 2) {
+			assert.Error(t, results[0].Err)
+			assert.NoError(t, results[1].Err)
+		}
+		return nil
+	})
+}
+
 func mailServer(t *testing.T, serverString, clientString string, expectedHeader map[string]string, send func(string, int) error) {
 	serverString = strings.Join(strings.Split(serverString, "\n"), "\r\n")
 	clientString = strings.Join(strings.Split(clientString, "\n"), "\r\n")
@@ -301,7 +949,7 @@ func mailServer(t *testing.T, serverString, clientString string, expectedHeader
 			t.Errorf("Accept error: %v", err)
 			return
 		}
-		defer conn.Close()
+		defer func() { conn.Close() }()
 
 		tc := textproto.NewConn(conn)
 		readdata := false
@@ -313,7 +961,17 @@ func mailServer(t *testing.T, serverString, clientString string, expectedHeader
 				tc.PrintfLine(data[i])
 			}
 			if data[i] == "221 Goodbye" {
-				return
+				if i+1 == len(data) || data[i+1] == "" {
+					return
+				}
+				// the client reconnects for the next lines
+				conn.Close()
+				if conn, err = l.Accept(); err != nil {
+					t.Errorf("Accept error: %v", err)
+					return
+				}
+				tc = textproto.NewConn(conn)
+				continue
 			}
 			read := false
 			for !read || data[i] == "354 Go ahead" {
@@ -337,6 +995,7 @@ func mailServer(t *testing.T, serverString, clientString string, expectedHeader
 				} else {
 					if msg == "." {
 						readdata = false
+						readhead = false
 					}
 					if msg == "DATA" {
 						readdata = true
@@ -370,6 +1029,41 @@ func mailServer(t *testing.T, serverString, clientString string, expectedHeader
 	assert.EqualValues(t, expectedHeader, headers)
 }
 
+func TestMailTranslatedTemplate(t *testing.T) {
+	i18n.LoadLocale("en", map[string]string{
+		"Mail Test Subject":  "Hello %s",
+		"Mail Test Greeting": "Welcome",
+	})
+	i18n.LoadLocale("fr", map[string]string{
+		"Mail Test Subject": "Bonjour %s",
+	})
+
+	base := &MailOptions{
+		From:    &MailAddress{Email: "me@me"},
+		Date:    &time.Time{},
+		Subject: `{{t "Mail Test Subject" .Name}}`,
+		Parts: []*MailPart{
+			&MailPart{Type: "text/plain", Body: `{{t "Mail Test Greeting"}}, {{.Name}}`},
+		},
+		Locales: []string{"fr-CA"},
+	}
+	recipient := &BatchRecipient{
+		To:             &MailAddress{Email: "you@you"},
+		TemplateValues: map[string]string{"Name": "Alice"},
+	}
+	mail, err := buildBatchMail(base, recipient)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the subject is only in the base language, and the greeting only in
+	// the default locale
+	assert.Equal(t, []string{"Bonjour Alice"}, mail.GetHeader("Subject"))
+	b := new(bytes.Buffer)
+	_, err = mail.WriteTo(b)
+	assert.NoError(t, err)
+	assert.Contains(t, b.String(), "Welcome, Alice")
+}
+
 func TestSendMailNoReply(t *testing.T) {
 	sendMail = func(ctx context.Context, opts *MailOptions) error {
 		assert.NotNil(t, opts.From)
@@ -377,11 +1071,14 @@ func TestSendMailNoReply(t *testing.T) {
 		assert.Len(t, opts.To, 1)
 		assert.Equal(t, "me@me", opts.To[0].Email)
 		assert.Equal(t, "noreply@noreply.triggers", opts.From.Email)
+		assert.Equal(t, "Cozy", opts.From.Name)
+		assert.Equal(t, []string{"fr", "en"}, opts.Locales)
 		return errors.New("yes")
 	}
 	_, err := instance.Create(&instance.Options{
 		Domain: "noreply.triggers",
 		Email:  "me@me",
+		Locale: "fr",
 	})
 	if !assert.NoError(t, err) {
 		return
@@ -413,6 +1110,7 @@ func TestSendMailFrom(t *testing.T) {
 		assert.Len(t, opts.To, 1)
 		assert.Equal(t, "you@you", opts.To[0].Email)
 		assert.Equal(t, "me@me", opts.From.Email)
+		assert.Equal(t, "from.triggers", opts.From.Name)
 		return errors.New("yes")
 	}
 	_, err := instance.Create(&instance.Options{
@@ -443,6 +1141,55 @@ func TestSendMailFrom(t *testing.T) {
 	}
 }
 
+func TestSendMailDefaultSender(t *testing.T) {
+	_, err := instance.Create(&instance.Options{
+		Domain: "sender.triggers",
+		Email:  "me@me",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		instance.Destroy("sender.triggers")
+		sendMail = doSendMail
+	}()
+
+	tests := []struct {
+		mode string
+		to   []*MailAddress
+		from string
+	}{
+		{"noreply", nil, `"Cozy" <noreply@sender.triggers>`},
+		{"from", []*MailAddress{&MailAddress{Email: "you@you"}}, `"sender.triggers" <me@me>`},
+	}
+	for _, test := range tests {
+		sendMail = func(ctx context.Context, opts *MailOptions) error {
+			assert.Nil(t, opts.Sender)
+			mail, err := buildMail(opts)
+			if assert.NoError(t, err) {
+				assert.Equal(t, []string{test.from}, mail.GetHeader("From"))
+				assert.Empty(t, mail.GetHeader("Sender"))
+			}
+			return errors.New("yes")
+		}
+		msg, _ := jobs.NewMessage("json", &MailOptions{
+			Mode:    test.mode,
+			To:      test.to,
+			Subject: "Up?",
+			Parts: []*MailPart{
+				&MailPart{
+					Type: "text/plain",
+					Body: "foo",
+				},
+			},
+		})
+		err = SendMail(jobs.NewWorkerContext("sender.triggers"), msg)
+		if assert.Error(t, err) {
+			assert.Equal(t, "yes", err.Error())
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	os.Exit(m.Run())
@@ -0,0 +1,143 @@
+package workers
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// PreviewWorkerType is the type of the jobs generating the previews of the
+// documents
+const PreviewWorkerType = "preview"
+
+func init() {
+	jobs.AddWorker(PreviewWorkerType, &jobs.WorkerConfig{
+		Concurrency:  2,
+		MaxExecCount: 2,
+		Timeout:      2 * time.Minute,
+		WorkerFunc:   GeneratePreview,
+	})
+}
+
+// PreviewOptions is the message of the preview jobs
+type PreviewOptions struct {
+	FileID string `json:"file_id"`
+}
+
+// GeneratePreview is the preview worker function: it renders the first page
+// of a document to an image, kept as the preview of the file.
+func GeneratePreview(ctx context.Context, m *jobs.Message) error {
+	opts := &PreviewOptions{}
+	if err := m.Unmarshal(opts); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	doc, err := vfs.GetFileDoc(i, opts.FileID)
+	if couchdb.IsNotFoundError(err) || os.IsNotExist(err) {
+		// the file has been deleted since the job was pushed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return RenderPreview(ctx, i, doc)
+}
+
+// RenderPreview renders the preview of the current content of the file with
+// the renderer of the configuration. Nothing is done if no renderer is
+// configured, if the type of the file is not supported, or if the preview
+// already exists. When the rendering fails, or when the document is too
+// large, the file is marked so that the rendering is not tried again for
+// this content.
+func RenderPreview(ctx context.Context, c vfs.Context, doc *vfs.FileDoc) error {
+	cfg := config.GetConfig().Previews
+	if cfg.Renderer == "" || !vfs.IsPreviewable(doc.Mime) || vfs.HasPreview(c, doc) {
+		return nil
+	}
+	if cfg.MaxSize > 0 && doc.Size > cfg.MaxSize {
+		return vfs.MarkPreviewFailed(c, doc)
+	}
+
+	// the renderer works in a temporary directory, removed after the
+	// rendering, with the copy of the document
+	dir, err := ioutil.TempDir("", "cozy-preview")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "document"+path.Ext(doc.Name))
+	if err = copyToLocalFile(c, doc, input); err != nil {
+		return err
+	}
+	output := filepath.Join(dir, "preview.png")
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultPreviewTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// #nosec
+	cmd := exec.CommandContext(ctx, cfg.Renderer, input, output)
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Warnf("[preview] %s: the rendering has failed: %s %s", doc.ID(), err, out)
+		return vfs.MarkPreviewFailed(c, doc)
+	}
+
+	image, err := os.Open(output)
+	if err != nil {
+		log.Warnf("[preview] %s: no image has been rendered: %s", doc.ID(), err)
+		return vfs.MarkPreviewFailed(c, doc)
+	}
+	defer image.Close()
+	infos, err := image.Stat()
+	if err != nil {
+		return err
+	}
+	if cfg.MaxSize > 0 && infos.Size() > cfg.MaxSize {
+		log.Warnf("[preview] %s: the rendered image is too large", doc.ID())
+		return vfs.MarkPreviewFailed(c, doc)
+	}
+	return vfs.StorePreview(c, doc, image)
+}
+
+func copyToLocalFile(c vfs.Context, doc *vfs.FileDoc, name string) error {
+	content, err := vfs.Open(c, doc)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package workers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+// smallPDF is a minimal PDF document with a single empty page
+const smallPDF = `%PDF-1.1
+1 0 obj << /Type /Catalog /Pages 2 0 R >> endobj
+2 0 obj << /Type /Pages /Kids [3 0 R] /Count 1 >> endobj
+3 0 obj << /Type /Page /Parent 2 0 R /MediaBox [0 0 200 200] >> endobj
+trailer << /Root 1 0 R >>
+%%EOF
+`
+
+type previewContext struct {
+	fs afero.Fs
+}
+
+func (c previewContext) Prefix() string { return "preview-test/" }
+func (c previewContext) FS() afero.Fs   { return c.fs }
+
+func createPreviewTestFile(t *testing.T, c vfs.Context, name, mime, content string) *vfs.FileDoc {
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)),
+		[]byte{0xca, 0xfe}, mime, "pdf", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	doc.SetID("preview-" + name)
+	err = afero.WriteFile(c.FS(), "/"+name, []byte(content), 0644)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return doc
+}
+
+// writeRenderer writes a shell script used as the renderer of the previews
+func writeRenderer(t *testing.T, dir, script string) string {
+	renderer := filepath.Join(dir, "renderer.sh")
+	err := ioutil.WriteFile(renderer, []byte("#!/bin/sh\n"+script), 0755)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return renderer
+}
+
+func TestRenderPreview(t *testing.T) {
+	config.UseTestFile()
+	cfg := config.GetConfig()
+	defer func() { cfg.Previews = config.Previews{} }()
+
+	dir, err := ioutil.TempDir("", "cozy-preview-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := previewContext{afero.NewMemMapFs()}
+	doc := createPreviewTestFile(t, c, "doc.pdf", "application/pdf", smallPDF)
+
+	// without a renderer, the preview is skipped
+	cfg.Previews = config.Previews{}
+	assert.NoError(t, RenderPreview(context.Background(), c, doc))
+	assert.False(t, vfs.HasPreview(c, doc))
+
+	// the renderer receives the document and writes the image
+	cfg.Previews = config.Previews{
+		Renderer: writeRenderer(t, dir, `head -c 4 "$1" > "$2"`),
+		Timeout:  10 * time.Second,
+		MaxSize:  1 << 20,
+	}
+	assert.NoError(t, RenderPreview(context.Background(), c, doc))
+	assert.True(t, vfs.HasPreview(c, doc))
+	content, err := afero.ReadFile(c.FS(), vfs.PreviewsDirName+"/preview-doc.pdf/cafe.png")
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF", string(content))
+
+	// the types without preview are skipped
+	txt := createPreviewTestFile(t, c, "doc.txt", "text/plain", "foo")
+	assert.NoError(t, RenderPreview(context.Background(), c, txt))
+	assert.False(t, vfs.HasPreview(c, txt))
+}
+
+func TestRenderPreviewFailure(t *testing.T) {
+	config.UseTestFile()
+	cfg := config.GetConfig()
+	defer func() { cfg.Previews = config.Previews{} }()
+
+	dir, err := ioutil.TempDir("", "cozy-preview-test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	c := previewContext{afero.NewMemMapFs()}
+	doc := createPreviewTestFile(t, c, "broken.pdf", "application/pdf", smallPDF)
+
+	// a failure is recorded, and the rendering is not tried again
+	marker := filepath.Join(dir, "called")
+	cfg.Previews = config.Previews{
+		Renderer: writeRenderer(t, dir, `echo >> "`+marker+`"; exit 1`),
+		Timeout:  10 * time.Second,
+	}
+	assert.NoError(t, RenderPreview(context.Background(), c, doc))
+	assert.True(t, vfs.HasPreview(c, doc))
+	assert.NoError(t, RenderPreview(context.Background(), c, doc))
+	calls, err := ioutil.ReadFile(marker)
+	assert.NoError(t, err)
+	assert.Equal(t, "\n", string(calls))
+	_, err = c.FS().Stat(vfs.PreviewsDirName + "/preview-broken.pdf/cafe.png")
+	assert.True(t, os.IsNotExist(err))
+
+	// a renderer that does not finish in time is stopped
+	slow := createPreviewTestFile(t, c, "slow.pdf", "application/pdf", smallPDF)
+	cfg.Previews = config.Previews{
+		Renderer: writeRenderer(t, dir, `exec sleep 10`),
+		Timeout:  100 * time.Millisecond,
+	}
+	start := time.Now()
+	assert.NoError(t, RenderPreview(context.Background(), c, slow))
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.True(t, vfs.HasPreview(c, slow))
+}
@@ -0,0 +1,70 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// RehashWorkerType is the type of the jobs computing the SHA-256 checksums of
+// the existing files
+const RehashWorkerType = "rehash"
+
+// rehashProgressEvery is the number of files between two logs of the
+// progress of the migration
+const rehashProgressEvery = 100
+
+func init() {
+	jobs.AddWorker(RehashWorkerType, &jobs.WorkerConfig{
+		Concurrency:  1,
+		MaxExecCount: 1,
+		Timeout:      24 * time.Hour,
+		WorkerFunc:   Rehash,
+	})
+}
+
+// RehashOptions is the message of the rehash jobs
+type RehashOptions struct {
+	// SkipTrashed keeps the files in the trash without their SHA-256
+	SkipTrashed bool `json:"skip_trashed"`
+	// PauseMs is the pause, in milliseconds, between two files
+	PauseMs int `json:"pause_ms"`
+}
+
+// Rehash is the worker function of the migration of the files to SHA-256. It
+// can be pushed again after an interruption: the files already migrated are
+// skipped.
+func Rehash(ctx context.Context, m *jobs.Message) error {
+	opts := &RehashOptions{}
+	if err := m.Unmarshal(opts); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+
+	report, err := vfs.RehashToSHA256(ctx, i, &vfs.RehashOptions{
+		SkipTrashed: opts.SkipTrashed,
+		Pause:       time.Duration(opts.PauseMs) * time.Millisecond,
+		Progress: func(r *vfs.RehashReport) {
+			if n := r.Rehashed + r.Skipped + r.Failed; n%rehashProgressEvery == 0 {
+				log.Infof("[rehash] %s: %d files rehashed, %d skipped, %d failed",
+					domain, r.Rehashed, r.Skipped, r.Failed)
+			}
+		},
+	})
+	if err != nil {
+		log.Warnf("[rehash] %s: interrupted after %d files: %s",
+			domain, report.Rehashed, err)
+		return err
+	}
+	log.Infof("[rehash] %s: done, %d files rehashed, %d skipped, %d failed",
+		domain, report.Rehashed, report.Skipped, report.Failed)
+	return nil
+}
@@ -0,0 +1,53 @@
+package workers
+
+import (
+	"context"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/webhooks"
+)
+
+func init() {
+	jobs.AddWorker(webhooks.WorkerType, &jobs.WorkerConfig{
+		Concurrency:  4,
+		MaxExecCount: 5,
+		MaxExecTime:  5 * time.Minute,
+		Timeout:      30 * time.Second,
+		RetryDelay:   2 * time.Second,
+		WorkerFunc:   SendWebhook,
+	})
+}
+
+// SendWebhook is the webhook worker function: it sends the payload of the
+// event to the URL of the webhook. When the request fails, the error is
+// recorded in the webhook document and the job is retried later.
+func SendWebhook(ctx context.Context, m *jobs.Message) error {
+	event := &webhooks.Event{}
+	if err := m.Unmarshal(event); err != nil {
+		return err
+	}
+	domain := ctx.Value(jobs.ContextDomainKey).(string)
+	i, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	w, err := webhooks.Get(i, event.WebhookID)
+	if couchdb.IsNotFoundError(err) {
+		// the webhook has been deleted since the change
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = w.Send(ctx, event.Payload); err != nil {
+		if errr := w.RecordFailure(i, err); errr != nil {
+			log.Errorf("[webhooks] %s: Could not record the failure: %s", w.WID, errr)
+		}
+		return err
+	}
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"sync"
 	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
 )
 
 // WorkersList is a map associating a worker type with its acutal
@@ -40,11 +42,32 @@ func init() {
 	}
 }
 
-// GetWorkersList returns a globally defined worker config list.
+// GetWorkersList returns a globally defined worker config list. The limits
+// given in the configuration file override the ones of the workers.
 func GetWorkersList() WorkersList {
 	workersMutex.Lock()
 	defer workersMutex.Unlock()
-	return workersList
+	cfg := config.GetConfig()
+	if cfg == nil || len(cfg.Jobs.Workers) == 0 {
+		return workersList
+	}
+	ws := make(WorkersList, len(workersList))
+	for workerType, conf := range workersList {
+		limits, ok := cfg.Jobs.Workers[workerType]
+		if !ok {
+			ws[workerType] = conf
+			continue
+		}
+		c := conf.clone()
+		if limits.Concurrency > 0 {
+			c.Concurrency = limits.Concurrency
+		}
+		if limits.RateLimit > 0 {
+			c.RateLimit = limits.RateLimit
+		}
+		ws[workerType] = c
+	}
+	return ws
 }
 
 // AddWorker adds a new worker to global list of available workers.
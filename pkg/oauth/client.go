@@ -182,7 +182,7 @@ func (c *Client) Create(i *instance.Instance) *ClientRegistrationError {
 	}
 
 	var err error
-	c.RegistrationToken, err = crypto.NewJWT(i.OAuthSecret, jwt.StandardClaims{
+	c.RegistrationToken, err = crypto.NewJWT(i.RegistrationTokenSecret(), jwt.StandardClaims{
 		Audience: permissions.RegistrationTokenAudience,
 		Issuer:   i.Domain,
 		IssuedAt: time.Now().Unix(),
@@ -292,10 +292,24 @@ func (c *Client) ValidToken(i *instance.Instance, audience, token string) (permi
 	if token == "" {
 		return claims, false
 	}
-	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		return i.OAuthSecret, nil
+	// the tokens signed with a previous OAuth secret are accepted until it
+	// expires, but the registration tokens have their own secret that is not
+	// rotated
+	secrets := i.OAuthSecrets()
+	if audience == permissions.RegistrationTokenAudience {
+		secrets = [][]byte{i.RegistrationTokenSecret()}
 	}
-	if err := crypto.ParseJWT(token, keyFunc, &claims); err != nil {
+	var err error
+	for _, secret := range secrets {
+		keyFunc := func(token *jwt.Token) (interface{}, error) {
+			return secret, nil
+		}
+		claims = permissions.Claims{}
+		if err = crypto.ParseJWT(token, keyFunc, &claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
 		log.Errorf("[oauth] Failed to verify the %s token: %s", audience, err)
 		return claims, false
 	}
@@ -78,3 +78,28 @@ func TestParseJWTInvalidSubject(t *testing.T) {
 	_, ok := c.ValidToken(in, permissions.RefreshTokenAudience, tokenString)
 	assert.False(t, ok, "The token should be invalid")
 }
+
+func TestRegistrationTokenAfterRotation(t *testing.T) {
+	rotated := &instance.Instance{
+		OAuthSecret: in.OAuthSecret,
+		Domain:      in.Domain,
+	}
+	tokenString, err := crypto.NewJWT(rotated.RegistrationTokenSecret(), jwt.StandardClaims{
+		Audience: permissions.RegistrationTokenAudience,
+		Issuer:   rotated.Domain,
+		IssuedAt: crypto.Timestamp(),
+		Subject:  c.CouchID,
+	})
+	assert.NoError(t, err)
+	refresh, err := c.CreateJWT(rotated, permissions.RefreshTokenAudience, "foo:read")
+	assert.NoError(t, err)
+
+	// what RotateOAuthSecret does, without the previous secrets
+	rotated.RegistrationSecret = rotated.OAuthSecret
+	rotated.OAuthSecret = crypto.GenerateRandomBytes(64)
+
+	_, ok := c.ValidToken(rotated, permissions.RegistrationTokenAudience, tokenString)
+	assert.True(t, ok, "The registration token must still be valid")
+	_, ok = c.ValidToken(rotated, permissions.RefreshTokenAudience, refresh)
+	assert.False(t, ok, "The refresh token should be invalid")
+}
@@ -15,6 +15,9 @@ const (
 
 	// RefreshTokenAudience is the audience field of JWT for refresh tokens
 	RefreshTokenAudience = "refresh"
+
+	// ShareAudience is the audience field of JWT for share links
+	ShareAudience = "share"
 )
 
 // Claims is used for JWT used in OAuth2 flow and applications token
@@ -15,4 +15,23 @@ var (
 	// ErrInvalidAudience is used when the audience is not expected
 	ErrInvalidAudience = echo.NewHTTPError(http.StatusBadRequest,
 		"Invalid audience for JWT token")
+
+	// ErrExpiredToken is used when a share link token has expired
+	ErrExpiredToken = echo.NewHTTPError(http.StatusGone,
+		"Expired JWT token")
+
+	// ErrNoPermissionDoc is used when an application has no permission
+	// document, as it is not installed (or no more)
+	ErrNoPermissionDoc = echo.NewHTTPError(http.StatusNotFound,
+		"No permission document for this application")
+
+	// ErrRuleNotFound is used when a rule is not in the permissions of an
+	// application
+	ErrRuleNotFound = echo.NewHTTPError(http.StatusNotFound,
+		"No rule with this title in the permissions")
+
+	// ErrNotNarrower is used when a rule is changed to give more permissions
+	// than it had
+	ErrNotNarrower = echo.NewHTTPError(http.StatusUnprocessableEntity,
+		"A rule can only be narrowed")
 )
@@ -18,6 +18,19 @@ type Permission struct {
 	Permissions   Set               `json:"permissions,omitempty"`
 	ExpiresAt     int               `json:"expires_at,omitempty"`
 	Codes         map[string]string `json:"codes,omitempty"`
+
+	// Restrictions are the changes made by the user on the rules of an
+	// application, by title. They are kept to be applied again on the rules
+	// of the new versions of the application.
+	Restrictions map[string]*Restriction `json:"restrictions,omitempty"`
+}
+
+// Restriction is a change made by the user on a rule of an application: the
+// rule is revoked, or its verbs and/or its values are narrowed.
+type Restriction struct {
+	Revoked bool     `json:"revoked,omitempty"`
+	Verbs   VerbSet  `json:"verbs,omitempty"`
+	Values  []string `json:"values,omitempty"`
 }
 
 // Index is the necessary index for this package
@@ -60,7 +73,7 @@ func GetForApp(db couchdb.Database, slug string) (*Permission, error) {
 		return nil, err
 	}
 	if len(res) == 0 {
-		return nil, fmt.Errorf("no permission doc for %v", slug)
+		return nil, ErrNoPermissionDoc
 	}
 	return &res[0], nil
 }
@@ -85,6 +98,24 @@ func Create(db couchdb.Database, slug string, set Set) (*Permission, error) {
 	return doc, nil
 }
 
+// UpdateForApp replaces the rules of an application by the given ones, from
+// the manifest of a new version of the application. The restrictions made by
+// the user on the previous rules are applied on the new ones.
+func UpdateForApp(db couchdb.Database, slug string, set Set) (*Permission, error) {
+	doc, err := GetForApp(db, slug)
+	if err == ErrNoPermissionDoc || couchdb.IsNotFoundError(err) {
+		return Create(db, slug, set)
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc.Permissions = doc.restrict(set)
+	if err = couchdb.UpdateDoc(db, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
 // Destroy removes Permission doc for a given app
 func Destroy(db couchdb.Database, slug string) error {
 	existing, err := GetForApp(db, slug)
@@ -93,3 +124,158 @@ func Destroy(db couchdb.Database, slug string) error {
 	}
 	return couchdb.DeleteDoc(db, existing)
 }
+
+// RevokeRule removes the rule with the given title from the permissions of an
+// application. The tokens of the application lose this access immediately, as
+// their permissions are read from the permission document.
+func RevokeRule(db couchdb.Database, slug, title string) (*Permission, error) {
+	doc, err := GetForApp(db, slug)
+	if err != nil {
+		return nil, err
+	}
+	i := doc.Permissions.indexOf(title)
+	if i < 0 {
+		return nil, ErrRuleNotFound
+	}
+	rules := make(Set, 0, len(doc.Permissions)-1)
+	rules = append(rules, doc.Permissions[:i]...)
+	doc.Permissions = append(rules, doc.Permissions[i+1:]...)
+	doc.restriction(title).Revoked = true
+	if err = couchdb.UpdateDoc(db, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// NarrowRule restricts the verbs and the values of the rule with the given
+// title in the permissions of an application. A nil verbs or values keeps
+// the current ones. The rule can't give more permissions than before.
+func NarrowRule(db couchdb.Database, slug, title string, verbs VerbSet, values []string) (*Permission, error) {
+	doc, err := GetForApp(db, slug)
+	if err != nil {
+		return nil, err
+	}
+	i := doc.Permissions.indexOf(title)
+	if i < 0 {
+		return nil, ErrRuleNotFound
+	}
+	rule := &doc.Permissions[i]
+	if verbs != nil {
+		if len(verbs) == 0 || !isSubsetOfVerbs(verbs, rule.Verbs) {
+			return nil, ErrNotNarrower
+		}
+		rule.Verbs = verbs
+		doc.restriction(title).Verbs = verbs
+	}
+	if values != nil {
+		if len(values) == 0 || !isSubsetOfValues(values, rule.Values) {
+			return nil, ErrNotNarrower
+		}
+		rule.Values = values
+		doc.restriction(title).Values = values
+	}
+	if err = couchdb.UpdateDoc(db, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// restriction returns the restriction of the rule with the given title,
+// creating it if the rule has none.
+func (p *Permission) restriction(title string) *Restriction {
+	if p.Restrictions == nil {
+		p.Restrictions = make(map[string]*Restriction)
+	}
+	r, ok := p.Restrictions[title]
+	if !ok {
+		r = &Restriction{}
+		p.Restrictions[title] = r
+	}
+	return r
+}
+
+// restrict returns the rules of the set with the restrictions of the
+// permission applied: the revoked rules are removed, and the other rules
+// keep only the verbs and values left by the user. A rule with no verb or no
+// value left is removed.
+func (p *Permission) restrict(set Set) Set {
+	rules := make(Set, 0, len(set))
+	for _, rule := range set {
+		r, ok := p.Restrictions[rule.Title]
+		if !ok {
+			rules = append(rules, rule)
+			continue
+		}
+		if r.Revoked {
+			continue
+		}
+		if r.Verbs != nil {
+			rule.Verbs = intersectVerbs(rule.Verbs, r.Verbs)
+			if len(rule.Verbs) == 0 {
+				continue
+			}
+		}
+		if r.Values != nil {
+			rule.Values = intersectValues(rule.Values, r.Values)
+			if len(rule.Values) == 0 {
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// intersectVerbs returns the verbs of b that are also in a
+func intersectVerbs(a, b VerbSet) VerbSet {
+	out := make(VerbSet)
+	for v := range b {
+		if a.Contains(v) {
+			out[v] = struct{}{}
+		}
+	}
+	return out
+}
+
+// intersectValues returns the values of b that are also in a, no values in a
+// meaning the whole doctype.
+func intersectValues(a, b []string) []string {
+	out := make([]string, 0, len(b))
+	for _, v := range b {
+		if isSubsetOfValues([]string{v}, a) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// isSubsetOfVerbs returns true if all the verbs of a are in b
+func isSubsetOfVerbs(a, b VerbSet) bool {
+	for v := range a {
+		if !b.Contains(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// isSubsetOfValues returns true if all the values of a are in b, no values
+// meaning the whole doctype.
+func isSubsetOfValues(a, b []string) bool {
+	if len(b) == 0 {
+		return true
+	}
+	for _, v := range a {
+		found := false
+		for _, w := range b {
+			if v == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -21,6 +21,20 @@ func TestVerbToString(t *testing.T) {
 
 }
 
+func TestVerbsFromJSON(t *testing.T) {
+	var vs VerbSet
+	err := json.Unmarshal([]byte(`["GET","DELETE"]`), &vs)
+	assert.NoError(t, err)
+	assert.Equal(t, Verbs(GET, DELETE), vs)
+
+	b, err := json.Marshal(Verbs(POST, PUT))
+	assert.NoError(t, err)
+	var vs2 VerbSet
+	err = json.Unmarshal(b, &vs2)
+	assert.NoError(t, err)
+	assert.Equal(t, "POST,PUT", vs2.String())
+}
+
 func TestRuleToJSON(t *testing.T) {
 	r := Rule{
 		Type:  "io.cozy.contacts",
@@ -231,6 +245,86 @@ func TestAllowCustomType(t *testing.T) {
 	assert.False(t, s.Allow(GET, n))
 }
 
+func TestAllowView(t *testing.T) {
+	s := Set{Rule{
+		Type:     "io.cozy.photos",
+		Verbs:    Verbs(GET),
+		Selector: ViewSelector,
+		Values:   []string{"albums/photos"},
+	}}
+	assert.True(t, s.AllowView(GET, "io.cozy.photos", "albums/photos"))
+	assert.False(t, s.AllowView(GET, "io.cozy.photos", "albums/other"))
+	assert.False(t, s.AllowView(POST, "io.cozy.photos", "albums/photos"))
+	assert.False(t, s.AllowView(GET, "io.cozy.files", "albums/photos"))
+
+	// the view gives no access to the documents
+	assert.False(t, s.AllowWholeType(GET, "io.cozy.photos"))
+	assert.False(t, s.AllowID(GET, "io.cozy.photos", "albums/photos"))
+	assert.False(t, s.Allow(GET, &validableFile{"albums/photos"}))
+	_, ok := s.ScopeSelector(GET, "io.cozy.photos")
+	assert.False(t, ok)
+
+	s2 := Set{Rule{Type: "io.cozy.photos", Verbs: Verbs(GET)}}
+	assert.True(t, s2.AllowView(GET, "io.cozy.photos", "albums/photos"))
+
+	r, err := UnmarshalRuleString("io.cozy.photos:GET:albums/photos:_view")
+	assert.NoError(t, err)
+	assert.True(t, r.IsViewRule())
+	assert.Equal(t, []string{"albums/photos"}, r.Values)
+}
+
+func TestViewKeys(t *testing.T) {
+	s := Set{Rule{
+		Type:     "io.cozy.photos",
+		Verbs:    Verbs(GET),
+		Selector: ViewSelector,
+		Values:   []string{"albums/photos/holidays", "albums/photos/family", "albums/other"},
+	}}
+	keys, ok := s.ViewKeys(GET, "io.cozy.photos", "albums/photos")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"holidays", "family"}, keys)
+	assert.True(t, s.AllowView(GET, "io.cozy.photos", "albums/photos"))
+
+	keys, ok = s.ViewKeys(GET, "io.cozy.photos", "albums/other")
+	assert.True(t, ok)
+	assert.Nil(t, keys)
+
+	_, ok = s.ViewKeys(GET, "io.cozy.photos", "albums/photo")
+	assert.False(t, ok)
+	_, ok = s.ViewKeys(POST, "io.cozy.photos", "albums/photos")
+	assert.False(t, ok)
+
+	s2 := Set{Rule{Type: "io.cozy.photos", Verbs: Verbs(GET)}}
+	keys, ok = s2.ViewKeys(GET, "io.cozy.photos", "albums/photos")
+	assert.True(t, ok)
+	assert.Nil(t, keys)
+}
+
+func TestScopeSelector(t *testing.T) {
+	s := Set{Rule{Type: "io.cozy.contacts", Verbs: Verbs(GET)}}
+	sel, ok := s.ScopeSelector(GET, "io.cozy.contacts")
+	assert.True(t, ok)
+	assert.Nil(t, sel)
+
+	_, ok = s.ScopeSelector(GET, "io.cozy.events")
+	assert.False(t, ok)
+	_, ok = s.ScopeSelector(POST, "io.cozy.contacts")
+	assert.False(t, ok)
+
+	s2 := Set{
+		Rule{Type: "io.cozy.contacts", Values: []string{"id1", "id2"}},
+		Rule{Type: "io.cozy.contacts", Selector: "foo", Values: []string{"bar"}},
+	}
+	sel, ok = s2.ScopeSelector(GET, "io.cozy.contacts")
+	assert.True(t, ok)
+	b, err := json.Marshal(sel)
+	assert.NoError(t, err)
+	assertEqualJSON(t, b, `{"$or": [
+		{"_id": {"$in": ["id1", "id2"]}},
+		{"foo": {"$in": ["bar"]}}
+	]}`)
+}
+
 func assertEqualJSON(t *testing.T, value []byte, expected string) {
 	expectedBytes := new(bytes.Buffer)
 	err := json.Compact(expectedBytes, []byte(expected))
@@ -257,3 +351,30 @@ func (t *validableFile) DocType() string { return "io.cozy.files" }
 func (t *validableFile) Valid(f, e string) bool {
 	return f == "path" && strings.HasPrefix(t.path, e)
 }
+
+func TestRestrictRules(t *testing.T) {
+	p := &Permission{Restrictions: map[string]*Restriction{
+		"contacts": {Revoked: true},
+		"settings": {Values: []string{"io.cozy.settings.instance"}},
+		"files":    {Verbs: Verbs(GET, DELETE)},
+		"events":   {Verbs: Verbs(DELETE)},
+	}}
+	set := Set{
+		Rule{Title: "contacts", Type: "io.cozy.contacts"},
+		Rule{Title: "settings", Type: "io.cozy.settings", Verbs: Verbs(GET)},
+		Rule{Title: "files", Type: "io.cozy.files", Verbs: Verbs(GET, POST)},
+		Rule{Title: "events", Type: "io.cozy.events", Verbs: Verbs(GET)},
+		Rule{Title: "photos", Type: "io.cozy.photos"},
+	}
+	rules := p.restrict(set)
+	if !assert.Len(t, rules, 3) {
+		return
+	}
+	assert.Equal(t, "settings", rules[0].Title)
+	assert.Equal(t, "GET", rules[0].Verbs.String())
+	assert.Equal(t, []string{"io.cozy.settings.instance"}, rules[0].Values)
+	assert.Equal(t, "files", rules[1].Title)
+	assert.Equal(t, "GET", rules[1].Verbs.String())
+	assert.Equal(t, "photos", rules[2].Title)
+	assert.Equal(t, "ALL", rules[2].Verbs.String())
+}
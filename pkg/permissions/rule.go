@@ -30,6 +30,19 @@ type Rule struct {
 	Values   []string `json:"values,omitempty"`
 }
 
+// ViewSelector is the selector of the rules that give access to some views
+// of the design docs of the doctype, and not to its documents. The values
+// are the views, as "ddoc/view", like in io.cozy.photos:GET:albums/photos:_view
+// or only the rows of a view with a key, as "ddoc/view/key", like in
+// io.cozy.photos:GET:albums/photos/holidays:_view
+const ViewSelector = "_view"
+
+// IsViewRule returns true if the rule gives access to some views, and not
+// to the documents.
+func (r Rule) IsViewRule() bool {
+	return r.Selector == ViewSelector
+}
+
 // MarshalScopeString transform a Rule into a string of the shape
 // io.cozy.files:GET:io.cozy.files.music-dir
 func (r Rule) MarshalScopeString() (string, error) {
@@ -100,3 +100,14 @@ func (ps Set) Some(predicate func(Rule) bool) bool {
 	}
 	return false
 }
+
+// indexOf returns the position of the rule with the given title in the set,
+// or -1 if there is none.
+func (ps Set) indexOf(title string) int {
+	for i, r := range ps {
+		if r.Title == title {
+			return i
+		}
+	}
+	return -1
+}
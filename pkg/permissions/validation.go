@@ -1,5 +1,11 @@
 package permissions
 
+import (
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
 // Validable is an interface for a object than can be validated by a Set
 type Validable interface {
 	ID() string
@@ -13,6 +19,11 @@ func validValues(r Rule, o Validable) bool {
 		return true
 	}
 
+	// the views give no access to the documents themselves
+	if r.IsViewRule() {
+		return false
+	}
+
 	if r.Selector == "" {
 		return r.ValuesContain(o.ID())
 	}
@@ -49,9 +60,78 @@ func (s Set) AllowID(v Verb, doctype, id string) bool {
 	})
 }
 
+// AllowView returns true if the set allows to apply verb to the view of a
+// design doc of the given doctype, given as "ddoc/view". It is the case for
+// the rules on the whole doctype, or on this view, even restricted to some
+// keys.
+func (s Set) AllowView(v Verb, doctype, view string) bool {
+	_, ok := s.ViewKeys(v, doctype, view)
+	return ok
+}
+
+// ViewKeys returns the keys of the rows of the view of a design doc of the
+// given doctype, given as "ddoc/view", on which the set allows to apply the
+// verb. The keys are nil if the set allows the whole view, and ok is false if
+// it allows no row of this view at all.
+func (s Set) ViewKeys(v Verb, doctype, view string) (keys []string, ok bool) {
+	prefix := view + "/"
+	for _, r := range s {
+		if !validVerbAndType(r, v, doctype) {
+			continue
+		}
+		if validWholeType(r) {
+			return nil, true
+		}
+		if !r.IsViewRule() {
+			continue
+		}
+		for _, value := range r.Values {
+			if value == view {
+				return nil, true
+			}
+			if strings.HasPrefix(value, prefix) {
+				keys = append(keys, strings.TrimPrefix(value, prefix))
+			}
+		}
+	}
+	return keys, len(keys) > 0
+}
+
 // Allow returns true if the set allows to apply verb to given doc
 func (s Set) Allow(v Verb, o Validable) bool {
 	return s.Some(func(r Rule) bool {
 		return validVerbAndType(r, v, o.DocType()) && validValues(r, o)
 	})
 }
+
+// ScopeSelector returns a mango selector for the documents of the given
+// doctype on which the set allows to apply the verb. The selector is nil if
+// the set allows the whole doctype, and ok is false if the set allows no
+// document of this doctype at all.
+func (s Set) ScopeSelector(v Verb, doctype string) (selector mango.Filter, ok bool) {
+	var filters []mango.Filter
+	for _, r := range s {
+		if !validVerbAndType(r, v, doctype) {
+			continue
+		}
+		if validWholeType(r) {
+			return nil, true
+		}
+		if r.IsViewRule() {
+			continue
+		}
+		field := r.Selector
+		if field == "" {
+			field = "_id"
+		}
+		filters = append(filters, mango.Map{field: mango.Map{"$in": r.Values}})
+	}
+	switch len(filters) {
+	case 0:
+		return nil, false
+	case 1:
+		return filters[0], true
+	default:
+		return mango.Or(filters...), true
+	}
+}
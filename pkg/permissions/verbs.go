@@ -76,8 +76,14 @@ func (vs *VerbSet) UnmarshalJSON(b []byte) error {
 	for v := range ALL {
 		delete(*vs, v)
 	}
-	for v := range *vs {
-		(*vs)[v] = struct{}{}
+	for _, v := range s {
+		if v == allVerbs {
+			for verb := range ALL {
+				(*vs)[verb] = struct{}{}
+			}
+			continue
+		}
+		(*vs)[Verb(v)] = struct{}{}
 	}
 	return nil
 }
@@ -0,0 +1,91 @@
+// Package realtime is the hub where the events of the stack are published,
+// for the clients that want to follow them as they occur. The events are
+// dispatched in memory, by database and doctype.
+package realtime
+
+import (
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// bufferSize is the number of events that can wait in a subscription before
+// the next ones are dropped
+const bufferSize = 64
+
+// Event is an event published on the hub
+type Event struct {
+	Doctype string      `json:"doctype"`
+	Doc     interface{} `json:"doc"`
+}
+
+// Subscription is used to receive the events of a doctype for a database.
+// It must be closed when the events are no longer read.
+type Subscription struct {
+	C <-chan *Event
+
+	c   chan *Event
+	key string
+}
+
+type hub struct {
+	mu   sync.RWMutex
+	subs map[string]map[*Subscription]struct{}
+}
+
+var globalHub = &hub{subs: make(map[string]map[*Subscription]struct{})}
+
+func subscriptionKey(db couchdb.Database, doctype string) string {
+	return db.Prefix() + doctype
+}
+
+// Subscribe returns a subscription to the events of the given doctype for
+// the given database.
+func Subscribe(db couchdb.Database, doctype string) *Subscription {
+	c := make(chan *Event, bufferSize)
+	sub := &Subscription{C: c, c: c, key: subscriptionKey(db, doctype)}
+
+	globalHub.mu.Lock()
+	defer globalHub.mu.Unlock()
+	subs, ok := globalHub.subs[sub.key]
+	if !ok {
+		subs = make(map[*Subscription]struct{})
+		globalHub.subs[sub.key] = subs
+	}
+	subs[sub] = struct{}{}
+	return sub
+}
+
+// Close stops the subscription and closes its channel.
+func (s *Subscription) Close() {
+	globalHub.mu.Lock()
+	defer globalHub.mu.Unlock()
+	subs, ok := globalHub.subs[s.key]
+	if !ok {
+		return
+	}
+	if _, ok = subs[s]; !ok {
+		return
+	}
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(globalHub.subs, s.key)
+	}
+	close(s.c)
+}
+
+// Publish sends an event to the subscribers of its doctype for the given
+// database. It never blocks: a subscriber that does not read its events
+// fast enough misses the next ones.
+func Publish(db couchdb.Database, doctype string, doc interface{}) {
+	e := &Event{Doctype: doctype, Doc: doc}
+
+	globalHub.mu.RLock()
+	defer globalHub.mu.RUnlock()
+	for sub := range globalHub.subs[subscriptionKey(db, doctype)] {
+		select {
+		case sub.c <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package realtime
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("realtime-test")
+	other := couchdb.SimpleDatabasePrefix("realtime-other")
+
+	sub := Subscribe(db, "io.cozy.foos")
+	Publish(db, "io.cozy.bars", "bar")
+	Publish(other, "io.cozy.foos", "other")
+	Publish(db, "io.cozy.foos", "foo")
+
+	e := <-sub.C
+	assert.Equal(t, "io.cozy.foos", e.Doctype)
+	assert.Equal(t, "foo", e.Doc)
+	assert.Len(t, sub.C, 0)
+
+	sub.Close()
+	sub.Close()
+	_, ok := <-sub.C
+	assert.False(t, ok)
+	Publish(db, "io.cozy.foos", "closed")
+}
+
+func TestPublishDoesNotBlock(t *testing.T) {
+	db := couchdb.SimpleDatabasePrefix("realtime-test")
+	sub := Subscribe(db, "io.cozy.foos")
+	defer sub.Close()
+
+	for i := 0; i < bufferSize+10; i++ {
+		Publish(db, "io.cozy.foos", i)
+	}
+	assert.Len(t, sub.C, bufferSize)
+}
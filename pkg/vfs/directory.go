@@ -30,6 +30,7 @@ type DirDoc struct {
 	DirID       string `json:"dir_id"`
 	RestorePath string `json:"restore_path,omitempty"`
 
+	// The dates are saved in UTC, for couchdb to compare them as strings
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Tags      []string  `json:"tags"`
@@ -37,9 +38,10 @@ type DirDoc struct {
 	// Directory path on VFS
 	Fullpath string `json:"path"`
 
-	parent *DirDoc
-	files  []*FileDoc
-	dirs   []*DirDoc
+	parent   *DirDoc
+	files    []*FileDoc
+	dirs     []*DirDoc
+	contents []jsonapi.Object
 }
 
 // ID returns the directory qualified identifier
@@ -91,21 +93,10 @@ func (d *DirDoc) Links() *jsonapi.LinksList {
 
 // Relationships is used to generate the content relationship in JSON-API format
 // (part of the jsonapi.Object interface)
-//
-// TODO: pagination
 func (d *DirDoc) Relationships() jsonapi.RelationshipMap {
-	l := len(d.files) + len(d.dirs)
-	i := 0
-
-	data := make([]jsonapi.ResourceIdentifier, l)
-	for _, child := range d.dirs {
-		data[i] = jsonapi.ResourceIdentifier{ID: child.ID(), Type: child.DocType()}
-		i++
-	}
-
-	for _, child := range d.files {
-		data[i] = jsonapi.ResourceIdentifier{ID: child.ID(), Type: child.DocType()}
-		i++
+	data := make([]jsonapi.ResourceIdentifier, len(d.contents))
+	for i, child := range d.contents {
+		data[i] = jsonapi.ResourceIdentifier{ID: child.ID(), Type: consts.Files}
 	}
 
 	contents := jsonapi.Relationship{Data: data}
@@ -131,24 +122,27 @@ func (d *DirDoc) Relationships() jsonapi.RelationshipMap {
 
 // Included is part of the jsonapi.Object interface
 func (d *DirDoc) Included() []jsonapi.Object {
-	var included []jsonapi.Object
-	for _, child := range d.dirs {
-		included = append(included, child)
-	}
-	for _, child := range d.files {
-		included = append(included, child)
-	}
-	return included
+	return d.contents
 }
 
-// FetchFiles is used to fetch direct children of the directory.
-//
-// @TODO: add pagination control
+// FetchFiles is used to fetch all the direct children of the directory. The
+// listings should use FetchFilesPage instead.
 func (d *DirDoc) FetchFiles(c Context) (err error) {
 	d.files, d.dirs, err = fetchChildren(c, d)
+	d.setContents()
 	return err
 }
 
+func (d *DirDoc) setContents() {
+	d.contents = make([]jsonapi.Object, 0, len(d.dirs)+len(d.files))
+	for _, child := range d.dirs {
+		d.contents = append(d.contents, child)
+	}
+	for _, child := range d.files {
+		d.contents = append(d.contents, child)
+	}
+}
+
 // NewDirDoc is the DirDoc constructor. The given name is validated.
 func NewDirDoc(name, dirID string, tags []string, parent *DirDoc) (*DirDoc, error) {
 	if err := checkFileName(name); err != nil {
@@ -158,10 +152,13 @@ func NewDirDoc(name, dirID string, tags []string, parent *DirDoc) (*DirDoc, erro
 	if dirID == "" {
 		dirID = consts.RootDirID
 	}
+	if err := checkReservedName(name, dirID); err != nil {
+		return nil, err
+	}
 
 	tags = uniqueTags(tags)
 
-	createDate := time.Now()
+	createDate := time.Now().UTC()
 	doc := &DirDoc{
 		Type:  consts.DirType,
 		Name:  name,
@@ -264,17 +261,19 @@ func CreateRootDirDoc(c Context) error {
 	})
 }
 
-// CreateTrashDir creates the trash directory for this context
+// CreateTrashDir creates the trash directory for this context, with its
+// custom name if it has one
 func CreateTrashDir(c Context) error {
-	err := c.FS().Mkdir(TrashDirName, 0755)
+	trashPath := TrashPath(c)
+	err := c.FS().Mkdir(trashPath, 0755)
 	if err != nil && !os.IsExist(err) {
 		return err
 	}
 	err = couchdb.CreateNamedDocWithDB(c, &DirDoc{
-		Name:     path.Base(TrashDirName),
+		Name:     path.Base(trashPath),
 		Type:     consts.DirType,
 		DocID:    consts.TrashDirID,
-		Fullpath: TrashDirName,
+		Fullpath: trashPath,
 		DirID:    consts.RootDirID,
 	})
 	if err != nil && !couchdb.IsConflictError(err) {
@@ -284,11 +283,11 @@ func CreateTrashDir(c Context) error {
 }
 
 // ModifyDirMetadata modify the metadata associated to a directory. It
-// can be used to rename or move the directory in the VFS.
+// can be used to rename or move the directory in the VFS. It returns
+// ErrConflict if the directory has been modified since olddoc was fetched.
 func ModifyDirMetadata(c Context, olddoc *DirDoc, patch *DocPatch) (*DirDoc, error) {
-	id := olddoc.ID()
-	if id == consts.RootDirID || id == consts.TrashDirID {
-		return nil, os.ErrInvalid
+	if isSpecialDir(olddoc) {
+		return nil, ErrForbiddenVFSOperation
 	}
 
 	var err error
@@ -324,11 +323,12 @@ func ModifyDirMetadata(c Context, olddoc *DirDoc, patch *DocPatch) (*DirDoc, err
 
 	newdoc.SetID(olddoc.ID())
 	newdoc.SetRev(olddoc.Rev())
-	newdoc.CreatedAt = cdate
+	newdoc.CreatedAt = cdate.UTC()
 	newdoc.UpdatedAt = *patch.UpdatedAt
 	newdoc.parent = parent
 	newdoc.files = olddoc.files
 	newdoc.dirs = olddoc.dirs
+	newdoc.contents = olddoc.contents
 
 	oldpath, err := olddoc.Path(c)
 	if err != nil {
@@ -350,7 +350,15 @@ func ModifyDirMetadata(c Context, olddoc *DirDoc, patch *DocPatch) (*DirDoc, err
 		}
 	}
 
-	err = couchdb.UpdateDoc(c, newdoc)
+	// the document may have been modified concurrently since olddoc was
+	// fetched: in this case, the renaming is reverted.
+	if err = couchdb.UpdateDoc(c, newdoc); couchdb.IsConflictError(err) {
+		if oldpath != newpath {
+			c.FS().Rename(newpath, oldpath)
+			bulkUpdateDocsPath(c, newpath, oldpath)
+		}
+		return nil, ErrConflict
+	}
 	return newdoc, err
 }
 
@@ -388,16 +396,24 @@ func bulkUpdateDocsPath(c Context, oldpath, newpath string) error {
 
 // TrashDir is used to delete a directory given its document
 func TrashDir(c Context, olddoc *DirDoc) (*DirDoc, error) {
+	if isSpecialDir(olddoc) {
+		return nil, ErrForbiddenVFSOperation
+	}
 	oldpath, err := olddoc.Path(c)
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(oldpath, TrashDirName) {
+	if IsInTrash(c, oldpath) {
 		return nil, ErrFileInTrash
 	}
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	// the modification date is the date of trashing, to sort the trash
+	trashedAt := time.Now()
+	if trashedAt.Before(olddoc.UpdatedAt) {
+		trashedAt = olddoc.UpdatedAt
+	}
 
 	var newdoc *DirDoc
 	tryOrUseSuffix(olddoc.Name, conflictFormat, func(name string) error {
@@ -405,6 +421,7 @@ func TrashDir(c Context, olddoc *DirDoc) (*DirDoc, error) {
 			DirID:       &trashDirID,
 			RestorePath: &restorePath,
 			Name:        &name,
+			UpdatedAt:   &trashedAt,
 		})
 		return err
 	})
@@ -417,10 +434,11 @@ func RestoreDir(c Context, olddoc *DirDoc) (*DirDoc, error) {
 	if err != nil {
 		return nil, err
 	}
-	restoreDir, err := getRestoreDir(c, oldpath, olddoc.RestorePath)
+	restoreDir, toRoot, err := getRestoreDir(c, oldpath, olddoc.RestorePath)
 	if err != nil {
 		return nil, err
 	}
+	tags := restoredTags(olddoc.Tags, toRoot)
 	var newdoc *DirDoc
 	var emptyStr string
 	name := stripSuffix(olddoc.Name, conflictSuffix)
@@ -429,12 +447,20 @@ func RestoreDir(c Context, olddoc *DirDoc) (*DirDoc, error) {
 			DirID:       &restoreDir.DocID,
 			RestorePath: &emptyStr,
 			Name:        &name,
+			Tags:        &tags,
 		})
 		return err
 	})
 	return newdoc, err
 }
 
+// isSpecialDir returns true for the root and trash directories, which can't
+// be trashed, moved or renamed.
+func isSpecialDir(doc *DirDoc) bool {
+	id := doc.ID()
+	return id == consts.RootDirID || id == consts.TrashDirID
+}
+
 // DestroyDirContent destroy all directories and files contained in a directory.
 func DestroyDirContent(c Context, doc *DirDoc) error {
 	err := doc.FetchFiles(c)
@@ -477,13 +503,12 @@ func DestroyDirAndContent(c Context, doc *DirDoc) error {
 	return err
 }
 
+// fetchChildren returns all the direct children of a directory, fetched in
+// batches: the walks, the export and the destructions must see all of them.
 func fetchChildren(c Context, parent *DirDoc) ([]*FileDoc, []*DirDoc, error) {
 	var files []*FileDoc
 	var dirs []*DirDoc
-	var docs []*DirOrFileDoc
-	sel := mango.Equal("dir_id", parent.ID())
-	req := &couchdb.FindRequest{Selector: sel, Limit: 10}
-	err := couchdb.FindDocs(c, consts.Files, req, &docs)
+	docs, err := fetchAllChildren(c, parent.ID())
 	if err != nil {
 		return files, dirs, err
 	}
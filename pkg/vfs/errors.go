@@ -11,6 +11,9 @@ var (
 	ErrForbiddenDocMove = errors.New("Forbidden document move")
 	// ErrIllegalFilename is used when the given filename is not allowed
 	ErrIllegalFilename = errors.New("Invalid filename: empty or contains an illegal character")
+	// ErrReservedFilename is used when the given filename is reserved for
+	// the data kept by the stack at the root of the file system
+	ErrReservedFilename = errors.New("Invalid filename: reserved by the stack")
 	// ErrIllegalTime is used when a time given (creation or
 	// modification) is not allowed
 	ErrIllegalTime = errors.New("Invalid time given")
@@ -20,9 +23,21 @@ var (
 	// ErrContentLengthMismatch is used when the content-length does not
 	// match the calculated one
 	ErrContentLengthMismatch = errors.New("Content length does not match")
+	// ErrUnknownHashAlgo is used when the hash algorithm asked for a file is
+	// not supported
+	ErrUnknownHashAlgo = errors.New("Unknown hash algorithm")
+	// ErrInvalidFileMode is used when the permissions given for a file are
+	// not in the octal notation
+	ErrInvalidFileMode = errors.New("Invalid mode: it should be in the octal notation, like 0755")
+	// ErrFileTooBig is used when there is no more space left on the disk
+	// quota of the instance for the file
+	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
 	// ErrConflict is used when the access to a file or directory is in
 	// conflict with another
 	ErrConflict = errors.New("Conflict access to same file or directory")
+	// ErrForbiddenVFSOperation is used when trying to trash, move or modify
+	// the root directory or the trash directory
+	ErrForbiddenVFSOperation = errors.New("The root and trash directories can't be trashed or moved")
 	// ErrFileInTrash is used when the file is already in the trash
 	ErrFileInTrash = errors.New("File or directory is already in the trash")
 	// ErrFileNotInTrash is used when the file is not in the trash
@@ -30,7 +45,23 @@ var (
 	// ErrNonAbsolutePath is used when the given path is not absolute
 	// while it is required to be
 	ErrNonAbsolutePath = errors.New("Path should be abolute")
+	// ErrIllegalPath is used when a path tries to escape from the storage
+	// of the instance
+	ErrIllegalPath = errors.New("Invalid path: it is outside of the instance storage")
 	// ErrDirNotEmpty is used to inform that the directory is not
 	// empty
 	ErrDirNotEmpty = errors.New("Directory is not empty")
+	// ErrRestoreImpossible is used when a file or directory can be restored
+	// from the trash neither in its original directory nor in the root
+	// directory
+	ErrRestoreImpossible = errors.New("File or directory cannot be restored")
+	// ErrInvalidListSort is used when the sort of a directory listing is
+	// not one of the known fields
+	ErrInvalidListSort = errors.New("Invalid sort: it should be name, size or updated_at, optionally prefixed by -")
+	// ErrInvalidListBookmark is used when the bookmark of a directory
+	// listing is not a child of the directory
+	ErrInvalidListBookmark = errors.New("Invalid bookmark")
+	// ErrInvalidExport is used when an archive to import is not a valid
+	// export of an instance
+	ErrInvalidExport = errors.New("Invalid export archive")
 )
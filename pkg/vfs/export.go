@@ -0,0 +1,413 @@
+package vfs
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// TarMime is the content-type for tar archives
+const TarMime = "application/x-tar"
+
+const (
+	// exportManifestName is the name of the entry of the export archive with
+	// the manifest. It is always the first entry.
+	exportManifestName = "manifest.json"
+	// exportContentDir is the directory of the export archive where the
+	// contents of the files are put, by their checksum
+	exportContentDir = "files/"
+	// exportTrailerName is the name of the last entry of the export archive,
+	// with the checksum of the other entries. An archive without it has been
+	// truncated by an error in the middle of the export.
+	exportTrailerName = "trailer.json"
+)
+
+// exportTrailer is the content of the last entry of an export archive: the
+// SHA-256 checksum of the data of all the other entries, in their order.
+type exportTrailer struct {
+	SHA256 string `json:"sha256"`
+}
+
+// ExportManifest is the manifest of an export archive. It lists the
+// directories and the files of the exported instance, with their metadata.
+// The directories are sorted so that a parent is always before its
+// children.
+type ExportManifest struct {
+	Dirs  []*ExportEntry `json:"dirs"`
+	Files []*ExportEntry `json:"files"`
+}
+
+// ExportEntry is the description of a directory or a file in the manifest
+// of an export archive.
+type ExportEntry struct {
+	ID           string                       `json:"id"`
+	Path         string                       `json:"path"`
+	CreatedAt    time.Time                    `json:"created_at"`
+	UpdatedAt    time.Time                    `json:"updated_at"`
+	Tags         []string                     `json:"tags,omitempty"`
+	Size         int64                        `json:"size,string,omitempty"`
+	MD5Sum       []byte                       `json:"md5sum,omitempty"`
+	HashAlgo     string                       `json:"hash_algo,omitempty"`
+	Mime         string                       `json:"mime,omitempty"`
+	Class        string                       `json:"class,omitempty"`
+	Executable   bool                         `json:"executable,omitempty"`
+	ReferencedBy []jsonapi.ResourceIdentifier `json:"referenced_by,omitempty"`
+	// Content is the name of the entry of the archive with the content of
+	// the file. The files with the same content share the same entry.
+	Content string `json:"content,omitempty"`
+}
+
+// Export streams the directories and files of the instance, except the
+// trash, in a tar archive. The first entry of the archive is the manifest,
+// then the contents of the files follow, named by their checksum: a content
+// is written only once, even if several files have it. The last entry is
+// the trailer, written only when everything else has been.
+func Export(c Context, w io.Writer) error {
+	manifest := &ExportManifest{}
+	contents := make(map[string]*FileDoc)
+	var order []string
+
+	err := Walk(c, "/", func(name string, dir *DirDoc, file *FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			if dir.ID() == consts.RootDirID {
+				return nil
+			}
+			if dir.ID() == consts.TrashDirID {
+				return ErrSkipDir
+			}
+			manifest.Dirs = append(manifest.Dirs, &ExportEntry{
+				ID:        dir.ID(),
+				Path:      name,
+				CreatedAt: dir.CreatedAt,
+				UpdatedAt: dir.UpdatedAt,
+				Tags:      dir.Tags,
+			})
+			return nil
+		}
+		content := exportContentName(file)
+		if _, ok := contents[content]; !ok {
+			contents[content] = file
+			order = append(order, content)
+		}
+		manifest.Files = append(manifest.Files, &ExportEntry{
+			ID:           file.ID(),
+			Path:         name,
+			CreatedAt:    file.CreatedAt,
+			UpdatedAt:    file.UpdatedAt,
+			Tags:         file.Tags,
+			Size:         file.Size,
+			MD5Sum:       file.MD5Sum,
+			HashAlgo:     file.HashAlgo,
+			Mime:         file.Mime,
+			Class:        file.Class,
+			Executable:   file.Executable,
+			ReferencedBy: file.ReferencedBy,
+			Content:      content,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	h := sha256.New()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err = writeExportEntry(tw, exportManifestName, data); err != nil {
+		return err
+	}
+	h.Write(data)
+
+	for _, content := range order {
+		if err = exportContent(c, tw, h, content, contents[content]); err != nil {
+			return err
+		}
+	}
+
+	trailer, err := json.Marshal(&exportTrailer{SHA256: hex.EncodeToString(h.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	if err = writeExportEntry(tw, exportTrailerName, trailer); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeExportEntry(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func exportContent(c Context, tw *tar.Writer, h hash.Hash, content string, doc *FileDoc) error {
+	f, err := Open(c, doc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:     content,
+		Mode:     int64(doc.Mode()),
+		Size:     doc.Size,
+		ModTime:  doc.UpdatedAt,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(tw, h), f)
+	return err
+}
+
+// exportContentName returns the name of the archive entry for the content
+// of a file: its checksum, or its identifier for the old files without one.
+func exportContentName(doc *FileDoc) string {
+	if len(doc.MD5Sum) == 0 {
+		return exportContentDir + doc.ID()
+	}
+	return exportContentDir + doc.HashAlgorithm() + "-" + hex.EncodeToString(doc.MD5Sum)
+}
+
+// CheckExport reads an archive created by Export, and returns
+// ErrInvalidExport if it is incomplete or corrupted: its last entry must be
+// the trailer, with the checksum of the other entries.
+func CheckExport(r io.Reader) error {
+	tr := tar.NewReader(r)
+	h := sha256.New()
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return ErrInvalidExport
+		}
+		if hdr.Name == exportTrailerName {
+			if err = checkExportTrailer(tr, h); err != nil {
+				return err
+			}
+			if _, err = tr.Next(); err != io.EOF {
+				return ErrInvalidExport
+			}
+			return nil
+		}
+		if _, err = io.Copy(h, tr); err != nil {
+			return ErrInvalidExport
+		}
+	}
+}
+
+func checkExportTrailer(r io.Reader, h hash.Hash) error {
+	var trailer exportTrailer
+	if err := json.NewDecoder(r).Decode(&trailer); err != nil {
+		return ErrInvalidExport
+	}
+	if trailer.SHA256 != hex.EncodeToString(h.Sum(nil)) {
+		return ErrInvalidExport
+	}
+	return nil
+}
+
+// importedDocs are the directories and files created by an import
+type importedDocs struct {
+	dirs  []*DirDoc
+	files []*FileDoc
+}
+
+// rollback destroys the directories and files created by an import that
+// has failed, the most recent first. The errors are ignored: what can't be
+// destroyed is left, and the error of the import is the one reported.
+func (d *importedDocs) rollback(c Context) {
+	for i := len(d.files) - 1; i >= 0; i-- {
+		_ = DestroyFile(c, d.files[i])
+	}
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		_ = DestroyDirAndContent(c, d.dirs[i])
+	}
+}
+
+// Import reads an archive created by Export and recreates its directories
+// and files in the instance, with their metadata. The directories that
+// already exist are reused, but a file that already exists stops the import
+// with an error. The checksums of the files, and the trailer of the archive,
+// are checked. When the import fails, the directories and files already
+// created are destroyed. The directories and files have new identifiers: the
+// returned map gives them by the identifiers of the manifest.
+func Import(c Context, r io.Reader) (map[string]string, error) {
+	created := &importedDocs{}
+	ids, err := importArchive(c, r, created)
+	if err != nil {
+		created.rollback(c)
+		return nil, err
+	}
+	return ids, nil
+}
+
+func importArchive(c Context, r io.Reader, created *importedDocs) (map[string]string, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err == io.EOF || (err == nil && hdr.Name != exportManifestName) {
+		return nil, ErrInvalidExport
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return nil, err
+	}
+	var manifest ExportManifest
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return nil, ErrInvalidExport
+	}
+	h := sha256.New()
+	h.Write(data)
+
+	ids := make(map[string]string)
+	dirIDs := map[string]string{"/": consts.RootDirID}
+	for _, entry := range manifest.Dirs {
+		dir, isNew, err := importDir(c, entry, dirIDs)
+		if err != nil {
+			return nil, err
+		}
+		if isNew {
+			created.dirs = append(created.dirs, dir)
+		}
+		dirIDs[entry.Path] = dir.ID()
+		ids[entry.ID] = dir.ID()
+	}
+
+	files := make(map[string][]*ExportEntry)
+	for _, entry := range manifest.Files {
+		files[entry.Content] = append(files[entry.Content], entry)
+	}
+	hasTrailer := false
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hasTrailer {
+			return nil, ErrInvalidExport
+		}
+		if hdr.Name == exportTrailerName {
+			if err = checkExportTrailer(tr, h); err != nil {
+				return nil, err
+			}
+			hasTrailer = true
+			continue
+		}
+		entries, ok := files[hdr.Name]
+		if !ok {
+			return nil, ErrInvalidExport
+		}
+		delete(files, hdr.Name)
+
+		// the content is read from the archive for the first file, and copied
+		// from this file for the other ones
+		first, err := importFile(c, entries[0], dirIDs, io.TeeReader(tr, h))
+		if err != nil {
+			return nil, err
+		}
+		created.files = append(created.files, first)
+		ids[entries[0].ID] = first.ID()
+		for _, entry := range entries[1:] {
+			f, err := Open(c, first)
+			if err != nil {
+				return nil, err
+			}
+			doc, err := importFile(c, entry, dirIDs, f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			created.files = append(created.files, doc)
+			ids[entry.ID] = doc.ID()
+		}
+	}
+	if len(files) > 0 || !hasTrailer {
+		return nil, ErrInvalidExport
+	}
+	return ids, nil
+}
+
+// importDir returns the directory for the entry, and true if it has been
+// created by the import.
+func importDir(c Context, entry *ExportEntry, dirIDs map[string]string) (*DirDoc, bool, error) {
+	dir, err := GetDirDocFromPath(c, entry.Path, false)
+	if err == nil {
+		return dir, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	parentID, ok := dirIDs[path.Dir(entry.Path)]
+	if !ok {
+		return nil, false, ErrInvalidExport
+	}
+	dir, err = NewDirDoc(path.Base(entry.Path), parentID, entry.Tags, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	dir.CreatedAt = entry.CreatedAt.UTC()
+	dir.UpdatedAt = entry.UpdatedAt.UTC()
+	if err = CreateDir(c, dir); err != nil {
+		return nil, false, err
+	}
+	return dir, true, nil
+}
+
+func importFile(c Context, entry *ExportEntry, dirIDs map[string]string, content io.Reader) (*FileDoc, error) {
+	parentID, ok := dirIDs[path.Dir(entry.Path)]
+	if !ok {
+		return nil, ErrInvalidExport
+	}
+	doc, err := NewFileDoc(path.Base(entry.Path), parentID, entry.Size,
+		entry.MD5Sum, entry.Mime, entry.Class, entry.CreatedAt,
+		entry.Executable, entry.Tags)
+	if err != nil {
+		return nil, err
+	}
+	doc.UpdatedAt = entry.UpdatedAt.UTC()
+	doc.HashAlgo = entry.HashAlgo
+	doc.ReferencedBy = entry.ReferencedBy
+
+	f, err := CreateFile(c, doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
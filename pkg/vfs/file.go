@@ -2,16 +2,24 @@ package vfs
 
 import (
 	"bytes"
-	"crypto/md5" // #nosec
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"hash"
+	"hash/fnv"
+	"io"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
@@ -19,6 +27,10 @@ import (
 	"github.com/spf13/afero"
 )
 
+// FileModeHeader is the HTTP header used to give the mode of a file when its
+// content is served
+const FileModeHeader = "X-Cozy-File-Mode"
+
 // FileDoc is a struct containing all the informations about a file.
 // It implements the couchdb.Doc and jsonapi.Object interfaces.
 type FileDoc struct {
@@ -35,11 +47,24 @@ type FileDoc struct {
 	DirID       string `json:"dir_id,omitempty"`
 	RestorePath string `json:"restore_path,omitempty"`
 
+	// The dates are saved in UTC, for couchdb to compare them as strings
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
-	Size       int64    `json:"size,string"` // Serialized in JSON as a string, because JS has some issues with big numbers
+	Size int64 `json:"size,string"` // Serialized in JSON as a string, because JS has some issues with big numbers
+	// ByteSize is the size as a number, for couchdb to sort and filter the
+	// files by size. It is set when the content is written, and by Reindex
+	// for the files written before it was added.
+	ByteSize *int64 `json:"byte_size,omitempty"`
+	// MD5Sum is the checksum of the content, computed with the HashAlgo
+	// algorithm (MD5 when empty). It keeps the md5sum name in JSON, for the
+	// documents already stored and their clients, even when it is a SHA-256
+	// checksum. SHA256Sum is the SHA-256 checksum of the content, whatever
+	// the HashAlgo: the files created before it was added get it with the
+	// RehashToSHA256 migration.
 	MD5Sum     []byte   `json:"md5sum"`
+	HashAlgo   string   `json:"hash_algo,omitempty"`
+	SHA256Sum  []byte   `json:"sha256sum,omitempty"`
 	Mime       string   `json:"mime"`
 	Class      string   `json:"class"`
 	Executable bool     `json:"executable"`
@@ -130,15 +155,46 @@ func (f *FileDoc) Relationships() jsonapi.RelationshipMap {
 }
 
 // HideFields returns a jsonapi.Object which serialize like the original
-// file but without the ReferencedBy field
+// file but without the ReferencedBy field, and with the mode of the file
 func (f *FileDoc) HideFields() jsonapi.Object {
-	return &struct {
-		ReferencedBy []jsonapi.ResourceIdentifier `json:"referenced_by,omitempty"`
-		*FileDoc
-	}{
-		FileDoc:      f,
-		ReferencedBy: nil,
+	return &hiddenFieldsFile{
+		FileDoc: f,
+		Mode:    FormatFileMode(f.Mode()),
+	}
+}
+
+// HideReferences is like HideFields, but the referenced_by relationship is
+// also removed, for the clients that are not allowed to know which documents
+// reference the file.
+func (f *FileDoc) HideReferences() jsonapi.Object {
+	return &hiddenFieldsFile{
+		FileDoc:        f,
+		Mode:           FormatFileMode(f.Mode()),
+		hideReferences: true,
+	}
+}
+
+type hiddenFieldsFile struct {
+	ReferencedBy []jsonapi.ResourceIdentifier `json:"referenced_by,omitempty"`
+	Mode         string                       `json:"mode"`
+	ByteSize     *int64                       `json:"byte_size,omitempty"`
+	*FileDoc
+	hideReferences bool
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (h *hiddenFieldsFile) Relationships() jsonapi.RelationshipMap {
+	rels := h.FileDoc.Relationships()
+	if h.hideReferences {
+		delete(rels, "referenced_by")
 	}
+	return rels
+}
+
+// Mode returns the permissions of the file on the filesystem: 0755 for an
+// executable file, 0644 else.
+func (f *FileDoc) Mode() os.FileMode {
+	return getFileMode(f.Executable)
 }
 
 // Included is part of the jsonapi.Object interface
@@ -146,9 +202,26 @@ func (f *FileDoc) Included() []jsonapi.Object {
 	return []jsonapi.Object{}
 }
 
-// AddReferencedBy adds referenced_by to the file
-func (f *FileDoc) AddReferencedBy(ri ...jsonapi.ResourceIdentifier) {
-	f.ReferencedBy = append(f.ReferencedBy, ri...)
+// AddReferencedBy adds referenced_by to the file. The references already on
+// the file are not added twice. It returns the number of added references.
+func (f *FileDoc) AddReferencedBy(ri ...jsonapi.ResourceIdentifier) int {
+	added := 0
+	for _, ref := range ri {
+		if !f.hasReferencedBy(ref) {
+			f.ReferencedBy = append(f.ReferencedBy, ref)
+			added++
+		}
+	}
+	return added
+}
+
+func (f *FileDoc) hasReferencedBy(ref jsonapi.ResourceIdentifier) bool {
+	for _, r := range f.ReferencedBy {
+		if r == ref {
+			return true
+		}
+	}
+	return false
 }
 
 // NewFileDoc is the FileDoc constructor. The given name is validated.
@@ -160,8 +233,12 @@ func NewFileDoc(name, dirID string, size int64, md5Sum []byte, mime, class strin
 	if dirID == "" {
 		dirID = consts.RootDirID
 	}
+	if err := checkReservedName(name, dirID); err != nil {
+		return nil, err
+	}
 
 	tags = uniqueTags(tags)
+	cdate = cdate.UTC()
 
 	doc := &FileDoc{
 		Type:  consts.FileType,
@@ -195,6 +272,35 @@ func GetFileDoc(c Context, fileID string) (*FileDoc, error) {
 	return doc, nil
 }
 
+// GetFileDocs fetches the documents of the files with the given identifiers,
+// in a single request. The returned slice has the same length and order than
+// the identifiers, with a nil document for the identifiers that are missing
+// or that are not files.
+func GetFileDocs(c Context, fileIDs []string) ([]*FileDoc, error) {
+	docs, err := couchdb.GetDocs(c, consts.Files, fileIDs)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]*FileDoc, len(docs))
+	for i, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		file := &FileDoc{}
+		if err = json.Unmarshal(data, file); err != nil {
+			return nil, err
+		}
+		if file.Type == consts.FileType {
+			files[i] = file
+		}
+	}
+	return files, nil
+}
+
 // GetFileDocFromPath is used to fetch file document information from
 // the database from its path.
 func GetFileDocFromPath(c Context, name string) (*FileDoc, error) {
@@ -237,25 +343,85 @@ func GetFileDocFromPath(c Context, name string) (*FileDoc, error) {
 	return fileDoc, nil
 }
 
+// ETag returns the entity tag of the content of the file. It is derived from
+// the checksum of the content, so it is the same for the same content, even
+// after a restart or a copy of the file.
+func (f *FileDoc) ETag() string {
+	eTag := base64.StdEncoding.EncodeToString(f.MD5Sum)
+	// the hash algorithm is put in the etag, except for MD5 to keep the
+	// same etags for the existing files
+	if algo := f.HashAlgorithm(); algo != HashMD5 {
+		eTag = algo + "-" + eTag
+	}
+	return eTag
+}
+
+// MatchETag returns true if the value of an If-None-Match or If-Range header
+// matches the given etag (without its quotes). With the weak comparison, used
+// for If-None-Match, the weak etags (W/"...") match too. If-Range needs the
+// strong comparison, as a range of a weakly equivalent content makes no
+// sense.
+func MatchETag(header, eTag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if strings.Trim(tag, `"`) == eTag {
+			return true
+		}
+	}
+	return false
+}
+
 // ServeFileContent replies to a http request using the content of a
 // file given its FileDoc.
 //
 // It uses internally http.ServeContent and benefits from it by
 // offering support to Range, If-Modified-Since and If-None-Match
-// requests. It uses the revision of the file as the Etag value for
-// non-ranged requests
+// requests. The Etag, derived from the checksum of the content, is sent for
+// the ranged requests too, so that the clients can resume a download with
+// If-Range: a stale If-Range gives the whole content.
 //
 // The content disposition is inlined.
 func ServeFileContent(c Context, doc *FileDoc, disposition string, req *http.Request, w http.ResponseWriter) error {
 	header := w.Header()
-	header.Set("Content-Type", doc.Mime)
+	mime := doc.Mime
+	if mime == "" {
+		mime = defaultMime()
+	}
+	header.Set("Content-Type", mime)
 	if disposition != "" {
 		header.Set("Content-Disposition", ContentDisposition(disposition, doc.Name))
 	}
-
-	if header.Get("Range") == "" {
-		eTag := base64.StdEncoding.EncodeToString(doc.MD5Sum)
-		header.Set("Etag", eTag)
+	eTag := doc.ETag()
+	header.Set("Etag", `"`+eTag+`"`)
+	header.Set(FileModeHeader, FormatFileMode(doc.Mode()))
+
+	// The conditional headers are checked here, and not left to
+	// http.ServeContent, as its comparison of the etags differs between the
+	// versions of Go
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		if MatchETag(inm, eTag, true) && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+			header.Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+	if ir := req.Header.Get("If-Range"); ir != "" {
+		req = req.WithContext(req.Context())
+		req.Header = cloneHeader(req.Header)
+		req.Header.Del("If-Range")
+		req.Header.Del("If-None-Match")
+		if !ifRangeMatches(ir, eTag, doc.UpdatedAt) {
+			req.Header.Del("Range")
+		}
 	}
 
 	name, err := doc.Path(c)
@@ -263,22 +429,59 @@ func ServeFileContent(c Context, doc *FileDoc, disposition string, req *http.Req
 		return err
 	}
 
-	content, err := c.FS().Open(name)
+	f, err := c.FS().Open(name)
 	if err != nil {
 		return err
 	}
+	content := &File{c: c, f: f}
+	content.SetContext(req.Context())
 	defer content.Close()
 
 	http.ServeContent(w, req, doc.Name, doc.UpdatedAt, content)
 	return nil
 }
 
+// ifRangeMatches returns true if the If-Range header, with an etag or a date,
+// designates the current content of the file.
+func ifRangeMatches(ir, eTag string, modtime time.Time) bool {
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return MatchETag(ir, eTag, false)
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && t.Unix() == modtime.Unix()
+}
+
+func cloneHeader(h http.Header) http.Header {
+	clone := make(http.Header, len(h))
+	for k, v := range h {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
 // File represents a file handle. It can be used either for writing OR
 // reading, but not both at the same time.
 type File struct {
-	c  Context       // vfs context
-	f  afero.File    // file handle
-	fc *fileCreation // file creation handle
+	c   Context         // vfs context
+	f   afero.File      // file handle
+	fc  *fileCreation   // file creation handle
+	ctx context.Context // context of the reads and writes, if any
+}
+
+// SetContext makes the reads and writes on the file fail as soon as the
+// context is done, typically when the client of an HTTP request has gone
+// away. For a file open for writing, the Close method then removes the new
+// content, and puts back the previous one for a modification.
+func (f *File) SetContext(ctx context.Context) {
+	f.ctx = ctx
+}
+
+// ctxErr returns the error of the context of the file, if it is done.
+func (f *File) ctxErr() error {
+	if f.ctx == nil {
+		return nil
+	}
+	return f.ctx.Err()
 }
 
 // fileCreation represents a file open for writing. It is used to
@@ -293,6 +496,10 @@ type fileCreation struct {
 	bakpath   string    // backup file path in case of modifying an existing file
 	checkHash bool      // whether or not we need the assert the hash is good
 	hash      hash.Hash // hash we build up along the file
+	sha256    hash.Hash // SHA-256 of the content, if it is not the hash of the document
+	sniff     bool      // whether or not the class is detected from the content
+	head      []byte    // first bytes of the content, used to detect the class
+	maxsize   int64     // maximal size of a content of unknown size, -1 for no limit
 	err       error     // write error
 }
 
@@ -307,7 +514,7 @@ func Open(c Context, doc *FileDoc) (*File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &File{c, f, nil}, nil
+	return &File{c: c, f: f}, nil
 }
 
 // CreateFile is used to create file or modify an existing file
@@ -319,42 +526,111 @@ func Open(c Context, doc *FileDoc) (*File, error) {
 //
 // Warning: you MUST call the Close() method and check for its error.
 // The Close() method will actually create or update the document in
-// couchdb. It will also check the md5 hash if required.
+// couchdb. It will also check the hash if required. The hash algorithm is
+// the one of the new document, or the default one of the configuration if
+// the document does not specify it.
 func CreateFile(c Context, newdoc, olddoc *FileDoc) (*File, error) {
+	return createFile(c, newdoc, olddoc, "")
+}
+
+// ModifyFile is like CreateFile for the modification of an existing file,
+// but it also checks that the current revision of the file is the expected
+// one, typically given by the If-Match header. It returns ErrConflict if the
+// file has been modified in the meantime, to avoid losing this modification.
+func ModifyFile(c Context, newdoc, olddoc *FileDoc, rev string) (*File, error) {
+	if olddoc == nil {
+		return nil, os.ErrInvalid
+	}
+	return createFile(c, newdoc, olddoc, rev)
+}
+
+func createFile(c Context, newdoc, olddoc *FileDoc, rev string) (*File, error) {
 	newpath, err := newdoc.Path(c)
 	if err != nil {
 		return nil, err
 	}
 
+	if newdoc.HashAlgo == "" {
+		newdoc.HashAlgo = defaultHashAlgo()
+	}
+	var sha hash.Hash
+	if newdoc.HashAlgo != HashSHA256 {
+		sha = sha256.New()
+	}
+	hash, err := newHash(newdoc.HashAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	// the replaced content is not freed when it is kept as a version
+	var freed int64
+	if olddoc != nil && config.GetConfig().Fs.Versions.MaxNumber <= 0 {
+		freed = olddoc.Size
+	}
+	maxsize := int64(-1)
+	if newdoc.Size >= 0 {
+		err = checkDiskQuota(c, newdoc.Size, freed)
+	} else {
+		// for a content of unknown size, the quota is checked as it is
+		// written
+		maxsize, err = availableDiskSpace(c, freed)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the concurrent creations and modifications of the same path are
+	// serialized until the new file is created, so that a modification
+	// can't take the backup of another one for the previous content
+	unlock := lockPath(c, newpath)
+	defer unlock()
+
 	var bakpath string
 	if olddoc != nil {
+		if err = checkFileRev(c, olddoc, rev); err != nil {
+			return nil, err
+		}
 		bakpath = fmt.Sprintf("/.%s_%s", olddoc.ID(), olddoc.Rev())
 		if err = safeRenameFile(c, newpath, bakpath); err != nil {
 			// in case of a concurrent access to this method, it can happend
 			// that the file has already been renamed. In this case the
-			// safeRenameFile will return an os.ErrNotExist error. But this
-			// error is misleading since it does not reflect the conflict.
-			if os.IsNotExist(err) {
+			// safeRenameFile will return an os.ErrNotExist error, or an
+			// os.ErrExist error if the backup file of the concurrent access
+			// is still there. But these errors are misleading since they do
+			// not reflect the conflict.
+			if os.IsNotExist(err) || os.IsExist(err) {
 				err = ErrConflict
 			}
 			return nil, err
 		}
+		// a concurrent modification may have been committed between the
+		// check and the renaming: in this case, the backup file is its
+		// content and it is put back.
+		if err = checkFileRev(c, olddoc, rev); err != nil {
+			c.FS().Rename(bakpath, newpath)
+			return nil, err
+		}
 	}
 
 	if olddoc != nil {
 		newdoc.SetID(olddoc.ID())
 		newdoc.SetRev(olddoc.Rev())
-		newdoc.CreatedAt = olddoc.CreatedAt
-		newdoc.UpdatedAt = time.Now()
+		newdoc.CreatedAt = olddoc.CreatedAt.UTC()
+		newdoc.UpdatedAt = time.Now().UTC()
 	}
 
 	f, err := safeCreateFile(newpath, newdoc.Executable, c.FS())
 	if err != nil {
+		if bakpath != "" {
+			safeRenameFile(c, bakpath, newpath)
+		}
+		// the file has been created by a concurrent request
+		if os.IsExist(err) {
+			err = ErrConflict
+		}
 		return nil, err
 	}
 
-	hash := md5.New() // #nosec
-
 	fc := &fileCreation{
 		w: 0,
 
@@ -365,9 +641,12 @@ func CreateFile(c Context, newdoc, olddoc *FileDoc) (*File, error) {
 
 		checkHash: newdoc.MD5Sum != nil,
 		hash:      hash,
+		sha256:    sha,
+		sniff:     isGenericMime(newdoc.Mime),
+		maxsize:   maxsize,
 	}
 
-	return &File{c, f, fc}, nil
+	return &File{c: c, f: f, fc: fc}, nil
 }
 
 // Read bytes from the file into given buffer - part of io.Reader
@@ -376,6 +655,9 @@ func (f *File) Read(p []byte) (int, error) {
 	if f.fc != nil {
 		return 0, os.ErrInvalid
 	}
+	if err := f.ctxErr(); err != nil {
+		return 0, err
+	}
 	return f.f.Read(p)
 }
 
@@ -395,6 +677,27 @@ func (f *File) Write(p []byte) (int, error) {
 		return 0, os.ErrInvalid
 	}
 
+	// the write is aborted when the client has gone away, and the content
+	// is not committed by Close
+	if err := f.ctxErr(); err != nil {
+		f.fc.err = err
+		return 0, err
+	}
+
+	// when the size is known, the write is aborted as soon as the content is
+	// larger than expected, without waiting for the Close
+	if size := f.fc.newdoc.Size; size >= 0 && f.fc.w+int64(len(p)) > size {
+		f.fc.err = ErrContentLengthMismatch
+		return 0, f.fc.err
+	}
+
+	// when the size is unknown, the write is aborted as soon as the content
+	// exceeds the disk quota
+	if max := f.fc.maxsize; max >= 0 && f.fc.w+int64(len(p)) > max {
+		f.fc.err = ErrFileTooBig
+		return 0, f.fc.err
+	}
+
 	n, err := f.f.Write(p)
 	if err != nil {
 		f.fc.err = err
@@ -403,6 +706,17 @@ func (f *File) Write(p []byte) (int, error) {
 
 	f.fc.w += int64(n)
 
+	if f.fc.sniff && len(f.fc.head) < sniffLen {
+		rest := sniffLen - len(f.fc.head)
+		if rest > n {
+			rest = n
+		}
+		f.fc.head = append(f.fc.head, p[:rest]...)
+	}
+
+	if f.fc.sha256 != nil {
+		f.fc.sha256.Write(p)
+	}
 	_, err = f.fc.hash.Write(p)
 	return n, err
 }
@@ -410,6 +724,14 @@ func (f *File) Write(p []byte) (int, error) {
 // Close the handle and commit the document in database if all checks
 // are OK. It is important to check errors returned by this method.
 func (f *File) Close() error {
+	return f.CloseWithSum(nil)
+}
+
+// CloseWithSum is like Close, but the content is also checked against the
+// given checksum, computed with the hash algorithm of the document. It is
+// used when the checksum is only known at the end of the upload, like with
+// an HTTP trailer. A nil checksum is not checked.
+func (f *File) CloseWithSum(trailerSum []byte) error {
 	if f.fc == nil {
 		return f.f.Close()
 	}
@@ -425,6 +747,14 @@ func (f *File) Close() error {
 			if err != nil || werr != nil {
 				c.FS().Rename(fc.bakpath, fc.newpath)
 			} else {
+				// the previous content is kept as a version if they are
+				// enabled. A failure to do so does not fail the
+				// modification: it is logged, and the backup file is
+				// simply removed.
+				if verr := keepFileVersion(c, fc.olddoc, fc.bakpath); verr != nil {
+					log.Errorf("[vfs] %s: Could not keep the previous content of %s as a version: %s",
+						c.Prefix(), fc.olddoc.ID(), verr)
+				}
 				c.FS().Remove(fc.bakpath)
 			}
 		} else if err != nil || werr != nil {
@@ -438,10 +768,19 @@ func (f *File) Close() error {
 		return err
 	}
 
+	// the document is not committed if a write has failed
+	if fc.err != nil {
+		return fc.err
+	}
+
 	newdoc, olddoc, written := fc.newdoc, fc.olddoc, fc.w
 
-	md5sum := fc.hash.Sum(nil)
-	if fc.checkHash && !bytes.Equal(newdoc.MD5Sum, md5sum) {
+	sum := fc.hash.Sum(nil)
+	if fc.checkHash && !bytes.Equal(newdoc.MD5Sum, sum) {
+		err = ErrInvalidHash
+		return err
+	}
+	if trailerSum != nil && !bytes.Equal(trailerSum, sum) {
 		err = ErrInvalidHash
 		return err
 	}
@@ -451,25 +790,55 @@ func (f *File) Close() error {
 	}
 
 	if newdoc.MD5Sum == nil {
-		newdoc.MD5Sum = md5sum
+		newdoc.MD5Sum = sum
+	}
+	if fc.sha256 != nil {
+		newdoc.SHA256Sum = fc.sha256.Sum(nil)
+	} else {
+		newdoc.SHA256Sum = sum
 	}
 
 	if newdoc.Size != written {
 		err = ErrContentLengthMismatch
 		return err
 	}
+	newdoc.ByteSize = &written
+
+	// the class given by a generic mime type is useless, a better one is
+	// detected from the content. And a file is never left without a mime
+	// type.
+	if fc.sniff {
+		class := sniffClass(fc.head)
+		if newdoc.Mime == "" {
+			newdoc.Mime, newdoc.Class = guessMimeAndClass(class)
+		} else if class != "" {
+			newdoc.Class = class
+		}
+	}
 
 	if olddoc != nil {
 		err = couchdb.UpdateDoc(c, newdoc)
+		// the file has been modified since olddoc was fetched: the previous
+		// content is put back by the deferred function
+		if couchdb.IsConflictError(err) {
+			err = ErrConflict
+		}
+		if err == nil {
+			updateCachedDiskUsage(c, newdoc.Size-olddoc.Size)
+		}
 	} else {
 		err = couchdb.CreateDoc(c, newdoc)
+		if err == nil {
+			updateCachedDiskUsage(c, newdoc.Size)
+		}
 	}
 
 	return err
 }
 
 // ModifyFileMetadata modify the metadata associated to a file. It can
-// be used to rename or move the file in the VFS.
+// be used to rename or move the file in the VFS. It returns ErrConflict if
+// the file has been modified since olddoc was fetched.
 func ModifyFileMetadata(c Context, olddoc *FileDoc, patch *DocPatch) (*FileDoc, error) {
 	var err error
 	cdate := olddoc.CreatedAt
@@ -502,6 +871,7 @@ func ModifyFileMetadata(c Context, olddoc *FileDoc, patch *DocPatch) (*FileDoc,
 	}
 
 	newdoc.RestorePath = *patch.RestorePath
+	newdoc.HashAlgo = olddoc.HashAlgo
 
 	var parent *DirDoc
 	if newdoc.DirID != olddoc.DirID {
@@ -542,22 +912,54 @@ func ModifyFileMetadata(c Context, olddoc *FileDoc, patch *DocPatch) (*FileDoc,
 		}
 	}
 
-	err = couchdb.UpdateDoc(c, newdoc)
+	// the document may have been modified concurrently since olddoc was
+	// fetched: in this case, the changes on the filesystem are reverted to
+	// not lose the other modification.
+	if err = couchdb.UpdateDoc(c, newdoc); couchdb.IsConflictError(err) {
+		if newdoc.Executable != olddoc.Executable {
+			c.FS().Chmod(newpath, getFileMode(olddoc.Executable))
+		}
+		if newpath != oldpath {
+			c.FS().Rename(newpath, oldpath)
+		}
+		return nil, ErrConflict
+	}
 	return newdoc, err
 }
 
+// TouchFile sets the modification date of a file to now, without changing
+// its content or its other metadata. It can be used to force the clients to
+// synchronize the file again. It returns ErrConflict if the file has been
+// modified since doc was fetched.
+func TouchFile(c Context, doc *FileDoc) (*FileDoc, error) {
+	newdoc := *doc
+	newdoc.UpdatedAt = time.Now().UTC()
+	if err := couchdb.UpdateDoc(c, &newdoc); err != nil {
+		if couchdb.IsConflictError(err) {
+			return nil, ErrConflict
+		}
+		return nil, err
+	}
+	return &newdoc, nil
+}
+
 // TrashFile is used to delete a file given its document
 func TrashFile(c Context, olddoc *FileDoc) (*FileDoc, error) {
 	oldpath, err := olddoc.Path(c)
 	if err != nil {
 		return nil, err
 	}
-	if strings.HasPrefix(oldpath, TrashDirName) {
+	if IsInTrash(c, oldpath) {
 		return nil, ErrFileInTrash
 	}
 
 	trashDirID := consts.TrashDirID
 	restorePath := path.Dir(oldpath)
+	// the modification date is the date of trashing, to sort the trash
+	trashedAt := time.Now()
+	if trashedAt.Before(olddoc.UpdatedAt) {
+		trashedAt = olddoc.UpdatedAt
+	}
 
 	var newdoc *FileDoc
 	tryOrUseSuffix(olddoc.Name, conflictFormat, func(name string) error {
@@ -565,6 +967,7 @@ func TrashFile(c Context, olddoc *FileDoc) (*FileDoc, error) {
 			DirID:       &trashDirID,
 			RestorePath: &restorePath,
 			Name:        &name,
+			UpdatedAt:   &trashedAt,
 		})
 		return err
 	})
@@ -577,10 +980,11 @@ func RestoreFile(c Context, olddoc *FileDoc) (*FileDoc, error) {
 	if err != nil {
 		return nil, err
 	}
-	restoreDir, err := getRestoreDir(c, oldpath, olddoc.RestorePath)
+	restoreDir, toRoot, err := getRestoreDir(c, oldpath, olddoc.RestorePath)
 	if err != nil {
 		return nil, err
 	}
+	tags := restoredTags(olddoc.Tags, toRoot)
 	var newdoc *FileDoc
 	var emptyStr string
 	name := stripSuffix(olddoc.Name, conflictSuffix)
@@ -589,6 +993,7 @@ func RestoreFile(c Context, olddoc *FileDoc) (*FileDoc, error) {
 			DirID:       &restoreDir.DocID,
 			RestorePath: &emptyStr,
 			Name:        &name,
+			Tags:        &tags,
 		})
 		return err
 	})
@@ -607,7 +1012,54 @@ func DestroyFile(c Context, doc *FileDoc) error {
 		return err
 	}
 
-	return couchdb.DeleteDoc(c, doc)
+	if err = DestroyFileVersions(c, doc); err != nil {
+		return err
+	}
+
+	if err = DestroyPreviews(c, doc); err != nil {
+		return err
+	}
+
+	if err = couchdb.DeleteDoc(c, doc); err != nil {
+		return err
+	}
+	updateCachedDiskUsage(c, -doc.Size)
+	return nil
+}
+
+// checkFileRev returns ErrConflict if the expected revision is not the
+// revision of olddoc and of the file document currently in couchdb. An empty
+// expected revision means that no check is done.
+func checkFileRev(c Context, olddoc *FileDoc, rev string) error {
+	if rev == "" {
+		return nil
+	}
+	if olddoc.Rev() != rev {
+		return ErrConflict
+	}
+	cur, err := GetFileDoc(c, olddoc.ID())
+	if err != nil {
+		return err
+	}
+	if cur.Rev() != rev {
+		return ErrConflict
+	}
+	return nil
+}
+
+// pathLocks are the mutexes used to serialize the operations on the same
+// path. A path is mapped to one of them by its hash.
+var pathLocks [64]sync.Mutex
+
+// lockPath locks the given path of the vfs context, and returns the function
+// to unlock it.
+func lockPath(c Context, name string) func() {
+	h := fnv.New32a()
+	io.WriteString(h, c.Prefix())
+	io.WriteString(h, name)
+	mu := &pathLocks[h.Sum32()%uint32(len(pathLocks))]
+	mu.Lock()
+	return mu.Unlock
 }
 
 func safeCreateFile(name string, executable bool, fs afero.Fs) (afero.File, error) {
@@ -644,6 +1096,23 @@ func getFileMode(executable bool) os.FileMode {
 	return 0644 // -rw-r--r--
 }
 
+// FormatFileMode returns the permissions of a file in the octal notation,
+// like 0755.
+func FormatFileMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", mode.Perm())
+}
+
+// ParseFileMode parses permissions in the octal notation, like 755 or
+// 0644, and returns whether they make the file executable. A file is
+// executable if one of the execute bits is set.
+func ParseFileMode(mode string) (executable bool, err error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return false, ErrInvalidFileMode
+	}
+	return perm&0111 != 0, nil
+}
+
 var (
 	_ couchdb.Doc    = &FileDoc{}
 	_ jsonapi.Object = &FileDoc{}
@@ -0,0 +1,46 @@
+package vfs
+
+import (
+	"crypto/md5" // #nosec
+	"crypto/sha256"
+	"hash"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+const (
+	// HashMD5 is the identifier of the MD5 hash algorithm, used for the
+	// checksums of the files by default
+	HashMD5 = config.HashMD5
+	// HashSHA256 is the identifier of the SHA-256 hash algorithm
+	HashSHA256 = config.HashSHA256
+)
+
+// HashAlgorithm returns the identifier of the hash algorithm used to compute
+// the checksum of the file. The files created before the algorithm was
+// selectable have no identifier and use MD5.
+func (f *FileDoc) HashAlgorithm() string {
+	if f.HashAlgo == "" {
+		return HashMD5
+	}
+	return f.HashAlgo
+}
+
+// defaultHashAlgo returns the hash algorithm to use for a new content when
+// the document does not ask for a specific one.
+func defaultHashAlgo() string {
+	if algo := config.GetConfig().Fs.HashAlgo; algo != "" {
+		return algo
+	}
+	return HashMD5
+}
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case HashMD5:
+		return md5.New(), nil // #nosec
+	case HashSHA256:
+		return sha256.New(), nil
+	}
+	return nil, ErrUnknownHashAlgo
+}
@@ -0,0 +1,318 @@
+package vfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+const (
+	// DefaultListLimit is the number of children of a directory returned
+	// when no limit is given
+	DefaultListLimit = 100
+	// MaxListLimit is the maximal number of children of a directory returned
+	// at once
+	MaxListLimit = 1000
+
+	// listBatchSize is the number of documents fetched from couchdb per
+	// request when all the children of a directory are needed
+	listBatchSize = 1000
+)
+
+// ListOptions are the options used to list the children of a directory.
+type ListOptions struct {
+	// Sort is the field used to sort the children: name, size or
+	// updated_at. It can be prefixed by a - for a descending order. The
+	// default is by name.
+	Sort string
+	// Limit is the maximal number of children in the page
+	Limit int
+	// Bookmark is the identifier of the last child of the previous page
+	Bookmark string
+
+	// Class, if not empty, keeps only the files of this class (image,
+	// video, text, etc.)
+	Class string
+	// MinSize and MaxSize, if positive, keep only the files with a size
+	// in this range, in bytes
+	MinSize int64
+	MaxSize int64
+	// Since, if not zero, keeps only the children updated after this date,
+	// compared at the second
+	Since time.Time
+}
+
+// selector returns the mango selector for the children of the directory
+// matching the filters of the options. The sizes are compared on byte_size,
+// as size is serialized as a string: the directories have no byte_size, and
+// are excluded when a size filter is used.
+//
+// The dates are compared as strings by couchdb. They are saved in UTC, but
+// the trailing zeros of the fraction of a second are dropped: "...:05Z" comes
+// after "...:05.5Z". So the updated_at of the children must be strictly
+// greater than the second before the since date, without fraction, which
+// keeps all the dates from the start of the second of the since date.
+func (opts *ListOptions) selector(dirID string) []mango.Filter {
+	filters := []mango.Filter{mango.Equal("dir_id", dirID)}
+	if opts.Class != "" {
+		filters = append(filters, mango.Equal("class", opts.Class))
+	}
+	if opts.MinSize > 0 {
+		filters = append(filters, mango.Gte("byte_size", opts.MinSize))
+	}
+	if opts.MaxSize > 0 {
+		filters = append(filters, mango.Lte("byte_size", opts.MaxSize))
+	}
+	if !opts.Since.IsZero() {
+		before := opts.Since.UTC().Truncate(time.Second).Add(-time.Second)
+		filters = append(filters, mango.Gt("updated_at", before.Format(time.RFC3339)))
+	}
+	return filters
+}
+
+// hasSizeFilter returns true if the options keep only the files in a range
+// of sizes.
+func (opts *ListOptions) hasSizeFilter() bool {
+	return opts.MinSize > 0 || opts.MaxSize > 0
+}
+
+// listSort is the order of the children of a directory in a listing: they
+// are sorted on a field, and on their identifier when the field is equal,
+// like in the couchdb indexes.
+type listSort struct {
+	field string
+	desc  bool
+}
+
+func parseListSort(sort string) (*listSort, error) {
+	s := &listSort{desc: strings.HasPrefix(sort, "-")}
+	switch strings.TrimPrefix(sort, "-") {
+	case "", "name":
+		s.field = "name"
+	case "size":
+		s.field = "byte_size"
+	case "updated_at":
+		s.field = "updated_at"
+	default:
+		return nil, ErrInvalidListSort
+	}
+	return s, nil
+}
+
+func (s *listSort) direction() mango.SortDirection {
+	if s.desc {
+		return mango.Desc
+	}
+	return mango.Asc
+}
+
+// after returns the selector of the children coming after the given one in
+// this order.
+func (s *listSort) after(child *DirOrFileDoc) mango.Filter {
+	var value interface{}
+	switch s.field {
+	case "name":
+		value = child.Name
+	case "byte_size":
+		value = child.ByteSize
+	case "updated_at":
+		value = child.UpdatedAt
+	}
+	if s.desc {
+		return mango.Or(
+			mango.Lt(s.field, value),
+			mango.And(mango.Equal(s.field, value), mango.Lt("_id", child.ID())),
+		)
+	}
+	return mango.Or(
+		mango.Gt(s.field, value),
+		mango.And(mango.Equal(s.field, value), mango.Gt("_id", child.ID())),
+	)
+}
+
+// FetchFilesPage is used to fetch a page of the direct children of the
+// directory, filtered and sorted as asked in the options. It returns the
+// total number of children, and the bookmark to use for the next page (empty
+// for the last page).
+//
+// The children are fetched with a mango query on an index on dir_id and the
+// sort field, starting after the bookmark. When sorted by size, the
+// directories, which have no size, come before the files, or after them in
+// the descending order.
+func (d *DirDoc) FetchFilesPage(c Context, opts *ListOptions) (total int, next string, err error) {
+	sort, err := parseListSort(opts.Sort)
+	if err != nil {
+		return 0, "", err
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	var bookmark *DirOrFileDoc
+	if opts.Bookmark != "" {
+		bookmark = &DirOrFileDoc{}
+		err = couchdb.GetDoc(c, consts.Files, opts.Bookmark, bookmark)
+		if couchdb.IsNotFoundError(err) || (err == nil && bookmark.DirID != d.ID()) {
+			return 0, "", ErrInvalidListBookmark
+		}
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	filters := opts.selector(d.ID())
+	children, err := findChildrenPage(c, filters, sort, bookmark, opts.hasSizeFilter(), limit+1)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(children) > limit {
+		children = children[:limit]
+		next = children[limit-1].ID()
+	}
+
+	total, err = countChildren(c, filters)
+	if err != nil {
+		return 0, "", err
+	}
+
+	d.files, d.dirs, d.contents = nil, nil, nil
+	for _, child := range children {
+		dir, file := child.Refine()
+		if dir != nil {
+			dir.parent = d
+			d.dirs = append(d.dirs, dir)
+			d.contents = append(d.contents, dir)
+		} else {
+			file.parent = d
+			d.files = append(d.files, file)
+			d.contents = append(d.contents, file)
+		}
+	}
+	return total, next, nil
+}
+
+// findChildrenPage returns at most limit children matching the filters,
+// sorted and starting after the bookmark if any.
+//
+// The directories have no byte_size, and are not in the index used to sort
+// by size. For this sort, they are fetched in a separate query, sorted by
+// name, before or after the files.
+func findChildrenPage(c Context, filters []mango.Filter, sort *listSort, bookmark *DirOrFileDoc, noDirs bool, limit int) ([]*DirOrFileDoc, error) {
+	if sort.field != "byte_size" {
+		return findChildren(c, filters, sort, bookmark, limit)
+	}
+
+	byName := &listSort{field: "name", desc: sort.desc}
+	dirFilters := append([]mango.Filter{mango.Equal("type", consts.DirType)}, filters...)
+	fileFilters := append([]mango.Filter{mango.Equal("type", consts.FileType)}, filters...)
+	inDirs := bookmark != nil && bookmark.Type == consts.DirType
+
+	var children []*DirOrFileDoc
+	if sort.desc {
+		if !inDirs {
+			files, err := findChildren(c, fileFilters, sort, bookmark, limit)
+			if err != nil {
+				return nil, err
+			}
+			children, bookmark = files, nil
+		}
+		if noDirs || len(children) >= limit {
+			return children, nil
+		}
+		dirs, err := findChildren(c, dirFilters, byName, bookmark, limit-len(children))
+		if err != nil {
+			return nil, err
+		}
+		return append(children, dirs...), nil
+	}
+
+	if !noDirs && (bookmark == nil || inDirs) {
+		dirs, err := findChildren(c, dirFilters, byName, bookmark, limit)
+		if err != nil {
+			return nil, err
+		}
+		children, bookmark = dirs, nil
+	}
+	if len(children) >= limit {
+		return children, nil
+	}
+	files, err := findChildren(c, fileFilters, sort, bookmark, limit-len(children))
+	if err != nil {
+		return nil, err
+	}
+	return append(children, files...), nil
+}
+
+// findChildren returns at most limit documents matching the filters, sorted
+// on the field of the sort, and starting after the bookmark if any. The sort
+// field is always in the selector, so that couchdb uses the index on it.
+func findChildren(c Context, filters []mango.Filter, sort *listSort, bookmark *DirOrFileDoc, limit int) ([]*DirOrFileDoc, error) {
+	filters = append(filters[:len(filters):len(filters)], mango.Gt(sort.field, nil))
+	if bookmark != nil {
+		filters = append(filters, sort.after(bookmark))
+	}
+	var docs []*DirOrFileDoc
+	req := &couchdb.FindRequest{
+		Selector: mango.And(filters...),
+		Sort: &mango.SortByFields{
+			Fields:    []string{"dir_id", sort.field},
+			Direction: sort.direction(),
+		},
+		Limit: limit,
+	}
+	if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// countChildren returns the number of documents matching the filters. Only
+// their identifiers are fetched.
+func countChildren(c Context, filters []mango.Filter) (int, error) {
+	count := 0
+	for skip := 0; ; skip += listBatchSize {
+		var docs []*DirOrFileDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.And(filters...),
+			Fields:   []string{"_id"},
+			Limit:    listBatchSize,
+			Skip:     skip,
+		}
+		if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+			return 0, err
+		}
+		count += len(docs)
+		if len(docs) < listBatchSize {
+			return count, nil
+		}
+	}
+}
+
+// fetchAllChildren returns all the direct children of a directory, in no
+// particular order.
+func fetchAllChildren(c Context, dirID string) ([]*DirOrFileDoc, error) {
+	var children []*DirOrFileDoc
+	for skip := 0; ; skip += listBatchSize {
+		var docs []*DirOrFileDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.Equal("dir_id", dirID),
+			Limit:    listBatchSize,
+			Skip:     skip,
+		}
+		if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+			return nil, err
+		}
+		children = append(children, docs...)
+		if len(docs) < listBatchSize {
+			return children, nil
+		}
+	}
+}
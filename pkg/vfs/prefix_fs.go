@@ -0,0 +1,189 @@
+package vfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// PrefixFs is an afero.Fs that namespaces all the paths under a prefix of an
+// underlying filesystem. It is used to isolate the files of an instance from
+// the files of the other instances sharing the same disk: the paths trying
+// to escape from the prefix with some .. are rejected.
+type PrefixFs struct {
+	source afero.Fs
+	prefix string
+}
+
+// NewPrefixFs returns a filesystem where all the paths are relative to the
+// given prefix of the source filesystem.
+func NewPrefixFs(source afero.Fs, prefix string) afero.Fs {
+	return &PrefixFs{source: source, prefix: filepath.Clean("/" + prefix)}
+}
+
+// realPath returns the path in the source filesystem for the given name. If
+// the name is outside of the prefix, it is returned unchanged with the
+// ErrIllegalPath error.
+func (p *PrefixFs) realPath(name string) (string, error) {
+	rel := path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return name, ErrIllegalPath
+	}
+	return filepath.Join(p.prefix, filepath.FromSlash(rel)), nil
+}
+
+// cleanError removes the prefix from the paths in the errors, to not leak
+// the location of the files on the disk.
+func (p *PrefixFs) cleanError(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return &os.PathError{Op: e.Op, Path: p.trimPrefix(e.Path), Err: e.Err}
+	case *os.LinkError:
+		return &os.LinkError{Op: e.Op, Old: p.trimPrefix(e.Old), New: p.trimPrefix(e.New), Err: e.Err}
+	}
+	return err
+}
+
+func (p *PrefixFs) trimPrefix(name string) string {
+	if p.prefix == string(filepath.Separator) {
+		return name
+	}
+	name = strings.TrimPrefix(name, p.prefix)
+	if name == "" {
+		return string(filepath.Separator)
+	}
+	return name
+}
+
+func (p *PrefixFs) wrapFile(f afero.File, err error) (afero.File, error) {
+	if err != nil {
+		return nil, p.cleanError(err)
+	}
+	return &prefixFile{File: f, fs: p}, nil
+}
+
+// Name implements the Name method of the afero.Fs interface
+func (p *PrefixFs) Name() string {
+	return "PrefixFs"
+}
+
+// Create implements the Create method of the afero.Fs interface
+func (p *PrefixFs) Create(name string) (afero.File, error) {
+	name, err := p.realPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: name, Err: err}
+	}
+	return p.wrapFile(p.source.Create(name))
+}
+
+// Mkdir implements the Mkdir method of the afero.Fs interface
+func (p *PrefixFs) Mkdir(name string, perm os.FileMode) error {
+	name, err := p.realPath(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return p.cleanError(p.source.Mkdir(name, perm))
+}
+
+// MkdirAll implements the MkdirAll method of the afero.Fs interface
+func (p *PrefixFs) MkdirAll(name string, perm os.FileMode) error {
+	name, err := p.realPath(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return p.cleanError(p.source.MkdirAll(name, perm))
+}
+
+// Open implements the Open method of the afero.Fs interface
+func (p *PrefixFs) Open(name string) (afero.File, error) {
+	name, err := p.realPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return p.wrapFile(p.source.Open(name))
+}
+
+// OpenFile implements the OpenFile method of the afero.Fs interface
+func (p *PrefixFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	name, err := p.realPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return p.wrapFile(p.source.OpenFile(name, flag, perm))
+}
+
+// Remove implements the Remove method of the afero.Fs interface
+func (p *PrefixFs) Remove(name string) error {
+	name, err := p.realPath(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return p.cleanError(p.source.Remove(name))
+}
+
+// RemoveAll implements the RemoveAll method of the afero.Fs interface
+func (p *PrefixFs) RemoveAll(name string) error {
+	name, err := p.realPath(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return p.cleanError(p.source.RemoveAll(name))
+}
+
+// Rename implements the Rename method of the afero.Fs interface
+func (p *PrefixFs) Rename(oldname, newname string) error {
+	oldpath, err := p.realPath(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	newpath, err := p.realPath(newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return p.cleanError(p.source.Rename(oldpath, newpath))
+}
+
+// Stat implements the Stat method of the afero.Fs interface
+func (p *PrefixFs) Stat(name string) (os.FileInfo, error) {
+	name, err := p.realPath(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info, err := p.source.Stat(name)
+	return info, p.cleanError(err)
+}
+
+// Chmod implements the Chmod method of the afero.Fs interface
+func (p *PrefixFs) Chmod(name string, mode os.FileMode) error {
+	name, err := p.realPath(name)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return p.cleanError(p.source.Chmod(name, mode))
+}
+
+// Chtimes implements the Chtimes method of the afero.Fs interface
+func (p *PrefixFs) Chtimes(name string, atime, mtime time.Time) error {
+	name, err := p.realPath(name)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: name, Err: err}
+	}
+	return p.cleanError(p.source.Chtimes(name, atime, mtime))
+}
+
+// prefixFile is a file opened from a PrefixFs: its name is relative to the
+// prefix.
+type prefixFile struct {
+	afero.File
+	fs *PrefixFs
+}
+
+func (f *prefixFile) Name() string {
+	return f.fs.trimPrefix(f.File.Name())
+}
+
+var _ afero.Fs = &PrefixFs{}
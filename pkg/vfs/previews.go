@@ -0,0 +1,159 @@
+package vfs
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/spf13/afero"
+)
+
+// PreviewsDirName is the path of the directory in which the previews of the
+// files are kept
+const PreviewsDirName = "/.cozy_previews"
+
+// PreviewMime is the content type of the previews
+const PreviewMime = "image/png"
+
+const (
+	// previewExt is the extension of the preview of a content
+	previewExt = ".png"
+	// previewFailedExt is the extension of the empty file that marks a
+	// content for which no preview can be generated
+	previewFailedExt = ".failed"
+)
+
+// previewableMimes is the list of the mime types of the documents that can
+// have a preview: PDF and the usual office documents.
+var previewableMimes = map[string]bool{
+	"application/pdf":                                                           true,
+	"application/msword":                                                        true,
+	"application/vnd.ms-excel":                                                  true,
+	"application/vnd.ms-powerpoint":                                             true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+	"application/vnd.oasis.opendocument.spreadsheet":                            true,
+	"application/vnd.oasis.opendocument.presentation":                           true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+}
+
+// IsPreviewable returns true if a preview can be generated for the documents
+// with the given mime type.
+func IsPreviewable(mime string) bool {
+	return previewableMimes[mime]
+}
+
+// previewPath returns the path of the preview of the current content of the
+// file. The checksum of the content is in the name, so that the preview of a
+// previous content is never used for the new one.
+func previewPath(doc *FileDoc, ext string) string {
+	return path.Join(PreviewsDirName, doc.ID(), hex.EncodeToString(doc.MD5Sum)+ext)
+}
+
+// HasPreview returns true if the preview of the current content of the file
+// has been generated, or if it is known that it can't be.
+func HasPreview(c Context, doc *FileDoc) bool {
+	for _, ext := range []string{previewExt, previewFailedExt} {
+		if _, err := c.FS().Stat(previewPath(doc, ext)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// StorePreview stores the given image as the preview of the current content
+// of the file. The previews of the previous contents are removed.
+func StorePreview(c Context, doc *FileDoc, image io.Reader) error {
+	return storePreview(c, doc, previewExt, image)
+}
+
+// MarkPreviewFailed records that no preview can be generated for the current
+// content of the file, so that it is not tried again.
+func MarkPreviewFailed(c Context, doc *FileDoc) error {
+	return storePreview(c, doc, previewFailedExt, nil)
+}
+
+func storePreview(c Context, doc *FileDoc, ext string, content io.Reader) error {
+	if err := DestroyPreviews(c, doc); err != nil {
+		return err
+	}
+	dir := path.Join(PreviewsDirName, doc.ID())
+	if err := c.FS().MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := c.FS().OpenFile(previewPath(doc, ext), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var written int64
+	if content != nil {
+		written, err = io.Copy(f, content)
+	}
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.FS().RemoveAll(dir)
+		return err
+	}
+	updateCachedDiskUsage(c, written)
+	return nil
+}
+
+// ServePreview sends the preview of the current content of the file. It
+// returns an os.ErrNotExist error if there is no preview.
+func ServePreview(c Context, doc *FileDoc, req *http.Request, w http.ResponseWriter) error {
+	content, err := c.FS().Open(previewPath(doc, previewExt))
+	if os.IsNotExist(err) {
+		return os.ErrNotExist
+	}
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	w.Header().Set("Content-Type", PreviewMime)
+	http.ServeContent(w, req, "preview"+previewExt, doc.UpdatedAt, content)
+	return nil
+}
+
+// DestroyPreviews removes the previews of the given file.
+func DestroyPreviews(c Context, doc *FileDoc) error {
+	dir := path.Join(PreviewsDirName, doc.ID())
+	size, err := previewsSize(c, dir)
+	if err != nil {
+		return err
+	}
+	if err = c.FS().RemoveAll(dir); err != nil {
+		return err
+	}
+	updateCachedDiskUsage(c, -size)
+	return nil
+}
+
+// previewsDiskUsage returns the total size of the previews of the files.
+func previewsDiskUsage(c Context) (int64, error) {
+	return previewsSize(c, PreviewsDirName)
+}
+
+// previewsSize returns the size of the previews in the given directory, or 0
+// if it does not exist.
+func previewsSize(c Context, dir string) (int64, error) {
+	var size int64
+	err := afero.Walk(c.FS(), dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return size, err
+}
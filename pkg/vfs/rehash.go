@@ -0,0 +1,126 @@
+package vfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// rehashBatchSize is the number of files fetched from couchdb per request
+// by the migration to SHA-256
+const rehashBatchSize = 100
+
+// RehashOptions are the options of the migration of the files to SHA-256
+type RehashOptions struct {
+	// SkipTrashed keeps the files in the trash without their SHA-256
+	SkipTrashed bool
+	// Pause is the delay between two files, to avoid an IO storm on the
+	// disks
+	Pause time.Duration
+	// Progress, if not nil, is called after each file
+	Progress func(report *RehashReport)
+}
+
+// RehashReport is the report of the migration of the files to SHA-256
+type RehashReport struct {
+	Rehashed int `json:"rehashed"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+}
+
+// RehashToSHA256 computes the SHA-256 checksum of the content of the files
+// that don't have one yet, and adds it to their document. The content is
+// streamed from the disk, and the other fields, like the MD5 checksum, are
+// kept as is.
+//
+// The migration can be interrupted with the context, and resumed later by
+// calling this function again: the files that have already been migrated are
+// not read again. The files that can't be migrated, because they have been
+// modified in the meantime for example, are counted as failed and will be
+// tried again on the next call.
+func RehashToSHA256(ctx context.Context, c Context, opts *RehashOptions) (*RehashReport, error) {
+	report := &RehashReport{}
+	lastID := ""
+	for {
+		var docs []*FileDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.And(
+				mango.Gt("_id", lastID),
+				mango.Equal("type", consts.FileType),
+				mango.NotExists("sha256sum"),
+			),
+			Sort:  &mango.SortByFields{Fields: []string{"_id"}, Direction: mango.Asc},
+			Limit: rehashBatchSize,
+		}
+		if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+			return report, err
+		}
+
+		for _, doc := range docs {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			lastID = doc.ID()
+
+			if opts.SkipTrashed && isFileInTrash(c, doc) {
+				report.Skipped++
+			} else if err := rehashFile(c, doc); err != nil {
+				report.Failed++
+			} else {
+				report.Rehashed++
+			}
+			if opts.Progress != nil {
+				opts.Progress(report)
+			}
+
+			if opts.Pause > 0 {
+				select {
+				case <-ctx.Done():
+					return report, ctx.Err()
+				case <-time.After(opts.Pause):
+				}
+			}
+		}
+
+		if len(docs) < rehashBatchSize {
+			return report, nil
+		}
+	}
+}
+
+func isFileInTrash(c Context, doc *FileDoc) bool {
+	if doc.RestorePath != "" {
+		return true
+	}
+	fullpath, err := doc.Path(c)
+	return err == nil && IsInTrash(c, fullpath)
+}
+
+// rehashFile computes the SHA-256 checksum of the content of the file, and
+// saves it in its document.
+func rehashFile(c Context, doc *FileDoc) error {
+	if doc.HashAlgorithm() == HashSHA256 {
+		doc.SHA256Sum = doc.MD5Sum
+		return couchdb.UpdateDoc(c, doc)
+	}
+
+	f, err := Open(c, doc)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if errc := f.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	doc.SHA256Sum = h.Sum(nil)
+	return couchdb.UpdateDoc(c, doc)
+}
@@ -0,0 +1,236 @@
+package vfs
+
+import (
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// ReindexReport is the report of the operations made by Reindex
+type ReindexReport struct {
+	Indexes  []IndexReport `json:"indexes"`
+	Views    string        `json:"views"`
+	RootDir  string        `json:"root_dir"`
+	TrashDir string        `json:"trash_dir"`
+
+	// ByteSizes is the number of files that were given their byte_size
+	ByteSizes int `json:"byte_sizes"`
+	// UTCDates is the number of files and directories whose dates were
+	// converted to UTC
+	UTCDates int `json:"utc_dates"`
+}
+
+// IndexReport says if an index has been created or if it already existed
+type IndexReport struct {
+	Doctype string `json:"doctype"`
+	Fields  string `json:"fields"`
+	Result  string `json:"result"`
+}
+
+const (
+	reindexCreated = "created"
+	reindexExists  = "exists"
+)
+
+// Reindex (re)defines the indexes and views used by the VFS, and checks that
+// the root and trash directories exist, to recreate them else. The files
+// written before the byte_size field was added are given one, and the dates
+// saved with a time zone are converted to UTC. It can be called several
+// times: what already exists is kept as is.
+func Reindex(c Context) (*ReindexReport, error) {
+	report := &ReindexReport{}
+
+	err := couchdb.CreateDB(c, consts.FilesVersions)
+	if err != nil && !couchdb.IsFileExists(err) {
+		return nil, err
+	}
+	for _, index := range Indexes {
+		res, err := defineIndex(c, consts.Files, index)
+		if err != nil {
+			return nil, err
+		}
+		report.Indexes = append(report.Indexes, *res)
+	}
+	res, err := defineIndex(c, consts.FilesVersions, VersionsIndex)
+	if err != nil {
+		return nil, err
+	}
+	report.Indexes = append(report.Indexes, *res)
+	err = couchdb.DefineViews(c, consts.FilesVersions, VersionsViews)
+	if err != nil && !couchdb.IsConflictError(err) {
+		return nil, err
+	}
+
+	report.Views = reindexCreated
+	err = couchdb.DefineViews(c, consts.Files, Views)
+	if couchdb.IsConflictError(err) {
+		report.Views = reindexExists
+	} else if err != nil {
+		return nil, err
+	}
+
+	report.RootDir, err = ensureDir(c, consts.RootDirID, CreateRootDirDoc)
+	if err != nil {
+		return nil, err
+	}
+	report.TrashDir, err = ensureDir(c, consts.TrashDirID, CreateTrashDir)
+	if err != nil {
+		return nil, err
+	}
+
+	report.ByteSizes, err = fillByteSizes(c)
+	if err != nil {
+		return nil, err
+	}
+
+	report.UTCDates, err = convertDatesToUTC(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func defineIndex(c Context, doctype string, index mango.Index) (*IndexReport, error) {
+	res, err := couchdb.DefineIndexRaw(c, doctype, &index)
+	if err != nil {
+		return nil, err
+	}
+	result := reindexCreated
+	if res.Result == "exists" {
+		result = reindexExists
+	}
+	return &IndexReport{
+		Doctype: doctype,
+		Fields:  strings.Join(index.Index, ","),
+		Result:  result,
+	}, nil
+}
+
+// ensureDir calls the create function if the directory with the given id
+// does not exist.
+func ensureDir(c Context, dirID string, create func(c Context) error) (string, error) {
+	err := couchdb.GetDoc(c, consts.Files, dirID, &DirDoc{})
+	if err == nil {
+		return reindexExists, nil
+	}
+	if !couchdb.IsNotFoundError(err) {
+		return "", err
+	}
+	err = create(c)
+	if couchdb.IsConflictError(err) {
+		return reindexExists, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return reindexCreated, nil
+}
+
+// fillByteSizes adds the byte_size field to the files that don't have it,
+// and returns the number of updated files. The files modified in the
+// meantime are skipped, and will be updated by the next call.
+func fillByteSizes(c Context) (int, error) {
+	filled := 0
+	lastID := ""
+	for {
+		var docs []*FileDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.And(
+				mango.Gt("_id", lastID),
+				mango.Equal("type", consts.FileType),
+				mango.NotExists("byte_size"),
+			),
+			Sort:  &mango.SortByFields{Fields: []string{"_id"}, Direction: mango.Asc},
+			Limit: listBatchSize,
+		}
+		if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+			return filled, err
+		}
+		if len(docs) == 0 {
+			return filled, nil
+		}
+		bulk := make([]couchdb.Doc, len(docs))
+		for i, doc := range docs {
+			size := doc.Size
+			doc.ByteSize = &size
+			bulk[i] = doc
+		}
+		results, err := couchdb.BulkUpdateDocs(c, consts.Files, bulk)
+		if err != nil {
+			return filled, err
+		}
+		for _, res := range results {
+			if res.Error == "" {
+				filled++
+			}
+		}
+		lastID = docs[len(docs)-1].ID()
+	}
+}
+
+// convertDatesToUTC saves in UTC the dates of the files and directories
+// saved with another time zone, and returns the number of updated documents.
+// The dates are compared as strings by couchdb, for the listings, and it
+// works only if they all have the same time zone.
+func convertDatesToUTC(c Context) (int, error) {
+	converted := 0
+	lastID := ""
+	for {
+		var docs []couchdb.JSONDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.Gt("_id", lastID),
+			Sort:     &mango.SortByFields{Fields: []string{"_id"}, Direction: mango.Asc},
+			Limit:    listBatchSize,
+		}
+		if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+			return converted, err
+		}
+		if len(docs) == 0 {
+			return converted, nil
+		}
+		var bulk []couchdb.Doc
+		for _, doc := range docs {
+			doc.Type = consts.Files
+			created := dateToUTC(doc, "created_at")
+			updated := dateToUTC(doc, "updated_at")
+			if created || updated {
+				bulk = append(bulk, doc)
+			}
+		}
+		if len(bulk) > 0 {
+			results, err := couchdb.BulkUpdateDocs(c, consts.Files, bulk)
+			if err != nil {
+				return converted, err
+			}
+			for _, res := range results {
+				if res.Error == "" {
+					converted++
+				}
+			}
+		}
+		lastID = docs[len(docs)-1].ID()
+	}
+}
+
+// dateToUTC converts the date of the given field of the document to UTC,
+// and returns true if it has been modified.
+func dateToUTC(doc couchdb.JSONDoc, field string) bool {
+	value, ok := doc.M[field].(string)
+	if !ok {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return false
+	}
+	utc := t.UTC().Format(time.RFC3339Nano)
+	if utc == value {
+		return false
+	}
+	doc.M[field] = utc
+	return true
+}
@@ -0,0 +1,94 @@
+package vfs
+
+import (
+	"unicode/utf8"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+)
+
+// TextMime is the mime type given to the files uploaded without a mime type
+// whose content looks like text
+const TextMime = "text/plain"
+
+const (
+	// TextClass is the class of the files with a generic mime type whose
+	// content looks like text
+	TextClass = "text"
+	// BinaryClass is the class of the files with a generic mime type whose
+	// content does not look like text
+	BinaryClass = "binary"
+)
+
+const (
+	// sniffLen is the number of bytes at the beginning of the content that
+	// are used to detect if it is text or binary
+	sniffLen = 512
+	// maxControlRatio is the maximal ratio of control characters for a
+	// content to be considered as text
+	maxControlRatio = 0.1
+)
+
+// isGenericMime returns true for the mime types that tell nothing about the
+// content of a file, like the default one.
+func isGenericMime(mime string) bool {
+	return mime == "" || mime == DefaultContentType
+}
+
+// defaultMime returns the mime type of the files uploaded without a mime type
+// that can't be guessed from their name or their content.
+func defaultMime() string {
+	if mime := config.GetConfig().Fs.DefaultMime; mime != "" {
+		return mime
+	}
+	return DefaultContentType
+}
+
+// guessMimeAndClass returns the mime type and the class of a file uploaded
+// without a mime type, from the class sniffed from its content: a text is
+// text/plain, and the other files have the default mime type.
+func guessMimeAndClass(sniffed string) (mime, class string) {
+	if sniffed == TextClass {
+		return TextMime, TextClass
+	}
+	mime, class = ExtractMimeAndClass(defaultMime())
+	if sniffed != "" && isGenericMime(mime) {
+		class = sniffed
+	}
+	return mime, class
+}
+
+// sniffClass returns the class of a content, TextClass or BinaryClass, from
+// its first bytes: a text is valid UTF-8 without NUL bytes and with only a
+// few control characters. An empty string is returned for an empty content.
+func sniffClass(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	// the first block may end in the middle of a multi-bytes character
+	for i := 0; i < utf8.UTFMax-1 && !utf8.Valid(data); i++ {
+		if len(data) < sniffLen {
+			break
+		}
+		data = data[:len(data)-1]
+	}
+	if !utf8.Valid(data) {
+		return BinaryClass
+	}
+
+	controls := 0
+	for _, b := range data {
+		switch {
+		case b == 0:
+			return BinaryClass
+		case b == '\t', b == '\n', b == '\r', b == '\f', b == '\b', b == 0x1b:
+			// usual whitespaces and escape sequences in text files
+		case b < 0x20 || b == 0x7f:
+			controls++
+		}
+	}
+	if float64(controls)/float64(len(data)) > maxControlRatio {
+		return BinaryClass
+	}
+	return TextClass
+}
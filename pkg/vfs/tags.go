@@ -0,0 +1,47 @@
+package vfs
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+)
+
+// ModifyTags adds and removes some tags on several files and directories, in
+// a single bulk request to couchdb. The tags that are not mentioned are kept.
+// The result of the modification of each document is returned in the same
+// order than the documents.
+func ModifyTags(c Context, docs []couchdb.Doc, add, remove []string) ([]couchdb.BulkResult, error) {
+	for _, doc := range docs {
+		switch d := doc.(type) {
+		case *DirDoc:
+			d.Tags = applyTags(d.Tags, add, remove)
+		case *FileDoc:
+			d.Tags = applyTags(d.Tags, add, remove)
+		default:
+			return nil, os.ErrInvalid
+		}
+	}
+	if len(docs) == 0 {
+		return []couchdb.BulkResult{}, nil
+	}
+	return couchdb.BulkUpdateDocs(c, consts.Files, docs)
+}
+
+// applyTags returns the tags with the added tags, and without the removed
+// ones.
+func applyTags(tags, add, remove []string) []string {
+	tags = uniqueTags(append(append([]string{}, tags...), add...))
+	removed := make(map[string]struct{}, len(remove))
+	for _, tag := range remove {
+		removed[strings.TrimSpace(tag)] = struct{}{}
+	}
+	kept := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if _, ok := removed[tag]; !ok {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
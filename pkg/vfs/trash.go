@@ -0,0 +1,90 @@
+package vfs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+)
+
+// RestoreAllError is the error returned by RestoreAll when some files or
+// directories of the trash can't be restored. It gives the error for each
+// of them, by identifier.
+type RestoreAllError map[string]error
+
+func (e RestoreAllError) Error() string {
+	return fmt.Sprintf("%d files or directories cannot be restored", len(e))
+}
+
+// RestoreAll restores all the files and directories of the trash where they
+// were before being trashed. Like for RestoreFile and RestoreDir, the
+// missing directories are re-created, and a suffix is added to the names
+// already taken. The restoration continues when an item can't be restored:
+// a RestoreAllError is then returned with the restored documents.
+func RestoreAll(c Context) ([]*FileDoc, []*DirDoc, error) {
+	trash, err := GetDirDoc(c, consts.TrashDirID, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	children, err := fetchAllChildren(c, trash.ID())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var trashedDirs []*DirDoc
+	var trashedFiles []*FileDoc
+	for _, child := range children {
+		dir, file := child.Refine()
+		if dir != nil {
+			dir.parent = trash
+			trashedDirs = append(trashedDirs, dir)
+		} else if file != nil {
+			file.parent = trash
+			trashedFiles = append(trashedFiles, file)
+		}
+	}
+
+	// the directories are restored before the files, and the parents before
+	// their children, so that the files go back in the restored directories
+	// instead of new ones
+	sort.Sort(dirsByRestorePath(trashedDirs))
+
+	errs := make(RestoreAllError)
+	var dirs []*DirDoc
+	for _, olddoc := range trashedDirs {
+		newdoc, err := RestoreDir(c, olddoc)
+		if err != nil {
+			errs[olddoc.ID()] = err
+			continue
+		}
+		dirs = append(dirs, newdoc)
+	}
+	var files []*FileDoc
+	for _, olddoc := range trashedFiles {
+		newdoc, err := RestoreFile(c, olddoc)
+		if err != nil {
+			errs[olddoc.ID()] = err
+			continue
+		}
+		files = append(files, newdoc)
+	}
+
+	if len(errs) > 0 {
+		return files, dirs, errs
+	}
+	return files, dirs, nil
+}
+
+// dirsByRestorePath sorts the trashed directories by the depth of the path
+// where they are restored.
+type dirsByRestorePath []*DirDoc
+
+func (d dirsByRestorePath) Len() int           { return len(d) }
+func (d dirsByRestorePath) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d dirsByRestorePath) Less(i, j int) bool { return d.depth(i) < d.depth(j) }
+
+func (d dirsByRestorePath) depth(i int) int {
+	return strings.Count(path.Join(d[i].RestorePath, d[i].Name), "/")
+}
@@ -0,0 +1,166 @@
+package vfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// Usage is the disk usage of the files, in bytes. Used is the total, as it
+// is counted for the disk quota. The files in the trash are not counted in
+// the usage by class, but only in Trashed, the previous contents of the
+// files only in Versions, and their previews only in Previews.
+type Usage struct {
+	Used     int64
+	Classes  map[string]int64
+	Trashed  int64
+	Versions int64
+	Previews int64
+}
+
+// ComputeUsage computes the disk usage of the files, with the reduce views
+// by class and by directory. The usage of the trash is fetched with a single
+// request, for all the classes of all the directories inside it.
+func ComputeUsage(c Context) (*Usage, error) {
+	var byClass struct {
+		Rows []struct {
+			Key   string `json:"key"`
+			Value int64  `json:"value"`
+		} `json:"rows"`
+	}
+	req := &couchdb.ViewRequest{Group: true}
+	err := couchdb.ExecViewWithRequest(c, consts.Files, DiskUsageByClassView, req, &byClass)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &Usage{Classes: make(map[string]int64)}
+	for _, row := range byClass.Rows {
+		usage.Used += row.Value
+		usage.Classes[row.Key] += row.Value
+	}
+
+	trashDirs, err := fetchTrashDirIDs(c)
+	if err != nil {
+		return nil, err
+	}
+	var keys []interface{}
+	for _, dirID := range trashDirs {
+		for _, row := range byClass.Rows {
+			keys = append(keys, []string{dirID, row.Key})
+		}
+	}
+	if len(keys) > 0 {
+		var byDir struct {
+			Rows []struct {
+				Key   []string `json:"key"`
+				Value int64    `json:"value"`
+			} `json:"rows"`
+		}
+		req = &couchdb.ViewRequest{Group: true, Keys: keys}
+		err = couchdb.ExecViewWithRequest(c, consts.Files, DiskUsageByDirView, req, &byDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range byDir.Rows {
+			if len(row.Key) != 2 {
+				continue
+			}
+			usage.Trashed += row.Value
+			usage.Classes[row.Key[1]] -= row.Value
+		}
+	}
+
+	for class, size := range usage.Classes {
+		if size <= 0 {
+			delete(usage.Classes, class)
+		}
+	}
+
+	usage.Versions, err = versionsDiskUsage(c)
+	if err != nil {
+		return nil, err
+	}
+	usage.Previews, err = previewsDiskUsage(c)
+	if err != nil {
+		return nil, err
+	}
+	usage.Used += usage.Versions + usage.Previews
+	return usage, nil
+}
+
+// fetchTrashDirIDs returns the identifiers of the trash and of all the
+// directories inside it.
+func fetchTrashDirIDs(c Context) ([]string, error) {
+	ids := []string{consts.TrashDirID}
+	for skip := 0; ; skip += listBatchSize {
+		var docs []*DirDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.StartWith("path", TrashPath(c)+"/"),
+			Fields:   []string{"_id"},
+			Limit:    listBatchSize,
+			Skip:     skip,
+		}
+		if err := couchdb.FindDocs(c, consts.Files, req, &docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			ids = append(ids, doc.ID())
+		}
+		if len(docs) < listBatchSize {
+			return ids, nil
+		}
+	}
+}
+
+// usageCacheTTL is the duration for which the disk usage of an instance is
+// kept in memory to check its quota, instead of querying the view on each
+// upload.
+const usageCacheTTL = 1 * time.Minute
+
+type cachedUsage struct {
+	used      int64
+	fetchedAt time.Time
+}
+
+var (
+	usageCache   = make(map[string]cachedUsage)
+	usageCacheMu sync.Mutex
+)
+
+// cachedDiskUsage is like DiskUsage, but the usage is cached for
+// usageCacheTTL. The cached usage is kept up to date with the contents
+// written and destroyed by this process, and the TTL bounds the drift with
+// the other ones.
+func cachedDiskUsage(c Context) (int64, error) {
+	key := c.Prefix()
+	usageCacheMu.Lock()
+	cached, ok := usageCache[key]
+	usageCacheMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < usageCacheTTL {
+		return cached.used, nil
+	}
+	used, err := DiskUsage(c)
+	if err != nil {
+		return 0, err
+	}
+	usageCacheMu.Lock()
+	usageCache[key] = cachedUsage{used: used, fetchedAt: time.Now()}
+	usageCacheMu.Unlock()
+	return used, nil
+}
+
+// updateCachedDiskUsage adds delta bytes to the cached disk usage of the
+// context, if any.
+func updateCachedDiskUsage(c Context, delta int64) {
+	key := c.Prefix()
+	usageCacheMu.Lock()
+	defer usageCacheMu.Unlock()
+	if cached, ok := usageCache[key]; ok {
+		cached.used += delta
+		usageCache[key] = cached
+	}
+}
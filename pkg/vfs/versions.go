@@ -0,0 +1,320 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// VersionsDirName is the path of the directory in which the previous
+// contents of the files are kept
+const VersionsDirName = "/.cozy_versions"
+
+// VersionsIndex is the index used to lookup the versions of a file
+var VersionsIndex = mango.IndexOnFields("file_id")
+
+// VersionsUsageView is the name of the view used for computing the disk
+// usage of the versions
+const VersionsUsageView = "versions-usage"
+
+// VersionsViews is the couchdb views required for the versions
+var VersionsViews = couchdb.Views{
+	VersionsUsageView: couchdb.View{
+		Map:    "function(doc) { if (doc.file_id) emit(doc._id, +doc.size); }",
+		Reduce: "_sum",
+	},
+}
+
+// FileVersion is a struct describing a previous content of a file. It
+// implements the couchdb.Doc and jsonapi.Object interfaces.
+type FileVersion struct {
+	DocID  string `json:"_id,omitempty"`
+	DocRev string `json:"_rev,omitempty"`
+	// FileID is the identifier of the file this version belongs to
+	FileID string `json:"file_id"`
+	// FileRev is the revision of the file document when it had this content
+	FileRev string `json:"file_rev"`
+
+	// UpdatedAt is the date of the last modification of this content
+	UpdatedAt time.Time `json:"updated_at"`
+
+	Size       int64  `json:"size,string"`
+	MD5Sum     []byte `json:"md5sum"`
+	HashAlgo   string `json:"hash_algo,omitempty"`
+	Mime       string `json:"mime"`
+	Class      string `json:"class"`
+	Executable bool   `json:"executable"`
+}
+
+// ID returns the version qualified identifier
+func (v *FileVersion) ID() string { return v.DocID }
+
+// Rev returns the version revision
+func (v *FileVersion) Rev() string { return v.DocRev }
+
+// DocType returns the version document type
+func (v *FileVersion) DocType() string { return consts.FilesVersions }
+
+// SetID changes the version qualified identifier
+func (v *FileVersion) SetID(id string) { v.DocID = id }
+
+// SetRev changes the version revision
+func (v *FileVersion) SetRev(rev string) { v.DocRev = rev }
+
+// Links is used to generate a JSON-API link for the version
+func (v *FileVersion) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + v.FileID + "/versions/" + v.DocID}
+}
+
+// Relationships is used to generate the parent relationship in JSON-API format
+func (v *FileVersion) Relationships() jsonapi.RelationshipMap {
+	return jsonapi.RelationshipMap{
+		"file": jsonapi.Relationship{
+			Data: jsonapi.ResourceIdentifier{
+				ID:   v.FileID,
+				Type: consts.Files,
+			},
+		},
+	}
+}
+
+// Included is part of the jsonapi.Object interface
+func (v *FileVersion) Included() []jsonapi.Object {
+	return []jsonapi.Object{}
+}
+
+func (v *FileVersion) path() string {
+	return path.Join(VersionsDirName, v.FileID, v.DocID)
+}
+
+type versionsByDate []*FileVersion
+
+func (v versionsByDate) Len() int           { return len(v) }
+func (v versionsByDate) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+func (v versionsByDate) Less(i, j int) bool { return v[i].UpdatedAt.After(v[j].UpdatedAt) }
+
+// ListFileVersions returns the versions kept for the given file, the most
+// recent first.
+func ListFileVersions(c Context, doc *FileDoc) ([]*FileVersion, error) {
+	versions, err := findFileVersions(c, doc.ID())
+	if couchdb.IsNoDatabaseError(err) {
+		return []*FileVersion{}, nil
+	}
+	return versions, err
+}
+
+// GetFileVersion returns the version of the given file with the specified
+// identifier.
+func GetFileVersion(c Context, doc *FileDoc, versionID string) (*FileVersion, error) {
+	v := &FileVersion{}
+	err := couchdb.GetDoc(c, consts.FilesVersions, versionID, v)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v.FileID != doc.ID() {
+		return nil, os.ErrNotExist
+	}
+	return v, nil
+}
+
+// RestoreFileVersion replaces the content of the file by the content of the
+// given version. The current content is itself kept as a version.
+func RestoreFileVersion(c Context, olddoc *FileDoc, versionID string) (*FileDoc, error) {
+	v, err := GetFileVersion(c, olddoc, versionID)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := c.FS().Open(v.path())
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	newdoc, err := NewFileDoc(olddoc.Name, olddoc.DirID, v.Size, v.MD5Sum,
+		v.Mime, v.Class, olddoc.CreatedAt, v.Executable, olddoc.Tags)
+	if err != nil {
+		return nil, err
+	}
+	newdoc.ReferencedBy = olddoc.ReferencedBy
+	newdoc.HashAlgo = v.HashAlgo
+
+	file, err := CreateFile(c, newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// DestroyFileVersions removes all the versions of the given file.
+func DestroyFileVersions(c Context, doc *FileDoc) error {
+	versions, err := findFileVersions(c, doc.ID())
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err = destroyFileVersion(c, v); err != nil {
+			return err
+		}
+	}
+	return c.FS().RemoveAll(path.Join(VersionsDirName, doc.ID()))
+}
+
+// keepFileVersion keeps the content of olddoc, currently at bakpath, as a
+// version of the file, if the versions are enabled. It then removes the
+// oldest versions exceeding the limits of the configuration.
+func keepFileVersion(c Context, olddoc *FileDoc, bakpath string) error {
+	cfg := config.GetConfig().Fs.Versions
+	if cfg.MaxNumber <= 0 {
+		return nil
+	}
+
+	versions, err := findFileVersions(c, olddoc.ID())
+	if couchdb.IsNoDatabaseError(err) {
+		if err = createVersionsDB(c); err != nil {
+			return err
+		}
+		versions, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	v := &FileVersion{
+		FileID:     olddoc.ID(),
+		FileRev:    olddoc.Rev(),
+		UpdatedAt:  olddoc.UpdatedAt,
+		Size:       olddoc.Size,
+		MD5Sum:     olddoc.MD5Sum,
+		HashAlgo:   olddoc.HashAlgo,
+		Mime:       olddoc.Mime,
+		Class:      olddoc.Class,
+		Executable: olddoc.Executable,
+	}
+	if err = couchdb.CreateDoc(c, v); err != nil {
+		return err
+	}
+	if err = c.FS().MkdirAll(path.Dir(v.path()), 0755); err != nil {
+		couchdb.DeleteDoc(c, v)
+		return err
+	}
+	if err = c.FS().Rename(bakpath, v.path()); err != nil {
+		couchdb.DeleteDoc(c, v)
+		return err
+	}
+	updateCachedDiskUsage(c, v.Size)
+
+	versions = append([]*FileVersion{v}, versions...)
+	var total int64
+	for i, v := range versions {
+		total += v.Size
+		if i < cfg.MaxNumber && (cfg.MaxSize <= 0 || total <= cfg.MaxSize) {
+			continue
+		}
+		if err = destroyFileVersion(c, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findFileVersions returns all the versions of a file, sorted by date. They
+// are fetched by batches, as couchdb returns only 25 documents by default.
+func findFileVersions(c Context, fileID string) ([]*FileVersion, error) {
+	var versions []*FileVersion
+	for skip := 0; ; skip += listBatchSize {
+		var batch []*FileVersion
+		req := &couchdb.FindRequest{
+			Selector: mango.Equal("file_id", fileID),
+			Limit:    listBatchSize,
+			Skip:     skip,
+		}
+		err := couchdb.FindDocs(c, consts.FilesVersions, req, &batch)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, batch...)
+		if len(batch) < listBatchSize {
+			break
+		}
+	}
+	sort.Sort(versionsByDate(versions))
+	return versions, nil
+}
+
+func destroyFileVersion(c Context, v *FileVersion) error {
+	err := c.FS().Remove(v.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = couchdb.DeleteDoc(c, v); err != nil {
+		return err
+	}
+	updateCachedDiskUsage(c, -v.Size)
+	return nil
+}
+
+// versionsDiskUsage returns the total size of the versions kept for the
+// files. The view is defined if the database has been created without it.
+func versionsDiskUsage(c Context) (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(c, consts.FilesVersions, VersionsUsageView, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if couchdb.IsNotFoundError(err) {
+		err = couchdb.DefineViews(c, consts.FilesVersions, VersionsViews)
+		if err != nil && !couchdb.IsConflictError(err) {
+			return 0, err
+		}
+		err = couchdb.ExecView(c, consts.FilesVersions, VersionsUsageView, &doc)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	return doc.Rows[0].Value, nil
+}
+
+func createVersionsDB(c Context) error {
+	err := couchdb.CreateDB(c, consts.FilesVersions)
+	if err != nil && !couchdb.IsFileExists(err) {
+		return err
+	}
+	if err = couchdb.DefineIndex(c, consts.FilesVersions, VersionsIndex); err != nil {
+		return err
+	}
+	err = couchdb.DefineViews(c, consts.FilesVersions, VersionsViews)
+	if err != nil && !couchdb.IsConflictError(err) {
+		return err
+	}
+	return nil
+}
+
+var (
+	_ couchdb.Doc    = &FileVersion{}
+	_ jsonapi.Object = &FileVersion{}
+)
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
@@ -27,19 +28,47 @@ var Indexes = []mango.Index{
 	mango.IndexOnFields("path"),
 	// Used to lookup children of a directory
 	mango.IndexOnFields("dir_id"),
+	// Used to sort and paginate the children of a directory, and to filter
+	// them by date and size
+	mango.IndexOnFields("dir_id", "name"),
+	mango.IndexOnFields("dir_id", "updated_at"),
+	mango.IndexOnFields("dir_id", "byte_size"),
+	// Used to filter the children of a directory by class and date
+	mango.IndexOnFields("dir_id", "class", "updated_at"),
 }
 
 // DiskUsageView is the name of the view used for computing the disk usage
 const DiskUsageView = "disk-usage"
 
+// DiskUsageByClassView is the name of the view used for computing the disk
+// usage of each class of files
+const DiskUsageByClassView = "disk-usage-by-class"
+
+// DiskUsageByDirView is the name of the view used for computing the disk
+// usage of each class of files in a directory
+const DiskUsageByDirView = "disk-usage-by-dir"
+
 // Views is the required couchdb views for computing the disk usage
 var Views = couchdb.Views{
 	DiskUsageView: couchdb.View{
 		Map:    "function(doc) { if (doc.type === 'file') emit(doc._id, +doc.size); }",
 		Reduce: "_sum",
 	},
+	DiskUsageByClassView: couchdb.View{
+		Map:    "function(doc) { if (doc.type === 'file') emit(doc.class || '', +doc.size); }",
+		Reduce: "_sum",
+	},
+	DiskUsageByDirView: couchdb.View{
+		Map:    "function(doc) { if (doc.type === 'file') emit([doc.dir_id, doc.class || ''], +doc.size); }",
+		Reduce: "_sum",
+	},
 }
 
+// RestoredTag is the tag added to the files and directories restored from
+// the trash in the root directory, because their original directory does not
+// exist anymore
+const RestoredTag = "restored"
+
 // DefaultContentType is used for files uploaded with no content-type
 const DefaultContentType = "application/octet-stream"
 
@@ -47,7 +76,8 @@ const DefaultContentType = "application/octet-stream"
 const ForbiddenFilenameChars = "/\x00"
 
 const (
-	// TrashDirName is the path of the trash directory
+	// TrashDirName is the default path of the trash directory, for the
+	// contexts without a custom trash name
 	TrashDirName = "/.cozy_trash"
 	// AppsDirName is the path of the directory in which apps are stored
 	AppsDirName = "/.cozy_apps"
@@ -69,6 +99,39 @@ type Context interface {
 	FS() afero.Fs
 }
 
+// DiskQuotaContext is a Context with a limit on the number of bytes that the
+// files can use. A quota of 0 means no limit.
+type DiskQuotaContext interface {
+	Context
+	DiskQuota() int64
+}
+
+// TrashNameContext is a Context with a custom name for the trash directory,
+// like a localized one. The identifier of the trash is still
+// consts.TrashDirID.
+type TrashNameContext interface {
+	Context
+	TrashName() string
+}
+
+// TrashPath returns the path of the trash directory of the context: the
+// default one, unless the context has a custom trash name.
+func TrashPath(c Context) string {
+	if tc, ok := c.(TrashNameContext); ok {
+		if name := tc.TrashName(); name != "" {
+			return "/" + name
+		}
+	}
+	return TrashDirName
+}
+
+// IsInTrash returns true if the given path is the trash directory of the
+// context or is inside it.
+func IsInTrash(c Context, name string) bool {
+	trash := TrashPath(c)
+	return name == trash || strings.HasPrefix(name, trash+"/")
+}
+
 // DocPatch is a struct containing modifiable fields from file and
 // directory documents.
 type DocPatch struct {
@@ -87,7 +150,10 @@ type DirOrFileDoc struct {
 
 	// fields from FileDoc not contained in DirDoc
 	Size       int64  `json:"size,string"`
+	ByteSize   *int64 `json:"byte_size,omitempty"`
 	MD5Sum     []byte `json:"md5sum"`
+	HashAlgo   string `json:"hash_algo,omitempty"`
+	SHA256Sum  []byte `json:"sha256sum,omitempty"`
 	Mime       string `json:"mime"`
 	Class      string `json:"class"`
 	Executable bool   `json:"executable"`
@@ -110,7 +176,10 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			CreatedAt:   fd.CreatedAt,
 			UpdatedAt:   fd.UpdatedAt,
 			Size:        fd.Size,
+			ByteSize:    fd.ByteSize,
 			MD5Sum:      fd.MD5Sum,
+			HashAlgo:    fd.HashAlgo,
+			SHA256Sum:   fd.SHA256Sum,
 			Mime:        fd.Mime,
 			Class:       fd.Class,
 			Executable:  fd.Executable,
@@ -341,17 +410,67 @@ func Remove(c Context, name string) error {
 	return c.FS().Remove(name)
 }
 
-// DiskUsage computes the total size of the files
+// DiskUsage computes the total size of the files, with the versions and the
+// previews kept for them
 func DiskUsage(c Context) (int64, error) {
 	var doc couchdb.ViewResponse
 	err := couchdb.ExecView(c, consts.Files, DiskUsageView, &doc)
 	if err != nil {
 		return 0, err
 	}
-	if len(doc.Rows) == 0 {
-		return 0, nil
+	var used int64
+	if len(doc.Rows) > 0 {
+		used = doc.Rows[0].Value
+	}
+	versions, err := versionsDiskUsage(c)
+	if err != nil {
+		return 0, err
+	}
+	previews, err := previewsDiskUsage(c)
+	if err != nil {
+		return 0, err
 	}
-	return doc.Rows[0].Value, nil
+	return used + versions + previews, nil
+}
+
+// checkDiskQuota returns ErrFileTooBig if adding size bytes to the files
+// exceeds the quota of the context, if any. The freed bytes are the size of
+// the content replaced by the new one.
+func checkDiskQuota(c Context, size, freed int64) error {
+	if size < 0 {
+		return nil
+	}
+	available, err := availableDiskSpace(c, freed)
+	if err != nil {
+		return err
+	}
+	if available >= 0 && size > available {
+		return ErrFileTooBig
+	}
+	return nil
+}
+
+// availableDiskSpace returns the number of bytes that a new content can use
+// without exceeding the disk quota, given the number of bytes freed by the
+// content it replaces. It returns -1 if the context has no quota.
+func availableDiskSpace(c Context, freed int64) (int64, error) {
+	qc, ok := c.(DiskQuotaContext)
+	if !ok {
+		return -1, nil
+	}
+	quota := qc.DiskQuota()
+	if quota <= 0 {
+		return -1, nil
+	}
+	used, err := cachedDiskUsage(c)
+	if err != nil {
+		return 0, err
+	}
+	available := quota - used + freed
+	if available < 0 {
+		available = 0
+	}
+	return available, nil
 }
 
 // WalkFn type works like filepath.WalkFn type function. It receives
@@ -453,11 +572,14 @@ func getParentDir(c Context, parent *DirDoc, dirID string) (*DirDoc, error) {
 
 // getRestoreDir returns the restoration directory document from a file a
 // directory path. The specified file path should be part of the trash
-// directory.
-func getRestoreDir(c Context, name, restorePath string) (*DirDoc, error) {
-	if !strings.HasPrefix(name, TrashDirName) {
-		return nil, ErrFileNotInTrash
+// directory. The returned boolean is true when the file should be restored
+// in the root directory, instead of its original directory, which does not
+// exist anymore.
+func getRestoreDir(c Context, name, restorePath string) (*DirDoc, bool, error) {
+	if !IsInTrash(c, name) {
+		return nil, false, ErrFileNotInTrash
 	}
+	trashPath := TrashPath(c)
 
 	// If the restore path is set, it means that the file is part of a directory
 	// hierarchy which has been trashed. The parent directory at the root of the
@@ -465,17 +587,17 @@ func getRestoreDir(c Context, name, restorePath string) (*DirDoc, error) {
 	// the restore path.
 	//
 	// For instance, when trying the restore the baz file inside
-	// TrashDirName/foo/bar/baz/quz, it should extract the "foo" (root) and
+	// trashPath/foo/bar/baz/quz, it should extract the "foo" (root) and
 	// "bar/baz" (rest) parts of the path.
 	if restorePath == "" {
-		name = strings.TrimPrefix(name, TrashDirName+"/")
+		name = strings.TrimPrefix(name, trashPath+"/")
 		split := strings.Index(name, "/")
 		if split >= 0 {
 			root := name[:split]
 			rest := path.Dir(name[split+1:])
-			doc, err := GetDirDocFromPath(c, TrashDirName+"/"+root, false)
+			doc, err := GetDirDocFromPath(c, trashPath+"/"+root, false)
 			if err != nil {
-				return nil, err
+				return nil, false, err
 			}
 			if doc.RestorePath != "" {
 				restorePath = path.Join(doc.RestorePath, doc.Name, rest)
@@ -489,14 +611,46 @@ func getRestoreDir(c Context, name, restorePath string) (*DirDoc, error) {
 		restorePath = "/"
 	}
 
-	// If the restore directory does not exist anymore, we re-create the
-	// directory hierarchy to restore the file in.
 	restoreDir, err := GetDirDocFromPath(c, restorePath, false)
-	if os.IsNotExist(err) {
+	if !os.IsNotExist(err) {
+		return restoreDir, false, err
+	}
+
+	// If the restore directory does not exist anymore, we re-create the
+	// directory hierarchy to restore the file in, unless the configuration
+	// asks to restore it in the root directory. The root directory is also
+	// used when the hierarchy cannot be re-created, for example when a file
+	// now has the name of one of the directories.
+	if config.GetConfig().Fs.RestoreMode != config.RestoreToRoot {
 		restoreDir, err = MkdirAll(c, restorePath, nil)
+		if err == nil {
+			return restoreDir, false, nil
+		}
+		if !os.IsExist(err) {
+			return nil, false, err
+		}
 	}
 
-	return restoreDir, err
+	restoreDir, err = GetDirDoc(c, consts.RootDirID, false)
+	if err != nil {
+		return nil, false, ErrRestoreImpossible
+	}
+	return restoreDir, true, nil
+}
+
+// restoredTags returns the tags of a document restored from the trash: the
+// RestoredTag is added when it is restored in the root directory instead of
+// its original directory.
+func restoredTags(tags []string, toRoot bool) []string {
+	if !toRoot {
+		return tags
+	}
+	for _, tag := range tags {
+		if tag == RestoredTag {
+			return tags
+		}
+	}
+	return append(append([]string{}, tags...), RestoredTag)
 }
 
 func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error) {
@@ -523,6 +677,8 @@ func normalizeDocPatch(data, patch *DocPatch, cdate time.Time) (*DocPatch, error
 	if patch.UpdatedAt.Before(cdate) {
 		return nil, ErrIllegalTime
 	}
+	updatedAt := patch.UpdatedAt.UTC()
+	patch.UpdatedAt = &updatedAt
 
 	if patch.Executable == nil {
 		patch.Executable = data.Executable
@@ -538,6 +694,24 @@ func checkFileName(str string) error {
 	return nil
 }
 
+// reservedNames are the names of the directories at the root of the file
+// system where the stack keeps its own data, like the versions and the
+// previews of the files. They are not in the VFS, and can't be used by its
+// files and directories.
+var reservedNames = map[string]bool{
+	path.Base(VersionsDirName): true,
+	path.Base(PreviewsDirName): true,
+}
+
+// checkReservedName returns an error if the name is reserved by the stack
+// in the given directory.
+func checkReservedName(name, dirID string) error {
+	if dirID == consts.RootDirID && reservedNames[name] {
+		return ErrReservedFilename
+	}
+	return nil
+}
+
 func uniqueTags(tags []string) []string {
 	m := make(map[string]struct{})
 	clone := make([]string, 0)
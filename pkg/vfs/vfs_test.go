@@ -1,8 +1,12 @@
 package vfs
 
 import (
+	"archive/tar"
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/md5" // #nosec
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +15,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -18,6 +23,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -161,6 +167,36 @@ func TestDiskUsage(t *testing.T) {
 	assert.Equal(t, len("hello !"), int(used))
 }
 
+func TestCachedDiskUsage(t *testing.T) {
+	used, err := cachedDiskUsage(vfsC)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc, err := NewFileDoc("cached-usage", "", -1, nil, "text/plain", "text", time.Now(), false, []string{})
+	assert.NoError(t, err)
+	file, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.Copy(file, bytes.NewReader([]byte("foo,bar")))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// the cached usage is updated without querying the view again
+	cached, err := cachedDiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used+int64(len("foo,bar")), cached)
+	computed, err := DiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, computed, cached)
+
+	assert.NoError(t, DestroyFile(vfsC, doc))
+	cached, err = cachedDiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used, cached)
+}
+
 func TestGetFileDocFromPath(t *testing.T) {
 	dir, _ := NewDirDoc("container", "", nil, nil)
 	err := CreateDir(vfsC, dir)
@@ -485,6 +521,1325 @@ func TestFileSerialization(t *testing.T) {
 	b3, err := jsonapi.MarshalObject(f2)
 	assert.NoError(t, err)
 	assert.Contains(t, string(b3), "foorefid")
+
+	f4 := f.HideReferences()
+	b4, err := jsonapi.MarshalObject(f4)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b4), "foorefid")
+	assert.NotContains(t, string(b4), "referenced_by")
+	assert.Contains(t, string(b4), `"parent"`)
+}
+
+func TestFileVersions(t *testing.T) {
+	config.GetConfig().Fs.Versions.MaxNumber = 2
+	defer func() { config.GetConfig().Fs.Versions.MaxNumber = 0 }()
+
+	write := func(olddoc *FileDoc, content string) *FileDoc {
+		doc, err := NewFileDoc("versioned", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		f, err := CreateFile(vfsC, doc, olddoc)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			t.FailNow()
+		}
+		return doc
+	}
+
+	doc := write(nil, "first")
+	doc = write(doc, "second")
+	doc = write(doc, "third")
+
+	versions, err := ListFileVersions(vfsC, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Len(t, versions, 2) {
+		return
+	}
+	assert.Equal(t, doc.ID(), versions[0].FileID)
+	assert.Equal(t, int64(6), versions[0].Size)
+	assert.Equal(t, int64(5), versions[1].Size)
+
+	_, err = GetFileVersion(vfsC, doc, "not-a-version")
+	assert.True(t, os.IsNotExist(err))
+
+	restored, err := RestoreFileVersion(vfsC, doc, versions[1].ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, doc.ID(), restored.ID())
+	assert.Equal(t, int64(5), restored.Size)
+
+	content, err := afero.ReadFile(vfsC.FS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(content))
+
+	versions, err = ListFileVersions(vfsC, restored)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	err = DestroyFile(vfsC, restored)
+	assert.NoError(t, err)
+	versions, err = ListFileVersions(vfsC, restored)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 0)
+}
+
+func TestManyFileVersions(t *testing.T) {
+	// more than the 25 documents returned by default by couchdb
+	config.GetConfig().Fs.Versions.MaxNumber = 30
+	defer func() { config.GetConfig().Fs.Versions.MaxNumber = 0 }()
+
+	var doc *FileDoc
+	for i := 0; i <= 30; i++ {
+		newdoc, err := NewFileDoc("manyversions", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := CreateFile(vfsC, newdoc, doc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = fmt.Fprintf(f, "version %d", i)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		doc = newdoc
+	}
+
+	versions, err := ListFileVersions(vfsC, doc)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 30)
+}
+
+func TestVersionsDiskUsage(t *testing.T) {
+	config.GetConfig().Fs.Versions.MaxNumber = 2
+	defer func() { config.GetConfig().Fs.Versions.MaxNumber = 0 }()
+
+	used, err := DiskUsage(vfsC)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var doc *FileDoc
+	for _, content := range []string{"first", "second", "third"} {
+		newdoc, err := NewFileDoc("versionsusage", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := CreateFile(vfsC, newdoc, doc)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		doc = newdoc
+	}
+
+	// the current content and the two versions
+	usage, err := DiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used+5+5+6, usage)
+
+	computed, err := ComputeUsage(vfsC)
+	if assert.NoError(t, err) {
+		assert.Equal(t, usage, computed.Used)
+		assert.True(t, computed.Versions >= 5+6)
+	}
+
+	assert.NoError(t, DestroyFile(vfsC, doc))
+	usage, err = DiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used, usage)
+}
+
+func TestPreviewsDiskUsage(t *testing.T) {
+	doc, err := NewFileDoc("previewsusage.pdf", consts.RootDirID, -1, nil, "application/pdf", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "not really a pdf")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	used, err := DiskUsage(vfsC)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, StorePreview(vfsC, doc, strings.NewReader("preview"))) {
+		return
+	}
+	assert.True(t, HasPreview(vfsC, doc))
+	usage, err := DiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used+7, usage)
+
+	computed, err := ComputeUsage(vfsC)
+	if assert.NoError(t, err) {
+		assert.Equal(t, usage, computed.Used)
+		assert.True(t, computed.Previews >= 7)
+	}
+
+	// a new preview replaces the previous one
+	if !assert.NoError(t, StorePreview(vfsC, doc, strings.NewReader("new preview"))) {
+		return
+	}
+	usage, err = DiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used+11, usage)
+
+	assert.NoError(t, DestroyFile(vfsC, doc))
+	usage, err = DiskUsage(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, used-16, usage)
+}
+
+type quotaContext struct {
+	TestContext
+	quota int64
+}
+
+func (c quotaContext) DiskQuota() int64 { return c.quota }
+
+func TestVersionsDiskQuota(t *testing.T) {
+	usageCacheMu.Lock()
+	delete(usageCache, vfsC.Prefix())
+	usageCacheMu.Unlock()
+	defer func() {
+		usageCacheMu.Lock()
+		delete(usageCache, vfsC.Prefix())
+		usageCacheMu.Unlock()
+	}()
+
+	used, err := DiskUsage(vfsC)
+	if !assert.NoError(t, err) {
+		return
+	}
+	qc := quotaContext{TestContext: vfsC, quota: used + 8}
+
+	write := func(olddoc *FileDoc, content string) (*FileDoc, error) {
+		doc, err := NewFileDoc("versionsquota", consts.RootDirID, int64(len(content)), nil, "", "", time.Now(), false, nil)
+		if err != nil {
+			return nil, err
+		}
+		f, err := CreateFile(qc, doc, olddoc)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(f, content)
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		return doc, err
+	}
+
+	doc, err := write(nil, "first")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// without the versions, the replaced content is freed
+	doc, err = write(doc, "second")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// with the versions, it is kept and still counted for the quota
+	config.GetConfig().Fs.Versions.MaxNumber = 2
+	defer func() { config.GetConfig().Fs.Versions.MaxNumber = 0 }()
+	_, err = write(doc, "third")
+	assert.Equal(t, ErrFileTooBig, err)
+
+	assert.NoError(t, DestroyFile(vfsC, doc))
+}
+
+func TestReservedNames(t *testing.T) {
+	_, err := NewDirDoc(".cozy_versions", "", nil, nil)
+	assert.Equal(t, ErrReservedFilename, err)
+	_, err = NewFileDoc(".cozy_versions", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	assert.Equal(t, ErrReservedFilename, err)
+	_, err = MkdirAll(vfsC, "/.cozy_versions/foo", nil)
+	assert.Equal(t, ErrReservedFilename, err)
+	_, err = NewDirDoc(".cozy_previews", "", nil, nil)
+	assert.Equal(t, ErrReservedFilename, err)
+
+	dir, err := NewDirDoc("reservednames", "", nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, CreateDir(vfsC, dir)) {
+		return
+	}
+	sub, err := NewDirDoc(".cozy_versions", dir.ID(), nil, dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, CreateDir(vfsC, sub))
+
+	newname := ".cozy_versions"
+	newdir := consts.RootDirID
+	_, err = ModifyDirMetadata(vfsC, sub, &DocPatch{Name: &newname, DirID: &newdir})
+	assert.Equal(t, ErrReservedFilename, err)
+}
+
+func TestModifyFileWithRev(t *testing.T) {
+	doc, err := NewFileDoc("modifywithrev", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "initial")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	rev := doc.Rev()
+
+	modify := func(olddoc *FileDoc, content string) error {
+		newdoc, err := NewFileDoc("modifywithrev", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if err != nil {
+			return err
+		}
+		f, err := ModifyFile(vfsC, newdoc, olddoc, rev)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, content)
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	n := 8
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		// each goroutine has its own copy of the document, as it would have
+		// been fetched by concurrent requests
+		olddoc := *doc
+		content := fmt.Sprintf("modified %d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- modify(&olddoc, content)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	successes := 0
+	for err := range errs {
+		if err == nil {
+			successes++
+		} else {
+			assert.Equal(t, ErrConflict, err)
+		}
+	}
+	assert.Equal(t, 1, successes)
+
+	cur, err := GetFileDoc(vfsC, doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, rev, cur.Rev())
+	content, err := afero.ReadFile(vfsC.FS(), "/modifywithrev")
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "modified")
+	assert.Equal(t, cur.Size, int64(len(content)))
+
+	// a modification with a stale revision is rejected, even if it comes
+	// after the other one has been committed
+	err = modify(doc, "too late")
+	assert.Equal(t, ErrConflict, err)
+	content, err = afero.ReadFile(vfsC.FS(), "/modifywithrev")
+	assert.NoError(t, err)
+	assert.NotEqual(t, "too late", string(content))
+}
+
+func TestConcurrentCreateFile(t *testing.T) {
+	n := 8
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		content := fmt.Sprintf("created %d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doc, err := NewFileDoc("concurrentcreate", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			f, err := CreateFile(vfsC, doc, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = io.WriteString(f, content)
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	successes := 0
+	for err := range errs {
+		if err == nil {
+			successes++
+		} else {
+			assert.Equal(t, ErrConflict, err)
+		}
+	}
+	assert.Equal(t, 1, successes)
+
+	doc, err := GetFileDocFromPath(vfsC, "/concurrentcreate")
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := afero.ReadFile(vfsC.FS(), "/concurrentcreate")
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "created")
+	assert.Equal(t, doc.Size, int64(len(content)))
+}
+
+func TestConcurrentModifyFile(t *testing.T) {
+	doc, err := NewFileDoc("concurrentmodify", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "initial")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	bakpath := fmt.Sprintf("/.%s_%s", doc.ID(), doc.Rev())
+
+	n := 8
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		// without the expected revision, the conflicts can only be detected
+		// with the backup of the file and with the revision of the document
+		olddoc := *doc
+		content := fmt.Sprintf("modified %d", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newdoc, err := NewFileDoc("concurrentmodify", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			f, err := CreateFile(vfsC, newdoc, &olddoc)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_, err = io.WriteString(f, content)
+			if cerr := f.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	successes := 0
+	for err := range errs {
+		if err == nil {
+			successes++
+		} else {
+			assert.Equal(t, ErrConflict, err)
+		}
+	}
+	assert.Equal(t, 1, successes)
+
+	cur, err := GetFileDoc(vfsC, doc.ID())
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := afero.ReadFile(vfsC.FS(), "/concurrentmodify")
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "modified")
+	assert.Equal(t, cur.Size, int64(len(content)))
+	_, err = vfsC.FS().Stat(bakpath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModifyMetadataWithStaleDoc(t *testing.T) {
+	doc, err := NewFileDoc("stalemeta", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+	stale := *doc
+
+	tags := []string{"foo"}
+	_, err = ModifyFileMetadata(vfsC, doc, &DocPatch{Tags: &tags})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	name := "stalemeta-renamed"
+	_, err = ModifyFileMetadata(vfsC, &stale, &DocPatch{Name: &name})
+	assert.Equal(t, ErrConflict, err)
+
+	exists, err := afero.Exists(vfsC.FS(), "/stalemeta")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = afero.Exists(vfsC.FS(), "/stalemeta-renamed")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	dir, err := NewDirDoc("stalemetadir", consts.RootDirID, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, CreateDir(vfsC, dir)) {
+		return
+	}
+	staleDir := *dir
+	_, err = ModifyDirMetadata(vfsC, dir, &DocPatch{Tags: &tags})
+	if !assert.NoError(t, err) {
+		return
+	}
+	name = "stalemetadir-renamed"
+	_, err = ModifyDirMetadata(vfsC, &staleDir, &DocPatch{Name: &name})
+	assert.Equal(t, ErrConflict, err)
+	exists, err = afero.DirExists(vfsC.FS(), "/stalemetadir")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestRestoreFileWithoutParent(t *testing.T) {
+	if !assert.NoError(t, CreateTrashDir(vfsC)) {
+		return
+	}
+
+	// trashFileAndDestroyParent creates the given file, puts it in the trash,
+	// and then destroys its parent directory
+	trashFileAndDestroyParent := func(name string) *FileDoc {
+		parent, err := MkdirAll(vfsC, path.Dir(name), nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		doc, err := NewFileDoc(path.Base(name), parent.ID(), -1, nil, "", "", time.Now(), false, []string{"foo"})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		f, err := CreateFile(vfsC, doc, nil)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, f.Close()) {
+			t.FailNow()
+		}
+		trashed, err := TrashFile(vfsC, doc)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, DestroyDirAndContent(vfsC, parent)) {
+			t.FailNow()
+		}
+		return trashed
+	}
+
+	// the missing directories are re-created
+	trashed := trashFileAndDestroyParent("/restoreparent1/child/file")
+	restored, err := RestoreFile(vfsC, trashed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fullpath, err := restored.Path(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, "/restoreparent1/child/file", fullpath)
+	assert.Equal(t, []string{"foo"}, restored.Tags)
+
+	// a file with the name of the missing directory prevents its re-creation
+	trashed = trashFileAndDestroyParent("/restoreparent2/file2")
+	blocking, err := NewFileDoc("restoreparent2", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, blocking, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, f.Close()) {
+		return
+	}
+	restored, err = RestoreFile(vfsC, trashed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, consts.RootDirID, restored.DirID)
+	assert.Equal(t, []string{"foo", RestoredTag}, restored.Tags)
+
+	// the configuration can ask to restore the files in the root directory
+	config.GetConfig().Fs.RestoreMode = config.RestoreToRoot
+	defer func() { config.GetConfig().Fs.RestoreMode = config.RestoreRecreate }()
+	trashed = trashFileAndDestroyParent("/restoreparent3/file3")
+	restored, err = RestoreFile(vfsC, trashed)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, consts.RootDirID, restored.DirID)
+	assert.Equal(t, "file3", restored.Name)
+	assert.Equal(t, []string{"foo", RestoredTag}, restored.Tags)
+	_, err = GetDirDocFromPath(vfsC, "/restoreparent3", false)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestTrashRootAndTrashDir(t *testing.T) {
+	if !assert.NoError(t, CreateTrashDir(vfsC)) {
+		return
+	}
+	root, err := GetDirDoc(vfsC, consts.RootDirID, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	trash, err := GetDirDoc(vfsC, consts.TrashDirID, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = TrashDir(vfsC, root)
+	assert.Equal(t, ErrForbiddenVFSOperation, err)
+	_, err = TrashDir(vfsC, trash)
+	assert.Equal(t, ErrForbiddenVFSOperation, err)
+
+	dir, err := MkdirAll(vfsC, "/trashspecial", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	dirID := dir.ID()
+	_, err = ModifyDirMetadata(vfsC, trash, &DocPatch{DirID: &dirID})
+	assert.Equal(t, ErrForbiddenVFSOperation, err)
+	name := "newroot"
+	_, err = ModifyDirMetadata(vfsC, root, &DocPatch{Name: &name})
+	assert.Equal(t, ErrForbiddenVFSOperation, err)
+
+	_, err = GetDirDoc(vfsC, consts.TrashDirID, false)
+	assert.NoError(t, err)
+	trashpath, err := trash.Path(vfsC)
+	assert.NoError(t, err)
+	assert.Equal(t, TrashDirName, trashpath)
+}
+
+func TestWriteMoreThanDeclaredSize(t *testing.T) {
+	doc, err := NewFileDoc("toolarge", consts.RootDirID, 5, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	n, err := f.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	n, err = f.Write([]byte("de"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// the write is aborted as soon as the declared size is exceeded, and
+	// nothing more is written on the disk
+	n, err = f.Write([]byte("f"))
+	assert.Equal(t, ErrContentLengthMismatch, err)
+	assert.Equal(t, 0, n)
+	n, err = f.Write([]byte("ghijklmnopqrstuvwxyz"))
+	assert.Equal(t, ErrContentLengthMismatch, err)
+	assert.Equal(t, 0, n)
+
+	err = f.Close()
+	assert.Equal(t, ErrContentLengthMismatch, err)
+
+	_, err = vfsC.FS().Stat("/toolarge")
+	assert.True(t, os.IsNotExist(err))
+	_, err = GetFileDocFromPath(vfsC, "/toolarge")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCancelWriteAndRead(t *testing.T) {
+	doc, err := NewFileDoc("cancelled", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f.SetContext(ctx)
+
+	n, err := f.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// the client goes away in the middle of the upload
+	cancel()
+	n, err = f.Write([]byte("def"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, context.Canceled, f.Close())
+
+	_, err = vfsC.FS().Stat("/cancelled")
+	assert.True(t, os.IsNotExist(err))
+	_, err = GetFileDocFromPath(vfsC, "/cancelled")
+	assert.True(t, os.IsNotExist(err))
+
+	// the previous content of a modified file is put back
+	doc, err = NewFileDoc("cancelled", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, "previous")
+	assert.NoError(t, err)
+	if !assert.NoError(t, f.Close()) {
+		return
+	}
+
+	newdoc, err := NewFileDoc("cancelled", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	f, err = CreateFile(vfsC, newdoc, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	f.SetContext(ctx)
+	_, err = io.WriteString(f, "new")
+	assert.NoError(t, err)
+	cancel()
+	_, err = io.WriteString(f, "content")
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, f.Close())
+
+	stored, err := GetFileDocFromPath(vfsC, "/cancelled")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, doc.Rev(), stored.Rev())
+	r, err := Open(vfsC, stored)
+	if !assert.NoError(t, err) {
+		return
+	}
+	content, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "previous", string(content))
+	assert.NoError(t, r.Close())
+
+	// and the reads are aborted too
+	r, err = Open(vfsC, stored)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	r.SetContext(ctx)
+	buf := make([]byte, 4)
+	n, err = r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	cancel()
+	n, err = r.Read(buf)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, r.Close())
+}
+
+func TestCreateFileWithHashAlgo(t *testing.T) {
+	content := "hash me"
+	md5sum := md5.Sum([]byte(content)) // #nosec
+	sha256sum := sha256.Sum256([]byte(content))
+
+	for algo, sum := range map[string][]byte{
+		"":         md5sum[:],
+		HashMD5:    md5sum[:],
+		HashSHA256: sha256sum[:],
+	} {
+		name := "hashalgo-" + algo
+		doc, err := NewFileDoc(name, consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		doc.HashAlgo = algo
+		f, err := CreateFile(vfsC, doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+
+		stored, err := GetFileDoc(vfsC, doc.ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		expected := algo
+		if expected == "" {
+			expected = HashMD5
+		}
+		assert.Equal(t, expected, stored.HashAlgo)
+		assert.Equal(t, expected, stored.HashAlgorithm())
+		assert.Equal(t, sum, stored.MD5Sum)
+		assert.Equal(t, sha256sum[:], stored.SHA256Sum)
+	}
+
+	// the checksum given for the content is verified with the algorithm of
+	// the document
+	doc, err := NewFileDoc("hashalgo-check", consts.RootDirID, -1, md5sum[:], "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc.HashAlgo = HashSHA256
+	f, err := CreateFile(vfsC, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = io.WriteString(f, content)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrInvalidHash, f.Close())
+
+	doc, err = NewFileDoc("hashalgo-unknown", consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc.HashAlgo = "crc32"
+	_, err = CreateFile(vfsC, doc, nil)
+	assert.Equal(t, ErrUnknownHashAlgo, err)
+}
+
+func TestRehashToSHA256(t *testing.T) {
+	contents := map[string]string{
+		"rehash-md5":     "rehash me",
+		"rehash-sha256":  "rehash me too",
+		"rehash-trashed": "rehash me later",
+	}
+	docs := make(map[string]*FileDoc)
+	for name, content := range contents {
+		doc, err := NewFileDoc(name, consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if name == "rehash-sha256" {
+			doc.HashAlgo = HashSHA256
+		}
+		f, err := CreateFile(vfsC, doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+		if name == "rehash-trashed" {
+			if doc, err = TrashFile(vfsC, doc); !assert.NoError(t, err) {
+				return
+			}
+		}
+		// the files created before the SHA-256 had no checksum for it
+		doc.SHA256Sum = nil
+		if !assert.NoError(t, couchdb.UpdateDoc(vfsC, doc)) {
+			return
+		}
+		docs[name] = doc
+	}
+
+	progress := 0
+	report, err := RehashToSHA256(context.Background(), vfsC, &RehashOptions{
+		SkipTrashed: true,
+		Pause:       time.Millisecond,
+		Progress:    func(r *RehashReport) { progress++ },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, report.Rehashed >= 2)
+	assert.True(t, report.Skipped >= 1)
+	assert.Equal(t, report.Rehashed+report.Skipped+report.Failed, progress)
+
+	for name, content := range contents {
+		stored, err := GetFileDoc(vfsC, docs[name].ID())
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, docs[name].MD5Sum, stored.MD5Sum)
+		if name == "rehash-trashed" {
+			assert.Nil(t, stored.SHA256Sum)
+			continue
+		}
+		sum := sha256.Sum256([]byte(content))
+		assert.Equal(t, sum[:], stored.SHA256Sum)
+
+		f, err := Open(vfsC, stored)
+		if !assert.NoError(t, err) {
+			return
+		}
+		stillThere, err := ioutil.ReadAll(f)
+		f.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, content, string(stillThere))
+	}
+
+	// the migration can be run again: only the skipped files are left
+	report, err = RehashToSHA256(context.Background(), vfsC, &RehashOptions{})
+	assert.NoError(t, err)
+	assert.True(t, report.Rehashed >= 1)
+	stored, err := GetFileDoc(vfsC, docs["rehash-trashed"].ID())
+	if assert.NoError(t, err) {
+		sum := sha256.Sum256([]byte(contents["rehash-trashed"]))
+		assert.Equal(t, sum[:], stored.SHA256Sum)
+	}
+}
+
+func TestPrefixFsIsolation(t *testing.T) {
+	disk := afero.NewMemMapFs()
+	alice := NewPrefixFs(disk, "/alice.cozy.tools")
+	alice2 := NewPrefixFs(disk, "/alice.cozy.tools2")
+	assert.NoError(t, alice.MkdirAll("/", 0755))
+	assert.NoError(t, alice2.MkdirAll("/", 0755))
+
+	assert.NoError(t, afero.WriteFile(alice2, "/secret", []byte("secret"), 0644))
+	assert.NoError(t, afero.WriteFile(alice, "/foo", []byte("foo"), 0644))
+
+	_, err := alice.Open("/secret")
+	assert.True(t, os.IsNotExist(err))
+	_, err = alice.Open("/../alice.cozy.tools2/secret")
+	assert.Error(t, err)
+	_, err = alice.Open("/foo/../../alice.cozy.tools2/secret")
+	assert.Error(t, err)
+	_, err = alice.Stat("..")
+	assert.Error(t, err)
+
+	f, err := alice.Open("/bar/../foo")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "/foo", f.Name())
+		content, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", string(content))
+		assert.NoError(t, f.Close())
+	}
+}
+
+func TestPrefixFsRename(t *testing.T) {
+	disk := afero.NewMemMapFs()
+	alice := NewPrefixFs(disk, "/alice.cozy.tools")
+	bob := NewPrefixFs(disk, "/bob.cozy.tools")
+	assert.NoError(t, alice.MkdirAll("/", 0755))
+	assert.NoError(t, bob.MkdirAll("/", 0755))
+	assert.NoError(t, afero.WriteFile(alice, "/foo", []byte("foo"), 0644))
+	assert.NoError(t, afero.WriteFile(bob, "/bar", []byte("bar"), 0644))
+
+	err := alice.Rename("/foo", "/../bob.cozy.tools/foo")
+	if assert.Error(t, err) {
+		lerr, ok := err.(*os.LinkError)
+		if assert.True(t, ok) {
+			assert.Equal(t, ErrIllegalPath, lerr.Err)
+		}
+	}
+	err = alice.Rename("/../bob.cozy.tools/bar", "/bar")
+	assert.Error(t, err)
+
+	_, err = bob.Stat("/foo")
+	assert.True(t, os.IsNotExist(err))
+	_, err = bob.Stat("/bar")
+	assert.NoError(t, err)
+
+	assert.NoError(t, alice.Rename("/foo", "/baz"))
+	content, err := afero.ReadFile(disk, "/alice.cozy.tools/baz")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", string(content))
+}
+
+func TestParseFileMode(t *testing.T) {
+	for mode, executable := range map[string]bool{
+		"0755": true,
+		"755":  true,
+		"0700": true,
+		"0001": true,
+		"0644": false,
+		"600":  false,
+	} {
+		exec, err := ParseFileMode(mode)
+		assert.NoError(t, err)
+		assert.Equal(t, executable, exec, mode)
+	}
+	for _, mode := range []string{"", "rwx", "0855", "01755"} {
+		_, err := ParseFileMode(mode)
+		assert.Equal(t, ErrInvalidFileMode, err, mode)
+	}
+	assert.Equal(t, "0755", FormatFileMode(getFileMode(true)))
+	assert.Equal(t, "0644", FormatFileMode(getFileMode(false)))
+}
+
+func TestSniffClass(t *testing.T) {
+	assert.Equal(t, "", sniffClass(nil))
+	assert.Equal(t, TextClass, sniffClass([]byte("Hello world!\n\tfoo\r\n")))
+	assert.Equal(t, TextClass, sniffClass([]byte("Ceci est un été à Noël ☃")))
+	assert.Equal(t, BinaryClass, sniffClass([]byte("foo\x00bar")))
+	assert.Equal(t, BinaryClass, sniffClass([]byte{0xff, 0xd8, 0xff, 0xe0, 'J', 'F', 'I', 'F'}))
+	assert.Equal(t, BinaryClass, sniffClass([]byte("\x01\x02\x03abcdefg")))
+
+	// a multi-bytes character cut at the end of the first block
+	head := append(bytes.Repeat([]byte("a"), sniffLen-1), "é"[0])
+	assert.Equal(t, TextClass, sniffClass(head))
+}
+
+func TestGuessMimeAndClass(t *testing.T) {
+	mime, class := guessMimeAndClass(TextClass)
+	assert.Equal(t, TextMime, mime)
+	assert.Equal(t, TextClass, class)
+
+	mime, class = guessMimeAndClass(BinaryClass)
+	assert.Equal(t, DefaultContentType, mime)
+	assert.Equal(t, BinaryClass, class)
+
+	mime, class = guessMimeAndClass("")
+	assert.Equal(t, DefaultContentType, mime)
+	assert.Equal(t, "application", class)
+
+	config.GetConfig().Fs.DefaultMime = "application/x-unknown"
+	defer func() { config.GetConfig().Fs.DefaultMime = "" }()
+	mime, class = guessMimeAndClass(BinaryClass)
+	assert.Equal(t, "application/x-unknown", mime)
+	assert.Equal(t, "application", class)
+}
+
+func TestCreateFileSniffsClass(t *testing.T) {
+	create := func(name, mime, class, content string) *FileDoc {
+		doc, err := NewFileDoc(name, consts.RootDirID, -1, nil, mime, class, time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := CreateFile(vfsC, doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return nil
+		}
+		return doc
+	}
+
+	doc := create("sniff.txt", DefaultContentType, "application", strings.Repeat("some text\n", 100))
+	if assert.NotNil(t, doc) {
+		assert.Equal(t, TextClass, doc.Class)
+	}
+	doc = create("sniff.bin", DefaultContentType, "application", "\x7fELF\x02\x01\x01\x00\x00\x00")
+	if assert.NotNil(t, doc) {
+		assert.Equal(t, BinaryClass, doc.Class)
+	}
+	doc = create("sniff.pdf", "application/pdf", "application", "not really a pdf")
+	if assert.NotNil(t, doc) {
+		assert.Equal(t, "application", doc.Class)
+	}
+}
+
+func TestCreateFileWithTrailerSum(t *testing.T) {
+	content := "content with a trailer"
+	sum := md5.Sum([]byte(content))
+
+	create := func(name string, trailerSum []byte) (*FileDoc, error) {
+		doc, err := NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, nil)
+		if err != nil {
+			return nil, err
+		}
+		doc.HashAlgo = HashMD5
+		f, err := CreateFile(vfsC, doc, nil)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(f, content); err != nil {
+			return nil, err
+		}
+		return doc, f.CloseWithSum(trailerSum)
+	}
+
+	doc, err := create("trailer-match", sum[:])
+	if assert.NoError(t, err) {
+		assert.Equal(t, sum[:], doc.MD5Sum)
+	}
+
+	_, err = create("trailer-mismatch", []byte("0123456789abcdef"))
+	assert.Equal(t, ErrInvalidHash, err)
+	_, err = GetFileDocFromPath(vfsC, "/trailer-mismatch")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExportImport(t *testing.T) {
+	dir, err := NewDirDoc("exportdir", "", []string{"foo"}, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDir(vfsC, dir)) {
+		return
+	}
+	contents := map[string]string{
+		"/exportdir/a.txt":   "content of a",
+		"/exportdir/b.txt":   "content of b",
+		"/exportdir/dup.txt": "content of a",
+	}
+	for name, content := range contents {
+		doc, err := NewFileDoc(path.Base(name), dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, []string{"bar"})
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := CreateFile(vfsC, doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = io.WriteString(f, content)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if !assert.NoError(t, Export(vfsC, buf)) {
+		return
+	}
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack-import")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	importC := TestContext{
+		prefix: "dev-import/",
+		fs:     afero.NewBasePathFs(afero.NewOsFs(), tempdir),
+	}
+	if !assert.NoError(t, couchdb.ResetDB(importC, consts.Files)) {
+		return
+	}
+	defer couchdb.DeleteDB(importC, consts.Files)
+	for _, index := range Indexes {
+		if !assert.NoError(t, couchdb.DefineIndex(importC, consts.Files, index)) {
+			return
+		}
+	}
+	if !assert.NoError(t, CreateRootDirDoc(importC)) {
+		return
+	}
+	assert.NoError(t, CheckExport(bytes.NewReader(buf.Bytes())))
+
+	// without the trailer and the end of the archive, the import fails and
+	// what has been created is destroyed
+	truncated := buf.Bytes()[:buf.Len()-2048]
+	assert.Equal(t, ErrInvalidExport, CheckExport(bytes.NewReader(truncated)))
+	_, err = Import(importC, bytes.NewReader(truncated))
+	assert.Equal(t, ErrInvalidExport, err)
+	_, err = GetDirDocFromPath(importC, "/exportdir", false)
+	assert.True(t, os.IsNotExist(err))
+
+	ids, err := Import(importC, buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	imported, err := GetDirDocFromPath(importC, "/exportdir", false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, imported.ID(), ids[dir.ID()])
+		assert.Equal(t, []string{"foo"}, imported.Tags)
+	}
+	for name, content := range contents {
+		orig, err := GetFileDocFromPath(vfsC, name)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		doc, err := GetFileDocFromPath(importC, name)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, doc.ID(), ids[orig.ID()])
+		assert.Equal(t, orig.MD5Sum, doc.MD5Sum)
+		assert.Equal(t, []string{"bar"}, doc.Tags)
+		assert.Equal(t, orig.CreatedAt.Unix(), doc.CreatedAt.Unix())
+
+		f, err := Open(importC, doc)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		h := md5.New() // #nosec
+		_, err = io.Copy(h, f)
+		f.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, orig.MD5Sum, h.Sum(nil))
+		sum := md5.Sum([]byte(content)) // #nosec
+		assert.Equal(t, sum[:], doc.MD5Sum)
+	}
+}
+
+func TestExportImportManyFiles(t *testing.T) {
+	dir, err := NewDirDoc("exportmany", "", nil, nil)
+	if !assert.NoError(t, err) || !assert.NoError(t, CreateDir(vfsC, dir)) {
+		return
+	}
+	// more files than the first page of children of a directory
+	n := 25
+	for i := 0; i < n; i++ {
+		doc, err := NewFileDoc(fmt.Sprintf("file-%d.txt", i), dir.ID(), -1, nil, "text/plain", "text", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := CreateFile(vfsC, doc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, err = fmt.Fprintf(f, "content %d", i)
+		assert.NoError(t, err)
+		if !assert.NoError(t, f.Close()) {
+			return
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if !assert.NoError(t, Export(vfsC, buf)) {
+		return
+	}
+
+	tempdir, err := ioutil.TempDir("", "cozy-stack-import")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tempdir)
+	importC := TestContext{
+		prefix: "dev-import-many/",
+		fs:     afero.NewBasePathFs(afero.NewOsFs(), tempdir),
+	}
+	if !assert.NoError(t, couchdb.ResetDB(importC, consts.Files)) {
+		return
+	}
+	defer couchdb.DeleteDB(importC, consts.Files)
+	for _, index := range Indexes {
+		if !assert.NoError(t, couchdb.DefineIndex(importC, consts.Files, index)) {
+			return
+		}
+	}
+	if !assert.NoError(t, CreateRootDirDoc(importC)) {
+		return
+	}
+	if _, err = Import(importC, buf); !assert.NoError(t, err) {
+		return
+	}
+
+	imported, err := GetDirDocFromPath(importC, "/exportmany", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	children, err := fetchAllChildren(importC, imported.ID())
+	assert.NoError(t, err)
+	assert.Len(t, children, n)
+	for i := 0; i < n; i++ {
+		_, err = GetFileDocFromPath(importC, fmt.Sprintf("/exportmany/file-%d.txt", i))
+		assert.NoError(t, err)
+	}
+
+	// the destruction of the directory removes all its files
+	assert.NoError(t, DestroyDirAndContent(importC, imported))
+	children, err = fetchAllChildren(importC, imported.ID())
+	assert.NoError(t, err)
+	assert.Len(t, children, 0)
+}
+
+func TestImportInvalidArchive(t *testing.T) {
+	_, err := Import(vfsC, strings.NewReader("not a tar archive"))
+	assert.Error(t, err)
+
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "foo", Size: 3, Mode: 0644}))
+	_, err = tw.Write([]byte("foo"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+	_, err = Import(vfsC, buf)
+	assert.Equal(t, ErrInvalidExport, err)
+}
+
+func TestReindex(t *testing.T) {
+	// the first call creates what is missing, like the trash
+	_, err := Reindex(vfsC)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	report, err := Reindex(vfsC)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, report.Indexes, len(Indexes)+1)
+	for _, index := range report.Indexes {
+		assert.Equal(t, "exists", index.Result)
+	}
+	assert.Equal(t, "exists", report.RootDir)
+	assert.Equal(t, "exists", report.TrashDir)
+	assert.Equal(t, 0, report.UTCDates)
+
+	indexes, err := couchdb.ListIndexes(vfsC, consts.Files)
+	if assert.NoError(t, err) {
+		// the _all_docs special index is listed too
+		assert.True(t, indexes.TotalRows >= len(Indexes)+1)
+	}
+
+	for _, fullpath := range []string{"/", TrashPath(vfsC)} {
+		var dirs []*DirDoc
+		req := &couchdb.FindRequest{Selector: mango.Equal("path", fullpath)}
+		err = couchdb.FindDocs(vfsC, consts.Files, req, &dirs)
+		if assert.NoError(t, err) {
+			assert.Len(t, dirs, 1)
+		}
+	}
+}
+
+func TestDateToUTC(t *testing.T) {
+	doc := couchdb.JSONDoc{M: map[string]interface{}{
+		"created_at": "2016-09-19T14:38:04.5+02:00",
+		"updated_at": "2016-09-19T12:38:04Z",
+	}}
+	assert.True(t, dateToUTC(doc, "created_at"))
+	assert.Equal(t, "2016-09-19T12:38:04.5Z", doc.M["created_at"])
+	assert.False(t, dateToUTC(doc, "updated_at"))
+	assert.False(t, dateToUTC(doc, "trashed_at"))
 }
 
 func TestMain(m *testing.M) {
@@ -535,6 +1890,7 @@ func TestMain(m *testing.M) {
 
 	os.RemoveAll(tempdir)
 	couchdb.DeleteDB(vfsC, consts.Files)
+	couchdb.DeleteDB(vfsC, consts.FilesVersions)
 
 	os.Exit(res)
 }
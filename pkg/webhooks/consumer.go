@@ -0,0 +1,232 @@
+package webhooks
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+// PollInterval is the delay between two checks of the changes feeds of the
+// doctypes watched by the webhooks of an instance
+var PollInterval = 5 * time.Second
+
+// pollBatchSize is the maximal number of changes fetched at once for a
+// webhook
+const pollBatchSize = 100
+
+// consumer is the polling of the changes feeds for the webhooks of an
+// instance. The goroutine runs only while the instance has webhooks: done is
+// nil when it is not running. gen is incremented each time a webhook is
+// registered, to know if one has been registered while the webhooks were
+// listed.
+type consumer struct {
+	db     couchdb.Database
+	broker jobs.Broker
+	done   chan struct{}
+	gen    int
+}
+
+var (
+	consumers   = make(map[string]*consumer)
+	consumersMu sync.Mutex
+)
+
+// Start enables the polling of the changes feeds for the webhooks of the
+// given instance. The jobs are pushed on the given broker. The changes are
+// polled only if the instance has webhooks: else, the polling starts when a
+// webhook is registered.
+func Start(db couchdb.Database, broker jobs.Broker) {
+	consumersMu.Lock()
+	if _, ok := consumers[db.Prefix()]; ok {
+		consumersMu.Unlock()
+		return
+	}
+	c := &consumer{db: db, broker: broker}
+	consumers[db.Prefix()] = c
+	consumersMu.Unlock()
+
+	hooks, err := List(db)
+	if err != nil {
+		// the polling is started anyway, to not miss the changes
+		log.Errorf("[webhooks] %s: Could not list the webhooks: %s", db.Prefix(), err)
+	}
+
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	// Stop may have been called in the meantime
+	if consumers[db.Prefix()] == c && (len(hooks) > 0 || err != nil) {
+		c.start()
+	}
+}
+
+// Stop ends the polling of the changes feeds for the webhooks of the given
+// instance.
+func Stop(db couchdb.Database) {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	if c, ok := consumers[db.Prefix()]; ok {
+		c.stop()
+		delete(consumers, db.Prefix())
+	}
+}
+
+// IsPolling returns true if the changes feeds are currently polled for the
+// webhooks of the given instance.
+func IsPolling(db couchdb.Database) bool {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	c, ok := consumers[db.Prefix()]
+	return ok && c.done != nil
+}
+
+// wake starts the polling for the instance, after a webhook has been
+// registered.
+func wake(db couchdb.Database) {
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	if c, ok := consumers[db.Prefix()]; ok {
+		c.gen++
+		c.start()
+	}
+}
+
+// sleepIfIdle stops the polling for the instance if it has no more
+// webhooks, after one has been deleted.
+func sleepIfIdle(db couchdb.Database) {
+	consumersMu.Lock()
+	c, ok := consumers[db.Prefix()]
+	if !ok {
+		consumersMu.Unlock()
+		return
+	}
+	gen := c.gen
+	consumersMu.Unlock()
+
+	hooks, err := List(db)
+	if err != nil {
+		log.Errorf("[webhooks] %s: Could not list the webhooks: %s", db.Prefix(), err)
+		return
+	}
+	if len(hooks) > 0 {
+		return
+	}
+
+	consumersMu.Lock()
+	defer consumersMu.Unlock()
+	if consumers[db.Prefix()] == c && c.gen == gen {
+		c.stop()
+	}
+}
+
+// start launches the goroutine polling the changes, if it is not already
+// running. It must be called with consumersMu locked.
+func (c *consumer) start() {
+	if c.done != nil {
+		return
+	}
+	done := make(chan struct{})
+	c.done = done
+	go func() {
+		ticker := time.NewTicker(PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := Poll(c.db, c.broker); err != nil {
+					log.Errorf("[webhooks] %s: Could not poll the changes: %s", c.db.Prefix(), err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// stop ends the goroutine polling the changes, if it is running. It must be
+// called with consumersMu locked.
+func (c *consumer) stop() {
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+}
+
+// Poll looks at the changes made since the last poll on the doctypes watched
+// by the webhooks, and pushes a job for each matching change.
+func Poll(db couchdb.Database, broker jobs.Broker) error {
+	hooks, err := List(db)
+	if err != nil {
+		return err
+	}
+	for _, w := range hooks {
+		if err = w.poll(db, broker); err != nil {
+			log.Errorf("[webhooks] %s: Could not poll the changes of %s: %s",
+				w.WID, w.WatchedDocType, err)
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) poll(db couchdb.Database, broker jobs.Broker) error {
+	res, err := couchdb.GetChanges(db, &couchdb.ChangesRequest{
+		DocType:     w.WatchedDocType,
+		Since:       w.LastSeq,
+		IncludeDocs: len(w.Selector) > 0,
+		Limit:       pollBatchSize,
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(res.Results) == 0 {
+		return nil
+	}
+
+	for _, change := range res.Results {
+		if strings.HasPrefix(change.DocID, "_design") || len(change.Changes) == 0 {
+			continue
+		}
+		if len(w.Selector) > 0 && (change.Deleted || !w.Match(change.Doc)) {
+			continue
+		}
+		msg, err := jobs.NewMessage(jobs.JSONEncoding, &Event{
+			WebhookID: w.WID,
+			Payload: &Payload{
+				DocType: w.WatchedDocType,
+				DocID:   change.DocID,
+				DocRev:  change.Changes[0].Rev,
+				Deleted: change.Deleted,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if _, _, err = broker.PushJob(&jobs.JobRequest{
+			WorkerType: WorkerType,
+			Message:    msg,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// The document may have been updated by the worker, to record a failure,
+	// since it was fetched: the update is tried again on a fresh version.
+	lastSeq := res.LastSeq
+	w.LastSeq = lastSeq
+	err = couchdb.UpdateDoc(db, w)
+	if couchdb.IsConflictError(err) {
+		var fresh *Webhook
+		if fresh, err = Get(db, w.WID); err != nil {
+			return err
+		}
+		fresh.LastSeq = lastSeq
+		err = couchdb.UpdateDoc(db, fresh)
+	}
+	return err
+}
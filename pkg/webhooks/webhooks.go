@@ -0,0 +1,433 @@
+// Package webhooks is used to notify some external services of the changes
+// made on the documents of a doctype. A webhook is registered with an URL, a
+// doctype and an optional selector: the changes feed of the doctype is
+// polled, and a job is pushed to the "webhook" worker for each matching
+// change. This worker sends a signed POST request to the URL.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// WorkerType is the type of the worker sending the requests of the webhooks
+const WorkerType = "webhook"
+
+// SignatureHeader is the HTTP header used to send the HMAC-SHA256 signature
+// of the body of the requests, computed with the secret of the webhook
+const SignatureHeader = "X-Cozy-Signature"
+
+var (
+	// ErrInvalidURL is used when the URL of a webhook is not an absolute
+	// http or https URL
+	ErrInvalidURL = errors.New("The URL of the webhook is invalid")
+	// ErrMissingDocType is used when a webhook is registered without a
+	// doctype
+	ErrMissingDocType = errors.New("The doctype of the webhook is missing")
+	// ErrForbiddenURL is used when the URL of a webhook targets the server
+	// itself or a private network, like its administration port, the
+	// loopback or the link-local addresses
+	ErrForbiddenURL = errors.New("The URL of the webhook targets a forbidden address")
+)
+
+// AllowLocalURLs allows the webhooks to target the loopback and the private
+// networks. It is only meant for the tests: a webhook could otherwise be used
+// to make requests to the internal services of the server.
+var AllowLocalURLs = false
+
+// listPageSize is the number of webhooks fetched at once when all the
+// webhooks of an instance are listed
+const listPageSize = 100
+
+// localNetworks are the networks, in addition to the loopback and the
+// link-local addresses, that the webhooks can't target
+var localNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// client is the HTTP client used to send the requests of the webhooks. Its
+// connections are made with dialWebhook, to check the addresses of the
+// targets, including the ones of the redirections.
+var client = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         dialWebhook,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// Webhook is a struct describing an URL to notify of the changes on the
+// documents of a doctype. It implements the couchdb.Doc and jsonapi.Object
+// interfaces.
+type Webhook struct {
+	WID  string `json:"_id,omitempty"`
+	WRev string `json:"_rev,omitempty"`
+
+	URL            string `json:"url"`
+	WatchedDocType string `json:"doctype"`
+	// Selector is an optional set of fields that the documents must have,
+	// with the same values, to be notified. The names of the fields can use
+	// a dot to look into the sub-objects.
+	Selector map[string]interface{} `json:"selector,omitempty"`
+	// Secret is the key used to sign the requests. It is only given in the
+	// response of the registration.
+	Secret string `json:"secret,omitempty"`
+	// LastSeq is the sequence of the last change of the doctype seen by the
+	// webhook
+	LastSeq string `json:"last_seq,omitempty"`
+
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Payload is the body of the requests sent to the URL of a webhook
+type Payload struct {
+	DocType string `json:"doctype"`
+	DocID   string `json:"id"`
+	DocRev  string `json:"rev"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Event is the message of the jobs of the webhook worker
+type Event struct {
+	WebhookID string   `json:"webhook_id"`
+	Payload   *Payload `json:"payload"`
+}
+
+// ID returns the webhook qualified identifier
+func (w *Webhook) ID() string { return w.WID }
+
+// Rev returns the webhook revision
+func (w *Webhook) Rev() string { return w.WRev }
+
+// DocType returns the webhook document type
+func (w *Webhook) DocType() string { return consts.Webhooks }
+
+// SetID changes the webhook qualified identifier
+func (w *Webhook) SetID(id string) { w.WID = id }
+
+// SetRev changes the webhook revision
+func (w *Webhook) SetRev(rev string) { w.WRev = rev }
+
+// Links is used to generate a JSON-API link for the webhook
+func (w *Webhook) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/webhooks/" + w.WID}
+}
+
+// Relationships is part of the jsonapi.Object interface
+func (w *Webhook) Relationships() jsonapi.RelationshipMap { return nil }
+
+// Included is part of the jsonapi.Object interface
+func (w *Webhook) Included() []jsonapi.Object { return nil }
+
+// Register creates a new webhook for the given URL and doctype. Only the
+// changes made after the registration are notified.
+func Register(db couchdb.Database, rawurl, doctype string, selector map[string]interface{}) (*Webhook, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	if err = checkURL(u); err != nil {
+		return nil, err
+	}
+	if doctype == "" {
+		return nil, ErrMissingDocType
+	}
+
+	w := &Webhook{
+		URL:            u.String(),
+		WatchedDocType: doctype,
+		Selector:       selector,
+		Secret:         utils.RandomString(32),
+	}
+	status, err := couchdb.DBStatus(db, doctype)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	if status != nil {
+		w.LastSeq = status.Stats.UpdateSeq
+	}
+
+	err = couchdb.CreateDoc(db, w)
+	if couchdb.IsNoDatabaseError(err) {
+		if err = couchdb.CreateDB(db, consts.Webhooks); err != nil && !couchdb.IsFileExists(err) {
+			return nil, err
+		}
+		err = couchdb.CreateDoc(db, w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wake(db)
+	return w, nil
+}
+
+// List returns all the webhooks of the instance.
+func List(db couchdb.Database) ([]*Webhook, error) {
+	hooks := []*Webhook{}
+	start := ""
+	for {
+		page, next, err := listPage(db, start, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, page...)
+		if next == "" {
+			return hooks, nil
+		}
+		start = next
+	}
+}
+
+// ListPage returns at most limit webhooks of the instance, without their
+// secrets, starting with the webhook with the given identifier (or with the
+// first one if it is empty). The identifier of the first webhook of the next
+// page is also returned, or an empty string for the last page.
+func ListPage(db couchdb.Database, start string, limit int) ([]*Webhook, string, error) {
+	hooks, next, err := listPage(db, start, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, w := range hooks {
+		w.Secret = ""
+	}
+	return hooks, next, nil
+}
+
+func listPage(db couchdb.Database, start string, limit int) ([]*Webhook, string, error) {
+	req := &couchdb.AllDocsRequest{Limit: limit + 1}
+	if start != "" {
+		key, err := json.Marshal(start)
+		if err != nil {
+			return nil, "", err
+		}
+		req.StartKey = string(key)
+	}
+	var hooks []*Webhook
+	err := couchdb.GetAllDocs(db, consts.Webhooks, req, &hooks)
+	if couchdb.IsNoDatabaseError(err) {
+		return []*Webhook{}, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(hooks) > limit {
+		next = hooks[limit].WID
+		hooks = hooks[:limit]
+	}
+	return hooks, next, nil
+}
+
+// Get returns the webhook with the given identifier.
+func Get(db couchdb.Database, id string) (*Webhook, error) {
+	w := &Webhook{}
+	if err := couchdb.GetDoc(db, consts.Webhooks, id, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Delete removes the webhook with the given identifier: no more requests
+// are sent to its URL.
+func Delete(db couchdb.Database, id string) error {
+	w, err := Get(db, id)
+	if err != nil {
+		return err
+	}
+	if err = couchdb.DeleteDoc(db, w); err != nil {
+		return err
+	}
+	sleepIfIdle(db)
+	return nil
+}
+
+// Match returns true if the document has all the fields of the selector of
+// the webhook, with the same values.
+func (w *Webhook) Match(doc couchdb.JSONDoc) bool {
+	for field, expected := range w.Selector {
+		var value interface{} = doc.M
+		for _, part := range strings.Split(field, ".") {
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			value = obj[part]
+		}
+		if !reflect.DeepEqual(value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// Send makes the POST request to the URL of the webhook with the payload.
+// An error is returned if the request can't be made or if its response
+// doesn't have a 2xx status code.
+func (w *Webhook) Send(ctx context.Context, p *Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign([]byte(w.Secret), body))
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook: %s responded with the status %d", w.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// RecordFailure keeps the error of the last request that has failed in the
+// webhook document.
+func (w *Webhook) RecordFailure(db couchdb.Database, failure error) error {
+	now := time.Now()
+	w.LastError = failure.Error()
+	w.LastErrorAt = &now
+	return couchdb.UpdateDoc(db, w)
+}
+
+// checkURL returns an error if the URL of a webhook targets the
+// administration port of the stack, or a local address. The addresses are
+// checked again when the requests are sent, as the DNS can change.
+func checkURL(u *url.URL) error {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = strings.Trim(u.Host, "[]")
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if isAdminPort(port) {
+		return ErrForbiddenURL
+	}
+	if AllowLocalURLs {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if isLocalIP(ip) {
+			return ErrForbiddenURL
+		}
+		return nil
+	}
+	// A host that can't be resolved now is accepted, it will be checked when
+	// the requests are sent.
+	ips, _ := net.LookupIP(host)
+	for _, ip := range ips {
+		if isLocalIP(ip) {
+			return ErrForbiddenURL
+		}
+	}
+	return nil
+}
+
+// dialWebhook opens the connections for the requests of the webhooks, after
+// having checked the addresses of the target. The connection is made to the
+// checked address, and not to the host, so that it can't be resolved again
+// to another address.
+func dialWebhook(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if isAdminPort(port) {
+		return nil, ErrForbiddenURL
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if !AllowLocalURLs {
+		for _, ip := range ips {
+			if isLocalIP(ip) {
+				return nil, ErrForbiddenURL
+			}
+		}
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func isAdminPort(port string) bool {
+	return port == strconv.Itoa(config.GetConfig().AdminPort)
+}
+
+// isLocalIP returns true for the addresses of the loopback, the link-local
+// addresses and the private networks.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, n := range localNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the value of the signature header for the given body: the
+// hexadecimal HMAC-SHA256 of the body, prefixed by "sha256=".
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	_ couchdb.Doc    = &Webhook{}
+	_ jsonapi.Object = &Webhook{}
+)
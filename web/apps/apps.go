@@ -10,8 +10,12 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	webpermissions "github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
@@ -99,11 +103,100 @@ func ListHandler(c echo.Context) error {
 	return jsonapi.DataList(c, http.StatusOK, objs, nil)
 }
 
+// PermissionsHandler handles the GET /:slug/permissions requests, to get the
+// permissions granted to an application at its installation. They can only
+// be read by the owner of the instance: with a session, or with a token that
+// can read all the permissions.
+func PermissionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+
+	if err := allowOwner(c, webpermissions.GET, slug); err != nil {
+		return err
+	}
+
+	doc, err := permissions.GetForApp(instance, slug)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, doc, nil)
+}
+
+// RevokePermissionHandler handles the DELETE /:slug/permissions/:rule
+// requests, to remove a rule, given by its title, from the permissions of an
+// application. The application may no longer work without it: it is the
+// choice of the user.
+func RevokePermissionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+
+	if err := allowOwner(c, webpermissions.DELETE, slug); err != nil {
+		return err
+	}
+
+	doc, err := permissions.RevokeRule(instance, slug, c.Param("rule"))
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, doc, nil)
+}
+
+type narrowedRule struct {
+	Verbs  permissions.VerbSet `json:"verbs"`
+	Values []string            `json:"values"`
+}
+
+// NarrowPermissionHandler handles the PATCH /:slug/permissions/:rule
+// requests, to restrict the verbs and/or the values of a rule in the
+// permissions of an application.
+func NarrowPermissionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	slug := c.Param("slug")
+
+	if err := allowOwner(c, webpermissions.PATCH, slug); err != nil {
+		return err
+	}
+
+	var attrs narrowedRule
+	if _, err := jsonapi.Bind(c.Request(), &attrs); err != nil {
+		return err
+	}
+
+	doc, err := permissions.NarrowRule(instance, slug, c.Param("rule"), attrs.Verbs, attrs.Values)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, doc, nil)
+}
+
+// allowOwner checks that the request comes from the owner of the instance,
+// with a session or with a token that can use the verb on all the
+// permissions, and that the application is installed.
+func allowOwner(c echo.Context, v permissions.Verb, slug string) error {
+	if !middlewares.IsLoggedIn(c) {
+		if err := webpermissions.AllowWholeType(c, v, consts.Permissions); err != nil {
+			return err
+		}
+	}
+
+	instance := middlewares.GetInstance(c)
+	if _, err := apps.GetBySlug(instance, slug); err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return jsonapi.NotFound(err)
+		}
+		return err
+	}
+	return nil
+}
+
 // Routes sets the routing for the apps service
 func Routes(router *echo.Group) {
 	router.GET("/", ListHandler)
 	router.POST("/:slug", InstallOrUpdateHandler)
 	router.GET("/:slug/init-cozy-bar.js", InitCozyBarJS)
+	router.GET("/:slug/permissions", PermissionsHandler)
+	router.DELETE("/:slug/permissions/:rule", RevokePermissionHandler)
+	router.PATCH("/:slug/permissions/:rule", NarrowPermissionHandler)
 }
 
 func wrapAppsError(err error) error {
@@ -122,5 +215,8 @@ func wrapAppsError(err error) error {
 	if _, ok := err.(*url.Error); ok {
 		return jsonapi.InvalidParameter("Source", err)
 	}
+	if _, ok := err.(*apps.ManifestError); ok {
+		return jsonapi.BadRequest(err)
+	}
 	return err
 }
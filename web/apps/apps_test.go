@@ -21,6 +21,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web"
@@ -125,6 +126,10 @@ func installMiniApp() error {
 	if err != nil {
 		return err
 	}
+	err = createFile(appdir, "app.3f2a9c1b.js", "var hashed = true;")
+	if err != nil {
+		return err
+	}
 	err = createFile(pubdir, "index.html", "this is a file in public/")
 	return err
 }
@@ -191,6 +196,85 @@ func TestServe(t *testing.T) {
 	assertNotFound(t, "/public/hello.html")
 }
 
+func TestServeSPADeepLink(t *testing.T) {
+	assertAuthGet(t, "/foo/photos/123", "text/html", `this is index.html. <a lang="en" href="https://cozywithapps.example.net/status/">Status</a>`)
+	assertAuthGet(t, "/public/some/deep/link", "text/html", "this is a file in public/")
+	assertAnonGet(t, "/public/some/deep/link", "text/html", "this is a file in public/")
+	assertNotPublic(t, "/foo/photos/123", 302, "https://cozywithapps.example.net/auth/login?redirect=https%3A%2F%2Fmini.cozywithapps.example.net%2F%2Ffoo%2Fphotos%2F123")
+}
+
+func TestServeMissingAsset(t *testing.T) {
+	assertNotFound(t, "/foo/missing.js")
+	assertNotFound(t, "/foo/photos/missing.png")
+	assertNotFound(t, "/public/missing.css")
+}
+
+func TestServeCacheControl(t *testing.T) {
+	res, err := doGet("/foo/", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+
+	res, err = doGet("/foo/hello.html", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	assert.NotEmpty(t, res.Header.Get("Etag"))
+
+	res, err = doGet("/foo/app.3f2a9c1b.js", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "private, max-age=31536000, immutable", res.Header.Get("Cache-Control"))
+	assert.Contains(t, res.Header.Get("Content-Type"), "javascript")
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, "var hashed = true;", string(body))
+}
+
+func TestServeNotModified(t *testing.T) {
+	res, err := doGet("/foo/hello.html", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	eTag := res.Header.Get("Etag")
+	lastModified := res.Header.Get("Last-Modified")
+	assert.NotEmpty(t, eTag)
+	assert.NotEmpty(t, lastModified)
+
+	doConditionalGet := func(header, value string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/foo/hello.html", nil)
+		req.Host = slug + "." + domain
+		req.Header.Set(header, value)
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+
+	res = doConditionalGet("If-None-Match", eTag)
+	assert.Equal(t, 304, res.StatusCode)
+	assert.Equal(t, eTag, res.Header.Get("Etag"))
+	assert.Equal(t, "no-cache", res.Header.Get("Cache-Control"))
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Empty(t, body)
+
+	res = doConditionalGet("If-None-Match", "W/"+eTag)
+	assert.Equal(t, 304, res.StatusCode)
+
+	res = doConditionalGet("If-Modified-Since", lastModified)
+	assert.Equal(t, 304, res.StatusCode)
+
+	res = doConditionalGet("If-None-Match", `"some-other-etag"`)
+	assert.Equal(t, 200, res.StatusCode)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.NotEmpty(t, body)
+
+	// the index is not an asset, it is always rendered again
+	req, _ := http.NewRequest("GET", ts.URL+"/foo/", nil)
+	req.Host = slug + "." + domain
+	req.Header.Set("If-Modified-Since", lastModified)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+}
+
 func TestCozyBar(t *testing.T) {
 	assertAuthGet(t, "/bar/", "text/html", ``+
 		`<script defer src="//cozywithapps.example.net/assets/js/cozy-bar.js"></script>`+
@@ -295,6 +379,167 @@ func TestListApps(t *testing.T) {
 	assert.Equal(t, "https://cozywithapps-mini.example.net/icon.png", icon)
 }
 
+func TestAppPermissions(t *testing.T) {
+	set := permissions.Set{
+		permissions.Rule{
+			Title:       "contacts",
+			Type:        "io.cozy.contacts",
+			Description: "Read the contacts",
+			Verbs:       permissions.Verbs(permissions.GET),
+		},
+		permissions.Rule{
+			Title:  "files",
+			Type:   "io.cozy.files",
+			Verbs:  permissions.Verbs(permissions.GET, permissions.POST),
+			Values: []string{"io.cozy.files.root-dir"},
+		},
+	}
+	_, err := permissions.Create(testInstance, slug, set)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer permissions.Destroy(testInstance, slug)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/apps/"+slug+"/permissions", nil)
+	req.Host = domain
+	res, err := client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result struct {
+		Data struct {
+			Type       string `json:"type"`
+			Attributes struct {
+				ApplicationID string          `json:"application_id"`
+				Permissions   permissions.Set `json:"permissions"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Equal(t, "io.cozy.permissions", result.Data.Type)
+	assert.Equal(t, "io.cozy.manifests/"+slug, result.Data.Attributes.ApplicationID)
+	got := result.Data.Attributes.Permissions
+	if assert.Len(t, got, 2) {
+		for _, rule := range got {
+			switch rule.Title {
+			case "contacts":
+				assert.Equal(t, "io.cozy.contacts", rule.Type)
+				assert.Equal(t, "Read the contacts", rule.Description)
+				assert.Equal(t, "GET", rule.Verbs.String())
+			case "files":
+				assert.Equal(t, "io.cozy.files", rule.Type)
+				assert.Equal(t, "GET,POST", rule.Verbs.String())
+				assert.Equal(t, []string{"io.cozy.files.root-dir"}, rule.Values)
+			default:
+				t.Errorf("Unexpected rule %s", rule.Title)
+			}
+		}
+	}
+
+	// only the owner can read them
+	anon := &http.Client{CheckRedirect: noRedirect}
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/"+slug+"/permissions", nil)
+	req.Host = domain
+	res, err = anon.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	// an unknown application
+	req, _ = http.NewRequest("GET", ts.URL+"/apps/no-such-app/permissions", nil)
+	req.Host = domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestRevokeAndNarrowAppPermissions(t *testing.T) {
+	set := permissions.Set{
+		permissions.Rule{
+			Title: "contacts",
+			Type:  "io.cozy.contacts",
+			Verbs: permissions.Verbs(permissions.GET),
+		},
+		permissions.Rule{
+			Title: "settings",
+			Type:  "io.cozy.settings",
+			Verbs: permissions.Verbs(permissions.GET, permissions.PUT),
+		},
+	}
+	_, err := permissions.Create(testInstance, slug, set)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer permissions.Destroy(testInstance, slug)
+
+	token := manifest.BuildToken(testInstance)
+	diskUsage := func() int {
+		req, _ := http.NewRequest("GET", ts.URL+"/settings/disk-usage", nil)
+		req.Host = domain
+		req.Header.Add("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	changeRule := func(method, rule, body string) int {
+		req, _ := http.NewRequest(method, ts.URL+"/apps/"+slug+"/permissions/"+rule,
+			bytes.NewBufferString(body))
+		req.Host = domain
+		req.Header.Add("Content-Type", "application/vnd.api+json")
+		res, err := client.Do(req)
+		assert.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(t, 200, diskUsage())
+
+	// a rule can't be widened
+	widened := `{"data": {"type": "io.cozy.permissions", "attributes": {"verbs": ["GET", "DELETE"]}}}`
+	assert.Equal(t, 422, changeRule("PATCH", "settings", widened))
+
+	// but it can be narrowed
+	narrowed := `{"data": {"type": "io.cozy.permissions", "attributes": {"values": ["io.cozy.settings.instance"]}}}`
+	assert.Equal(t, 200, changeRule("PATCH", "settings", narrowed))
+	assert.Equal(t, 403, diskUsage())
+	narrowed = `{"data": {"type": "io.cozy.permissions", "attributes": {"values": ["io.cozy.settings.disk-usage"]}}}`
+	assert.Equal(t, 422, changeRule("PATCH", "settings", narrowed))
+
+	// and revoked
+	assert.Equal(t, 200, changeRule("DELETE", "contacts", ""))
+	assert.Equal(t, 404, changeRule("DELETE", "contacts", ""))
+	doc, err := permissions.GetForApp(testInstance, slug)
+	if assert.NoError(t, err) && assert.Len(t, doc.Permissions, 1) {
+		rule := doc.Permissions[0]
+		assert.Equal(t, "settings", rule.Title)
+		assert.Equal(t, "GET,PUT", rule.Verbs.String())
+		assert.Equal(t, []string{"io.cozy.settings.instance"}, rule.Values)
+	}
+
+	// the changes are kept when the application is updated
+	set = append(set, permissions.Rule{
+		Title: "files",
+		Type:  "io.cozy.files",
+		Verbs: permissions.Verbs(permissions.GET),
+	})
+	doc, err = permissions.UpdateForApp(testInstance, slug, set)
+	if assert.NoError(t, err) && assert.Len(t, doc.Permissions, 2) {
+		assert.Equal(t, "settings", doc.Permissions[0].Title)
+		assert.Equal(t, []string{"io.cozy.settings.instance"}, doc.Permissions[0].Values)
+		assert.Equal(t, "files", doc.Permissions[1].Title)
+	}
+	assert.Equal(t, 403, diskUsage())
+
+	assert.Equal(t, 200, changeRule("DELETE", "settings", ""))
+	assert.Equal(t, 403, diskUsage())
+
+	// only the owner can change them
+	req, _ := http.NewRequest("DELETE", ts.URL+"/apps/"+slug+"/permissions/settings", nil)
+	req.Host = domain
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	config.GetConfig().Assets = "../../assets"
@@ -7,7 +7,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"regexp"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -20,10 +23,15 @@ import (
 	"github.com/labstack/echo"
 )
 
+// fingerprintReg matches the names of the assets with a hash in them, like
+// app.3f2a9c1b.js or app-3f2a9c1b.min.css
+var fingerprintReg = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[^/]+$`)
+
 // Serve is an handler for serving files from the VFS for a client-side app
 func Serve(c echo.Context) error {
 	req := c.Request()
 	if req.Method != "GET" && req.Method != "HEAD" {
+		c.Response().Header().Set("Allow", "GET, HEAD")
 		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method %s not allowed", req.Method)
 	}
 
@@ -93,7 +101,7 @@ func serveApp(c echo.Context, i *instance.Instance, app *apps.Manifest, vpath st
 		return echo.NewHTTPError(http.StatusNotFound, "Page not found")
 	}
 	if !route.Public && !middlewares.IsLoggedIn(c) {
-		if file != "" {
+		if file != "" && !isClientSideRoute(file) {
 			return echo.NewHTTPError(http.StatusUnauthorized, "You must be authenticated")
 		}
 		redirect := url.Values{
@@ -106,14 +114,33 @@ func serveApp(c echo.Context, i *instance.Instance, app *apps.Manifest, vpath st
 	}
 	filepath := path.Join(vfs.AppsDirName, app.Slug, route.Folder, file)
 	doc, err := vfs.GetFileDocFromPath(i, filepath)
-	if err != nil {
+	if os.IsNotExist(err) && file != route.Index && isClientSideRoute(file) {
+		// Single-page apps use deep links for their client-side routes: they
+		// are served with the index of the route
+		file = route.Index
+		filepath = path.Join(vfs.AppsDirName, app.Slug, route.Folder, file)
+		doc, err = vfs.GetFileDocFromPath(i, filepath)
+	}
+	if os.IsNotExist(err) {
 		return echo.NewHTTPError(http.StatusNotFound)
 	}
+	if err != nil {
+		return err
+	}
 	res := c.Response()
 	if file != route.Index {
+		res.Header().Set("Cache-Control", assetCacheControl(file, route.Public))
+		if isNotModified(c.Request(), doc) {
+			res.Header().Set("Etag", `"`+doc.ETag()+`"`)
+			return c.NoContent(http.StatusNotModified)
+		}
 		return vfs.ServeFileContent(i, doc, "", c.Request(), res)
 	}
 
+	// The index must be revalidated to always use the last version of the
+	// assets after an update of the app
+	res.Header().Set("Cache-Control", "no-cache")
+
 	// For index file, we inject the locale, the stack domain, and a token if the
 	// user is connected
 	name, err := doc.Path(i)
@@ -147,3 +174,42 @@ func serveApp(c echo.Context, i *instance.Instance, app *apps.Manifest, vpath st
 		"CozyBar": cozybar(i, app),
 	})
 }
+
+// isClientSideRoute returns true if the path looks like a route of a
+// single-page app, and not like an asset: the assets have an extension.
+func isClientSideRoute(file string) bool {
+	return path.Ext(file) == ""
+}
+
+// isNotModified checks the conditional headers of the request against an
+// asset, so that the browsers can revalidate it without downloading it again.
+// If-None-Match has precedence over If-Modified-Since, and the etags are
+// compared with the weak comparison.
+func isNotModified(req *http.Request, doc *vfs.FileDoc) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return vfs.MatchETag(inm, doc.ETag(), true)
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a one second precision
+	return !doc.UpdatedAt.Truncate(time.Second).After(since)
+}
+
+// assetCacheControl returns the Cache-Control header for an asset of an app.
+// The fingerprinted assets never change and can be cached forever, the
+// others must be revalidated.
+func assetCacheControl(file string, public bool) string {
+	if !fingerprintReg.MatchString(file) {
+		return "no-cache"
+	}
+	if public {
+		return "public, max-age=31536000, immutable"
+	}
+	return "private, max-age=31536000, immutable"
+}
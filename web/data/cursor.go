@@ -0,0 +1,118 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+// ErrInvalidCursor is used when a cursor can't be decoded, or has not been
+// issued by the stack for this doctype
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// cursorMaxLen is the maximal length of an encoded cursor
+const cursorMaxLen = 8192
+
+// Cursor is the position of the next page of a paginated list. It is sent to
+// the clients as an opaque string, signed with a secret of the instance, so
+// that all the list endpoints paginate the same way and a cursor can't be
+// forged or used on another doctype.
+//
+// For _all_docs and the views, the position is given by the startkey and
+// startkey_docid parameters. For the mango queries, it is the bookmark of the
+// previous response.
+type Cursor struct {
+	StartKey      interface{} `json:"startkey,omitempty"`
+	StartKeyDocID string      `json:"startkey_docid,omitempty"`
+	Bookmark      string      `json:"bookmark,omitempty"`
+}
+
+func cursorMACConfig(i *instance.Instance, doctype string) *crypto.MACConfig {
+	return &crypto.MACConfig{
+		Key:    i.SessionSecret,
+		Name:   "cursor:" + doctype,
+		MaxLen: cursorMaxLen,
+	}
+}
+
+// Encode returns the opaque string of the cursor, for the given doctype.
+func (cur *Cursor) Encode(i *instance.Instance, doctype string) (string, error) {
+	value, err := json.Marshal(cur)
+	if err != nil {
+		return "", err
+	}
+	encoded, err := crypto.EncodeAuthMessage(cursorMACConfig(i, doctype), value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// DecodeCursor returns the cursor of an opaque string issued by Encode for
+// the given doctype, or ErrInvalidCursor if it has been tampered with.
+func DecodeCursor(i *instance.Instance, doctype, encoded string) (*Cursor, error) {
+	value, err := crypto.DecodeAuthMessage(cursorMACConfig(i, doctype), []byte(encoded))
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cur Cursor
+	if err = json.Unmarshal(value, &cur); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cur, nil
+}
+
+// ApplyToQuery sets the position of the cursor in the query-string of a
+// request on _all_docs or on a view. The other parameters of position are
+// removed.
+func (cur *Cursor) ApplyToQuery(query url.Values) error {
+	query.Del("start_key")
+	query.Del("startkey")
+	query.Del("startkey_docid")
+	query.Del("skip")
+	if cur.StartKey != nil {
+		startkey, err := json.Marshal(cur.StartKey)
+		if err != nil {
+			return err
+		}
+		query.Set("startkey", string(startkey))
+	}
+	if cur.StartKeyDocID != "" {
+		query.Set("startkey_docid", cur.StartKeyDocID)
+	}
+	return nil
+}
+
+// ApplyToFind sets the position of the cursor in a mango query.
+func (cur *Cursor) ApplyToFind(req *couchdb.FindRequest) {
+	req.Skip = 0
+	req.Bookmark = cur.Bookmark
+}
+
+// applyCursorParam replaces the cursor parameter of the query-string of the
+// request by the position it gives, for the handler and for the proxy to
+// couchdb.
+func applyCursorParam(c echo.Context, doctype string) error {
+	params := c.QueryParams()
+	encoded := params.Get("cursor")
+	if encoded == "" {
+		return nil
+	}
+	cursor, err := DecodeCursor(middlewares.GetInstance(c), doctype, encoded)
+	if err != nil {
+		return jsonapi.InvalidParameter("cursor", err)
+	}
+	if err = cursor.ApplyToQuery(params); err != nil {
+		return err
+	}
+	params.Del("cursor")
+	c.Request().URL.RawQuery = params.Encode()
+	return nil
+}
@@ -0,0 +1,60 @@
+package data
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorEncodeDecode(t *testing.T) {
+	cursor := &Cursor{StartKey: "abc", StartKeyDocID: "abc"}
+	encoded, err := cursor.Encode(testInstance, Type)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotContains(t, encoded, "abc")
+
+	decoded, err := DecodeCursor(testInstance, Type, encoded)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, cursor, decoded)
+
+	query := url.Values{"skip": {"10"}, "start_key": {`"aaa"`}}
+	assert.NoError(t, decoded.ApplyToQuery(query))
+	assert.Equal(t, url.Values{
+		"startkey":       {`"abc"`},
+		"startkey_docid": {"abc"},
+	}, query)
+
+	req := &couchdb.FindRequest{Skip: 10}
+	(&Cursor{Bookmark: "g1AAAAA"}).ApplyToFind(req)
+	assert.Equal(t, 0, req.Skip)
+	assert.Equal(t, "g1AAAAA", req.Bookmark)
+}
+
+func TestCursorTampered(t *testing.T) {
+	cursor := &Cursor{StartKey: "abc", StartKeyDocID: "abc"}
+	encoded, err := cursor.Encode(testInstance, Type)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tampered := []byte(encoded)
+	if tampered[10] == 'A' {
+		tampered[10] = 'B'
+	} else {
+		tampered[10] = 'A'
+	}
+	_, err = DecodeCursor(testInstance, Type, string(tampered))
+	assert.Equal(t, ErrInvalidCursor, err)
+
+	// a cursor can't be used for another doctype
+	_, err = DecodeCursor(testInstance, "io.cozy.contacts", encoded)
+	assert.Equal(t, ErrInvalidCursor, err)
+
+	_, err = DecodeCursor(testInstance, Type, "not-a-cursor")
+	assert.Equal(t, ErrInvalidCursor, err)
+}
@@ -2,27 +2,83 @@
 package data
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
+// maxDoctypeLength is the maximal length of a doctype, to keep the names of
+// the databases under the limit of CouchDB
+const maxDoctypeLength = 128
+
+// doctypeRegexp is the pattern of the doctypes: lowercase letters, digits,
+// dots, underscores and hyphens, starting with a letter.
+var doctypeRegexp = regexp.MustCompile(`^[a-z][a-z0-9._-]*$`)
+
+// couchdbSystemNames are the system databases of CouchDB, which have a name
+// starting with an underscore.
+var couchdbSystemNames = map[string]bool{
+	"_users":          true,
+	"_replicator":     true,
+	"_global_changes": true,
+	"_metadata":       true,
+	"_dbs":            true,
+	"_nodes":          true,
+}
+
+// validDoctype checks that the doctype of the request can be used as the
+// name of a database, and that it is not reserved, before any access to
+// CouchDB.
 func validDoctype(next echo.HandlerFunc) echo.HandlerFunc {
-	// TODO extends me to verificate characters allowed in db name.
 	return func(c echo.Context) error {
 		doctype := c.Param("doctype")
-		if doctype == "" && c.Path() != "/data/" {
-			return jsonapi.NewError(http.StatusBadRequest, "Invalid doctype '%s'", doctype)
+		if doctype == "" && c.Path() == "/data/" {
+			c.Set("doctype", doctype)
+			return next(c)
+		}
+		if err := checkDoctype(doctype); err != nil {
+			return err
 		}
 		c.Set("doctype", doctype)
 		return next(c)
 	}
 }
 
+// checkDoctype returns an error if the doctype is reserved or invalid.
+func checkDoctype(doctype string) error {
+	if couchdbSystemNames[doctype] || isReservedDoctype(doctype) {
+		return jsonapi.NewError(http.StatusForbidden,
+			fmt.Sprintf("Reserved doctype '%s'", doctype))
+	}
+	if len(doctype) > maxDoctypeLength || !doctypeRegexp.MatchString(doctype) {
+		return jsonapi.NewError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid doctype '%s'", doctype))
+	}
+	return nil
+}
+
 // GetDoc get a doc by its type and id
 func getDoc(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
@@ -42,16 +98,181 @@ func getDoc(c echo.Context) error {
 		return proxy(c, docid)
 	}
 
-	var out couchdb.JSONDoc
-	err := couchdb.GetDoc(instance, doctype, docid, &out)
+	content, size, err := couchdb.OpenDoc(instance, doctype, docid)
 	if err != nil {
 		return err
 	}
+	defer content.Close()
+
+	if size < 0 || size > LargeDocSize {
+		lastModified, ok, err := largeDocLastModified(instance, doctype, docid)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if isNotModifiedSince(c.Request(), lastModified) {
+				return c.NoContent(http.StatusNotModified)
+			}
+			c.Response().Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+		}
+		return streamDoc(c, doctype, content)
+	}
+
+	var out couchdb.JSONDoc
+	if err = json.NewDecoder(content).Decode(&out); err != nil {
+		return err
+	}
 
 	out.Type = doctype
+	if lastModified, ok := docLastModified(out); ok {
+		if isNotModifiedSince(c.Request(), lastModified) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		c.Response().Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
 	return c.JSON(http.StatusOK, out.ToMapWithType())
 }
 
+// headDoc checks if a document exists, and gives its current revision in the
+// Etag header, without sending its content.
+func headDoc(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+
+	if err := CheckReadable(c, doctype); err != nil {
+		return err
+	}
+
+	rev, err := couchdb.GetDocRev(instance, doctype, c.Param("docid"))
+	if err != nil {
+		if ce, ok := err.(*couchdb.Error); ok {
+			return c.NoContent(ce.StatusCode)
+		}
+		return err
+	}
+	c.Response().Header().Set("Etag", `"`+rev+`"`)
+	return c.NoContent(http.StatusOK)
+}
+
+// LargeDocSize is the size, in bytes, from which the documents are streamed
+// from couchdb to the client, instead of being decoded and encoded again.
+var LargeDocSize int64 = 1 << 20
+
+// streamDoc sends a document, given by its JSON representation from couchdb,
+// to the client, without buffering it. The response is compressed with gzip
+// if the client accepts it. The _type field is inserted at the beginning of
+// the JSON object.
+func streamDoc(c echo.Context, doctype string, content io.Reader) error {
+	r := bufio.NewReader(content)
+	if err := skipObjectStart(r); err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+	var w io.Writer = res
+	var gz *gzip.Writer
+	if acceptsGzip(c.Request()) {
+		res.Header().Set(echo.HeaderContentEncoding, "gzip")
+		gz = gzip.NewWriter(res)
+		w = gz
+	}
+	res.WriteHeader(http.StatusOK)
+
+	typ, err := json.Marshal(doctype)
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, `{"_type":`+string(typ)+`,`); err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// skipObjectStart reads the opening brace of a JSON object
+func skipObjectStart(r *bufio.Reader) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return nil
+		default:
+			return fmt.Errorf("Unexpected character %q at the start of a document", b)
+		}
+	}
+}
+
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get(echo.HeaderAcceptEncoding), ",") {
+		enc = strings.TrimSpace(strings.SplitN(enc, ";", 2)[0])
+		if enc == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// docLastModified returns the modification date of a document, taken from
+// its updated_at field. The boolean is false for documents without such a
+// timestamp.
+func docLastModified(doc couchdb.JSONDoc) (time.Time, bool) {
+	updatedAt, ok := doc.Get("updated_at").(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, updatedAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// largeDocLastModified returns the modification date of a document that is
+// streamed, and so not decoded, by fetching only its updated_at field.
+func largeDocLastModified(db couchdb.Database, doctype, docid string) (time.Time, bool, error) {
+	var docs []couchdb.JSONDoc
+	req := &couchdb.FindRequest{
+		Selector: mango.Equal("_id", docid),
+		Fields:   []string{"_id", "updated_at"},
+		Limit:    1,
+	}
+	if err := couchdb.FindDocs(db, doctype, req, &docs); err != nil {
+		return time.Time{}, false, err
+	}
+	if len(docs) == 0 {
+		return time.Time{}, false, nil
+	}
+	lastModified, ok := docLastModified(docs[0])
+	return lastModified, ok, nil
+}
+
+// isNotModifiedSince checks the If-Modified-Since header of the request
+// against the given modification date. HTTP dates have a one second
+// precision, so the modification date is truncated before the comparison.
+func isNotModifiedSince(req *http.Request, lastModified time.Time) bool {
+	header := req.Header.Get("If-Modified-Since")
+	if header == "" {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
 // CreateDoc create doc from the json passed as body
 func createDoc(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
@@ -66,17 +287,16 @@ func createDoc(c echo.Context) error {
 		return err
 	}
 
-	if err := couchdb.CreateDoc(instance, doc); err != nil {
+	if err := checkUniqueConstraints(instance, doc); err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusCreated, echo.Map{
-		"ok":   true,
-		"id":   doc.ID(),
-		"rev":  doc.Rev(),
-		"type": doc.DocType(),
-		"data": doc.ToMapWithType(),
-	})
+	if err := createUniqueDoc(instance, doc); err != nil {
+		return err
+	}
+
+	setDocLocation(c, doc)
+	return writeDocResponse(c, http.StatusCreated, doc)
 }
 
 func updateDoc(c echo.Context) error {
@@ -93,6 +313,12 @@ func updateDoc(c echo.Context) error {
 		return err
 	}
 
+	rev, err := docRev(c, doc.Rev())
+	if err != nil {
+		return err
+	}
+	doc.SetRev(rev)
+
 	if (doc.ID() == "") != (doc.Rev() == "") {
 		return jsonapi.NewError(http.StatusBadRequest,
 			"You must either provide an _id and _rev in document (update) or neither (create with  fixed id).")
@@ -102,10 +328,18 @@ func updateDoc(c echo.Context) error {
 		return jsonapi.NewError(http.StatusBadRequest, "document _id doesnt match url")
 	}
 
-	var err error
-	if doc.ID() == "" {
+	creation := doc.ID() == ""
+	if creation {
 		doc.SetID(c.Param("docid"))
-		err = couchdb.CreateNamedDoc(instance, doc)
+	}
+	if err = checkUniqueConstraints(instance, doc); err != nil {
+		return err
+	}
+
+	if creation {
+		if err = couchdb.CreateNamedDoc(instance, doc); err == nil {
+			setDocLocation(c, doc)
+		}
 	} else {
 		err = couchdb.UpdateDoc(instance, doc)
 	}
@@ -114,7 +348,29 @@ func updateDoc(c echo.Context) error {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{
+	return writeDocResponse(c, http.StatusOK, doc)
+}
+
+// setDocLocation sets the Location header of the response to the URL of a
+// created document.
+func setDocLocation(c echo.Context, doc couchdb.JSONDoc) {
+	u := url.URL{Path: "/data/" + doc.DocType() + "/" + doc.ID()}
+	c.Response().Header().Set("Location", u.String())
+}
+
+// writeDocResponse sends the response of a write on a document. If the
+// client has asked for it with a `Prefer: return=minimal` header, the
+// document is not echoed back.
+func writeDocResponse(c echo.Context, status int, doc couchdb.JSONDoc) error {
+	if prefersMinimalReturn(c.Request()) {
+		c.Response().Header().Set("Preference-Applied", "return=minimal")
+		return c.JSON(status, echo.Map{
+			"ok":  true,
+			"id":  doc.ID(),
+			"rev": doc.Rev(),
+		})
+	}
+	return c.JSON(status, echo.Map{
 		"ok":   true,
 		"id":   doc.ID(),
 		"rev":  doc.Rev(),
@@ -123,22 +379,140 @@ func updateDoc(c echo.Context) error {
 	})
 }
 
+// prefersMinimalReturn checks if the return=minimal preference is in the
+// Prefer headers of the request (see RFC 7240).
+func prefersMinimalReturn(req *http.Request) bool {
+	for _, header := range req.Header["Prefer"] {
+		for _, pref := range strings.Split(header, ",") {
+			pref = strings.TrimSpace(strings.SplitN(pref, ";", 2)[0])
+			if strings.EqualFold(pref, "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// copyMethod is the HTTP method for the copy of a document, as in CouchDB
+const copyMethod = "COPY"
+
+// RewriteCopyMethod is a pre-routing middleware for the COPY requests on
+// the documents: the router knows only the standard methods, so they are
+// routed as a POST on /data/:doctype/:docid/copy.
+func RewriteCopyMethod(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Method == copyMethod && strings.HasPrefix(req.URL.Path, "/data/") {
+			req.Method = http.MethodPost
+			req.URL.Path = strings.TrimSuffix(req.URL.Path, "/") + "/copy"
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = strings.TrimSuffix(req.URL.RawPath, "/") + "/copy"
+			}
+		}
+		return next(c)
+	}
+}
+
+// docOptions responds to the OPTIONS requests on a document with the methods
+// of its routes. The COPY requests are routed as a POST on /copy, and COPY is
+// listed if such a route is registered.
+func docOptions(c echo.Context) error {
+	methods := middlewares.RouteMethods(c.Echo(), c.Path())
+	for _, method := range middlewares.RouteMethods(c.Echo(), c.Path()+"/copy") {
+		if method == http.MethodPost {
+			methods = append(methods, copyMethod)
+			sort.Strings(methods)
+		}
+	}
+	return middlewares.AllowMethods(c, methods)
+}
+
+// copyDoc copies a document, with its attachments, to the id given in the
+// Destination header. The destination can also be a /data/:doctype/:docid
+// path, for a copy in another doctype.
+func copyDoc(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+	docid := c.Param("docid")
+
+	targetDoctype, targetID, err := parseDestination(doctype, c.Request().Header.Get("Destination"))
+	if err != nil {
+		return err
+	}
+	rev, err := docRev(c, "")
+	if err != nil {
+		return err
+	}
+
+	if err = CheckReadable(c, doctype); err != nil {
+		return err
+	}
+	if err = CheckWritable(c, targetDoctype); err != nil {
+		return err
+	}
+
+	// the copy has the same fields as the original document, so it must
+	// respect the unique constraints of the destination doctype too
+	src := couchdb.JSONDoc{Type: doctype}
+	if err = couchdb.GetDoc(instance, doctype, docid, &src); err != nil {
+		return err
+	}
+	target := couchdb.JSONDoc{Type: targetDoctype, M: make(map[string]interface{}, len(src.M))}
+	for k, v := range src.M {
+		target.M[k] = v
+	}
+	delete(target.M, "_rev")
+	target.M["_id"] = targetID
+	if err = checkUniqueConstraints(instance, target); err != nil {
+		return err
+	}
+
+	res, err := couchdb.CopyDoc(instance, doctype, docid, rev, targetDoctype, targetID)
+	if err != nil {
+		return err
+	}
+	if res.AttachmentsDropped {
+		c.Response().Header().Set("Warning", `199 - "The attachments have not been copied"`)
+	}
+
+	doc := couchdb.JSONDoc{Type: targetDoctype}
+	if err = couchdb.GetDoc(instance, targetDoctype, res.ID, &doc); err != nil {
+		return err
+	}
+	setDocLocation(c, doc)
+	return writeDocResponse(c, http.StatusCreated, doc)
+}
+
+// parseDestination returns the doctype and the id of the destination of a
+// copy, from the Destination header.
+func parseDestination(doctype, destination string) (string, string, error) {
+	if destination == "" {
+		return "", "", jsonapi.NewError(http.StatusBadRequest, "Missing Destination header")
+	}
+	if !strings.HasPrefix(destination, "/data/") {
+		return doctype, destination, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(destination, "/data/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", jsonapi.NewError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid Destination header '%s'", destination))
+	}
+	if err := checkDoctype(parts[0]); err != nil {
+		return "", "", err
+	}
+	return parts[0], parts[1], nil
+}
+
 func deleteDoc(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	doctype := c.Get("doctype").(string)
 	docid := c.Param("docid")
-	revHeader := c.Request().Header.Get("If-Match")
-	revQuery := c.QueryParam("rev")
-	rev := ""
 
-	if revHeader != "" && revQuery != "" && revQuery != revHeader {
-		return jsonapi.NewError(http.StatusBadRequest,
-			"If-Match Header and rev query parameters mismatch")
-	} else if revHeader != "" {
-		rev = revHeader
-	} else if revQuery != "" {
-		rev = revQuery
-	} else {
+	rev, err := docRev(c, "")
+	if err != nil {
+		return err
+	}
+	if rev == "" {
 		return jsonapi.NewError(http.StatusBadRequest, "delete without revision")
 	}
 
@@ -161,6 +535,87 @@ func deleteDoc(c echo.Context) error {
 
 }
 
+// docRev returns the revision of the document given by the client for a
+// write on it: it can be in the If-Match header, in the rev query parameter,
+// or in the _rev field of the body. They must be the same if several of them
+// are given, else a 400 Bad Request is returned. The revision is empty if
+// none is given. It is used by all the handlers that modify a document, so
+// that a stale revision gives a 409 Conflict in all the cases.
+func docRev(c echo.Context, bodyRev string) (string, error) {
+	rev := ""
+	for _, r := range []string{
+		c.Request().Header.Get("If-Match"),
+		c.QueryParam("rev"),
+		bodyRev,
+	} {
+		if r == "" {
+			continue
+		}
+		if rev != "" && r != rev {
+			return "", jsonapi.NewError(http.StatusBadRequest,
+				"If-Match header, rev query parameter and _rev mismatch")
+		}
+		rev = r
+	}
+	return rev, nil
+}
+
+// patchDoc updates some fields of a document: the top-level fields of the
+// body replace those of the document, and a field with a null value is
+// removed. The revision of the document must be given.
+func patchDoc(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+	docid := c.Param("docid")
+
+	var patch map[string]interface{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&patch); err != nil {
+		return jsonapi.NewError(http.StatusBadRequest, err)
+	}
+
+	if err := CheckWritable(c, doctype); err != nil {
+		return err
+	}
+
+	if id, ok := patch["_id"]; ok && id != docid {
+		return jsonapi.NewError(http.StatusBadRequest, "document _id doesnt match url")
+	}
+	bodyRev, _ := patch["_rev"].(string)
+	rev, err := docRev(c, bodyRev)
+	if err != nil {
+		return err
+	}
+	if rev == "" {
+		return jsonapi.NewError(http.StatusBadRequest, "patch without revision")
+	}
+
+	doc := couchdb.JSONDoc{Type: doctype}
+	if err = couchdb.GetDoc(instance, doctype, docid, &doc); err != nil {
+		return err
+	}
+	for key, value := range patch {
+		if key == "_id" || key == "_rev" {
+			continue
+		}
+		if value == nil {
+			delete(doc.M, key)
+		} else {
+			doc.M[key] = value
+		}
+	}
+	doc.SetRev(rev)
+
+	if err = checkUniqueConstraints(instance, doc); err != nil {
+		return err
+	}
+
+	if err = couchdb.UpdateDoc(instance, doc); err != nil {
+		return err
+	}
+
+	return writeDocResponse(c, http.StatusOK, doc)
+}
+
 func defineIndex(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	doctype := c.Get("doctype").(string)
@@ -187,6 +642,110 @@ func defineIndex(c echo.Context) error {
 	return c.JSON(http.StatusOK, result)
 }
 
+func listIndexes(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+
+	if err := CheckReadable(c, doctype); err != nil {
+		return err
+	}
+
+	result, err := couchdb.ListIndexes(instance, doctype)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+func deleteIndex(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+
+	if err := CheckWritable(c, doctype); err != nil {
+		return err
+	}
+
+	ddoc := strings.TrimPrefix(c.Param("ddoc"), "_design/")
+	name := c.Param("name")
+	stack, err := isStackIndex(instance, doctype, ddoc, name)
+	if err != nil {
+		return err
+	}
+	if stack {
+		return jsonapi.NewError(http.StatusForbidden,
+			fmt.Sprintf("The index %s/%s is used by the stack", ddoc, name))
+	}
+
+	err = couchdb.DeleteIndex(instance, doctype, ddoc, name)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{"ok": true})
+}
+
+// stackIndexes are the indexes defined by the stack on its writable
+// doctypes. The other doctypes of the stack can't be written with the data
+// API, and so their indexes can't be deleted.
+var stackIndexes = map[string][]mango.Index{
+	consts.FilesVersions: {vfs.VersionsIndex},
+	consts.Jobs:          {jobs.Index},
+}
+
+// isStackIndex returns true if the index with the given design document and
+// name is used by the stack: it is in the design document of its views, or
+// it is on the same fields as an index of the stack or of a unique
+// constraint.
+func isStackIndex(db couchdb.Database, doctype, ddoc, name string) (bool, error) {
+	if ddoc == doctype {
+		return true, nil
+	}
+	indexes, err := couchdb.ListIndexes(db, doctype)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var fields []string
+	for _, raw := range indexes.Indexes {
+		var index struct {
+			DDoc string `json:"ddoc"`
+			Name string `json:"name"`
+			Def  struct {
+				Fields []map[string]string `json:"fields"`
+			} `json:"def"`
+		}
+		if err = json.Unmarshal(raw, &index); err != nil {
+			return false, err
+		}
+		if index.DDoc != "_design/"+ddoc || index.Name != name {
+			continue
+		}
+		for _, field := range index.Def.Fields {
+			for f := range field {
+				fields = append(fields, f)
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return false, nil
+	}
+	key := strings.Join(fields, ",")
+	for _, index := range stackIndexes[doctype] {
+		if strings.Join(index.Index, ",") == key {
+			return true, nil
+		}
+	}
+	for _, unique := range getUniqueConstraints(doctype) {
+		if strings.Join(unique, ",") == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func findDocuments(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	doctype := c.Get("doctype").(string)
@@ -200,15 +759,135 @@ func findDocuments(c echo.Context) error {
 		return err
 	}
 
+	if err := restrictToScope(c, doctype, findRequest); err != nil {
+		return err
+	}
+
+	// For NDJSON, the index of the query is checked without running it, so
+	// that its errors (like a missing index) are sent before the response
+	// starts
+	ndjson := acceptsNDJSON(c.Request())
 	var results []couchdb.JSONDoc
-	err := couchdb.FindDocsRaw(instance, doctype, &findRequest, &results)
+	find := func() error {
+		if ndjson {
+			return couchdb.CheckFindIndex(instance, doctype, &findRequest)
+		}
+		return couchdb.FindDocsRaw(instance, doctype, &findRequest, &results)
+	}
+
+	err := find()
+	if couchdb.IsNoIndexError(err) && c.QueryParam("ensure_index") == "true" {
+		// an index is created for the fields of the query, and the query is
+		// tried again, only once
+		fields := indexFieldsForQuery(findRequest)
+		if len(fields) > 0 {
+			index := mango.IndexOnFields(fields...)
+			if _, err = couchdb.DefineIndexRaw(instance, doctype, &index); err != nil {
+				return err
+			}
+			results = nil
+			err = find()
+		}
+	}
+	if couchdb.IsNoDatabaseError(err) && emptyIfMissingDB(c) {
+		if ndjson {
+			return c.Blob(http.StatusOK, mimeNDJSON, nil)
+		}
+		return c.JSON(http.StatusOK, echo.Map{"docs": []interface{}{}})
+	}
 	if err != nil {
 		return err
 	}
 
+	if ndjson {
+		content, err := couchdb.OpenFind(instance, doctype, &findRequest)
+		if err != nil {
+			return err
+		}
+		defer content.Close()
+		return streamNDJSON(c, content, "docs", nil)
+	}
+
 	return c.JSON(http.StatusOK, echo.Map{"docs": results})
 }
 
+// restrictToScope narrows the selector of a mango query to the documents
+// allowed by the permissions of the request, if it has a token: the selector
+// of the client is combined with the one of the permissions, so that the
+// results never exceed the granted scope.
+func restrictToScope(c echo.Context, doctype string, query map[string]interface{}) error {
+	if !permissions.HasToken(c) {
+		return nil
+	}
+	scope, err := permissions.ScopeSelector(c, permissions.GET, doctype)
+	if err != nil || scope == nil {
+		return err
+	}
+	if selector, ok := query["selector"]; ok {
+		query["selector"] = map[string]interface{}{
+			"$and": []interface{}{selector, scope},
+		}
+	} else {
+		query["selector"] = scope
+	}
+	return nil
+}
+
+// indexFieldsForQuery returns the fields of an index suitable for the given
+// mango query: the sort fields first, in the same order, and then the other
+// fields used in the selector.
+func indexFieldsForQuery(query map[string]interface{}) []string {
+	var fields []string
+	seen := make(map[string]bool)
+	add := func(field string) {
+		if !seen[field] {
+			seen[field] = true
+			fields = append(fields, field)
+		}
+	}
+
+	if sort, ok := query["sort"].([]interface{}); ok {
+		for _, s := range sort {
+			switch s := s.(type) {
+			case string:
+				add(s)
+			case map[string]interface{}:
+				for field := range s {
+					add(field)
+				}
+			}
+		}
+	}
+
+	var selectorFields []string
+	collectSelectorFields(query["selector"], &selectorFields)
+	sort.Strings(selectorFields)
+	for _, field := range selectorFields {
+		add(field)
+	}
+	return fields
+}
+
+// collectSelectorFields appends the fields used in a mango selector. The
+// combination operators ($and, $or, etc.) are walked through, and the
+// conditions on a field ($gt, $in, etc.) are ignored.
+func collectSelectorFields(selector interface{}, fields *[]string) {
+	switch selector := selector.(type) {
+	case []interface{}:
+		for _, sub := range selector {
+			collectSelectorFields(sub, fields)
+		}
+	case map[string]interface{}:
+		for key, value := range selector {
+			if strings.HasPrefix(key, "$") {
+				collectSelectorFields(value, fields)
+			} else {
+				*fields = append(*fields, key)
+			}
+		}
+	}
+}
+
 var allowedChangesParams = map[string]bool{
 	"feed":      true,
 	"style":     true,
@@ -216,8 +895,13 @@ var allowedChangesParams = map[string]bool{
 	"limit":     true,
 	"timeout":   true,
 	"heartbeat": true, // Pouchdb sends heartbeet even for non-continuous
+	"filter":    true, // only _selector, with the selector in the body
 }
 
+// selectorFilter is the only filter supported by the changes feed: the
+// selector is given in the body of a POST request.
+const selectorFilter = couchdb.ChangesFilterSelector
+
 func changesFeed(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -246,12 +930,25 @@ func changesFeed(c echo.Context) error {
 		}
 	}
 
+	var selector interface{}
+	filter := c.QueryParam("filter")
+	if filter != "" {
+		if filter != selectorFilter {
+			return jsonapi.NewError(http.StatusBadRequest, "Unsuported filter value '%s'", filter)
+		}
+		if selector, err = changesSelector(c); err != nil {
+			return err
+		}
+	}
+
 	results, err := couchdb.GetChanges(instance, &couchdb.ChangesRequest{
-		DocType: c.Get("doctype").(string),
-		Feed:    feed,
-		Style:   feedStyle,
-		Since:   c.QueryParam("since"),
-		Limit:   limit,
+		DocType:  c.Get("doctype").(string),
+		Feed:     feed,
+		Style:    feedStyle,
+		Since:    c.QueryParam("since"),
+		Limit:    limit,
+		Filter:   filter,
+		Selector: selector,
 	})
 
 	if err != nil {
@@ -261,14 +958,212 @@ func changesFeed(c echo.Context) error {
 	return c.JSON(http.StatusOK, results)
 }
 
+// changesSelector returns the mango selector in the body of a request on the
+// changes feed with the _selector filter. It must be a JSON object.
+func changesSelector(c echo.Context) (interface{}, error) {
+	if c.Request().Method != http.MethodPost {
+		return nil, jsonapi.NewError(http.StatusBadRequest, "The _selector filter is only supported with POST")
+	}
+	var body struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.NewDecoder(c.Request().Body).Decode(&body)
+	if err != nil || body.Selector == nil {
+		return nil, jsonapi.NewError(http.StatusBadRequest, "Invalid selector")
+	}
+	return body.Selector, nil
+}
+
+// allDocs lists the documents of a doctype. The number of rows is capped by
+// the configuration: when a client asks for more, it gets a page with the
+// maximal number of rows, and a link to the next page.
 func allDocs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+
+	if err := CheckReadable(c, doctype); err != nil {
+		return err
+	}
+
+	// _all_docs can't be restricted to a scope: the tokens must give access
+	// to the whole doctype
+	if permissions.HasToken(c) {
+		if err := permissions.AllowWholeType(c, permissions.GET, doctype); err != nil {
+			return err
+		}
+	}
+
+	if err := applyCursorParam(c, doctype); err != nil {
+		return err
+	}
+
+	if emptyIfMissingDB(c) {
+		_, err := couchdb.DBStatus(instance, doctype)
+		if couchdb.IsNoDatabaseError(err) {
+			if acceptsNDJSON(c.Request()) {
+				return c.Blob(http.StatusOK, mimeNDJSON, nil)
+			}
+			return c.JSON(http.StatusOK, echo.Map{
+				"offset":     0,
+				"total_rows": 0,
+				"rows":       []interface{}{},
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if acceptsNDJSON(c.Request()) {
+		return streamAllDocs(c)
+	}
+
+	max := config.GetConfig().CouchDB.AllDocsLimit
+	if max <= 0 {
+		return proxy(c, "_all_docs")
+	}
+
+	// The requests with keys are bounded by their number of keys
+	params := c.QueryParams()
+	if params.Get("keys") != "" {
+		return proxy(c, "_all_docs")
+	}
+	keys, err := bodyKeys(c)
+	if err != nil {
+		return err
+	}
+	if keys != nil {
+		return proxy(c, "_all_docs")
+	}
+
+	if limit, err := strconv.Atoi(params.Get("limit")); err == nil && limit <= max {
+		return proxy(c, "_all_docs")
+	}
+
+	// One more row is fetched to know if there is a next page
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	query.Set("limit", strconv.Itoa(max+1))
+	page, err := couchdb.GetAllDocsPage(instance, doctype, query)
+	if err != nil {
+		return err
+	}
+
+	res := echo.Map{
+		"offset":     page.Offset,
+		"total_rows": page.TotalRows,
+		"rows":       page.Rows,
+	}
+	if len(page.Rows) > max {
+		var next struct {
+			ID string `json:"id"`
+		}
+		if err = json.Unmarshal(page.Rows[max], &next); err != nil {
+			return err
+		}
+		cursor := &Cursor{StartKey: next.ID, StartKeyDocID: next.ID}
+		encoded, err := cursor.Encode(instance, doctype)
+		if err != nil {
+			return err
+		}
+		for _, param := range []string{"start_key", "startkey", "startkey_docid", "skip"} {
+			query.Del(param)
+		}
+		query.Set("limit", strconv.Itoa(max))
+		query.Set("cursor", encoded)
+		res["rows"] = page.Rows[:max]
+		res["next"] = "/data/" + doctype + "/_all_docs?" + query.Encode()
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// wrongDoctypeReason is the reason of the not_found errors for a doctype
+// without database.
+const wrongDoctypeReason = "wrong_doctype"
+
+// emptyIfMissingDB returns true if the client has asked to get an empty list,
+// instead of a not_found error, when there is no database for the doctype
+// (no document of this doctype has been created yet).
+func emptyIfMissingDB(c echo.Context) bool {
+	return c.QueryParam("empty_if_missing_db") == "true"
+}
+
+// streamAllDocs sends the rows of _all_docs as NDJSON, with one document per
+// line, without the cap on the number of rows, as they are not buffered.
+func streamAllDocs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+
+	keys, err := bodyKeys(c)
+	if err != nil {
+		return err
+	}
+	content, err := couchdb.OpenAllDocs(instance, doctype, c.QueryParams(), keys)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return streamNDJSON(c, content, "rows", rowDoc)
+}
+
+// bodyKeys returns the keys given in the body of a POST on _all_docs, if
+// any. The body is kept, so that it can still be sent to couchdb.
+func bodyKeys(c echo.Context) ([]string, error) {
+	if c.Request().Method != http.MethodPost {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Request().Body = ioutil.NopCloser(bytes.NewReader(body))
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, &req); err != nil {
+			return nil, jsonapi.NewError(http.StatusBadRequest, err)
+		}
+	}
+	return req.Keys, nil
+}
+
+// getDocs returns the documents with the given ids, in one response. The ids
+// without document are marked as not found, without failing the others.
+func getDocs(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
 	doctype := c.Get("doctype").(string)
 
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return jsonapi.NewError(http.StatusBadRequest, err)
+	}
+	if len(req.Keys) == 0 {
+		return jsonapi.NewError(http.StatusBadRequest, "The keys of the documents are missing")
+	}
+
 	if err := CheckReadable(c, doctype); err != nil {
 		return err
 	}
 
-	return proxy(c, "_all_docs")
+	docs, err := couchdb.GetDocs(instance, doctype, req.Keys)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]echo.Map, len(docs))
+	for i, doc := range docs {
+		if doc == nil {
+			rows[i] = echo.Map{"id": req.Keys[i], "error": "not_found"}
+		} else {
+			rows[i] = echo.Map{"id": req.Keys[i], "doc": doc.ToMapWithType()}
+		}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"rows": rows})
 }
 
 func couchdbStyleErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
@@ -279,7 +1174,13 @@ func couchdbStyleErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		if ce, ok := err.(*couchdb.Error); ok {
-			return c.JSON(ce.StatusCode, ce.JSON())
+			res := ce.JSON()
+			// the missing databases have the same reason on all the routes,
+			// so that the clients can distinguish them from missing documents
+			if couchdb.IsNoDatabaseError(ce) {
+				res["reason"] = wrongDoctypeReason
+			}
+			return c.JSON(ce.StatusCode, res)
 		}
 
 		if he, ok := err.(*echo.HTTPError); ok {
@@ -298,20 +1199,30 @@ func couchdbStyleErrorHandler(next echo.HandlerFunc) echo.HandlerFunc {
 
 // Routes sets the routing for the status service
 func Routes(router *echo.Group) {
+	addConfiguredConstraints()
+
 	router.Use(validDoctype)
 	router.Use(couchdbStyleErrorHandler)
 
 	replicationRoutes(router)
 
 	// API Routes
+	router.OPTIONS("/:doctype/:docid", docOptions)
 	router.GET("/:doctype/:docid", getDoc)
+	router.HEAD("/:doctype/:docid", headDoc)
 	router.PUT("/:doctype/:docid", updateDoc)
+	router.PATCH("/:doctype/:docid", patchDoc)
 	router.DELETE("/:doctype/:docid", deleteDoc)
-	router.POST("/:doctype/:docid/relationships/references", addReferencesHandler)
+	router.POST("/:doctype/:docid/copy", copyDoc)
+	router.POST("/:doctype/:docid/_increment", incrementDoc)
+	router.POST("/:doctype/:docid/relationships/references", addReferencesHandler, jsonapi.CheckMediaType)
 	router.POST("/:doctype/", createDoc)
 	router.GET("/:doctype/_all_docs", allDocs)
 	router.POST("/:doctype/_all_docs", allDocs)
+	router.POST("/:doctype/_get", getDocs)
 	router.POST("/:doctype/_index", defineIndex)
+	router.GET("/:doctype/_index", listIndexes)
+	router.DELETE("/:doctype/_index/:ddoc/:name", deleteIndex)
 	router.POST("/:doctype/_find", findDocuments)
 	// router.DELETE("/:doctype/:docid", DeleteDoc)
 }
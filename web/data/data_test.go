@@ -1,7 +1,9 @@
 package data
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,15 +11,23 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
 
 var client = &http.Client{}
@@ -117,6 +127,7 @@ func TestMain(m *testing.M) {
 
 	handler := echo.New()
 	handler.HTTPErrorHandler = errors.ErrorHandler
+	handler.Pre(RewriteCopyMethod)
 	Routes(handler.Group("/data", injectInstance(inst)))
 	ts = httptest.NewServer(handler)
 
@@ -146,6 +157,107 @@ func TestSuccessGet(t *testing.T) {
 	}
 }
 
+func TestGetWithoutUpdatedAt(t *testing.T) {
+	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/"+ID, nil)
+	req.Header.Add("Host", Host)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Empty(t, res.Header.Get("Last-Modified"))
+}
+
+func TestGetWithUpdatedAt(t *testing.T) {
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{
+		"test":       "value",
+		"updated_at": "2016-09-19T12:38:04Z",
+	}}
+	err := couchdb.CreateDoc(testInstance, &doc)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Equal(t, "Mon, 19 Sep 2016 12:38:04 GMT", res.Header.Get("Last-Modified"))
+
+	req, _ = http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	req.Header.Add("If-Modified-Since", "Mon, 19 Sep 2016 12:38:04 GMT")
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "304 Not Modified", res.Status, "should get a 304")
+
+	req, _ = http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	req.Header.Add("If-Modified-Since", "Sun, 18 Sep 2016 12:38:04 GMT")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+}
+
+func TestGetLargeDocStreamed(t *testing.T) {
+	big := strings.Repeat("0123456789", 110*1024)
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"big": big}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &doc))
+
+	req, _ := http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	req.Header.Add("Accept-Encoding", "identity")
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Equal(t, int64(-1), res.ContentLength)
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding)
+	assert.Equal(t, doc.ID(), out["_id"])
+	assert.Equal(t, Type, out["_type"])
+	assert.Equal(t, big, out["big"])
+
+	// the http client asks for gzip and decompresses the response itself
+	req, _ = http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.True(t, res.Uncompressed, "the response should be gzipped")
+	assert.Equal(t, big, out["big"])
+
+	// the small documents are not streamed
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+Type+"/"+ID, nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Empty(t, res.TransferEncoding)
+	assert.False(t, res.Uncompressed)
+}
+
+func TestGetLargeDocWithUpdatedAt(t *testing.T) {
+	big := strings.Repeat("0123456789", 110*1024)
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{
+		"big":        big,
+		"updated_at": "2016-09-19T12:38:04Z",
+	}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &doc))
+
+	req, _ := http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Equal(t, "Mon, 19 Sep 2016 12:38:04 GMT", res.Header.Get("Last-Modified"))
+	assert.Equal(t, big, out["big"])
+
+	req, _ = http.NewRequest("GET", docURL(ts, doc), nil)
+	req.Header.Add("Host", Host)
+	req.Header.Add("If-Modified-Since", "Mon, 19 Sep 2016 12:38:04 GMT")
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "304 Not Modified", res.Status, "should get a 304")
+}
+
 func TestWrongDoctype(t *testing.T) {
 
 	couchdb.DeleteDB(testInstance, "nottype")
@@ -164,6 +276,90 @@ func TestWrongDoctype(t *testing.T) {
 
 }
 
+func TestMissingDatabaseAndDocument(t *testing.T) {
+	doctype := "io.cozy.nodb"
+	couchdb.DeleteDB(testInstance, doctype)
+
+	// a missing document in an existing database
+	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/no-such-doc", nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "not_found", out["error"])
+	assert.Equal(t, "missing", out["reason"])
+
+	// a document in a missing database
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+doctype+"/no-such-doc", nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "not_found", out["error"])
+	assert.Equal(t, "wrong_doctype", out["reason"])
+
+	// the lists of a missing database, without and with the flag
+	query := M{"selector": M{"foo": "bar"}}
+	req, _ = http.NewRequest("POST", ts.URL+"/data/"+doctype+"/_find", jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "wrong_doctype", out["reason"])
+
+	req, _ = http.NewRequest("POST", ts.URL+"/data/"+doctype+"/_find?empty_if_missing_db=true", jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, []interface{}{}, out["docs"])
+
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+doctype+"/_all_docs?empty_if_missing_db=true", nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, float64(0), out["total_rows"])
+	assert.Equal(t, []interface{}{}, out["rows"])
+
+	// the flag has no effect on an existing database
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+Type+"/_all_docs?empty_if_missing_db=true", nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.NotEmpty(t, out["rows"])
+}
+
+func TestHeadDoc(t *testing.T) {
+	doc := getDocForTest()
+
+	req, _ := http.NewRequest("HEAD", ts.URL+"/data/"+Type+"/"+doc.ID(), nil)
+	req.Header.Add("Host", Host)
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, `"`+doc.Rev()+`"`, res.Header.Get("Etag"))
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Empty(t, body)
+
+	req, _ = http.NewRequest("HEAD", ts.URL+"/data/"+Type+"/no-such-doc", nil)
+	req.Header.Add("Host", Host)
+	res2, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res2.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res2.StatusCode)
+	assert.Empty(t, res2.Header.Get("Etag"))
+}
+
 func TestUnderscoreName(t *testing.T) {
 	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/_foo", nil)
 	req.Header.Add("Host", Host)
@@ -244,6 +440,140 @@ func TestSuccessCreateKnownDoctype(t *testing.T) {
 	assert.Equal(t, sur.Type, sur.Data.Type, "type is correct")
 	assert.Equal(t, sur.Rev, sur.Data.Rev(), "rev is correct")
 	assert.Equal(t, "avalue", sur.Data.Get("somefield"), "content is correct")
+	assert.Equal(t, "/data/"+Type+"/"+sur.ID, res.Header.Get("Location"))
+}
+
+func TestConfiguredUniqueConstraints(t *testing.T) {
+	doctype := "io.cozy.configuredunique"
+	cfg := config.GetConfig()
+	was := cfg.Data.UniqueConstraints
+	defer func() { cfg.Data.UniqueConstraints = was }()
+	cfg.Data.UniqueConstraints = []config.UniqueConstraint{
+		{DocType: doctype, Fields: []string{"user", "key"}},
+	}
+	defer RemoveUniqueConstraints(doctype)
+
+	addConfiguredConstraints()
+	addConfiguredConstraints()
+	assert.Equal(t, [][]string{{"user", "key"}}, getUniqueConstraints(doctype))
+}
+
+func TestUniqueConstraint(t *testing.T) {
+	doctype := "io.cozy.uniquesettings"
+	couchdb.DeleteDB(testInstance, doctype)
+	AddUniqueConstraint(doctype, "user", "key")
+	defer RemoveUniqueConstraints(doctype)
+
+	create := func(body M) (map[string]interface{}, *http.Response) {
+		req, _ := http.NewRequest("POST", ts.URL+"/data/"+doctype+"/", jsonReader(&body))
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return out, res
+	}
+
+	out, res := create(M{"user": "alice", "key": "theme", "value": "dark"})
+	assert.Equal(t, 201, res.StatusCode)
+	firstID, _ := out["id"].(string)
+	out, res = create(M{"user": "alice", "key": "lang", "value": "fr"})
+	assert.Equal(t, 201, res.StatusCode)
+	secondID, _ := out["id"].(string)
+	secondRev, _ := out["rev"].(string)
+	_, res = create(M{"user": "bob", "key": "theme", "value": "light"})
+	assert.Equal(t, 201, res.StatusCode)
+
+	// the documents without all the fields are not concerned
+	_, res = create(M{"user": "alice", "value": "none"})
+	assert.Equal(t, 201, res.StatusCode)
+	_, res = create(M{"user": "alice", "value": "none"})
+	assert.Equal(t, 201, res.StatusCode)
+
+	out, res = create(M{"user": "alice", "key": "theme", "value": "light"})
+	assert.Equal(t, 409, res.StatusCode)
+	assert.Equal(t, "conflict", out["error"])
+
+	// a creation with a fixed id
+	body := M{"user": "alice", "key": "theme"}
+	req, _ := http.NewRequest("PUT", ts.URL+"/data/"+doctype+"/fixed-theme", jsonReader(&body))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+
+	// an update with the key of another document
+	body = M{"_id": secondID, "_rev": secondRev, "user": "alice", "key": "theme"}
+	req, _ = http.NewRequest("PUT", ts.URL+"/data/"+doctype+"/"+secondID, jsonReader(&body))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+
+	patch := M{"_rev": secondRev, "key": "theme"}
+	req, _ = http.NewRequest("PATCH", ts.URL+"/data/"+doctype+"/"+secondID, jsonReader(&patch))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+
+	// a document can be updated without changing its key
+	patch = M{"_rev": secondRev, "value": "en"}
+	req, _ = http.NewRequest("PATCH", ts.URL+"/data/"+doctype+"/"+secondID, jsonReader(&patch))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+
+	// a copy has the key of its original document
+	req, _ = http.NewRequest("COPY", ts.URL+"/data/"+doctype+"/"+secondID, nil)
+	req.Header.Add("Host", Host)
+	req.Header.Add("Destination", secondID+"-copy")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+	_, err = couchdb.GetDocRev(testInstance, doctype, secondID+"-copy")
+	assert.True(t, couchdb.IsNotFoundError(err))
+
+	// the key of a deleted document can be used again
+	doc := couchdb.JSONDoc{Type: doctype}
+	assert.NoError(t, couchdb.GetDoc(testInstance, doctype, firstID, &doc))
+	assert.NoError(t, couchdb.DeleteDoc(testInstance, doc))
+	_, res = create(M{"user": "alice", "key": "theme", "value": "light"})
+	assert.Equal(t, 201, res.StatusCode)
+}
+
+func TestUniqueConstraintIncrement(t *testing.T) {
+	doctype := "io.cozy.uniqueranks"
+	couchdb.DeleteDB(testInstance, doctype)
+	AddUniqueConstraint(doctype, "user", "rank")
+	defer RemoveUniqueConstraints(doctype)
+
+	first := couchdb.JSONDoc{Type: doctype, M: M{"user": "carol", "rank": 1}}
+	second := couchdb.JSONDoc{Type: doctype, M: M{"user": "carol", "rank": 2}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, first))
+	assert.NoError(t, couchdb.CreateDoc(testInstance, second))
+
+	increment := func(body M) *http.Response {
+		url := ts.URL + "/data/" + doctype + "/" + first.ID() + "/_increment"
+		req, _ := http.NewRequest("POST", url, jsonReader(&body))
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		_, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return res
+	}
+
+	// the rank of the second document is already taken
+	assert.Equal(t, 409, increment(M{"field": "rank"}).StatusCode)
+	doc := couchdb.JSONDoc{Type: doctype}
+	assert.NoError(t, couchdb.GetDoc(testInstance, doctype, first.ID(), &doc))
+	assert.Equal(t, float64(1), doc.M["rank"])
+
+	assert.Equal(t, 200, increment(M{"field": "rank", "by": 2}).StatusCode)
 }
 
 func TestSuccessCreateUnknownDoctype(t *testing.T) {
@@ -281,6 +611,24 @@ func TestWrongCreateWithID(t *testing.T) {
 	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
 }
 
+func TestCreateDocTooLarge(t *testing.T) {
+	handler := echo.New()
+	handler.HTTPErrorHandler = errors.ErrorHandler
+	Routes(handler.Group("/data", injectInstance(testInstance), middlewares.BodyLimit(1000)))
+	limited := httptest.NewServer(handler)
+	defer limited.Close()
+
+	var in = jsonReader(&map[string]interface{}{
+		"somefield": strings.Repeat("a", 2000),
+	})
+	req, _ := http.NewRequest("POST", limited.URL+"/data/"+Type+"/", in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "413 Request Entity Too Large", res.Status, "should get a 413")
+}
+
 func TestSuccessUpdate(t *testing.T) {
 
 	// Get revision
@@ -312,7 +660,144 @@ func TestSuccessUpdate(t *testing.T) {
 	assert.Equal(t, "anewvalue", out.Data.Get("somefield"), "content has changed")
 }
 
+func TestCreateWithMinimalReturn(t *testing.T) {
+	var in = jsonReader(&map[string]interface{}{
+		"somefield": "avalue",
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/", in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal")
+	var out map[string]interface{}
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "201 Created", res.Status, "should get a 201")
+	assert.Equal(t, "return=minimal", res.Header.Get("Preference-Applied"))
+	assert.Equal(t, true, out["ok"], "ok is true")
+	assert.NotEmpty(t, out["id"], "there is an id")
+	assert.NotEmpty(t, out["rev"], "there is a rev")
+	assert.NotContains(t, out, "data", "the document is not echoed back")
+}
+
+func TestUpdateWithMinimalReturn(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID()
+	var in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      doc.Rev(),
+		"test":      doc.Get("test"),
+		"somefield": "anewvalue",
+	})
+	req, _ := http.NewRequest("PUT", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "respond-async, return=minimal")
+	var out map[string]interface{}
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Equal(t, true, out["ok"], "ok is true")
+	assert.Equal(t, doc.ID(), out["id"], "id has not changed")
+	assert.NotEqual(t, doc.Rev(), out["rev"], "rev has changed")
+	assert.NotContains(t, out, "data", "the document is not echoed back")
+}
+
 // Test for having not the same ID in document and URL
+func TestCreateTooLargeDoc(t *testing.T) {
+	cfg := config.GetConfig()
+	maxDocSize := cfg.CouchDB.MaxDocSize
+	cfg.CouchDB.MaxDocSize = 1024
+	defer func() { cfg.CouchDB.MaxDocSize = maxDocSize }()
+
+	var in = jsonReader(&map[string]interface{}{
+		"somefield": strings.Repeat("a", 2048),
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/", in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 413, res.StatusCode)
+	assert.Equal(t, "document_too_large", out["error"])
+	assert.Contains(t, out["reason"], "the maximum is 1024 bytes")
+
+	doc := getDocForTest()
+	in = jsonReader(&map[string]interface{}{
+		"_id":       doc.ID(),
+		"_rev":      doc.Rev(),
+		"somefield": strings.Repeat("a", 2048),
+	})
+	req, _ = http.NewRequest("PUT", docURL(ts, doc), in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 413, res.StatusCode)
+}
+
+func TestOptionsDoc(t *testing.T) {
+	req, _ := http.NewRequest("OPTIONS", ts.URL+"/data/"+Type+"/"+ID, nil)
+	req.Header.Add("Host", Host)
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	assert.Equal(t, "COPY, DELETE, GET, HEAD, OPTIONS, PATCH, PUT", res.Header.Get("Allow"))
+}
+
+func TestCopyDocWithAttachment(t *testing.T) {
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{
+		"_id":  "tocopy",
+		"test": "template",
+		"_attachments": map[string]interface{}{
+			"hello.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         base64.StdEncoding.EncodeToString([]byte("hello")),
+			},
+		},
+	}}
+	if !assert.NoError(t, couchdb.CreateNamedDoc(testInstance, doc)) {
+		return
+	}
+
+	type2 := "io.cozy.copytarget"
+	for _, dest := range []struct{ doctype, header string }{
+		{Type, "copied"},
+		{type2, "/data/" + type2 + "/copied"},
+	} {
+		req, _ := http.NewRequest("COPY", ts.URL+"/data/"+Type+"/tocopy", nil)
+		req.Header.Add("Host", Host)
+		req.Header.Add("Destination", dest.header)
+		var out stackUpdateResponse
+		_, res, err := doRequest(req, &out)
+		assert.NoError(t, err)
+		assert.Equal(t, "201 Created", res.Status, "should get a 201")
+		assert.Equal(t, "copied", out.ID)
+		assert.Equal(t, dest.doctype, out.Type)
+		assert.Equal(t, "template", out.Data.Get("test"))
+		assert.Equal(t, "/data/"+dest.doctype+"/copied", res.Header.Get("Location"))
+		assert.Empty(t, res.Header.Get("Warning"))
+
+		var copied couchdb.JSONDoc
+		err = couchdb.GetDoc(testInstance, dest.doctype, "copied", &copied)
+		if assert.NoError(t, err) {
+			attachments, ok := copied.M["_attachments"].(map[string]interface{})
+			if assert.True(t, ok) {
+				assert.Contains(t, attachments, "hello.txt")
+			}
+		}
+	}
+	couchdb.DeleteDB(testInstance, type2)
+
+	req, _ := http.NewRequest("COPY", ts.URL+"/data/"+Type+"/tocopy", nil)
+	req.Header.Add("Host", Host)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
+}
+
 func TestWrongIDInDocUpdate(t *testing.T) {
 	// Get revision
 	doc := getDocForTest()
@@ -355,7 +840,7 @@ func TestCreateDocWithAFixedID(t *testing.T) {
 	assert.Equal(t, out.Type, out.Data.Type, "in doc type is correct")
 	assert.Equal(t, out.Rev, out.Data.Rev(), "in doc rev is correct")
 	assert.Equal(t, "anewvalue", out.Data.Get("somefield"), "content has changed")
-
+	assert.Equal(t, "/data/"+Type+"/specific-id", res.Header.Get("Location"))
 }
 
 func TestNoRevInDocUpdate(t *testing.T) {
@@ -473,6 +958,81 @@ func TestFailDeleteIfNoRev(t *testing.T) {
 	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
 }
 
+func TestRevHandlingOfWrites(t *testing.T) {
+	writes := map[string]func(doc couchdb.JSONDoc, query string) *http.Request{
+		"delete": func(doc couchdb.JSONDoc, query string) *http.Request {
+			req, _ := http.NewRequest("DELETE", ts.URL+"/data/"+Type+"/"+doc.ID()+query, nil)
+			return req
+		},
+		"patch": func(doc couchdb.JSONDoc, query string) *http.Request {
+			body := strings.NewReader(`{"test": "patched", "other": null}`)
+			req, _ := http.NewRequest("PATCH", ts.URL+"/data/"+Type+"/"+doc.ID()+query, body)
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		},
+		"copy": func(doc couchdb.JSONDoc, query string) *http.Request {
+			req, _ := http.NewRequest("COPY", ts.URL+"/data/"+Type+"/"+doc.ID()+query, nil)
+			req.Header.Set("Destination", doc.ID()+"-copy")
+			return req
+		},
+	}
+	success := map[string]int{"delete": 200, "patch": 200, "copy": 201}
+
+	for name, write := range writes {
+		// a mismatch between the header and the query parameter
+		doc := getDocForTest()
+		req := write(doc, "?rev="+doc.Rev())
+		req.Header.Add("Host", Host)
+		req.Header.Add("If-Match", "1-23823823231")
+		_, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, res.StatusCode, name)
+
+		// a stale revision
+		req = write(doc, "?rev=1-238238232322121")
+		req.Header.Add("Host", Host)
+		_, res, err = doRequest(req, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 409, res.StatusCode, name)
+
+		// the current revision, in the header
+		req = write(doc, "")
+		req.Header.Add("Host", Host)
+		req.Header.Add("If-Match", doc.Rev())
+		_, res, err = doRequest(req, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, success[name], res.StatusCode, name)
+	}
+}
+
+func TestPatchDoc(t *testing.T) {
+	doc := getDocForTest()
+	doc.M["other"] = "field"
+	if !assert.NoError(t, couchdb.UpdateDoc(testInstance, doc)) {
+		return
+	}
+
+	body := strings.NewReader(`{"_rev": "` + doc.Rev() + `", "test": "patched", "other": null}`)
+	req, _ := http.NewRequest("PATCH", ts.URL+"/data/"+Type+"/"+doc.ID(), body)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	var out stackUpdateResponse
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.NotEqual(t, doc.Rev(), out.Rev)
+	assert.Equal(t, "patched", out.Data.Get("test"))
+	assert.Nil(t, out.Data.Get("other"))
+
+	// without revision
+	req, _ = http.NewRequest("PATCH", ts.URL+"/data/"+Type+"/"+doc.ID(), strings.NewReader(`{"test": "again"}`))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
+}
+
 type M map[string]interface{}
 type S []interface{}
 type indexCreationResponse struct {
@@ -483,6 +1043,70 @@ type indexCreationResponse struct {
 	Name   string `json:"name"`
 }
 
+func TestIncrementDoc(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID() + "/_increment"
+	increment := func(body M) (map[string]interface{}, *http.Response) {
+		req, _ := http.NewRequest("POST", url, jsonReader(&body))
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return out, res
+	}
+
+	// the field is created at 0 if missing
+	out, res := increment(M{"field": "likes"})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, float64(1), out["value"])
+	out, res = increment(M{"field": "likes", "by": 10})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, float64(11), out["value"])
+
+	// a non-numeric field is rejected
+	_, res = increment(M{"field": "test"})
+	assert.Equal(t, 422, res.StatusCode)
+	_, res = increment(M{"field": "_rev"})
+	assert.Equal(t, 400, res.StatusCode)
+
+	// the concurrent increments are not lost
+	var wg sync.WaitGroup
+	workers, increments := 8, 5
+	errs := make(chan int, workers*increments)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				body := M{"field": "views"}
+				req, _ := http.NewRequest("POST", url, jsonReader(&body))
+				req.Header.Add("Host", Host)
+				req.Header.Set("Content-Type", "application/json")
+				res, err := client.Do(req)
+				if err != nil {
+					errs <- 0
+					continue
+				}
+				res.Body.Close()
+				if res.StatusCode != 200 {
+					errs <- res.StatusCode
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for status := range errs {
+		t.Errorf("An increment has failed: %d", status)
+	}
+
+	var updated couchdb.JSONDoc
+	err := couchdb.GetDoc(testInstance, doc.DocType(), doc.ID(), &updated)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(workers*increments), updated.M["views"])
+	assert.Equal(t, float64(11), updated.M["likes"])
+}
+
 func TestDefineIndex(t *testing.T) {
 	var def map[string]interface{}
 	def = M{"index": M{"fields": S{"foo"}}}
@@ -540,6 +1164,96 @@ func TestDefineIndexUnexistingDoctype(t *testing.T) {
 	assert.NotEmpty(t, out.ID, "should have an design doc ID")
 }
 
+func TestListAndDeleteIndex(t *testing.T) {
+	var def map[string]interface{}
+	def = M{"index": M{"fields": S{"deleteme"}}, "name": "deleteme-index"}
+	var url = ts.URL + "/data/" + Type + "/_index"
+	req, _ := http.NewRequest("POST", url, jsonReader(&def))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	var created indexCreationResponse
+	_, res, err := doRequest(req, &created)
+	assert.NoError(t, err)
+	if !assert.Equal(t, "200 OK", res.Status) {
+		return
+	}
+
+	type index struct {
+		Ddoc string `json:"ddoc"`
+		Name string `json:"name"`
+	}
+	listIndexes := func() []index {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Add("Host", Host)
+		var out struct {
+			Indexes []index `json:"indexes"`
+		}
+		_, res, err := doRequest(req, &out)
+		assert.NoError(t, err)
+		assert.Equal(t, "200 OK", res.Status)
+		return out.Indexes
+	}
+	assert.Contains(t, listIndexes(), index{Ddoc: created.ID, Name: "deleteme-index"})
+
+	ddoc := strings.TrimPrefix(created.ID, "_design/")
+	req, _ = http.NewRequest("DELETE", url+"/"+ddoc+"/deleteme-index", nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Equal(t, true, out["ok"])
+	assert.NotContains(t, listIndexes(), index{Ddoc: created.ID, Name: "deleteme-index"})
+
+	req, _ = http.NewRequest("DELETE", url+"/"+ddoc+"/deleteme-index", nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "404 Not Found", res.Status)
+}
+
+func TestDeleteIndexUnwritableDoctype(t *testing.T) {
+	var url = ts.URL + "/data/" + consts.Files + "/_index/foo/bar"
+	req, _ := http.NewRequest("DELETE", url, nil)
+	req.Header.Add("Host", Host)
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "403 Forbidden", res.Status)
+}
+
+func TestDeleteStackIndex(t *testing.T) {
+	doctype := "io.cozy.uniqueindexes"
+	couchdb.DeleteDB(testInstance, doctype)
+	AddUniqueConstraint(doctype, "user", "key")
+	defer RemoveUniqueConstraints(doctype)
+
+	var def map[string]interface{}
+	def = M{"index": M{"fields": S{"user", "key"}}, "name": "unique-index"}
+	var url = ts.URL + "/data/" + doctype + "/_index"
+	req, _ := http.NewRequest("POST", url, jsonReader(&def))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	var created indexCreationResponse
+	_, res, err := doRequest(req, &created)
+	assert.NoError(t, err)
+	if !assert.Equal(t, "200 OK", res.Status) {
+		return
+	}
+
+	ddoc := strings.TrimPrefix(created.ID, "_design/")
+	req, _ = http.NewRequest("DELETE", url+"/"+ddoc+"/unique-index", nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "403 Forbidden", res.Status)
+
+	// the design document of the views of the stack
+	req, _ = http.NewRequest("DELETE", url+"/"+doctype+"/unique-index", nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "403 Forbidden", res.Status)
+}
+
 func TestFindDocuments(t *testing.T) {
 
 	couchdb.ResetDB(testInstance, Type)
@@ -592,6 +1306,250 @@ func TestFindDocumentsWithoutIndex(t *testing.T) {
 	assert.Contains(t, out2.Reason, "no matching index")
 }
 
+func TestFindDocumentsEnsureIndex(t *testing.T) {
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"ensured-field": "ensured"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &doc))
+
+	var query map[string]interface{}
+	query = M{"selector": M{"ensured-field": "ensured"}}
+	var url = ts.URL + "/data/" + Type + "/_find?ensure_index=true"
+	req, _ := http.NewRequest("POST", url, jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	var out struct {
+		Docs []couchdb.JSONDoc `json:"docs"`
+	}
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	if assert.Len(t, out.Docs, 1) {
+		assert.Equal(t, doc.ID(), out.Docs[0].ID())
+	}
+
+	indexes, err := couchdb.ListIndexes(testInstance, Type)
+	if !assert.NoError(t, err) {
+		return
+	}
+	found := false
+	for _, raw := range indexes.Indexes {
+		if strings.Contains(string(raw), `"ensured-field"`) {
+			found = true
+		}
+	}
+	assert.True(t, found, "an index should have been created")
+
+	// the index can now be used without the flag
+	req, _ = http.NewRequest("POST", ts.URL+"/data/"+Type+"/_find", jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	_, res, err = doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+}
+
+func TestFindDocumentsEnsureIndexWithSort(t *testing.T) {
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"sorted-field": "a", "sorted-date": "2017"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &doc))
+
+	query := M{
+		"selector": M{"sorted-field": "a"},
+		"sort":     []interface{}{M{"sorted-date": "desc"}},
+	}
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/_find?ensure_index=true", jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	var out struct {
+		Docs []couchdb.JSONDoc `json:"docs"`
+	}
+	_, res, err := doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	if assert.Len(t, out.Docs, 1) {
+		assert.Equal(t, doc.ID(), out.Docs[0].ID())
+	}
+}
+
+func TestFindDocumentsWithScopedToken(t *testing.T) {
+	couchdb.ResetDB(testInstance, Type)
+	index := mango.IndexOnFields("test")
+	_, err := couchdb.DefineIndexRaw(testInstance, Type, &index)
+	assert.NoError(t, err)
+
+	doc1 := getDocForTest()
+	doc2 := getDocForTest()
+	_ = getDocForTest()
+	other := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"test": "other"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &other))
+
+	find := func(scope string, query map[string]interface{}) ([]couchdb.JSONDoc, *http.Response) {
+		token, err := crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+			StandardClaims: jwt.StandardClaims{
+				Audience: permissions.AccessTokenAudience,
+				Issuer:   testInstance.Domain,
+				IssuedAt: crypto.Timestamp(),
+				Subject:  "test-data-app",
+			},
+			Scope: scope,
+		})
+		assert.NoError(t, err)
+		req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/_find", jsonReader(&query))
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		var out struct {
+			Docs []couchdb.JSONDoc `json:"docs"`
+		}
+		_, res, err := doRequest(req, &out)
+		assert.NoError(t, err)
+		return out.Docs, res
+	}
+
+	// a token on the whole doctype sees all the documents
+	docs, res := find(Type+":GET", M{"selector": M{"test": "value"}})
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Len(t, docs, 3)
+
+	// a token on some ids only sees these documents
+	scope := Type + ":GET:" + doc1.ID() + "," + doc2.ID()
+	docs, res = find(scope, M{"selector": M{"test": "value"}})
+	assert.Equal(t, "200 OK", res.Status)
+	if assert.Len(t, docs, 2) {
+		ids := []string{docs[0].ID(), docs[1].ID()}
+		assert.Contains(t, ids, doc1.ID())
+		assert.Contains(t, ids, doc2.ID())
+	}
+
+	// a token with a selector only sees the matching documents
+	docs, res = find(Type+":GET:other:test", M{"selector": M{"test": M{"$gt": nil}}})
+	assert.Equal(t, "200 OK", res.Status)
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, other.ID(), docs[0].ID())
+	}
+
+	// a token for another doctype can't read the documents
+	_, res = find("io.cozy.contacts:GET", M{"selector": M{"test": "value"}})
+	assert.Equal(t, "403 Forbidden", res.Status)
+}
+
+func TestQueryViewWithScopedToken(t *testing.T) {
+	couchdb.ResetDB(testInstance, Type)
+	_ = getDocForTest()
+	err := couchdb.DefineViews(testInstance, Type, couchdb.Views{
+		"by-test": couchdb.View{Map: "function(doc) { emit(doc.test, null); }"},
+		"secret":  couchdb.View{Map: "function(doc) { emit(doc._id, doc); }"},
+	})
+	assert.NoError(t, err)
+
+	token, err := crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   testInstance.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "test-data-app",
+		},
+		Scope: Type + ":GET:" + Type + "/by-test:" + permissions.ViewSelector,
+	})
+	assert.NoError(t, err)
+
+	do := func(method, path string, body io.Reader) (map[string]interface{}, *http.Response) {
+		req, _ := http.NewRequest(method, ts.URL+"/data/"+Type+path, body)
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return out, res
+	}
+
+	// the view of the token can be queried
+	out, res := do("GET", "/_design/"+Type+"/_view/by-test", nil)
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Len(t, out["rows"], 1)
+
+	// but not the other views
+	_, res = do("GET", "/_design/"+Type+"/_view/secret", nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+
+	// nor the documents through the view
+	_, res = do("GET", "/_design/"+Type+"/_view/by-test?include_docs=true", nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+	_, res = do("GET", "/_design/"+Type+"/_view/by-test?conflicts=true", nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+
+	// nor the documents
+	_, res = do("GET", "/_all_docs", nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+	_, res = do("POST", "/_find", jsonReader(&M{"selector": M{"test": "value"}}))
+	assert.Equal(t, "403 Forbidden", res.Status)
+}
+
+func TestQueryViewWithKeyScopedToken(t *testing.T) {
+	couchdb.ResetDB(testInstance, Type)
+	shared := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"album": "holidays"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &shared))
+	private := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"album": "private"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &private))
+	err := couchdb.DefineViews(testInstance, Type, couchdb.Views{
+		"by-album": couchdb.View{Map: "function(doc) { emit(doc.album, null); }"},
+	})
+	assert.NoError(t, err)
+
+	token, err := crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   testInstance.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "test-data-app",
+		},
+		Scope: Type + ":GET:" + Type + "/by-album/holidays:" + permissions.ViewSelector,
+	})
+	assert.NoError(t, err)
+
+	do := func(method, path string, body io.Reader) (map[string]interface{}, *http.Response) {
+		req, _ := http.NewRequest(method, ts.URL+"/data/"+Type+"/_design/"+Type+"/_view/by-album"+path, body)
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return out, res
+	}
+
+	// the rows of the shared key can be read
+	out, res := do("GET", `?key="holidays"`, nil)
+	assert.Equal(t, "200 OK", res.Status)
+	if rows, ok := out["rows"].([]interface{}); assert.True(t, ok) && assert.Len(t, rows, 1) {
+		assert.Equal(t, shared.ID(), rows[0].(map[string]interface{})["id"])
+	}
+	out, res = do("POST", "", strings.NewReader(`{"keys": ["holidays"]}`))
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Len(t, out["rows"], 1)
+
+	// but not the other keys, or the whole view
+	_, res = do("GET", `?key="private"`, nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+	_, res = do("POST", "", strings.NewReader(`{"keys": ["holidays", "private"]}`))
+	assert.Equal(t, "403 Forbidden", res.Status)
+	_, res = do("GET", `?startkey="a"&endkey="z"`, nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+	_, res = do("GET", "", nil)
+	assert.Equal(t, "403 Forbidden", res.Status)
+}
+
+func TestIndexFieldsForQuery(t *testing.T) {
+	var query map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"selector": {
+			"$and": [{"year": {"$gt": 2010}}, {"director": "Lucas"}],
+			"title": {"$exists": true}
+		},
+		"sort": [{"year": "asc"}]
+	}`), &query)
+	assert.NoError(t, err)
+	fields := indexFieldsForQuery(query)
+	assert.Equal(t, []string{"year", "director", "title"}, fields)
+}
+
 func TestGetChanges(t *testing.T) {
 
 	assert.NoError(t, couchdb.ResetDB(testInstance, Type))
@@ -633,6 +1591,49 @@ func TestPostChanges(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestChangesWithSelectorFilter(t *testing.T) {
+	url := ts.URL + "/data/" + Type + "/_changes"
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Host", Host)
+	out, _, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	var seqno = out["last_seq"].(string)
+
+	matching := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"color": "blue"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &matching))
+	other := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{"color": "red"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &other))
+
+	url = ts.URL + "/data/" + Type + "/_changes?filter=_selector&since=" + seqno
+	body := strings.NewReader(`{"selector": {"color": "blue"}}`)
+	req, _ = http.NewRequest("POST", url, body)
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "application/json")
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	results := out["results"].([]interface{})
+	if assert.Len(t, results, 1) {
+		change := results[0].(map[string]interface{})
+		assert.Equal(t, matching.ID(), change["id"])
+	}
+
+	body = strings.NewReader(`{"selector": "blue"}`)
+	req, _ = http.NewRequest("POST", url, body)
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "application/json")
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
+
+	url = ts.URL + "/data/" + Type + "/_changes?filter=myddoc/myfilter"
+	req, _ = http.NewRequest("POST", url, nil)
+	req.Header.Add("Host", Host)
+	_, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "400 Bad Request", res.Status, "should get a 400")
+}
+
 func TestWrongFeedChanges(t *testing.T) {
 	url := ts.URL + "/data/" + Type + "/_changes?feed=continuous"
 	req, _ := http.NewRequest("POST", url, nil)
@@ -669,6 +1670,91 @@ func TestUnsupportedOption(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestLocalDocConflict(t *testing.T) {
+	url := ts.URL + "/data/" + Type + "/_local/checkpoint-conflict"
+	put := func(body M) (map[string]interface{}, *http.Response) {
+		req, _ := http.NewRequest("PUT", url, jsonReader(body))
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return out, res
+	}
+
+	out, res := put(M{"last_seq": "1"})
+	if !assert.Equal(t, "201 Created", res.Status) {
+		return
+	}
+	rev := out["rev"].(string)
+
+	// two replications write their checkpoint from the same revision: the
+	// second one is told that the checkpoint has diverged
+	_, res = put(M{"_rev": rev, "last_seq": "2"})
+	assert.Equal(t, "201 Created", res.Status)
+	out, res = put(M{"_rev": rev, "last_seq": "3"})
+	assert.Equal(t, "409 Conflict", res.Status)
+	assert.Equal(t, "conflict", out["error"])
+
+	// and a checkpoint can't be overwritten without its revision
+	_, res = put(M{"last_seq": "4"})
+	assert.Equal(t, "409 Conflict", res.Status)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+	assert.Equal(t, "2", out["last_seq"])
+}
+
+func TestBulkGetWithAttachments(t *testing.T) {
+	content := base64.StdEncoding.EncodeToString([]byte("hello world"))
+	doc := couchdb.JSONDoc{Type: Type, M: map[string]interface{}{
+		"test": "attachment",
+		"_attachments": map[string]interface{}{
+			"hello.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         content,
+			},
+		},
+	}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, &doc))
+
+	bulkGet := func(query string, body interface{}) map[string]interface{} {
+		url := ts.URL + "/data/" + Type + "/_bulk_get?" + query
+		req, _ := http.NewRequest("POST", url, jsonReader(body))
+		req.Header.Add("Host", Host)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		out, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "200 OK", res.Status)
+		return out
+	}
+	attachment := func(out map[string]interface{}) map[string]interface{} {
+		results := out["results"].([]interface{})
+		docs := results[0].(map[string]interface{})["docs"].([]interface{})
+		ok := docs[0].(map[string]interface{})["ok"].(map[string]interface{})
+		atts := ok["_attachments"].(map[string]interface{})
+		return atts["hello.txt"].(map[string]interface{})
+	}
+
+	// the content of the attachment is sent with attachments=true
+	out := bulkGet("revs=true&attachments=true&not_a_param=true", &M{
+		"docs": []M{{"id": doc.ID()}},
+	})
+	att := attachment(out)
+	assert.Equal(t, content, att["data"])
+
+	// but not if the client already has it
+	out = bulkGet("revs=true&attachments=true", &M{
+		"docs": []M{{"id": doc.ID(), "atts_since": []string{doc.Rev()}}},
+	})
+	att = attachment(out)
+	assert.Nil(t, att["data"])
+	assert.Equal(t, true, att["stub"])
+}
+
 func TestGetAllDocs(t *testing.T) {
 	url := ts.URL + "/data/" + Type + "/_all_docs?include_docs=true"
 	req, _ := http.NewRequest("GET", url, nil)
@@ -690,3 +1776,208 @@ func TestGetAllDocs(t *testing.T) {
 	value := doc["test"].(string)
 	assert.Equal(t, "value", value)
 }
+
+func TestGetAllDocsLimit(t *testing.T) {
+	cfg := config.GetConfig()
+	allDocsLimit := cfg.CouchDB.AllDocsLimit
+	cfg.CouchDB.AllDocsLimit = 2
+	defer func() { cfg.CouchDB.AllDocsLimit = allDocsLimit }()
+
+	url := ts.URL + "/data/" + Type + "/_all_docs?include_docs=true&limit=1000"
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	rows := out["rows"].([]interface{})
+	if !assert.Len(t, rows, 2) {
+		return
+	}
+	last := rows[1].(map[string]interface{})["id"].(string)
+	next, ok := out["next"].(string)
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Contains(t, next, "limit=2")
+
+	req, _ = http.NewRequest("GET", ts.URL+next, nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	rows = out["rows"].([]interface{})
+	if assert.NotEmpty(t, rows) {
+		first := rows[0].(map[string]interface{})
+		assert.True(t, first["id"].(string) > last)
+		_, ok = first["doc"].(map[string]interface{})
+		assert.True(t, ok)
+	}
+
+	// a limit under the maximum is kept
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+Type+"/_all_docs?limit=1", nil)
+	req.Header.Add("Host", Host)
+	out, res, err = doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Len(t, out["rows"], 1)
+	assert.Nil(t, out["next"])
+}
+
+func TestListDocsAsNDJSON(t *testing.T) {
+	doctype := "io.cozy.ndjson"
+	assert.NoError(t, couchdb.ResetDB(testInstance, doctype))
+	defer couchdb.DeleteDB(testInstance, doctype)
+	for i := 0; i < 5; i++ {
+		doc := couchdb.JSONDoc{Type: doctype, M: map[string]interface{}{
+			"num":    i,
+			"nested": map[string]interface{}{"multi": "line\ntext"},
+		}}
+		assert.NoError(t, couchdb.CreateDoc(testInstance, &doc))
+	}
+	index := mango.IndexOnFields("num")
+	assert.NoError(t, couchdb.DefineIndex(testInstance, doctype, index))
+
+	readLines := func(res *http.Response) []map[string]interface{} {
+		defer res.Body.Close()
+		var docs []map[string]interface{}
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			var doc map[string]interface{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			docs = append(docs, doc)
+		}
+		assert.NoError(t, scanner.Err())
+		return docs
+	}
+
+	query := M{"selector": M{"num": M{"$gte": 2}}}
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+doctype+"/_find", jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+	docs := readLines(res)
+	if assert.Len(t, docs, 3) {
+		for _, doc := range docs {
+			assert.True(t, doc["num"].(float64) >= 2)
+			assert.NotEmpty(t, doc["_id"])
+		}
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/data/"+doctype+"/_all_docs?include_docs=true", nil)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err = client.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 200, res.StatusCode)
+	docs = readLines(res)
+	nums := 0
+	for _, doc := range docs {
+		if _, ok := doc["num"]; ok {
+			nums++
+		}
+	}
+	assert.Equal(t, 5, nums)
+
+	// the errors are still sent as JSON, before the stream starts
+	query = M{"selector": M{"no-index-for-this-field": "value"}}
+	req, _ = http.NewRequest("POST", ts.URL+"/data/"+doctype+"/_find", jsonReader(&query))
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-ndjson")
+	var out struct {
+		Error string `json:"error"`
+	}
+	_, res, err = doRequest(req, &out)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+	assert.Contains(t, out.Error, "no_index")
+}
+
+func TestGetDocs(t *testing.T) {
+	doc1 := getDocForTest()
+	doc2 := getDocForTest()
+	body := `{"keys": ["` + doc1.ID() + `", "missing-doc-id", "` + doc2.ID() + `"]}`
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+Type+"/_get", strings.NewReader(body))
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "application/json")
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+
+	rows, ok := out["rows"].([]interface{})
+	if !assert.True(t, ok) || !assert.Len(t, rows, 3) {
+		return
+	}
+	for i, expected := range []couchdb.JSONDoc{doc1, {}, doc2} {
+		row := rows[i].(map[string]interface{})
+		if expected.M == nil {
+			assert.Equal(t, "missing-doc-id", row["id"])
+			assert.Equal(t, "not_found", row["error"])
+			assert.Nil(t, row["doc"])
+			continue
+		}
+		assert.Equal(t, expected.ID(), row["id"])
+		doc, ok := row["doc"].(map[string]interface{})
+		if assert.True(t, ok) {
+			assert.Equal(t, expected.ID(), doc["_id"])
+			assert.Equal(t, Type, doc["_type"])
+			assert.Equal(t, "value", doc["test"])
+		}
+	}
+}
+
+func TestGetDocsUnreadableDoctype(t *testing.T) {
+	body := `{"keys": ["foo"]}`
+	req, _ := http.NewRequest("POST", ts.URL+"/data/"+consts.Permissions+"/_get", strings.NewReader(body))
+	req.Header.Add("Host", Host)
+	req.Header.Add("Content-Type", "application/json")
+	_, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "403 Forbidden", res.Status, "should get a 403")
+}
+
+func TestValidDoctypeNames(t *testing.T) {
+	get := func(doctype string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/data/"+doctype+"/"+ID, nil)
+		req.Header.Add("Host", Host)
+		_, res, err := doRequest(req, nil)
+		assert.NoError(t, err)
+		return res
+	}
+
+	// a valid doctype reaches the database
+	res := get(Type)
+	assert.NotEqual(t, "400 Bad Request", res.Status)
+	assert.NotEqual(t, "403 Forbidden", res.Status)
+	res = get("io.cozy.some_thing-2")
+	assert.Equal(t, "404 Not Found", res.Status)
+
+	for _, doctype := range []string{
+		"IO.cozy.events",
+		"io.cozy.events!",
+		"9io.cozy.events",
+		"_foo",
+		strings.Repeat("a", 129),
+	} {
+		res := get(doctype)
+		assert.Equal(t, "400 Bad Request", res.Status, "%s should be invalid", doctype)
+	}
+
+	for _, doctype := range []string{
+		"_users",
+		"_replicator",
+		consts.Sessions,
+		consts.Webhooks,
+	} {
+		res := get(doctype)
+		assert.Equal(t, "403 Forbidden", res.Status, "%s should be reserved", doctype)
+	}
+}
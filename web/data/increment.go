@@ -0,0 +1,97 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+// maxIncrementRetries is the number of times an increment is tried again
+// after a conflict with a concurrent write on the same document
+var maxIncrementRetries = 30
+
+// incrementRetryDelay is the maximal delay before trying again an increment.
+// A random delay is used, growing with the number of attempts, to avoid
+// retrying in lockstep with the other writers.
+var incrementRetryDelay = 5 * time.Millisecond
+
+type incrementRequest struct {
+	Field string   `json:"field"`
+	By    *float64 `json:"by"`
+}
+
+// incrementDoc adds a number (1 by default) to a numeric field of a
+// document, and returns its new value. The conflicts with the concurrent
+// writes are resolved by reading the document again and retrying, so that
+// no increment is lost.
+func incrementDoc(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doctype := c.Get("doctype").(string)
+	docid := c.Param("docid")
+
+	var req incrementRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return jsonapi.NewError(http.StatusBadRequest, err)
+	}
+	if req.Field == "" || strings.HasPrefix(req.Field, "_") {
+		return jsonapi.NewError(http.StatusBadRequest, "Invalid field to increment")
+	}
+	by := float64(1)
+	if req.By != nil {
+		by = *req.By
+	}
+
+	if err := CheckWritable(c, doctype); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		doc := couchdb.JSONDoc{Type: doctype}
+		if err := couchdb.GetDoc(instance, doctype, docid, &doc); err != nil {
+			return err
+		}
+
+		var value float64
+		switch v := doc.M[req.Field].(type) {
+		case nil:
+			value = 0
+		case float64:
+			value = v
+		default:
+			return jsonapi.InvalidAttribute(req.Field,
+				errors.New("The field to increment is not a number"))
+		}
+		value += by
+		doc.M[req.Field] = value
+
+		if err := checkUniqueConstraints(instance, doc); err != nil {
+			return err
+		}
+
+		err := couchdb.UpdateDoc(instance, doc)
+		if couchdb.IsConflictError(err) && attempt < maxIncrementRetries {
+			delay := rand.Int63n(int64(incrementRetryDelay) * int64(attempt+1))
+			time.Sleep(time.Duration(delay))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"ok":    true,
+			"id":    doc.ID(),
+			"rev":   doc.Rev(),
+			"field": req.Field,
+			"value": value,
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// mimeNDJSON is the content type of the responses with one JSON document per
+// line, for the exports of large lists of documents.
+const mimeNDJSON = "application/x-ndjson"
+
+// acceptsNDJSON returns true if the client asks for one document per line
+// instead of a JSON array.
+func acceptsNDJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get(echo.HeaderAccept), ",") {
+		accept = strings.TrimSpace(strings.SplitN(accept, ";", 2)[0])
+		if accept == mimeNDJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// streamNDJSON reads the JSON object sent by couchdb, and writes the items of
+// its array in the given field, one per line, as they are read. The extract
+// function can be used to send only a part of each item.
+func streamNDJSON(c echo.Context, content io.Reader, field string, extract func(json.RawMessage) (json.RawMessage, error)) error {
+	dec := json.NewDecoder(content)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, mimeNDJSON)
+	res.WriteHeader(http.StatusOK)
+
+	var line bytes.Buffer
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != field {
+			var skipped json.RawMessage
+			if err = dec.Decode(&skipped); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = expectDelim(dec, '['); err != nil {
+			return err
+		}
+		for dec.More() {
+			var item json.RawMessage
+			if err = dec.Decode(&item); err != nil {
+				return err
+			}
+			if extract != nil {
+				if item, err = extract(item); err != nil {
+					return err
+				}
+			}
+			line.Reset()
+			if err = json.Compact(&line, item); err != nil {
+				return err
+			}
+			line.WriteByte('\n')
+			if _, err = res.Write(line.Bytes()); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+		if err = expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("Unexpected token %v instead of %v", tok, delim)
+	}
+	return nil
+}
+
+// rowDoc returns the document of a row of _all_docs, if it has been included,
+// or the row itself else (for the missing or deleted documents too).
+func rowDoc(row json.RawMessage) (json.RawMessage, error) {
+	var r struct {
+		Doc json.RawMessage `json:"doc"`
+	}
+	if err := json.Unmarshal(row, &r); err != nil {
+		return nil, err
+	}
+	if len(r.Doc) == 0 || string(r.Doc) == "null" {
+		return row, nil
+	}
+	return r.Doc, nil
+}
@@ -16,10 +16,18 @@ var blackList = map[string]bool{
 	consts.Permissions:      none,
 	consts.OAuthClients:     none,
 	consts.OAuthAccessCodes: none,
+	consts.Webhooks:         none,
 	consts.Files:            readable,
 	consts.Instances:        readable,
 }
 
+// isReservedDoctype returns true for the doctypes used by the stack that can
+// be neither read nor written with the data API.
+func isReservedDoctype(doctype string) bool {
+	readable, inblacklist := blackList[doctype]
+	return inblacklist && !readable
+}
+
 // CheckReadable will abort the context and returns false if the doctype
 // is unreadable
 func CheckReadable(c echo.Context, doctype string) error {
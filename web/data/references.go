@@ -1,6 +1,11 @@
 package data
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
@@ -8,6 +13,14 @@ import (
 	"github.com/labstack/echo"
 )
 
+// bulkUpdateDocs is the function used to write the updated files in CouchDB.
+// It can be replaced in the tests.
+var bulkUpdateDocs = couchdb.BulkUpdateDocs
+
+// addReferencesHandler adds a reference to the document on many files at
+// once. The files are fetched and updated with a single request each. The
+// bulk update of CouchDB is not atomic: if some files can't be updated, the
+// others are still written, and the response gives the result for each file.
 func addReferencesHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -21,17 +34,71 @@ func addReferencesHandler(c echo.Context) error {
 		ID:   c.Param("docid"),
 	}
 
+	var ids []string
+	seen := make(map[string]bool)
 	for _, fRef := range references {
-		file, err := vfs.GetFileDoc(instance, fRef.ID)
-		if err != nil {
-			return err
+		if !seen[fRef.ID] {
+			seen[fRef.ID] = true
+			ids = append(ids, fRef.ID)
 		}
-		file.AddReferencedBy(docRef)
-		err = couchdb.UpdateDoc(instance, file)
-		if err != nil {
-			return err
+	}
+	if len(ids) == 0 {
+		return jsonapi.NewError(http.StatusBadRequest, "The references are missing")
+	}
+
+	files, err := vfs.GetFileDocs(instance, ids)
+	if err != nil {
+		return err
+	}
+
+	var docs []couchdb.Doc
+	for i, file := range files {
+		if file == nil {
+			return jsonapi.NotFound(fmt.Errorf("File %s not found", ids[i]))
+		}
+		if file.AddReferencedBy(docRef) > 0 {
+			docs = append(docs, file)
 		}
 	}
 
-	return c.NoContent(204)
+	if len(docs) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	results, err := bulkUpdateDocs(instance, consts.Files, docs)
+	if err != nil {
+		return err
+	}
+
+	status := http.StatusNoContent
+	failed := make(map[string]*jsonapi.Error)
+	for _, res := range results {
+		if res.Error == "" {
+			continue
+		}
+		if res.Error == "conflict" {
+			failed[res.ID] = jsonapi.Conflict(errors.New(res.Reason))
+		} else {
+			failed[res.ID] = jsonapi.NewError(http.StatusInternalServerError, res.Reason)
+		}
+		if status == http.StatusNoContent {
+			status = failed[res.ID].Status
+		}
+	}
+	if len(failed) == 0 {
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	// the files without error have been written: they are given in data, and
+	// the others in errors
+	rows := make([]jsonapi.BulkResult, 0, len(files))
+	for _, file := range files {
+		rows = append(rows, jsonapi.BulkResult{ID: file.ID(), Object: file})
+	}
+	for i, row := range rows {
+		if e, ok := failed[row.ID]; ok {
+			rows[i] = jsonapi.BulkResult{ID: row.ID, Error: e}
+		}
+	}
+	return jsonapi.DataBulk(c, status, rows)
 }
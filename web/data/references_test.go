@@ -1,11 +1,14 @@
 package data
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"testing"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/stretchr/testify/assert"
@@ -52,3 +55,131 @@ func TestAddReferencesHandler(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 204, res.StatusCode)
 }
+
+func TestAddManyReferences(t *testing.T) {
+	doc := getDocForTest()
+	url := ts.URL + "/data/" + doc.DocType() + "/" + doc.ID() + "/relationships/references"
+
+	var refs []jsonapi.ResourceIdentifier
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("manyrefs-%d.txt", i)
+		filedoc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		f, err := vfs.CreateFile(testInstance, filedoc, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		if err = f.Close(); !assert.NoError(t, err) {
+			return
+		}
+		refs = append(refs, jsonapi.ResourceIdentifier{
+			ID:   filedoc.ID(),
+			Type: filedoc.DocType(),
+		})
+	}
+	// a duplicate of the first file
+	refs = append(refs, refs[0])
+
+	calls := 0
+	defer func() { bulkUpdateDocs = couchdb.BulkUpdateDocs }()
+	bulkUpdateDocs = func(db couchdb.Database, doctype string, docs []couchdb.Doc) ([]couchdb.BulkResult, error) {
+		calls++
+		assert.Len(t, docs, 100)
+		return couchdb.BulkUpdateDocs(db, doctype, docs)
+	}
+
+	in := jsonReader(jsonapi.Relationship{Data: refs})
+	req, _ := http.NewRequest("POST", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 204, res.StatusCode)
+	assert.Equal(t, 1, calls)
+
+	for i := 0; i < 100; i++ {
+		file, err := vfs.GetFileDoc(testInstance, refs[i].ID)
+		if assert.NoError(t, err) {
+			assert.Len(t, file.ReferencedBy, 1)
+		}
+	}
+
+	// a missing file: nothing is updated
+	other := jsonapi.ResourceIdentifier{ID: "other-album", Type: doc.DocType()}
+	url = ts.URL + "/data/" + other.Type + "/" + other.ID + "/relationships/references"
+	in = jsonReader(jsonapi.Relationship{
+		Data: []jsonapi.ResourceIdentifier{
+			refs[0],
+			jsonapi.ResourceIdentifier{ID: "no-such-file", Type: consts.Files},
+		},
+	})
+	req, _ = http.NewRequest("POST", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 404, res.StatusCode)
+
+	file, err := vfs.GetFileDoc(testInstance, refs[0].ID)
+	if assert.NoError(t, err) {
+		assert.Len(t, file.ReferencedBy, 1)
+	}
+
+	// a conflict on a file: the other one is still written, and the
+	// response says which one
+	bulkUpdateDocs = func(db couchdb.Database, doctype string, docs []couchdb.Doc) ([]couchdb.BulkResult, error) {
+		results, err := couchdb.BulkUpdateDocs(db, doctype, docs[1:])
+		conflict := couchdb.BulkResult{ID: docs[0].ID(), Error: "conflict", Reason: "Document update conflict."}
+		return append([]couchdb.BulkResult{conflict}, results...), err
+	}
+	partial := jsonapi.ResourceIdentifier{ID: "partial-album", Type: doc.DocType()}
+	url = ts.URL + "/data/" + partial.Type + "/" + partial.ID + "/relationships/references"
+	in = jsonReader(jsonapi.Relationship{
+		Data: []jsonapi.ResourceIdentifier{refs[1], refs[2]},
+	})
+	req, _ = http.NewRequest("POST", url, in)
+	req.Header.Add("Host", Host)
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 409, res.StatusCode)
+	var out struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+		Errors []struct {
+			Status string `json:"status"`
+			Meta   struct {
+				ID string `json:"id"`
+			} `json:"meta"`
+		} `json:"errors"`
+	}
+	if assert.NoError(t, json.NewDecoder(res.Body).Decode(&out)) {
+		if assert.Len(t, out.Data, 1) {
+			assert.Equal(t, refs[2].ID, out.Data[0].ID)
+		}
+		if assert.Len(t, out.Errors, 1) {
+			assert.Equal(t, "409", out.Errors[0].Status)
+			assert.Equal(t, refs[1].ID, out.Errors[0].Meta.ID)
+		}
+	}
+	file, err = vfs.GetFileDoc(testInstance, refs[1].ID)
+	if assert.NoError(t, err) {
+		assert.Len(t, file.ReferencedBy, 1)
+	}
+	file, err = vfs.GetFileDoc(testInstance, refs[2].ID)
+	if assert.NoError(t, err) {
+		assert.Len(t, file.ReferencedBy, 2)
+	}
+}
@@ -1,10 +1,16 @@
 package data
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
@@ -29,6 +35,140 @@ func getDesignDoc(c echo.Context) error {
 	})
 }
 
+// viewParams are the parameters of the query-string of a view that are sent
+// to couchdb for a token that gives access to this view, but not to the
+// documents of the doctype
+var viewParams = []string{
+	"key", "keys", "startkey", "start_key", "endkey", "end_key",
+	"startkey_docid", "start_key_doc_id", "endkey_docid", "end_key_doc_id",
+	"inclusive_end", "descending", "limit", "skip", "reduce", "group",
+	"group_level", "stale", "update", "update_seq", "sorted", "stable",
+}
+
+// viewDocsParams are the parameters of a view that would read the documents,
+// and not only the rows of the view
+var viewDocsParams = []string{"include_docs", "attachments", "conflicts", "att_encoding_info"}
+
+// viewRangeParams are the parameters of a view for a range of keys
+var viewRangeParams = []string{
+	"startkey", "start_key", "endkey", "end_key",
+	"startkey_docid", "start_key_doc_id", "endkey_docid", "end_key_doc_id",
+}
+
+// queryView proxies the query of a view of a design doc to couchdb. The
+// tokens must give access to this view, or to the whole doctype. When the
+// token gives only access to the view, the documents can't be included in
+// the response, and the keys are restricted to the ones of its permissions.
+func queryView(c echo.Context) error {
+	doctype := c.Get("doctype").(string)
+	ddoc := c.Param("ddoc")
+	view := c.Param("view")
+
+	if err := CheckReadable(c, doctype); err != nil {
+		return err
+	}
+
+	if permissions.HasToken(c) {
+		keys, err := permissions.ViewKeys(c, permissions.GET, doctype, ddoc+"/"+view)
+		if err != nil {
+			return err
+		}
+		if permissions.AllowWholeType(c, permissions.GET, doctype) != nil {
+			if err = restrictViewQuery(c, keys); err != nil {
+				return err
+			}
+		}
+	}
+
+	return proxy(c, "_design/"+ddoc+"/_view/"+view)
+}
+
+// restrictViewQuery keeps only the parameters of the query of a view that
+// don't read the documents, and checks that the keys asked are in the given
+// keys, if they are not nil.
+func restrictViewQuery(c echo.Context, keys []string) error {
+	req := c.Request()
+	query := req.URL.Query()
+	for _, param := range viewDocsParams {
+		if _, ok := query[param]; ok {
+			return jsonapi.NewError(http.StatusForbidden,
+				"The parameter ", param, " needs a permission on the whole doctype")
+		}
+	}
+	params := url.Values{}
+	for _, param := range viewParams {
+		if values, ok := query[param]; ok {
+			params[param] = values
+		}
+	}
+
+	var asked []interface{}
+	if req.Method == http.MethodPost {
+		var body struct {
+			Keys []interface{} `json:"keys"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return jsonapi.BadJSON()
+		}
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		req.ContentLength = int64(len(b))
+		asked = append(asked, body.Keys...)
+	}
+
+	if keys != nil {
+		for _, param := range viewRangeParams {
+			if _, ok := params[param]; ok {
+				return jsonapi.NewError(http.StatusForbidden,
+					"The parameter ", param, " needs a permission on the whole view")
+			}
+		}
+		if key := params.Get("key"); key != "" {
+			var k interface{}
+			if err := json.Unmarshal([]byte(key), &k); err != nil {
+				return jsonapi.InvalidParameter("key", err)
+			}
+			asked = append(asked, k)
+		}
+		if ks := params.Get("keys"); ks != "" {
+			var k []interface{}
+			if err := json.Unmarshal([]byte(ks), &k); err != nil {
+				return jsonapi.InvalidParameter("keys", err)
+			}
+			asked = append(asked, k...)
+		}
+		if len(asked) == 0 {
+			return jsonapi.NewError(http.StatusForbidden,
+				"The key or keys parameter is required to query this view")
+		}
+		for _, k := range asked {
+			if !viewKeyAllowed(k, keys) {
+				return jsonapi.NewError(http.StatusForbidden,
+					"The key ", k, " is not allowed for this view")
+			}
+		}
+	}
+
+	req.URL.RawQuery = params.Encode()
+	return nil
+}
+
+func viewKeyAllowed(key interface{}, keys []string) bool {
+	str, ok := key.(string)
+	if !ok {
+		return false
+	}
+	for _, k := range keys {
+		if k == str {
+			return true
+		}
+	}
+	return false
+}
+
 func getLocalDoc(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 	docid := c.Param("docid")
@@ -41,6 +181,10 @@ func getLocalDoc(c echo.Context) error {
 
 }
 
+// setLocalDoc proxies the write of a _local doc, like a replication
+// checkpoint, to couchdb. Its revision is checked by couchdb, and a conflict
+// is sent back as is to the client, so that a replicator can detect that its
+// checkpoint has been modified by another replication.
 func setLocalDoc(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 	docid := c.Param("docid")
@@ -52,6 +196,13 @@ func setLocalDoc(c echo.Context) error {
 	return proxy(c, "_local/"+docid)
 }
 
+// bulkGetParams are the parameters of the query-string of _bulk_get that are
+// sent to couchdb, in particular for the replication of the attachments
+var bulkGetParams = []string{"revs", "latest", "attachments", "atts_since", "att_encoding_info"}
+
+// bulkGet proxies _bulk_get to couchdb. The response can be in JSON, or in
+// multipart/related with the attachments when they are asked with
+// attachments=true and an Accept header for it: it is streamed as is.
 func bulkGet(c echo.Context) error {
 	doctype := c.Get("doctype").(string)
 
@@ -59,6 +210,16 @@ func bulkGet(c echo.Context) error {
 		return err
 	}
 
+	req := c.Request()
+	query := req.URL.Query()
+	params := url.Values{}
+	for _, param := range bulkGetParams {
+		if values, ok := query[param]; ok {
+			params[param] = values
+		}
+	}
+	req.URL.RawQuery = params.Encode()
+
 	return proxy(c, "_bulk_get")
 }
 
@@ -101,6 +262,8 @@ func replicationRoutes(router *echo.Group) {
 	router.GET("/", dataAPIWelcome)
 	router.GET("/:doctype/", dbStatus)
 	router.GET("/:doctype/_design/:designdocid", getDesignDoc)
+	router.GET("/:doctype/_design/:ddoc/_view/:view", queryView)
+	router.POST("/:doctype/_design/:ddoc/_view/:view", queryView)
 	router.GET("/:doctype/_changes", changesFeed)
 	// POST=GET see http://docs.couchdb.org/en/2.0.0/api/database/changes.html#post--db-_changes)
 	router.POST("/:doctype/_changes", changesFeed)
@@ -109,6 +272,7 @@ func replicationRoutes(router *echo.Group) {
 
 	// useful for Pouchdb replication
 	router.GET("/:doctype/_bulk_get", bulkGet)
+	router.POST("/:doctype/_bulk_get", bulkGet)
 
 	// for storing checkpoints
 	router.GET("/:doctype/_local/:docid", getLocalDoc)
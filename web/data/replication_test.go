@@ -63,3 +63,30 @@ func TestReplicationFromcozy(t *testing.T) {
 	assert.Equal(t, "200 OK", res.Status)
 	assert.Equal(t, out["_id"], doc4.ID())
 }
+
+func TestDBStatus(t *testing.T) {
+	assert.NoError(t, couchdb.ResetDB(testInstance, Type))
+	var doc1 = getDocForTest()
+	var _ = getDocForTest()
+	assert.NoError(t, couchdb.DeleteDoc(testInstance, doc1))
+
+	req, _ := http.NewRequest("GET", ts.URL+"/data/"+Type+"/", nil)
+	req.Header.Add("Host", Host)
+	out, res, err := doRequest(req, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status)
+
+	// the raw fields of couchdb are kept
+	assert.Contains(t, out, "db_name")
+	assert.Contains(t, out, "update_seq")
+
+	stats, ok := out["stats"].(map[string]interface{})
+	if !assert.True(t, ok, "stats should be present") {
+		return
+	}
+	assert.Equal(t, float64(1), stats["doc_count"])
+	assert.Equal(t, float64(1), stats["doc_del_count"])
+	seq, ok := stats["update_seq"].(string)
+	assert.True(t, ok, "update_seq should be a string")
+	assert.NotEmpty(t, seq)
+}
@@ -0,0 +1,204 @@
+package data
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// uniqueConstraints is the registry of the combinations of fields that must
+// be unique among the documents of a doctype.
+var uniqueConstraints = make(map[string][][]string)
+var uniqueConstraintsMu sync.RWMutex
+
+// uniqueIndexes are the indexes of the unique constraints that have been
+// defined, by database, doctype and fields. The databases are created with
+// the instances, so an index is defined on the first check of its constraint
+// for an instance, and then only if it is found missing.
+var uniqueIndexes = make(map[string]bool)
+var uniqueIndexesMu sync.Mutex
+
+// AddUniqueConstraint declares that two documents of the doctype can't have
+// the same values for the given fields. A document without one of these
+// fields is not concerned by the constraint. Adding the same constraint
+// twice has no effect.
+func AddUniqueConstraint(doctype string, fields ...string) {
+	uniqueConstraintsMu.Lock()
+	defer uniqueConstraintsMu.Unlock()
+	for _, existing := range uniqueConstraints[doctype] {
+		if strings.Join(existing, ",") == strings.Join(fields, ",") {
+			return
+		}
+	}
+	uniqueConstraints[doctype] = append(uniqueConstraints[doctype], fields)
+}
+
+// RemoveUniqueConstraints removes all the unique constraints of a doctype.
+func RemoveUniqueConstraints(doctype string) {
+	uniqueConstraintsMu.Lock()
+	defer uniqueConstraintsMu.Unlock()
+	delete(uniqueConstraints, doctype)
+}
+
+// addConfiguredConstraints registers the unique constraints of the
+// configuration.
+func addConfiguredConstraints() {
+	for _, uc := range config.GetConfig().Data.UniqueConstraints {
+		AddUniqueConstraint(uc.DocType, uc.Fields...)
+	}
+}
+
+func getUniqueConstraints(doctype string) [][]string {
+	uniqueConstraintsMu.RLock()
+	defer uniqueConstraintsMu.RUnlock()
+	return uniqueConstraints[doctype]
+}
+
+// uniqueKey returns the values of the fields of the constraint for the
+// document, or false if the document doesn't have all these fields.
+func uniqueKey(doc couchdb.JSONDoc, fields []string) ([]interface{}, bool) {
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		value, ok := doc.M[field]
+		if !ok || value == nil {
+			return nil, false
+		}
+		values[i] = value
+	}
+	return values, true
+}
+
+// uniqueConflict returns the error sent when a document would violate a
+// unique constraint.
+func uniqueConflict(fields []string) error {
+	return &couchdb.Error{
+		StatusCode: http.StatusConflict,
+		Name:       "conflict",
+		Reason: fmt.Sprintf("A document with the same %s already exists",
+			strings.Join(fields, ", ")),
+	}
+}
+
+// checkUniqueConstraints looks for another document of the same doctype with
+// the same values for the fields of a unique constraint, and returns a 409
+// error if there is one.
+//
+// This check is made before writing the document, so two concurrent writes
+// can still both pass it: see createUniqueDoc for the creations.
+func checkUniqueConstraints(db couchdb.Database, doc couchdb.JSONDoc) error {
+	for _, fields := range getUniqueConstraints(doc.DocType()) {
+		values, ok := uniqueKey(doc, fields)
+		if !ok {
+			continue
+		}
+		filters := make([]mango.Filter, len(fields))
+		for i, field := range fields {
+			filters[i] = mango.Equal(field, values[i])
+		}
+		var others []couchdb.JSONDoc
+		req := &couchdb.FindRequest{
+			Selector: mango.And(filters...),
+			Limit:    2,
+		}
+		err := ensureUniqueIndex(db, doc.DocType(), fields, false)
+		if err == nil {
+			err = couchdb.FindDocs(db, doc.DocType(), req, &others)
+		}
+		if couchdb.IsNoIndexError(err) {
+			// the database may have been recreated since the index was defined
+			if err = ensureUniqueIndex(db, doc.DocType(), fields, true); err == nil {
+				err = couchdb.FindDocs(db, doc.DocType(), req, &others)
+			}
+		}
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			if other.ID() != doc.ID() {
+				return uniqueConflict(fields)
+			}
+		}
+	}
+	return nil
+}
+
+// ensureUniqueIndex defines the index on the fields of a unique constraint,
+// if it has not already been defined for this database, or if force is true.
+func ensureUniqueIndex(db couchdb.Database, doctype string, fields []string, force bool) error {
+	key := db.Prefix() + "/" + doctype + "/" + strings.Join(fields, ",")
+	uniqueIndexesMu.Lock()
+	defined := uniqueIndexes[key]
+	uniqueIndexesMu.Unlock()
+	if defined && !force {
+		return nil
+	}
+	if err := couchdb.DefineIndex(db, doctype, mango.IndexOnFields(fields...)); err != nil {
+		return err
+	}
+	uniqueIndexesMu.Lock()
+	uniqueIndexes[key] = true
+	uniqueIndexesMu.Unlock()
+	return nil
+}
+
+// uniqueDocID returns an identifier derived from the values of the first
+// unique constraint of the doctype, or an empty string if the document
+// is not concerned by it.
+func uniqueDocID(doc couchdb.JSONDoc) string {
+	constraints := getUniqueConstraints(doc.DocType())
+	if len(constraints) == 0 {
+		return ""
+	}
+	values, ok := uniqueKey(doc, constraints[0])
+	if !ok {
+		return ""
+	}
+	key, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:16])
+}
+
+// createUniqueDoc creates a document without identifier. When the doctype
+// has a unique constraint, the identifier is derived from the values of its
+// fields: the uniqueness of the identifiers in CouchDB makes the concurrent
+// creations of the same key fail, even if they have both passed the check of
+// checkUniqueConstraints.
+func createUniqueDoc(db couchdb.Database, doc couchdb.JSONDoc) error {
+	id := uniqueDocID(doc)
+	if id == "" {
+		return couchdb.CreateDoc(db, doc)
+	}
+	doc.SetID(id)
+	err := couchdb.CreateNamedDocWithDB(db, doc)
+	if !couchdb.IsConflictError(err) {
+		return err
+	}
+
+	// The document with this identifier may have been updated since with
+	// other values for the unique fields, and the identifier is no longer
+	// the key of this document.
+	existing := couchdb.JSONDoc{Type: doc.DocType()}
+	if err = couchdb.GetDoc(db, doc.DocType(), id, &existing); err != nil {
+		return err
+	}
+	fields := getUniqueConstraints(doc.DocType())[0]
+	if uniqueDocID(existing) == id {
+		return uniqueConflict(fields)
+	}
+	doc.SetID("")
+	return couchdb.CreateDoc(db, doc)
+}
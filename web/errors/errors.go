@@ -4,16 +4,19 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo"
 )
 
 // ErrorHandler is the default error handler of our server. It always write a
-// jsonapi compatible error.
+// jsonapi compatible error, except for the HTTP errors sent to a browser,
+// that are written as plain text.
 func ErrorHandler(err error, c echo.Context) {
 	var je *jsonapi.Error
 	var ce *couchdb.Error
@@ -24,21 +27,29 @@ func ErrorHandler(err error, c echo.Context) {
 	req := c.Request()
 
 	if he, ok = err.(*echo.HTTPError); ok {
-		// #nosec
-		if !res.Committed {
-			if c.Request().Method == http.MethodHead {
-				c.NoContent(he.Code)
-			} else {
-				c.String(he.Code, fmt.Sprintf("%v", he.Message))
+		if he.Code == http.StatusMethodNotAllowed && res.Header().Get("Allow") == "" {
+			res.Header().Set("Allow", strings.Join(allowedMethods(c), ", "))
+		}
+		if acceptsHTML(req) {
+			// #nosec
+			if !res.Committed {
+				if req.Method == http.MethodHead {
+					c.NoContent(he.Code)
+				} else {
+					c.String(he.Code, fmt.Sprintf("%v", he.Message))
+				}
+			}
+			if config.IsDevRelease() {
+				log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
 			}
+			return
 		}
-		if config.IsDevRelease() {
-			log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
+		je = &jsonapi.Error{
+			Status: he.Code,
+			Title:  http.StatusText(he.Code),
+			Detail: fmt.Sprintf("%v", he.Message),
 		}
-		return
-	}
-
-	if os.IsExist(err) {
+	} else if os.IsExist(err) {
 		je = jsonapi.Conflict(err)
 	} else if os.IsNotExist(err) {
 		je = jsonapi.NotFound(err)
@@ -69,3 +80,16 @@ func ErrorHandler(err error, c echo.Context) {
 		log.Errorf("[http] %s %s %s", req.Method, req.URL.Path, err)
 	}
 }
+
+// acceptsHTML returns true if the request comes from a browser, ie it accepts
+// HTML in its Accept header.
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// allowedMethods returns the HTTP methods of the routes registered for the
+// path of the request, for the Allow header of a 405 Method Not Allowed
+// response.
+func allowedMethods(c echo.Context) []string {
+	return middlewares.RouteMethods(c.Echo(), c.Path())
+}
@@ -0,0 +1,165 @@
+package files
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// defaultChangesLimit is the number of changes sent by default in a response
+// of the sync endpoint
+const defaultChangesLimit = 100
+
+// maxChangesLimit is the maximal number of changes that can be asked in a
+// response of the sync endpoint
+const maxChangesLimit = 1000
+
+// ErrInvalidSyncToken is used when the token given to the sync endpoint
+// can't be decoded
+var ErrInvalidSyncToken = errors.New("Invalid sync token")
+
+// removedFile is the JSON-API resource of a file or directory that has been
+// trashed or destroyed since the sync token.
+type removedFile struct {
+	DocID   string `json:"_id,omitempty"`
+	DocRev  string `json:"_rev,omitempty"`
+	Deleted bool   `json:"_deleted"`
+}
+
+func (r *removedFile) ID() string                             { return r.DocID }
+func (r *removedFile) Rev() string                            { return r.DocRev }
+func (r *removedFile) DocType() string                        { return consts.Files }
+func (r *removedFile) SetID(id string)                        { r.DocID = id }
+func (r *removedFile) SetRev(rev string)                      { r.DocRev = rev }
+func (r *removedFile) Links() *jsonapi.LinksList              { return nil }
+func (r *removedFile) Relationships() jsonapi.RelationshipMap { return nil }
+func (r *removedFile) Included() []jsonapi.Object             { return nil }
+
+// encodeSyncToken and decodeSyncToken wrap the couchdb update sequence in an
+// opaque token, so that the clients don't rely on its format.
+func encodeSyncToken(seq string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(seq))
+}
+
+func decodeSyncToken(token string) (string, error) {
+	seq, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(seq) == 0 {
+		return "", jsonapi.InvalidParameter("since", ErrInvalidSyncToken)
+	}
+	return string(seq), nil
+}
+
+// ChangesHandler handles GET requests on /files/_changes. It returns the
+// files and directories created or modified since the sync token given in
+// the since parameter, the ones that have been trashed or destroyed as
+// removals, and a new token for the next call.
+func ChangesHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	// the removals can't be checked against the permissions on some files
+	// or directories, so the whole doctype is required
+	if permissions.HasToken(c) {
+		if err := permissions.AllowWholeType(c, pkgperm.GET, consts.Files); err != nil {
+			return err
+		}
+	} else if err := checkSession(c); err != nil {
+		return err
+	}
+
+	req := &couchdb.ChangesRequest{
+		DocType:     consts.Files,
+		IncludeDocs: true,
+		Limit:       defaultChangesLimit,
+	}
+	if since := c.QueryParam("since"); since != "" {
+		seq, err := decodeSyncToken(since)
+		if err != nil {
+			return err
+		}
+		req.Since = seq
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+		}
+		if n > maxChangesLimit {
+			n = maxChangesLimit
+		}
+		req.Limit = n
+	}
+
+	res, err := couchdb.GetChanges(instance, req)
+	if err != nil {
+		return err
+	}
+
+	data := make([]jsonapi.Object, 0, len(res.Results))
+	for _, change := range res.Results {
+		if strings.HasPrefix(change.DocID, "_design/") || change.DocID == consts.TrashDirID {
+			continue
+		}
+		rev := ""
+		if len(change.Changes) > 0 {
+			rev = change.Changes[0].Rev
+		}
+		removed := &removedFile{DocID: change.DocID, DocRev: rev, Deleted: true}
+		if change.Deleted {
+			data = append(data, removed)
+			continue
+		}
+
+		doc, err := dirOrFileFromChange(change)
+		if err != nil {
+			return err
+		}
+		dir, file := doc.Refine()
+		switch {
+		case dir != nil && vfs.IsInTrash(instance, dir.Fullpath):
+			data = append(data, removed)
+		case dir != nil:
+			data = append(data, dir)
+		case file != nil && (file.RestorePath != "" || file.DirID == consts.TrashDirID):
+			data = append(data, removed)
+		case file != nil:
+			data = append(data, fileData(c, file))
+		}
+	}
+
+	token := encodeSyncToken(res.LastSeq)
+	var links *jsonapi.LinksList
+	if res.Pending > 0 {
+		v := url.Values{}
+		v.Set("since", token)
+		v.Set("limit", strconv.Itoa(req.Limit))
+		links = &jsonapi.LinksList{Next: "/files/_changes?" + v.Encode()}
+	}
+	count := len(data)
+	meta := &jsonapi.Meta{Count: &count, Token: token}
+	return jsonapi.DataListWithMeta(c, http.StatusOK, data, links, meta)
+}
+
+func dirOrFileFromChange(change couchdb.Change) (*vfs.DirOrFileDoc, error) {
+	b, err := json.Marshal(change.Doc.M)
+	if err != nil {
+		return nil, err
+	}
+	var doc vfs.DirOrFileDoc
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
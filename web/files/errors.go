@@ -0,0 +1,123 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+)
+
+// HTTPStatus returns the HTTP status code sent to the client for an error
+// emitted by the vfs. The unknown errors are internal server errors.
+func HTTPStatus(err error) int {
+	switch e := err.(type) {
+	case *jsonapi.Error:
+		return e.Status
+	case *couchdb.Error:
+		return e.StatusCode
+	}
+	if je := vfsError(err); je != nil {
+		return je.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// wrapVfsError returns a formatted error from a golang error emitted by the
+// vfs. The errors that are not known are returned unchanged.
+func wrapVfsError(err error) error {
+	if je := vfsError(err); je != nil {
+		return je
+	}
+	return err
+}
+
+// bulkError returns the error given for an item of a bulk operation that
+// has failed, with the status given by HTTPStatus.
+func bulkError(err error) *jsonapi.Error {
+	if je, ok := err.(*jsonapi.Error); ok {
+		return je
+	}
+	if je := vfsError(err); je != nil {
+		return je
+	}
+	return jsonapi.NewError(HTTPStatus(err), err)
+}
+
+// bulkResultError returns the error given for a document that couchdb has
+// not updated in a bulk request.
+func bulkResultError(res couchdb.BulkResult) *jsonapi.Error {
+	if res.Error == "conflict" {
+		return jsonapi.Conflict(errors.New(res.Reason))
+	}
+	return jsonapi.NewError(http.StatusInternalServerError, res.Reason)
+}
+
+// vfsError is the mapping between the errors of the vfs and the jsonapi
+// errors. It returns nil for the errors it does not know.
+func vfsError(err error) *jsonapi.Error {
+	if err == nil {
+		return nil
+	}
+	switch underlyingError(err) {
+	case ErrDocTypeInvalid:
+		return jsonapi.InvalidAttribute("type", err)
+	case vfs.ErrParentDoesNotExist:
+		return jsonapi.NotFound(err)
+	case vfs.ErrForbiddenDocMove:
+		return jsonapi.PreconditionFailed("dir-id", err)
+	case vfs.ErrForbiddenVFSOperation:
+		return jsonapi.NewError(http.StatusForbidden, err)
+	case vfs.ErrIllegalFilename, vfs.ErrReservedFilename:
+		return jsonapi.InvalidParameter("name", err)
+	case vfs.ErrIllegalTime:
+		return jsonapi.InvalidParameter("UpdatedAt", err)
+	case vfs.ErrIllegalPath:
+		return jsonapi.InvalidParameter("path", err)
+	case vfs.ErrInvalidFileMode:
+		return jsonapi.InvalidParameter("Mode", err)
+	case vfs.ErrInvalidHash:
+		return jsonapi.PreconditionFailed("Content-MD5", err)
+	case vfs.ErrContentLengthMismatch:
+		return jsonapi.PreconditionFailed("Content-Length", err)
+	case vfs.ErrFileTooBig:
+		return jsonapi.NewError(http.StatusInsufficientStorage, err)
+	case vfs.ErrUnknownHashAlgo:
+		return jsonapi.InternalServerError(err)
+	case vfs.ErrConflict:
+		return jsonapi.Conflict(err)
+	case vfs.ErrFileInTrash, vfs.ErrFileNotInTrash:
+		return jsonapi.BadRequest(err)
+	case vfs.ErrRestoreImpossible:
+		return jsonapi.Conflict(err)
+	case vfs.ErrNonAbsolutePath:
+		return jsonapi.BadRequest(err)
+	case vfs.ErrDirNotEmpty:
+		return jsonapi.BadRequest(err)
+	case vfs.ErrInvalidListSort:
+		return jsonapi.InvalidParameter("sort", err)
+	case vfs.ErrInvalidListBookmark:
+		return jsonapi.InvalidParameter("bookmark", err)
+	}
+	if os.IsExist(err) {
+		return jsonapi.Conflict(err)
+	}
+	if os.IsNotExist(err) {
+		return jsonapi.NotFound(err)
+	}
+	return nil
+}
+
+// underlyingError returns the error wrapped by the errors of the os package,
+// like the ones returned by the afero filesystems.
+func underlyingError(err error) error {
+	switch e := err.(type) {
+	case *os.PathError:
+		return e.Err
+	case *os.LinkError:
+		return e.Err
+	}
+	return err
+}
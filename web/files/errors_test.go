@@ -0,0 +1,80 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	statuses := []struct {
+		err    error
+		status int
+	}{
+		{ErrDocTypeInvalid, 422},
+		{vfs.ErrParentDoesNotExist, 404},
+		{vfs.ErrForbiddenDocMove, 412},
+		{vfs.ErrForbiddenVFSOperation, 403},
+		{vfs.ErrIllegalFilename, 422},
+		{vfs.ErrIllegalTime, 422},
+		{vfs.ErrIllegalPath, 422},
+		{vfs.ErrInvalidFileMode, 422},
+		{vfs.ErrInvalidHash, 412},
+		{vfs.ErrContentLengthMismatch, 412},
+		{vfs.ErrFileTooBig, 507},
+		{vfs.ErrUnknownHashAlgo, 500},
+		{vfs.ErrConflict, 409},
+		{vfs.ErrFileInTrash, 400},
+		{vfs.ErrFileNotInTrash, 400},
+		{vfs.ErrRestoreImpossible, 409},
+		{vfs.ErrNonAbsolutePath, 400},
+		{vfs.ErrDirNotEmpty, 400},
+		{vfs.ErrInvalidListSort, 422},
+		{vfs.ErrInvalidListBookmark, 422},
+		{os.ErrExist, 409},
+		{os.ErrNotExist, 404},
+		{&os.PathError{Op: "open", Path: "/foo", Err: os.ErrNotExist}, 404},
+		{&os.PathError{Op: "open", Path: "../foo", Err: vfs.ErrIllegalPath}, 422},
+		{&os.LinkError{Op: "rename", Old: "/foo", New: "/bar", Err: os.ErrExist}, 409},
+		{&couchdb.Error{StatusCode: 413, Name: "document_too_large"}, 413},
+		{jsonapi.NotFound(errors.New("missing")), 404},
+		{errors.New("unknown"), 500},
+	}
+	for _, s := range statuses {
+		assert.Equal(t, s.status, HTTPStatus(s.err), "%s", s.err)
+	}
+}
+
+func TestWrapVfsError(t *testing.T) {
+	err := wrapVfsError(vfs.ErrInvalidHash)
+	je, ok := err.(*jsonapi.Error)
+	if assert.True(t, ok) {
+		assert.Equal(t, http.StatusPreconditionFailed, je.Status)
+		assert.Equal(t, "Content-MD5", je.Source.Parameter)
+		assert.Equal(t, vfs.ErrInvalidHash.Error(), je.Detail)
+	}
+
+	unknown := errors.New("unknown")
+	assert.Equal(t, unknown, wrapVfsError(unknown))
+}
+
+func TestUploadOverDiskQuota(t *testing.T) {
+	used, err := vfs.DiskUsage(testInstance)
+	if !assert.NoError(t, err) {
+		return
+	}
+	testInstance.BytesDiskQuota = used + 5
+	defer func() { testInstance.BytesDiskQuota = 0 }()
+
+	res, _ := upload(t, "/files/?Type=file&Name=overquota", "text/plain", "foo,bar,baz", "")
+	assert.Equal(t, http.StatusInsufficientStorage, res.StatusCode)
+
+	res, _ = upload(t, "/files/?Type=file&Name=underquota", "text/plain", "foo", "")
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+}
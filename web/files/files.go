@@ -8,28 +8,56 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	mimetype "mime"
 	"net/http"
 	"net/url"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
 // TagSeparator is the character separating tags
 const TagSeparator = ","
 
+// DefaultShareLinkTTL is the validity duration of a share link, when no TTL
+// is given in the request
+const DefaultShareLinkTTL = 24 * time.Hour
+
+// MaxShareLinkTTL is the maximal validity duration of a share link
+const MaxShareLinkTTL = 30 * 24 * time.Hour
+
+// TrailerMD5 is the HTTP trailer where a client can send the MD5 checksum of
+// the content at the end of a chunked upload, when it is not known upfront.
+const TrailerMD5 = "X-Content-MD5"
+
+// ErrInvalidTTL is used when the TTL of a share link is not valid
+var ErrInvalidTTL = errors.New("Invalid TTL")
+
 // ErrDocTypeInvalid is used when the document type sent is not
 // recognized
 var ErrDocTypeInvalid = errors.New("Invalid document type")
 
+// fileData returns the JSON-API resource for a file, with the documents
+// referencing it only if the request is allowed to read them.
+func fileData(c echo.Context, file *vfs.FileDoc) jsonapi.Object {
+	if canReadReferences(c) {
+		return file.HideFields()
+	}
+	return file.HideReferences()
+}
+
 func hideFields(doc jsonapi.Object) jsonapi.Object {
 	if f, ok := doc.(*vfs.FileDoc); ok {
 		return f.HideFields()
@@ -45,6 +73,16 @@ func CreationHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	var doc jsonapi.Object
 	var err error
+
+	if name := c.QueryParam("Path"); name != "" {
+		err = checkPermOnParent(c, permissions.POST, name)
+	} else {
+		err = checkPermOnDirID(c, permissions.POST, c.Param("dir-id"))
+	}
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
 	switch c.QueryParam("Type") {
 	case consts.FileType:
 		doc, err = createFileHandler(c, instance)
@@ -58,8 +96,7 @@ func CreationHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
-	hideFields(doc)
-	return jsonapi.Data(c, http.StatusCreated, doc, nil)
+	return jsonapi.Data(c, http.StatusCreated, hideFields(doc), nil)
 }
 
 func createFileHandler(c echo.Context, vfsC vfs.Context) (doc *vfs.FileDoc, err error) {
@@ -76,11 +113,15 @@ func createFileHandler(c echo.Context, vfsC vfs.Context) (doc *vfs.FileDoc, err
 	if err != nil {
 		return
 	}
+	file.SetContext(c.Request().Context())
 
 	defer func() {
-		if cerr := file.Close(); cerr != nil && err == nil {
+		if cerr := closeFile(c, file); cerr != nil && err == nil {
 			err = cerr
 		}
+		if err == nil {
+			pushPreviewJob(c, doc)
+		}
 	}()
 
 	_, err = io.Copy(file, c.Request().Body)
@@ -124,6 +165,10 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.PUT, nil, olddoc); err != nil {
+		return err
+	}
+
 	newdoc, err = fileDocFromReq(
 		c,
 		olddoc.Name,
@@ -140,19 +185,21 @@ func OverwriteFileContentHandler(c echo.Context) (err error) {
 		return wrapVfsError(err)
 	}
 
-	file, err := vfs.CreateFile(instance, newdoc, olddoc)
+	file, err := vfs.ModifyFile(instance, newdoc, olddoc, wantedRev(c))
 	if err != nil {
 		return wrapVfsError(err)
 	}
+	file.SetContext(c.Request().Context())
 
 	defer func() {
-		if cerr := file.Close(); cerr != nil && err == nil {
+		if cerr := closeFile(c, file); cerr != nil && err == nil {
 			err = cerr
 		}
 		if err != nil {
 			err = wrapVfsError(err)
 			return
 		}
+		pushPreviewJob(c, newdoc)
 		err = jsonapi.Data(c, http.StatusOK, hideFields(newdoc), nil)
 	}()
 
@@ -203,7 +250,7 @@ func getPatch(c echo.Context) (*vfs.DocPatch, error) {
 
 	obj, err := jsonapi.Bind(c.Request(), &patch)
 	if err != nil {
-		return nil, jsonapi.BadJSON()
+		return nil, err
 	}
 
 	if rel, ok := obj.GetRelationship("parent"); ok {
@@ -225,6 +272,16 @@ func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch
 		doc = file
 	}
 
+	if err := checkPerm(c, permissions.PATCH, dir, file); err != nil {
+		return err
+	}
+
+	if patch.DirID != nil {
+		if err := checkPermOnDirID(c, permissions.PATCH, *patch.DirID); err != nil {
+			return wrapVfsError(err)
+		}
+	}
+
 	if err := checkIfMatch(c, doc.Rev()); err != nil {
 		return wrapVfsError(err)
 	}
@@ -232,11 +289,22 @@ func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch
 	var data jsonapi.Object
 	var err error
 	if fileDoc, ok := doc.(*vfs.FileDoc); ok {
+		if err = checkIfUnmodifiedSince(c, fileDoc.UpdatedAt); err != nil {
+			return err
+		}
 		data, err = vfs.ModifyFileMetadata(instance, fileDoc, patch)
 	} else if dirDoc, ok := doc.(*vfs.DirDoc); ok {
+		if err = checkIfUnmodifiedSince(c, dirDoc.UpdatedAt); err != nil {
+			return err
+		}
 		data, err = vfs.ModifyDirMetadata(instance, dirDoc, patch)
 	}
 
+	// the document has been modified between the check of the revision and
+	// its update: the revision known by the client is stale.
+	if err == vfs.ErrConflict && wantedRev(c) != "" {
+		return jsonapi.PreconditionFailed("If-Match", fmt.Errorf("Revision does not match"))
+	}
 	if err != nil {
 		return wrapVfsError(err)
 	}
@@ -245,27 +313,176 @@ func applyPatch(c echo.Context, instance *instance.Instance, patch *vfs.DocPatch
 	return jsonapi.Data(c, http.StatusOK, data, nil)
 }
 
+type tagsPatch struct {
+	IDs    []string `json:"ids"`
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// TagsHandler handles POST requests on /files/_tag
+//
+// It can be used to add and remove some tags on several files and
+// directories at once. The result is given for each identifier.
+func TagsHandler(c echo.Context) error {
+	patch := &tagsPatch{}
+	if _, err := jsonapi.Bind(c.Request(), patch); err != nil {
+		return err
+	}
+	if len(patch.IDs) == 0 {
+		return jsonapi.BadRequest(errors.New("No file identifiers given"))
+	}
+	if len(patch.Add) == 0 && len(patch.Remove) == 0 {
+		return jsonapi.BadRequest(errors.New("No tags to add or remove"))
+	}
+
+	instance := middlewares.GetInstance(c)
+	results := make([]jsonapi.BulkResult, len(patch.IDs))
+	var docs []couchdb.Doc
+	var indexes []int
+	for i, id := range patch.IDs {
+		results[i].ID = id
+		dir, file, err := vfs.GetDirOrFileDoc(instance, id, false)
+		if err != nil {
+			results[i].Error = bulkError(err)
+			continue
+		}
+		if err = checkPerm(c, permissions.PATCH, dir, file); err != nil {
+			results[i].Error = jsonapi.NewError(http.StatusForbidden, "Not allowed to modify the tags of ", id)
+			continue
+		}
+		if dir != nil {
+			docs = append(docs, dir)
+			results[i].Object = dir
+		} else {
+			docs = append(docs, file)
+			results[i].Object = hideFields(file)
+		}
+		indexes = append(indexes, i)
+	}
+
+	updated, err := vfs.ModifyTags(instance, docs, patch.Add, patch.Remove)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+	for j, res := range updated {
+		if j < len(indexes) && res.Error != "" {
+			i := indexes[j]
+			results[i].Object = nil
+			results[i].Error = bulkResultError(res)
+		}
+	}
+
+	return jsonapi.DataBulk(c, http.StatusOK, results)
+}
+
 // ReadMetadataFromIDHandler handles all GET requests on /files/:file-
-// id aiming at getting file metadata from its path.
+// id aiming at getting file metadata from its path. For a directory, its
+// children are listed, sorted and paginated.
 func ReadMetadataFromIDHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
 	fileID := c.Param("file-id")
 
-	dir, file, err := vfs.GetDirOrFileDoc(instance, fileID, true)
+	dir, file, err := vfs.GetDirOrFileDoc(instance, fileID, false)
 	if err != nil {
 		return wrapVfsError(err)
 	}
 
-	var data jsonapi.Object
-	if dir != nil {
-		data = dir
-	} else {
-		data = file
+	if err = checkPerm(c, permissions.GET, dir, file); err != nil {
+		return err
 	}
 
-	data = hideFields(data)
-	return jsonapi.Data(c, http.StatusOK, data, nil)
+	if dir == nil {
+		return jsonapi.Data(c, http.StatusOK, fileData(c, file), nil)
+	}
+
+	opts, err := listOptionsFromReq(c, "")
+	if err != nil {
+		return err
+	}
+
+	total, next, err := dir.FetchFilesPage(instance, opts)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	links := nextPageLinks("/files/"+dir.ID(), opts, next)
+	return jsonapi.DataWithMeta(c, http.StatusOK, dir, links, &jsonapi.Meta{Count: &total})
+}
+
+// listOptionsFromReq returns the options for listing the children of a
+// directory from the sort, limit and bookmark query parameters, and the
+// class, min_size, max_size and since filters.
+func listOptionsFromReq(c echo.Context, defaultSort string) (*vfs.ListOptions, error) {
+	opts := &vfs.ListOptions{
+		Sort:     c.QueryParam("sort"),
+		Bookmark: c.QueryParam("bookmark"),
+		Class:    c.QueryParam("class"),
+	}
+	if opts.Sort == "" {
+		opts.Sort = defaultSort
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		var err error
+		opts.Limit, err = strconv.Atoi(limit)
+		if err != nil || opts.Limit <= 0 {
+			return nil, jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+		}
+	}
+	var err error
+	if opts.MinSize, err = sizeFilterFromReq(c, "min_size"); err != nil {
+		return nil, err
+	}
+	if opts.MaxSize, err = sizeFilterFromReq(c, "max_size"); err != nil {
+		return nil, err
+	}
+	if since := c.QueryParam("since"); since != "" {
+		opts.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, jsonapi.BadRequest(errors.New("Invalid since: it should be a date in the RFC 3339 format"))
+		}
+	}
+	return opts, nil
+}
+
+func sizeFilterFromReq(c echo.Context, param string) (int64, error) {
+	value := c.QueryParam(param)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, jsonapi.BadRequest(fmt.Errorf("Invalid %s: it should be a number of bytes", param))
+	}
+	return size, nil
+}
+
+// nextPageLinks returns the links to the next page of a listing, or nil for
+// the last page.
+func nextPageLinks(path string, opts *vfs.ListOptions, next string) *jsonapi.LinksList {
+	if next == "" {
+		return nil
+	}
+	query := url.Values{"bookmark": {next}}
+	if opts.Sort != "" {
+		query.Set("sort", opts.Sort)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Class != "" {
+		query.Set("class", opts.Class)
+	}
+	if opts.MinSize > 0 {
+		query.Set("min_size", strconv.FormatInt(opts.MinSize, 10))
+	}
+	if opts.MaxSize > 0 {
+		query.Set("max_size", strconv.FormatInt(opts.MaxSize, 10))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339))
+	}
+	return &jsonapi.LinksList{Next: path + "?" + query.Encode()}
 }
 
 // ReadMetadataFromPathHandler handles all GET requests on
@@ -280,17 +497,52 @@ func ReadMetadataFromPathHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.GET, dir, file); err != nil {
+		return err
+	}
+
 	var data jsonapi.Object
 	if dir != nil {
 		data = dir
 	} else {
-		data = file
+		data = fileData(c, file)
 	}
-
-	data = hideFields(data)
 	return jsonapi.Data(c, http.StatusOK, data, nil)
 }
 
+// FilePathHandler handles GET requests on /files/:file-id/path and returns
+// the full path of the file or directory. The path is computed from the
+// parents of the document, and an error is returned if one of them is
+// missing.
+func FilePathHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	fileID := c.Param("file-id")
+	dir, file, err := vfs.GetDirOrFileDoc(instance, fileID, false)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, dir, file); err != nil {
+		return wrapVfsError(err)
+	}
+
+	var fullpath string
+	if dir != nil {
+		fullpath, err = dir.Path(instance)
+	} else {
+		fullpath, err = file.Path(instance)
+	}
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"id":   fileID,
+		"path": fullpath,
+	})
+}
+
 // ReadFileContentFromIDHandler handles all GET requests on /files/:file-id
 // aiming at downloading a file given its ID. It serves the file in inline
 // mode.
@@ -302,6 +554,10 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
 	err = vfs.ServeFileContent(instance, doc, "inline", c.Request(), c.Response())
 	if err != nil {
 		return wrapVfsError(err)
@@ -310,7 +566,10 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	return nil
 }
 
-func sendFileFromPath(c echo.Context, path string) error {
+// sendFileFromPath serves the content of a file given by its path. The
+// permissions are checked, unless they already have been, like for the
+// download secrets.
+func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 	instance := middlewares.GetInstance(c)
 
 	doc, err := vfs.GetFileDocFromPath(instance, path)
@@ -318,6 +577,12 @@ func sendFileFromPath(c echo.Context, path string) error {
 		return wrapVfsError(err)
 	}
 
+	if checkPermission {
+		if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+			return err
+		}
+	}
+
 	err = vfs.ServeFileContent(instance, doc, "attachment", c.Request(), c.Response())
 	if err != nil {
 		return wrapVfsError(err)
@@ -330,7 +595,7 @@ func sendFileFromPath(c echo.Context, path string) error {
 // aiming at downloading a file given its path. It serves the file in in
 // attachment mode.
 func ReadFileContentFromPathHandler(c echo.Context) error {
-	return sendFileFromPath(c, c.QueryParam("Path"))
+	return sendFileFromPath(c, c.QueryParam("Path"), true)
 }
 
 // ArchiveDownloadCreateHandler handles requests to /files/archive and stores the
@@ -351,6 +616,12 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 	}
 	instance := middlewares.GetInstance(c)
 
+	for _, name := range archive.Files {
+		if err := checkPermOnPath(c, permissions.GET, name); err != nil {
+			return wrapVfsError(err)
+		}
+	}
+
 	// if accept header is application/zip, send the archive immediately
 	if c.Request().Header.Get("Accept") == "application/zip" {
 		return archive.Serve(instance, c.Response())
@@ -383,6 +654,10 @@ func FileDownloadCreateHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
 	secret, err := vfs.GetStore(instance.Domain).AddFile(path)
 	if err != nil {
 		return wrapVfsError(err)
@@ -395,6 +670,57 @@ func FileDownloadCreateHandler(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, doc, links)
 }
 
+// ShareLinkCreateHandler handles requests on /files/:file-id/link and creates
+// a read-only link for the file or directory, valid for a limited time.
+func ShareLinkCreateHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	dir, file, err := vfs.GetDirOrFileDoc(instance, c.Param("file-id"), false)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, dir, file); err != nil {
+		return err
+	}
+
+	// a share link can't be used to create another one with a later
+	// expiration date
+	claims := permissions.GetClaims(c)
+	if claims != nil && claims.Audience == pkgperm.ShareAudience {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+
+	ttl := DefaultShareLinkTTL
+	if param := c.QueryParam("TTL"); param != "" {
+		ttl, err = time.ParseDuration(param)
+		if err != nil || ttl <= 0 || ttl > MaxShareLinkTTL {
+			return jsonapi.InvalidParameter("TTL", ErrInvalidTTL)
+		}
+	}
+
+	var doc jsonapi.Object
+	var id, related string
+	if dir != nil {
+		doc, id = dir, dir.ID()
+		related = "/files/" + id
+	} else {
+		doc, id = file, file.ID()
+		related = "/files/download/" + id
+	}
+
+	token, err := permissions.CreateShareToken(instance, id, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	links := &jsonapi.LinksList{
+		Related: related + "?bearer_token=" + url.QueryEscape(token),
+	}
+
+	return jsonapi.Data(c, http.StatusOK, hideFields(doc), links)
+}
+
 // ArchiveDownloadHandler handles requests to /files/archive/:secret/whatever.zip
 // and creates on the fly zip archive from the parameters linked to secret.
 func ArchiveDownloadHandler(c echo.Context) error {
@@ -422,7 +748,8 @@ func FileDownloadHandler(c echo.Context) error {
 	if path == "" {
 		return jsonapi.NewError(400, "Wrong download token")
 	}
-	return sendFileFromPath(c, path)
+	// the permissions have been checked when the secret was created
+	return sendFileFromPath(c, path, false)
 }
 
 // TrashHandler handles all DELETE requests on /files/:file-id and
@@ -438,6 +765,10 @@ func TrashHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.DELETE, dir, file); err != nil {
+		return err
+	}
+
 	var data jsonapi.Object
 	if dir != nil {
 		data, err = vfs.TrashDir(instance, dir)
@@ -454,16 +785,37 @@ func TrashHandler(c echo.Context) error {
 }
 
 // ReadTrashFilesHandler handle GET requests on /files/trash and return the
-// list of trashed files and directories
+// list of trashed files and directories. The most recently trashed come
+// first, and the list is paginated like the children of a directory.
 func ReadTrashFilesHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
-	trash, err := vfs.GetDirDoc(instance, consts.TrashDirID, true)
+	trash, err := vfs.GetDirDoc(instance, consts.TrashDirID, false)
 	if err != nil {
 		return wrapVfsError(err)
 	}
 
-	return jsonapi.DataList(c, http.StatusOK, trash.Included(), nil)
+	if err = checkPerm(c, permissions.GET, trash, nil); err != nil {
+		return err
+	}
+
+	opts, err := listOptionsFromReq(c, "-updated_at")
+	if err != nil {
+		return err
+	}
+
+	total, next, err := trash.FetchFilesPage(instance, opts)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	contents := trash.Included()
+	data := make([]jsonapi.Object, len(contents))
+	for i, child := range contents {
+		data[i] = hideFields(child)
+	}
+	links := nextPageLinks("/files/trash", opts, next)
+	return jsonapi.DataListWithMeta(c, http.StatusOK, data, links, &jsonapi.Meta{Count: &total})
 }
 
 // RestoreTrashFileHandler handle POST requests on /files/trash/file-id and
@@ -478,6 +830,10 @@ func RestoreTrashFileHandler(c echo.Context) error {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.PATCH, dir, file); err != nil {
+		return err
+	}
+
 	var data jsonapi.Object
 	if dir != nil {
 		data, err = vfs.RestoreDir(instance, dir)
@@ -493,14 +849,54 @@ func RestoreTrashFileHandler(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, data, nil)
 }
 
+// RestoreAllTrashHandler handles POST requests on /files/trash/restore and
+// restores all the files and directories of the trash. The result is given
+// for each of them.
+func RestoreAllTrashHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	trash, err := vfs.GetDirDoc(instance, consts.TrashDirID, false)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.PATCH, trash, nil); err != nil {
+		return err
+	}
+
+	files, dirs, err := vfs.RestoreAll(instance)
+	errs, ok := err.(vfs.RestoreAllError)
+	if err != nil && !ok {
+		return wrapVfsError(err)
+	}
+
+	results := make([]jsonapi.BulkResult, 0, len(dirs)+len(files)+len(errs))
+	for _, dir := range dirs {
+		results = append(results, jsonapi.BulkResult{ID: dir.ID(), Object: dir})
+	}
+	for _, file := range files {
+		results = append(results, jsonapi.BulkResult{ID: file.ID(), Object: hideFields(file)})
+	}
+	for id, err := range errs {
+		results = append(results, jsonapi.BulkResult{ID: id, Error: bulkError(err)})
+	}
+
+	return jsonapi.DataBulk(c, http.StatusOK, results)
+}
+
 // ClearTrashHandler handles DELETE request to clear the trash
 func ClearTrashHandler(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
-	trash, err := vfs.GetDirDoc(instance, consts.TrashDirID, true)
+	trash, err := vfs.GetDirDoc(instance, consts.TrashDirID, false)
 	if err != nil {
 		return wrapVfsError(err)
 	}
+
+	if err = checkPerm(c, permissions.DELETE, trash, nil); err != nil {
+		return err
+	}
+
 	err = vfs.DestroyDirContent(instance, trash)
 	if err != nil {
 		return wrapVfsError(err)
@@ -515,11 +911,15 @@ func DestroyFileHandler(c echo.Context) error {
 
 	fileID := c.Param("file-id")
 
-	dir, file, err := vfs.GetDirOrFileDoc(instance, fileID, true)
+	dir, file, err := vfs.GetDirOrFileDoc(instance, fileID, false)
 	if err != nil {
 		return wrapVfsError(err)
 	}
 
+	if err = checkPerm(c, permissions.DELETE, dir, file); err != nil {
+		return err
+	}
+
 	if dir != nil {
 		err = vfs.DestroyDirAndContent(instance, dir)
 	} else {
@@ -532,69 +932,145 @@ func DestroyFileHandler(c echo.Context) error {
 	return c.NoContent(204)
 }
 
+// ListFileVersionsHandler handles GET requests on /files/:file-id/versions
+// and returns the previous contents kept for a file, the most recent first.
+func ListFileVersionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
+	versions, err := vfs.ListFileVersions(instance, doc)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	objs := make([]jsonapi.Object, len(versions))
+	for i, v := range versions {
+		objs[i] = v
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// RestoreFileVersionHandler handles POST requests on
+// /files/:file-id/versions/:version-id and replaces the content of a file by
+// the one of the given version.
+func RestoreFileVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	olddoc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.PUT, nil, olddoc); err != nil {
+		return err
+	}
+
+	if err = checkIfMatch(c, olddoc.Rev()); err != nil {
+		return wrapVfsError(err)
+	}
+
+	newdoc, err := vfs.RestoreFileVersion(instance, olddoc, c.Param("version-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return jsonapi.Data(c, http.StatusOK, hideFields(newdoc), nil)
+}
+
+// TouchHandler handles POST requests on /files/:file-id/touch and sets the
+// modification date of a file to now, without changing its content.
+func TouchHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	olddoc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.PATCH, nil, olddoc); err != nil {
+		return err
+	}
+
+	if err = checkIfMatch(c, olddoc.Rev()); err != nil {
+		return wrapVfsError(err)
+	}
+
+	newdoc, err := vfs.TouchFile(instance, olddoc)
+	if err == vfs.ErrConflict && wantedRev(c) != "" {
+		return jsonapi.PreconditionFailed("If-Match", fmt.Errorf("Revision does not match"))
+	}
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return jsonapi.Data(c, http.StatusOK, hideFields(newdoc), nil)
+}
+
 // Routes sets the routing for the files service
 func Routes(router *echo.Group) {
+	router.Use(jsonapi.CheckMediaType)
+
 	router.HEAD("/download", ReadFileContentFromPathHandler)
 	router.GET("/download", ReadFileContentFromPathHandler)
 	router.HEAD("/download/:file-id", ReadFileContentFromIDHandler)
 	router.GET("/download/:file-id", ReadFileContentFromIDHandler)
 
+	router.OPTIONS("/metadata", middlewares.Options)
+	router.OPTIONS("/:file-id", middlewares.Options)
+	router.OPTIONS("/trash", middlewares.Options)
+	router.OPTIONS("/trash/:file-id", middlewares.Options)
+
 	router.GET("/metadata", ReadMetadataFromPathHandler)
+	router.GET("/usage", UsageHandler)
+	router.GET("/_changes", ChangesHandler)
 	router.GET("/:file-id", ReadMetadataFromIDHandler)
+	router.GET("/:file-id/path", FilePathHandler)
 
 	router.PATCH("/metadata", ModifyMetadataByPathHandler)
 	router.PATCH("/:file-id", ModifyMetadataByIDHandler)
+	router.POST("/_tag", TagsHandler)
 
-	router.POST("/", CreationHandler)
-	router.POST("/:dir-id", CreationHandler)
-	router.PUT("/:file-id", OverwriteFileContentHandler)
+	// the uploads have their own limit, instead of the one of the other
+	// requests
+	uploadLimit := middlewares.BodyLimit(config.GetConfig().BodyLimits.MaxUploadSize)
+	router.POST("/", CreationHandler, uploadLimit)
+	router.POST("/:dir-id", CreationHandler, uploadLimit)
+	router.PUT("/:file-id", OverwriteFileContentHandler, uploadLimit)
 
 	router.POST("/archive", ArchiveDownloadCreateHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
 	router.POST("/downloads", FileDownloadCreateHandler)
+	router.POST("/:file-id/link", ShareLinkCreateHandler)
+	router.POST("/:file-id/signed", SignedURLCreateHandler)
+	router.POST("/:file-id/touch", TouchHandler)
+	router.GET("/:file-id/preview", PreviewHandler)
+	router.GET("/:file-id/versions", ListFileVersionsHandler)
+	router.POST("/:file-id/versions/:version-id", RestoreFileVersionHandler)
 	router.GET("/downloads/:secret/:fake-name", FileDownloadHandler)
+	router.HEAD("/signed/:file-id", SignedDownloadHandler, checkSignedURL)
+	router.GET("/signed/:file-id", SignedDownloadHandler, checkSignedURL)
 
 	router.POST("/:file-id/relationships/referenced_by", AddReferencedHandler)
 
 	router.GET("/trash", ReadTrashFilesHandler)
 	router.DELETE("/trash", ClearTrashHandler)
 
+	router.POST("/trash/restore", RestoreAllTrashHandler)
 	router.POST("/trash/:file-id", RestoreTrashFileHandler)
 	router.DELETE("/trash/:file-id", DestroyFileHandler)
 
 	router.DELETE("/:file-id", TrashHandler)
 }
 
-// wrapVfsError returns a formatted error from a golang error emitted by the vfs
-func wrapVfsError(err error) error {
-	switch err {
-	case ErrDocTypeInvalid:
-		return jsonapi.InvalidAttribute("type", err)
-	case vfs.ErrParentDoesNotExist:
-		return jsonapi.NotFound(err)
-	case vfs.ErrForbiddenDocMove:
-		return jsonapi.PreconditionFailed("dir-id", err)
-	case vfs.ErrIllegalFilename:
-		return jsonapi.InvalidParameter("name", err)
-	case vfs.ErrIllegalTime:
-		return jsonapi.InvalidParameter("UpdatedAt", err)
-	case vfs.ErrInvalidHash:
-		return jsonapi.PreconditionFailed("Content-MD5", err)
-	case vfs.ErrContentLengthMismatch:
-		return jsonapi.PreconditionFailed("Content-Length", err)
-	case vfs.ErrConflict:
-		return jsonapi.Conflict(err)
-	case vfs.ErrFileInTrash:
-		return jsonapi.BadRequest(err)
-	case vfs.ErrNonAbsolutePath:
-		return jsonapi.BadRequest(err)
-	case vfs.ErrDirNotEmpty:
-		return jsonapi.BadRequest(err)
-	}
-	return err
-}
-
 func fileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.FileDoc, error) {
 	header := c.Request().Header
 
@@ -621,9 +1097,23 @@ func fileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 	}
 
 	executable := c.QueryParam("Executable") == "true"
+	if mode := c.QueryParam("Mode"); mode != "" {
+		executable, err = vfs.ParseFileMode(mode)
+		if err != nil {
+			return nil, jsonapi.InvalidParameter("Mode", err)
+		}
+	}
+	// without a mime type given by the client or guessed from the extension,
+	// the mime type is guessed from the content when it is written
 	contentType := header.Get("Content-Type")
-	mime, class := vfs.ExtractMimeAndClass(contentType)
-	return vfs.NewFileDoc(
+	if contentType == "" {
+		contentType = mimetype.TypeByExtension(path.Ext(name))
+	}
+	var mime, class string
+	if contentType != "" {
+		mime, class = vfs.ExtractMimeAndClass(contentType)
+	}
+	doc, err := vfs.NewFileDoc(
 		name,
 		dirID,
 		size,
@@ -634,24 +1124,76 @@ func fileDocFromReq(c echo.Context, name, dirID string, tags []string) (*vfs.Fil
 		executable,
 		tags,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	// the checksum given by the client can only be verified with MD5
+	if md5Sum != nil || hasTrailerMD5(c) {
+		doc.HashAlgo = vfs.HashMD5
+	}
+	return doc, nil
 }
 
-func checkIfMatch(c echo.Context, rev string) error {
-	ifMatch := c.Request().Header.Get("If-Match")
-	revQuery := c.QueryParam("rev")
-	var wantedRev string
-	if ifMatch != "" {
-		wantedRev = ifMatch
+// hasTrailerMD5 returns true if the client has announced that it will send
+// the checksum of the content in the X-Content-MD5 trailer.
+func hasTrailerMD5(c echo.Context) bool {
+	_, ok := c.Request().Trailer[http.CanonicalHeaderKey(TrailerMD5)]
+	return ok
+}
+
+// closeFile closes a file opened for writing. When the client has sent the
+// checksum of the content in the X-Content-MD5 trailer, it is checked. The
+// trailer can only be read once the body has been consumed.
+func closeFile(c echo.Context, file *vfs.File) error {
+	md5Str := c.Request().Trailer.Get(TrailerMD5)
+	if md5Str == "" {
+		return file.Close()
 	}
-	if revQuery != "" && wantedRev == "" {
-		wantedRev = revQuery
+	sum, err := parseMD5Hash(md5Str)
+	if err != nil {
+		// an invalid checksum can't match the content, and the file must
+		// not be committed
+		sum = []byte{}
 	}
-	if wantedRev != "" && rev != wantedRev {
+	return file.CloseWithSum(sum)
+}
+
+func checkIfMatch(c echo.Context, rev string) error {
+	if wanted := wantedRev(c); wanted != "" && rev != wanted {
 		return jsonapi.PreconditionFailed("If-Match", fmt.Errorf("Revision does not match"))
 	}
 	return nil
 }
 
+// checkIfUnmodifiedSince returns a 412 error if the If-Unmodified-Since
+// header is set and the document has been modified after this date.
+func checkIfUnmodifiedSince(c echo.Context, updatedAt time.Time) error {
+	header := c.Request().Header.Get("If-Unmodified-Since")
+	if header == "" {
+		return nil
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return jsonapi.InvalidParameter("If-Unmodified-Since", err)
+	}
+	// the HTTP dates have a precision of one second
+	if updatedAt.Truncate(time.Second).After(since) {
+		return jsonapi.PreconditionFailed("If-Unmodified-Since",
+			fmt.Errorf("The document has been modified since this date"))
+	}
+	return nil
+}
+
+// wantedRev returns the revision expected by the client, given by the
+// If-Match header or the rev query parameter.
+func wantedRev(c echo.Context) string {
+	if ifMatch := c.Request().Header.Get("If-Match"); ifMatch != "" {
+		return ifMatch
+	}
+	return c.QueryParam("rev")
+}
+
 func parseMD5Hash(md5B64 string) ([]byte, error) {
 	// Encoded md5 hash in base64 should at least have 22 caracters in
 	// base64: 16*3/4 = 21+1/3
@@ -13,16 +13,24 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cozy/checkup"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
 
 var ts *httptest.Server
@@ -37,6 +45,17 @@ func injectInstance(i *instance.Instance) echo.MiddlewareFunc {
 	}
 }
 
+// injectSession makes the requests without a token come from the browser of
+// the owner of the instance
+func injectSession(s *sessions.Session) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(sessions.SessionContextKey, s)
+			return next(c)
+		}
+	}
+}
+
 func extractJSONRes(res *http.Response, mp *map[string]interface{}) error {
 	if res.StatusCode >= 300 {
 		return nil
@@ -489,6 +508,266 @@ func TestModifyMetadataFileMove(t *testing.T) {
 	assert.Equal(t, "3", attrs3["size"])
 }
 
+func TestListDirSortedBySize(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=listsorted&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, _ := extractDirData(t, data1)
+
+	res2, _ := createDir(t, "/files/"+dirID+"?Name=subdir&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	for name, body := range map[string]string{"small": "a", "big": "abcdef", "medium": "abc"} {
+		res, _ := upload(t, "/files/"+dirID+"?Type=file&Name="+name, "text/plain", body, "")
+		assert.Equal(t, 201, res.StatusCode)
+	}
+
+	list := func(query string) (names []string, count float64, next string) {
+		res, err := http.Get(ts.URL + "/files/" + dirID + "?" + query)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		var result struct {
+			Data struct {
+				Relationships struct {
+					Parent struct {
+						Data struct {
+							ID string `json:"id"`
+						} `json:"data"`
+					} `json:"parent"`
+				} `json:"relationships"`
+			} `json:"data"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+			Meta struct {
+				Count float64 `json:"count"`
+			} `json:"meta"`
+			Included []struct {
+				Attributes struct {
+					Name string `json:"name"`
+				} `json:"attributes"`
+			} `json:"included"`
+		}
+		if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&result)) {
+			return
+		}
+		assert.Equal(t, consts.RootDirID, result.Data.Relationships.Parent.Data.ID)
+		for _, child := range result.Included {
+			names = append(names, child.Attributes.Name)
+		}
+		return names, result.Meta.Count, result.Links.Next
+	}
+
+	names, count, next := list("sort=-size&limit=3")
+	assert.Equal(t, []string{"big", "medium", "small"}, names)
+	assert.EqualValues(t, 4, count)
+	if !assert.NotEmpty(t, next) {
+		return
+	}
+	u, err := url.Parse(next)
+	if !assert.NoError(t, err) {
+		return
+	}
+	names, count, next = list(u.RawQuery)
+	assert.Equal(t, []string{"subdir"}, names)
+	assert.EqualValues(t, 4, count)
+	assert.Empty(t, next)
+
+	names, _, _ = list("sort=name")
+	assert.Equal(t, []string{"big", "medium", "small", "subdir"}, names)
+
+	// the directories come first in the ascending order of sizes, and the
+	// pages go from the directories to the files
+	names, count, next = list("sort=size&limit=2")
+	assert.Equal(t, []string{"subdir", "small"}, names)
+	assert.EqualValues(t, 4, count)
+	if !assert.NotEmpty(t, next) {
+		return
+	}
+	u, err = url.Parse(next)
+	if !assert.NoError(t, err) {
+		return
+	}
+	names, _, next = list(u.RawQuery)
+	assert.Equal(t, []string{"medium", "big"}, names)
+	assert.Empty(t, next)
+
+	res3, err := http.Get(ts.URL + "/files/" + dirID + "?sort=foo")
+	if assert.NoError(t, err) {
+		res3.Body.Close()
+		assert.Equal(t, 422, res3.StatusCode)
+	}
+}
+
+func TestListDirFiltered(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=listfiltered&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, _ := extractDirData(t, data1)
+
+	res2, _ := createDir(t, "/files/"+dirID+"?Name=subdir&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	files := []struct{ name, mime, body string }{
+		{"small.png", "image/png", "a"},
+		{"big.png", "image/png", "abcdef"},
+		{"medium.jpg", "image/jpeg", "abc"},
+		{"big.txt", "text/plain", "abcdef"},
+	}
+	for _, f := range files {
+		res, _ := upload(t, "/files/"+dirID+"?Type=file&Name="+f.name, f.mime, f.body, "")
+		assert.Equal(t, 201, res.StatusCode)
+	}
+
+	list := func(query string) (names []string, status int) {
+		res, err := http.Get(ts.URL + "/files/" + dirID + "?" + query)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return nil, res.StatusCode
+		}
+		var result struct {
+			Included []struct {
+				Attributes struct {
+					Name string `json:"name"`
+				} `json:"attributes"`
+			} `json:"included"`
+		}
+		if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&result)) {
+			return
+		}
+		for _, child := range result.Included {
+			names = append(names, child.Attributes.Name)
+		}
+		return names, res.StatusCode
+	}
+
+	names, _ := list("class=image")
+	assert.Equal(t, []string{"big.png", "medium.jpg", "small.png"}, names)
+	names, _ = list("min_size=2&max_size=5")
+	assert.Equal(t, []string{"medium.jpg"}, names)
+	names, _ = list("class=image&min_size=3")
+	assert.Equal(t, []string{"big.png", "medium.jpg"}, names)
+	names, _ = list("class=text&max_size=3")
+	assert.Empty(t, names)
+	names, _ = list("since=2000-01-01T00:00:00Z&sort=name")
+	assert.Equal(t, []string{"big.png", "big.txt", "medium.jpg", "small.png", "subdir"}, names)
+	since := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	names, _ = list("since=" + since)
+	assert.Empty(t, names)
+	// the dates with a time zone are compared to the dates in UTC
+	kiribati := time.FixedZone("LINT", 14*3600)
+	since = time.Now().Add(-time.Minute).In(kiribati).Format(time.RFC3339)
+	names, _ = list("since=" + url.QueryEscape(since) + "&sort=name")
+	assert.Equal(t, []string{"big.png", "big.txt", "medium.jpg", "small.png", "subdir"}, names)
+
+	_, status := list("min_size=foo")
+	assert.Equal(t, 400, status)
+	_, status = list("max_size=-1")
+	assert.Equal(t, 400, status)
+	_, status = list("since=yesterday")
+	assert.Equal(t, 400, status)
+}
+
+func TestBulkTags(t *testing.T) {
+	var ids []string
+	for _, name := range []string{"tagged1", "tagged2", "tagged3"} {
+		res, data := upload(t, "/files/?Type=file&Name="+name+"&Tags=holidays", "text/plain", "foo", "")
+		if !assert.Equal(t, 201, res.StatusCode) {
+			return
+		}
+		id, _ := extractDirData(t, data)
+		ids = append(ids, id)
+	}
+
+	type bulkResults struct {
+		Data []struct {
+			ID   string `json:"id"`
+			Meta struct {
+				Rev string `json:"rev"`
+			} `json:"meta"`
+			Attributes struct {
+				Tags []string `json:"tags"`
+			} `json:"attributes"`
+		} `json:"data"`
+		Errors []struct {
+			Status string `json:"status"`
+			Meta   struct {
+				ID string `json:"id"`
+			} `json:"meta"`
+		} `json:"errors"`
+		Meta struct {
+			Count int `json:"count"`
+		} `json:"meta"`
+	}
+
+	bulkTag := func(ids, add, remove []string) *bulkResults {
+		attrs, _ := json.Marshal(map[string]interface{}{
+			"ids":    ids,
+			"add":    add,
+			"remove": remove,
+		})
+		body := bytes.NewBufferString(`{"data": {"attributes": ` + string(attrs) + `}}`)
+		res, err := http.Post(ts.URL+"/files/_tag", "application/vnd.api+json", body)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return nil
+		}
+		result := &bulkResults{}
+		if !assert.NoError(t, json.NewDecoder(res.Body).Decode(result)) {
+			return nil
+		}
+		return result
+	}
+
+	tagsOf := func(id string) []interface{} {
+		res, err := http.Get(ts.URL + "/files/" + id)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		var v map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &v))
+		_, attrs := extractDirData(t, v)
+		tags, _ := attrs["tags"].([]interface{})
+		return tags
+	}
+
+	results := bulkTag(append(ids, "no-such-file"), []string{"photo", "holidays"}, nil)
+	if !assert.NotNil(t, results) {
+		return
+	}
+	assert.Equal(t, 4, results.Meta.Count)
+	if assert.Len(t, results.Data, 3) {
+		for i, id := range ids {
+			assert.Equal(t, id, results.Data[i].ID)
+			assert.NotEmpty(t, results.Data[i].Meta.Rev)
+			assert.Equal(t, []string{"holidays", "photo"}, results.Data[i].Attributes.Tags)
+		}
+	}
+	if assert.Len(t, results.Errors, 1) {
+		assert.Equal(t, "404", results.Errors[0].Status)
+		assert.Equal(t, "no-such-file", results.Errors[0].Meta.ID)
+	}
+	for _, id := range ids {
+		assert.Equal(t, []interface{}{"holidays", "photo"}, tagsOf(id))
+	}
+
+	results = bulkTag(ids[:2], nil, []string{"holidays"})
+	if assert.NotNil(t, results) {
+		assert.Len(t, results.Data, 2)
+		assert.Empty(t, results.Errors)
+	}
+	assert.Equal(t, []interface{}{"photo"}, tagsOf(ids[0]))
+	assert.Equal(t, []interface{}{"photo"}, tagsOf(ids[1]))
+	assert.Equal(t, []interface{}{"holidays", "photo"}, tagsOf(ids[2]))
+}
+
 func TestModifyMetadataFileConflict(t *testing.T) {
 	body := "foo"
 	res1, data1 := upload(t, "/files/?Type=file&Name=fmodme1&Tags=foo,bar", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -507,6 +786,107 @@ func TestModifyMetadataFileConflict(t *testing.T) {
 	assert.Equal(t, 409, res3.StatusCode)
 }
 
+func TestModifyMetadataStaleRevision(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=fstale", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, fileData := extractDirData(t, data1)
+	meta := fileData["meta"].(map[string]interface{})
+	rev := meta["rev"].(string)
+
+	attrs := map[string]interface{}{"tags": []string{"foo"}}
+	res2, _ := patchFile(t, "/files/"+fileID+"?rev="+rev, "file", fileID, attrs, nil)
+	assert.Equal(t, 200, res2.StatusCode)
+
+	attrs = map[string]interface{}{"name": "fstale-renamed"}
+	res3, _ := patchFile(t, "/files/"+fileID+"?rev="+rev, "file", fileID, attrs, nil)
+	assert.Equal(t, 412, res3.StatusCode)
+
+	doc, err := vfs.GetFileDoc(testInstance, fileID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "fstale", doc.Name)
+	}
+	storage := testInstance.FS()
+	exists, err := afero.Exists(storage, "/fstale")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestTouchFile(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=ftouch", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, fileData := extractDirData(t, data1)
+	rev := fileData["meta"].(map[string]interface{})["rev"].(string)
+	before, err := vfs.GetFileDoc(testInstance, fileID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	req, _ := http.NewRequest("POST", ts.URL+"/files/"+fileID+"/touch", nil)
+	req.Header.Add("If-Match", "1-badrev")
+	res2, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res2.Body.Close()
+		assert.Equal(t, 412, res2.StatusCode)
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/files/"+fileID+"/touch", nil)
+	req.Header.Add("If-Match", rev)
+	res3, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var data3 map[string]interface{}
+	err = extractJSONRes(res3, &data3)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res3.StatusCode)
+
+	after, err := vfs.GetFileDoc(testInstance, fileID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, before.Rev(), after.Rev())
+	assert.True(t, after.UpdatedAt.After(before.UpdatedAt))
+	assert.Equal(t, before.Name, after.Name)
+	assert.Equal(t, before.DirID, after.DirID)
+	assert.Equal(t, before.MD5Sum, after.MD5Sum)
+	assert.Equal(t, before.Size, after.Size)
+	assert.Equal(t, before.CreatedAt.Unix(), after.CreatedAt.Unix())
+	assert.Equal(t, before.Tags, after.Tags)
+
+	_, content := download(t, "/files/download/"+fileID, "")
+	assert.Equal(t, "foo", string(content))
+}
+
+func TestModifyMetadataIfUnmodifiedSince(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=funmodified", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data1)
+
+	patch := func(since time.Time) int {
+		body := `{"data": {"type": "file", "id": "` + fileID + `", "attributes": {"tags": ["bar"]}}}`
+		req, err := http.NewRequest("PATCH", ts.URL+"/files/"+fileID, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		req.Header.Add("If-Unmodified-Since", since.UTC().Format(http.TimeFormat))
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 412, patch(time.Now().Add(-1*time.Hour)))
+	assert.Equal(t, 200, patch(time.Now().Add(1*time.Hour)))
+}
+
 func TestModifyMetadataDirMove(t *testing.T) {
 	res1, data1 := createDir(t, "/files/?Name=dirmodme&Type=directory&Tags=foo,bar,bar")
 	assert.Equal(t, 201, res1.StatusCode)
@@ -796,6 +1176,115 @@ func TestDownloadFileBadPath(t *testing.T) {
 	assert.Equal(t, 404, res.StatusCode)
 }
 
+func TestDownloadFileNonAbsolutePath(t *testing.T) {
+	res1, _ := download(t, "/files/download?Path="+url.QueryEscape("i/am/relative"), "")
+	assert.Equal(t, 400, res1.StatusCode)
+
+	res2, _ := download(t, "/files/download", "")
+	assert.Equal(t, 400, res2.StatusCode)
+}
+
+func TestFileModeRoundTrip(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=modeexec&Executable=true", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	execID, attrs1 := extractDirData(t, data1)
+	attrs1 = attrs1["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs1["executable"])
+	assert.Equal(t, "0755", attrs1["mode"])
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=modeplain", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	plainID, attrs2 := extractDirData(t, data2)
+	attrs2 = attrs2["attributes"].(map[string]interface{})
+	assert.Equal(t, false, attrs2["executable"])
+	assert.Equal(t, "0644", attrs2["mode"])
+
+	res3, data3 := upload(t, "/files/?Type=file&Name=modeoctal&Mode=0750", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	octalID, attrs3 := extractDirData(t, data3)
+	attrs3 = attrs3["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs3["executable"])
+	assert.Equal(t, "0755", attrs3["mode"])
+
+	res4, _ := upload(t, "/files/?Type=file&Name=modeinvalid&Mode=rwx", "text/plain", "foo", "")
+	assert.Equal(t, 422, res4.StatusCode)
+
+	for id, mode := range map[string]string{execID: "0755", plainID: "0644", octalID: "0755"} {
+		res, err := http.Get(ts.URL + "/files/" + id)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var v map[string]interface{}
+		assert.NoError(t, extractJSONRes(res, &v))
+		res.Body.Close()
+		_, data := extractDirData(t, v)
+		attrs := data["attributes"].(map[string]interface{})
+		assert.Equal(t, mode, attrs["mode"])
+
+		res, _ = download(t, "/files/download/"+id, "")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, mode, res.Header.Get(vfs.FileModeHeader))
+	}
+
+	storage := testInstance.FS()
+	infos, err := storage.Stat("/modeexec")
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0755), infos.Mode().Perm())
+	}
+}
+
+func TestUploadOctetStreamClass(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=sniffed-text", "application/octet-stream", "Hello world!\n", "")
+	if assert.Equal(t, 201, res1.StatusCode) {
+		_, attrs := extractDirData(t, data1)
+		attrs = attrs["attributes"].(map[string]interface{})
+		assert.Equal(t, "application/octet-stream", attrs["mime"])
+		assert.Equal(t, "text", attrs["class"])
+	}
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=sniffed-binary", "application/octet-stream", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "")
+	if assert.Equal(t, 201, res2.StatusCode) {
+		_, attrs := extractDirData(t, data2)
+		attrs = attrs["attributes"].(map[string]interface{})
+		assert.Equal(t, "application/octet-stream", attrs["mime"])
+		assert.Equal(t, "binary", attrs["class"])
+	}
+}
+
+func TestUploadWithoutMime(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=README", "", "Hello world!\n", "")
+	if assert.Equal(t, 201, res1.StatusCode) {
+		_, attrs := extractDirData(t, data1)
+		attrs = attrs["attributes"].(map[string]interface{})
+		assert.Equal(t, "text/plain", attrs["mime"])
+		assert.Equal(t, "text", attrs["class"])
+	}
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=unknown-binary", "", "\x7fELF\x02\x01\x01\x00", "")
+	if assert.Equal(t, 201, res2.StatusCode) {
+		fileID, attrs := extractDirData(t, data2)
+		attrs = attrs["attributes"].(map[string]interface{})
+		assert.Equal(t, "application/octet-stream", attrs["mime"])
+		assert.Equal(t, "binary", attrs["class"])
+
+		res3, _ := download(t, "/files/download/"+fileID, "")
+		assert.Equal(t, "application/octet-stream", res3.Header.Get("Content-Type"))
+	}
+
+	res4, data4 := upload(t, "/files/?Type=file&Name=guessed.pdf", "", "not really a pdf", "")
+	if assert.Equal(t, 201, res4.StatusCode) {
+		_, attrs := extractDirData(t, data4)
+		attrs = attrs["attributes"].(map[string]interface{})
+		assert.Equal(t, "application/pdf", attrs["mime"])
+	}
+}
+
 func TestDownloadFileByIDSuccess(t *testing.T) {
 	body := "foo"
 	res1, filedata := upload(t, "/files/?Type=file&Name=downloadme1", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
@@ -851,6 +1340,55 @@ func TestDownloadRangeSuccess(t *testing.T) {
 	assert.Equal(t, "bar", string(res4body))
 }
 
+func TestDownloadIfRange(t *testing.T) {
+	body := "foo,bar"
+	res1, _ := upload(t, "/files/?Type=file&Name=downloadmeifrange", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
+	assert.Equal(t, 201, res1.StatusCode)
+	path := "/files/download?Path=" + url.QueryEscape("/downloadmeifrange")
+
+	downloadIfRange := func(ifRange string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Add("Range", "bytes=4-")
+		req.Header.Add("If-Range", ifRange)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	// the etag is sent for the ranged requests too
+	res2, res2body := download(t, path, "bytes=0-2")
+	assert.Equal(t, 206, res2.StatusCode)
+	assert.Equal(t, "foo", string(res2body))
+	eTag := res2.Header.Get("Etag")
+	assert.Equal(t, `"UmfjCVWct/albVkURcJJfg=="`, eTag)
+
+	// a matching If-Range gives the partial content
+	res3, res3body := downloadIfRange(eTag)
+	assert.Equal(t, 206, res3.StatusCode)
+	assert.Equal(t, "bar", res3body)
+
+	// a stale If-Range gives the whole content
+	res4, res4body := downloadIfRange(`"rL0Y20zC+Fzt72VPzMSk2A=="`)
+	assert.Equal(t, 200, res4.StatusCode)
+	assert.Equal(t, body, res4body)
+
+	// the weak etags are not used for the ranges
+	res5, res5body := downloadIfRange("W/" + eTag)
+	assert.Equal(t, 200, res5.StatusCode)
+	assert.Equal(t, body, res5body)
+
+	// but they are fine for If-None-Match
+	req, _ := http.NewRequest("GET", ts.URL+path, nil)
+	req.Header.Add("If-None-Match", "W/"+eTag)
+	res6, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 304, res6.StatusCode)
+}
+
 func TestGetFileMetadataFromPath(t *testing.T) {
 	res1, _ := http.Get(ts.URL + "/files/metadata?Path=/noooooop")
 	assert.Equal(t, 404, res1.StatusCode)
@@ -901,93 +1439,558 @@ func TestGetDirMetadataFromID(t *testing.T) {
 	assert.Equal(t, 200, res3.StatusCode)
 }
 
-func TestArchiveNoFiles(t *testing.T) {
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {}
-		}
-	}`)
-	res, err := http.Post(ts.URL+"/files/archive", "application/vnd.api+json", body)
-	assert.NoError(t, err)
-	assert.Equal(t, 400, res.StatusCode)
-	msg, err := ioutil.ReadAll(res.Body)
-	assert.NoError(t, err)
-	assert.Equal(t, `"Can't create an archive with no files"`, string(msg))
+func doGetWithToken(t *testing.T, path, scope string) *http.Response {
+	return doWithToken(t, http.MethodGet, path, scope, nil)
 }
 
-func TestArchiveDirectDownload(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Name=archive&Type=directory")
-	if !assert.Equal(t, 201, res1.StatusCode) {
-		return
+func doWithToken(t *testing.T, method, path, scope string, body []byte) *http.Response {
+	token, err := crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   testInstance.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "test-files-app",
+		},
+		Scope: scope,
+	})
+	if !assert.NoError(t, err) {
+		return nil
 	}
-	dirID, _ := extractDirData(t, data1)
-	names := []string{"foo", "bar", "baz"}
-	for _, name := range names {
-		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
-		if !assert.Equal(t, 201, res2.StatusCode) {
-			return
-		}
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return nil
 	}
-
-	// direct download
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {
-				"files": [
-					"/archive/foo.jpg",
-					"/archive/bar.jpg",
-					"/archive/baz.jpg"
-				]
-			}
-		}
-	}`)
-
-	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
-	req.Header.Add("Content-Type", "application/zip")
-	req.Header.Add("Accept", "application/zip")
-	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
 	res, err := http.DefaultClient.Do(req)
-	assert.NoError(t, err)
-	if !assert.Equal(t, 200, res.StatusCode) {
-		b, err2 := ioutil.ReadAll(res.Body)
-		fmt.Println(err2, string(b))
+	if !assert.NoError(t, err) {
+		return nil
 	}
-	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
-
+	return res
 }
 
-func TestArchiveCreateAndDownload(t *testing.T) {
-	res1, data1 := createDir(t, "/files/?Name=archive2&Type=directory")
-	if !assert.Equal(t, 201, res1.StatusCode) {
-		return
+func getWithToken(t *testing.T, path, scope string) *http.Response {
+	res := doGetWithToken(t, path, scope)
+	if res != nil {
+		res.Body.Close()
 	}
+	return res
+}
+
+func TestGetFileAsJSONAPI(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=jsonapidir&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
 	dirID, _ := extractDirData(t, data1)
-	names := []string{"foo", "bar", "baz"}
-	for _, name := range names {
-		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
-		if !assert.Equal(t, 201, res2.StatusCode) {
+
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=jsonapifile", "text/plain", "foo", "")
+	assert.Equal(t, 201, res2.StatusCode)
+	fileID, _ := extractDirData(t, data2)
+
+	ref := jsonapi.ResourceIdentifier{ID: "jsonapialbum", Type: "io.cozy.photos.albums"}
+	content, _ := json.Marshal(&jsonapi.Relationship{Data: ref})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/files/"+fileID+"/relationships/referenced_by", bytes.NewReader(content))
+	res3, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res3.Body.Close()
+		assert.Equal(t, 200, res3.StatusCode)
+	}
+
+	type resource struct {
+		Data struct {
+			Type       string                 `json:"type"`
+			ID         string                 `json:"id"`
+			Attributes map[string]interface{} `json:"attributes"`
+			Links      struct {
+				Self string `json:"self"`
+			} `json:"links"`
+			Relationships map[string]struct {
+				Links struct {
+					Related string `json:"related"`
+				} `json:"links"`
+				Data json.RawMessage `json:"data"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	get := func(res *http.Response) (out resource) {
+		if !assert.NotNil(t, res) {
 			return
 		}
+		defer res.Body.Close()
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Contains(t, res.Header.Get("Content-Type"), jsonapi.ContentType)
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&out))
+		return
 	}
 
-	body := bytes.NewBufferString(`{
-		"data": {
-			"attributes": {
-				"files": [
-					"/archive/foo.jpg",
-					"/archive/bar.jpg",
-					"/archive/baz.jpg"
-				]
-			}
-		}
-	}`)
+	out := get(doGetWithToken(t, "/files/"+fileID, consts.Files))
+	assert.Equal(t, consts.Files, out.Data.Type)
+	assert.Equal(t, fileID, out.Data.ID)
+	assert.Equal(t, "jsonapifile", out.Data.Attributes["name"])
+	assert.NotContains(t, out.Data.Attributes, "referenced_by")
+	assert.Equal(t, "/files/"+fileID, out.Data.Links.Self)
+	if assert.Contains(t, out.Data.Relationships, "parent") {
+		assert.Equal(t, "/files/"+dirID, out.Data.Relationships["parent"].Links.Related)
+	}
+	if assert.Contains(t, out.Data.Relationships, "referenced_by") {
+		assert.Contains(t, string(out.Data.Relationships["referenced_by"].Data), "jsonapialbum")
+	}
 
-	res, err := http.Post(ts.URL+"/files/archive", "application/vnd.api+json", body)
-	assert.NoError(t, err)
-	assert.Equal(t, 200, res.StatusCode)
-	var data map[string]interface{}
-	err = json.NewDecoder(res.Body).Decode(&data)
-	assert.NoError(t, err)
+	// a token on the directory only can't see the references
+	out = get(doGetWithToken(t, "/files/"+fileID, "io.cozy.files:GET:"+dirID))
+	assert.Equal(t, fileID, out.Data.ID)
+	assert.NotContains(t, out.Data.Attributes, "referenced_by")
+	assert.Contains(t, out.Data.Relationships, "parent")
+	assert.NotContains(t, out.Data.Relationships, "referenced_by")
+}
+
+func TestGetWithDirectoryPermission(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=permdir&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, _ := extractDirData(t, data1)
+
+	res2, data2 := createDir(t, "/files/"+dirID+"?Name=permsubdir&Type=directory")
+	assert.Equal(t, 201, res2.StatusCode)
+	subdirID, _ := extractDirData(t, data2)
+
+	res3, data3 := upload(t, "/files/"+subdirID+"?Type=file&Name=permfile", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res3.StatusCode)
+	fileID, _ := extractDirData(t, data3)
+
+	res4, data4 := createDir(t, "/files/?Name=permdirsibling&Type=directory")
+	assert.Equal(t, 201, res4.StatusCode)
+	siblingID, _ := extractDirData(t, data4)
+
+	res5, data5 := upload(t, "/files/?Type=file&Name=permdir-file", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res5.StatusCode)
+	prefixedID, _ := extractDirData(t, data5)
+
+	scope := "io.cozy.files:GET:" + dirID
+	assert.Equal(t, 200, getWithToken(t, "/files/"+dirID, scope).StatusCode)
+	assert.Equal(t, 200, getWithToken(t, "/files/"+subdirID, scope).StatusCode)
+	assert.Equal(t, 200, getWithToken(t, "/files/"+fileID, scope).StatusCode)
+	assert.Equal(t, 200, getWithToken(t, "/files/download/"+fileID, scope).StatusCode)
+	assert.Equal(t, 403, getWithToken(t, "/files/"+siblingID, scope).StatusCode)
+	assert.Equal(t, 403, getWithToken(t, "/files/"+prefixedID, scope).StatusCode)
+
+	otherScope := "io.cozy.files:POST:" + dirID
+	assert.Equal(t, 403, getWithToken(t, "/files/"+fileID, otherScope).StatusCode)
+
+	attrs := map[string]interface{}{
+		"dir_id": siblingID,
+	}
+	res6, _ := patchFile(t, "/files/"+fileID, "file", fileID, attrs, nil)
+	assert.Equal(t, 200, res6.StatusCode)
+	assert.Equal(t, 403, getWithToken(t, "/files/"+fileID, scope).StatusCode)
+}
+
+func TestWriteWithDirectoryPermission(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=writepermdir&Type=directory")
+	assert.Equal(t, 201, res1.StatusCode)
+	dirID, _ := extractDirData(t, data1)
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=writepermoutside", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+	outsideID, _ := extractDirData(t, data2)
+
+	res3, data3 := upload(t, "/files/?Type=file&Name=writepermtrashed", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res3.StatusCode)
+	trashedID, _ := extractDirData(t, data3)
+	res4, _ := trash(t, "/files/"+trashedID)
+	assert.Equal(t, 200, res4.StatusCode)
+
+	res5, _ := upload(t, "/files/"+dirID+"?Type=file&Name=insidefile", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res5.StatusCode)
+
+	scope := "io.cozy.files:ALL:" + dirID
+	status := func(method, path string, body []byte) int {
+		res := doWithToken(t, method, path, scope, body)
+		if !assert.NotNil(t, res) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 201, status("POST", "/files/?Type=directory&Path=/writepermdir/inside", nil))
+	assert.Equal(t, 201, status("POST", "/files/?Type=directory&Recursive=true&Path=/writepermdir/a/b", nil))
+	assert.Equal(t, 403, status("POST", "/files/?Type=directory&Path=/writepermoutside-dir", nil))
+	assert.Equal(t, 403, status("POST", "/files/?Type=directory&Recursive=true&Path=/writepermother/a", nil))
+
+	assert.Equal(t, 200, status("POST", "/files/downloads?Path=/writepermdir/insidefile", nil))
+	assert.Equal(t, 403, status("POST", "/files/downloads?Path=/writepermoutside", nil))
+
+	archive := func(files ...string) []byte {
+		body, _ := json.Marshal(map[string]interface{}{
+			"data": map[string]interface{}{
+				"attributes": map[string]interface{}{"files": files},
+			},
+		})
+		return body
+	}
+	assert.Equal(t, 200, status("POST", "/files/archive", archive("/writepermdir/insidefile")))
+	assert.Equal(t, 403, status("POST", "/files/archive", archive("/writepermdir/insidefile", "/writepermoutside")))
+
+	assert.Equal(t, 403, status("POST", "/files/trash/"+trashedID, nil))
+	assert.Equal(t, 403, status("DELETE", "/files/trash/"+trashedID, nil))
+	assert.Equal(t, 403, status("DELETE", "/files/trash", nil))
+	assert.Equal(t, 403, status("DELETE", "/files/trash/"+outsideID, nil))
+
+	// the trashed file is still there for the owner
+	res6, err := http.Post(ts.URL+"/files/trash/"+trashedID, "", nil)
+	if assert.NoError(t, err) {
+		res6.Body.Close()
+		assert.Equal(t, 200, res6.StatusCode)
+	}
+}
+
+func TestNoTokenWithoutSession(t *testing.T) {
+	handler := echo.New()
+	handler.HTTPErrorHandler = errors.ErrorHandler
+	handler.Use(injectInstance(testInstance), middlewares.LoadSession)
+	Routes(handler.Group("/files"))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	res1, err := http.Get(server.URL + "/files/" + consts.RootDirID)
+	if assert.NoError(t, err) {
+		res1.Body.Close()
+		assert.Equal(t, 401, res1.StatusCode)
+	}
+	res2, err := http.Post(server.URL+"/files/?Type=directory&Path=/nosessiondir", "", nil)
+	if assert.NoError(t, err) {
+		res2.Body.Close()
+		assert.Equal(t, 401, res2.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/files/trash", nil)
+	res3, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		res3.Body.Close()
+		assert.Equal(t, 401, res3.StatusCode)
+	}
+}
+
+func createShareLink(t *testing.T, fileID string) string {
+	res, err := http.Post(ts.URL+"/files/"+fileID+"/link?TTL=1h", "", nil)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return ""
+	}
+
+	var v map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&v)
+	assert.NoError(t, err)
+	links, _ := v["links"].(map[string]interface{})
+	related, _ := links["related"].(string)
+	return related
+}
+
+func TestShareLinkSuccess(t *testing.T) {
+	body := "foo"
+	res1, data1 := upload(t, "/files/?Type=file&Name=sharelinkfile", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	link := createShareLink(t, fileID)
+	assert.Contains(t, link, "/files/download/"+fileID+"?bearer_token=")
+
+	res2, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	resbody, err := ioutil.ReadAll(res2.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(resbody))
+
+	res3, err := http.Post(ts.URL+"/files/"+fileID+"/link?TTL=foo", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res3.StatusCode)
+}
+
+func TestShareLinkExpired(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=sharelinkexpired", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	token, err := crypto.NewJWT(testInstance.SessionSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  permissions.ShareAudience,
+			Issuer:    testInstance.Domain,
+			IssuedAt:  crypto.Timestamp() - 7200,
+			ExpiresAt: crypto.Timestamp() - 3600,
+			Subject:   fileID,
+		},
+		Scope: "io.cozy.files:GET:" + fileID,
+	})
+	assert.NoError(t, err)
+
+	res2, err := http.Get(ts.URL + "/files/download/" + fileID + "?bearer_token=" + token)
+	assert.NoError(t, err)
+	assert.Equal(t, 410, res2.StatusCode)
+}
+
+func TestShareLinkOtherFile(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=sharelinkshared", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=sharelinkother", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+	otherID, _ := extractDirData(t, data2)
+
+	link := createShareLink(t, fileID)
+	link = strings.Replace(link, fileID, otherID, 1)
+
+	res3, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res3.StatusCode)
+
+	res4, _ := trash(t, "/files/"+fileID)
+	assert.Equal(t, 200, res4.StatusCode)
+	link = strings.Replace(link, otherID, fileID, 1)
+	res5, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res5.StatusCode)
+}
+
+func createSignedURL(t *testing.T, fileID string) string {
+	res, err := http.Post(ts.URL+"/files/"+fileID+"/signed?TTL=1h", "", nil)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer res.Body.Close()
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return ""
+	}
+
+	var v map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&v)
+	assert.NoError(t, err)
+	links, _ := v["links"].(map[string]interface{})
+	related, _ := links["related"].(string)
+	return related
+}
+
+func TestSignedURLSuccess(t *testing.T) {
+	body := "foo"
+	res1, data1 := upload(t, "/files/?Type=file&Name=signedurlfile", "text/plain", body, "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	link := createSignedURL(t, fileID)
+	assert.Contains(t, link, "/files/signed/"+fileID+"?")
+
+	res2, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	resbody, err := ioutil.ReadAll(res2.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, body, string(resbody))
+}
+
+func TestSignedURLExpired(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=signedurlexpired", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	expires := time.Now().Add(-time.Hour).Unix()
+	signature := signDownload(testInstance.OAuthSecret, testInstance.Domain, fileID, expires)
+	link := fmt.Sprintf("/files/signed/%s?Expires=%d&Signature=%s", fileID, expires, signature)
+
+	res2, err := http.Get(ts.URL + link)
+	assert.NoError(t, err)
+	assert.Equal(t, 410, res2.StatusCode)
+}
+
+func TestSignedURLTampered(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=signedurlsigned", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res1.StatusCode)
+	fileID, _ := extractDirData(t, data1)
+
+	res2, data2 := upload(t, "/files/?Type=file&Name=signedurlother", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	assert.Equal(t, 201, res2.StatusCode)
+	otherID, _ := extractDirData(t, data2)
+
+	link := createSignedURL(t, fileID)
+
+	// another file
+	res3, err := http.Get(ts.URL + strings.Replace(link, fileID, otherID, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res3.StatusCode)
+
+	// a later expiration date
+	u, err := url.Parse(link)
+	assert.NoError(t, err)
+	q := u.Query()
+	expires, _ := strconv.ParseInt(q.Get("Expires"), 10, 64)
+	q.Set("Expires", strconv.FormatInt(expires+3600, 10))
+	res4, err := http.Get(ts.URL + u.Path + "?" + q.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res4.StatusCode)
+
+	// no signature
+	res5, err := http.Get(ts.URL + "/files/signed/" + fileID)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res5.StatusCode)
+}
+
+func getPath(t *testing.T, id string) (int, map[string]interface{}) {
+	res, err := http.Get(ts.URL + "/files/" + id + "/path")
+	if !assert.NoError(t, err) {
+		return 0, nil
+	}
+	defer res.Body.Close()
+	var v map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&v)
+	assert.NoError(t, err)
+	return res.StatusCode, v
+}
+
+func TestFilePathNested(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=pathparent&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	parentID, _ := extractDirData(t, data1)
+	res2, data2 := createDir(t, "/files/"+parentID+"?Name=pathchild&Type=directory")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	childID, _ := extractDirData(t, data2)
+	res3, data3 := upload(t, "/files/"+childID+"?Type=file&Name=pathfile", "text/plain", "foo", "rL0Y20zC+Fzt72VPzMSk2A==")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	fileID, _ := extractDirData(t, data3)
+
+	status, v := getPath(t, fileID)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, fileID, v["id"])
+	assert.Equal(t, "/pathparent/pathchild/pathfile", v["path"])
+
+	status, v = getPath(t, childID)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "/pathparent/pathchild", v["path"])
+}
+
+func TestFilePathBrokenParentChain(t *testing.T) {
+	doc, err := vfs.NewFileDoc("orphan", "missing-parent-dir", 0, nil,
+		"text/plain", "text", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = couchdb.CreateDoc(testInstance, doc)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	status, v := getPath(t, doc.ID())
+	assert.Equal(t, 404, status)
+	assert.Nil(t, v["path"])
+	errs, _ := v["errors"].([]interface{})
+	if assert.Len(t, errs, 1) {
+		detail, _ := errs[0].(map[string]interface{})["detail"].(string)
+		assert.Equal(t, vfs.ErrParentDoesNotExist.Error(), detail)
+	}
+}
+
+func TestTrashRootAndTrashDir(t *testing.T) {
+	res1, _ := trash(t, "/files/"+consts.RootDirID)
+	assert.Equal(t, 403, res1.StatusCode)
+
+	res2, _ := trash(t, "/files/"+consts.TrashDirID)
+	assert.Equal(t, 403, res2.StatusCode)
+}
+
+func TestArchiveNoFiles(t *testing.T) {
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {}
+		}
+	}`)
+	res, err := http.Post(ts.URL+"/files/archive", "application/vnd.api+json", body)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, res.StatusCode)
+	msg, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, `"Can't create an archive with no files"`, string(msg))
+}
+
+func TestArchiveDirectDownload(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=archive&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	names := []string{"foo", "bar", "baz"}
+	for _, name := range names {
+		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
+		if !assert.Equal(t, 201, res2.StatusCode) {
+			return
+		}
+	}
+
+	// direct download
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"files": [
+					"/archive/foo.jpg",
+					"/archive/bar.jpg",
+					"/archive/baz.jpg"
+				]
+			}
+		}
+	}`)
+
+	req, err := http.NewRequest("POST", ts.URL+"/files/archive", body)
+	req.Header.Add("Content-Type", "application/zip")
+	req.Header.Add("Accept", "application/zip")
+	assert.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		b, err2 := ioutil.ReadAll(res.Body)
+		fmt.Println(err2, string(b))
+	}
+	assert.Equal(t, "application/zip", res.Header.Get("Content-Type"))
+
+}
+
+func TestArchiveCreateAndDownload(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=archive2&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	names := []string{"foo", "bar", "baz"}
+	for _, name := range names {
+		res2, _ := createDir(t, "/files/"+dirID+"?Name="+name+".jpg&Type=file")
+		if !assert.Equal(t, 201, res2.StatusCode) {
+			return
+		}
+	}
+
+	body := bytes.NewBufferString(`{
+		"data": {
+			"attributes": {
+				"files": [
+					"/archive/foo.jpg",
+					"/archive/bar.jpg",
+					"/archive/baz.jpg"
+				]
+			}
+		}
+	}`)
+
+	res, err := http.Post(ts.URL+"/files/archive", "application/vnd.api+json", body)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var data map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&data)
+	assert.NoError(t, err)
 
 	downloadURL := ts.URL + data["links"].(map[string]interface{})["related"].(string)
 	res2, err := http.Get(downloadURL)
@@ -1299,6 +2302,121 @@ func TestDirRestoreWithConflicts(t *testing.T) {
 	assert.NotEqual(t, "torestoredirwithconflict", restoredData["name"].(string))
 }
 
+type changesResponse struct {
+	Data []struct {
+		Type  string                 `json:"type"`
+		ID    string                 `json:"id"`
+		Attrs map[string]interface{} `json:"attributes"`
+	} `json:"data"`
+	Links struct {
+		Next string `json:"next"`
+	} `json:"links"`
+	Meta struct {
+		Token string `json:"token"`
+	} `json:"meta"`
+}
+
+// getChanges returns the changes since the token, and the token to use for
+// the next call, after following all the pages
+func getChanges(t *testing.T, token string) (map[string]map[string]interface{}, string) {
+	changes := make(map[string]map[string]interface{})
+	path := "/files/_changes?limit=1000"
+	if token != "" {
+		path += "&since=" + token
+	}
+	for path != "" {
+		res, err := http.Get(ts.URL + path)
+		if !assert.NoError(t, err) {
+			return nil, ""
+		}
+		var v changesResponse
+		err = json.NewDecoder(res.Body).Decode(&v)
+		res.Body.Close()
+		if !assert.Equal(t, 200, res.StatusCode) || !assert.NoError(t, err) {
+			return nil, ""
+		}
+		for _, d := range v.Data {
+			assert.Equal(t, consts.Files, d.Type)
+			changes[d.ID] = d.Attrs
+		}
+		token = v.Meta.Token
+		path = v.Links.Next
+	}
+	assert.NotEmpty(t, token)
+	return changes, token
+}
+
+func TestFilesChanges(t *testing.T) {
+	_, token := getChanges(t, "")
+
+	res1, data1 := createDir(t, "/files/?Name=changesdir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=kept", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	keptID, _ := extractDirData(t, data2)
+	res3, data3 := upload(t, "/files/?Type=file&Name=changestrashed", "text/plain", "bar", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	trashedID, _ := extractDirData(t, data3)
+	res4, data4 := upload(t, "/files/?Type=file&Name=changesdestroyed", "text/plain", "baz", "")
+	if !assert.Equal(t, 201, res4.StatusCode) {
+		return
+	}
+	destroyedID, _ := extractDirData(t, data4)
+
+	changes, token := getChanges(t, token)
+	assert.Len(t, changes, 4)
+	if assert.Contains(t, changes, dirID) {
+		assert.Equal(t, "changesdir", changes[dirID]["name"])
+	}
+	if assert.Contains(t, changes, keptID) {
+		assert.Equal(t, "kept", changes[keptID]["name"])
+	}
+
+	res5, _ := trash(t, "/files/"+trashedID)
+	assert.Equal(t, 200, res5.StatusCode)
+	res6, _ := trash(t, "/files/"+destroyedID)
+	assert.Equal(t, 200, res6.StatusCode)
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/files/trash/"+destroyedID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res7, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res7.Body.Close()
+	assert.Equal(t, 204, res7.StatusCode)
+
+	changes, token = getChanges(t, token)
+	assert.Len(t, changes, 2)
+	if assert.Contains(t, changes, trashedID) {
+		assert.Equal(t, true, changes[trashedID]["_deleted"])
+	}
+	if assert.Contains(t, changes, destroyedID) {
+		assert.Equal(t, true, changes[destroyedID]["_deleted"])
+	}
+
+	changes, _ = getChanges(t, token)
+	assert.Len(t, changes, 0)
+
+	res8, err := http.Get(ts.URL + "/files/_changes?since=not-a-token!")
+	if assert.NoError(t, err) {
+		res8.Body.Close()
+		assert.Equal(t, 422, res8.StatusCode)
+	}
+	res9 := getWithToken(t, "/files/_changes", consts.Files+":GET:"+dirID)
+	if assert.NotNil(t, res9) {
+		assert.Equal(t, 403, res9.StatusCode)
+	}
+}
+
 func TestTrashList(t *testing.T) {
 	body := "foo,bar"
 	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
@@ -1343,6 +2461,146 @@ func TestTrashList(t *testing.T) {
 	assert.True(t, len(v.Data) >= 2)
 }
 
+func TestTrashListSortedAndPaginated(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=trashlistsrc&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	res2, data2 := upload(t, "/files/"+dirID+"?Type=file&Name=trashed1", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	res3, data3 := upload(t, "/files/"+dirID+"?Type=file&Name=trashed2", "text/plain", "bar", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	file1ID, _ := extractDirData(t, data2)
+	file2ID, _ := extractDirData(t, data3)
+
+	res4, _ := trash(t, "/files/"+file1ID)
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+	time.Sleep(10 * time.Millisecond)
+	res5, _ := trash(t, "/files/"+file2ID)
+	if !assert.Equal(t, 200, res5.StatusCode) {
+		return
+	}
+
+	type trashPage struct {
+		Data []struct {
+			ID    string                 `json:"id"`
+			Attrs map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+		Links struct {
+			Next string `json:"next"`
+		} `json:"links"`
+		Meta struct {
+			Count int `json:"count"`
+		} `json:"meta"`
+	}
+	getPage := func(path string) *trashPage {
+		res, err := http.Get(ts.URL + path)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer res.Body.Close()
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return nil
+		}
+		var page trashPage
+		if !assert.NoError(t, json.NewDecoder(res.Body).Decode(&page)) {
+			return nil
+		}
+		return &page
+	}
+
+	page1 := getPage("/files/trash?limit=1")
+	if !assert.NotNil(t, page1) || !assert.Len(t, page1.Data, 1) {
+		return
+	}
+	assert.Equal(t, file2ID, page1.Data[0].ID)
+	assert.Equal(t, "/trashlistsrc", page1.Data[0].Attrs["restore_path"])
+	assert.True(t, page1.Meta.Count >= 2)
+	if !assert.NotEmpty(t, page1.Links.Next) {
+		return
+	}
+
+	page2 := getPage(page1.Links.Next)
+	if !assert.NotNil(t, page2) || !assert.Len(t, page2.Data, 1) {
+		return
+	}
+	assert.Equal(t, file1ID, page2.Data[0].ID)
+	assert.Equal(t, "/trashlistsrc", page2.Data[0].Attrs["restore_path"])
+}
+
+func TestTrashRestoreAll(t *testing.T) {
+	res1, data1 := upload(t, "/files/?Type=file&Name=torestoreallfile", "text/plain", "foo", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	res2, data2 := createDir(t, "/files/?Name=torestorealldir&Type=directory")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	res3, data3 := createDir(t, "/files/?Name=torestoreallgone&Type=directory")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+
+	fileID, _ := extractDirData(t, data1)
+	dirID, _ := extractDirData(t, data2)
+	goneID, _ := extractDirData(t, data3)
+
+	res4, data4 := upload(t, "/files/"+goneID+"?Type=file&Name=orphan", "text/plain", "bar", "")
+	if !assert.Equal(t, 201, res4.StatusCode) {
+		return
+	}
+	orphanID, _ := extractDirData(t, data4)
+
+	for _, id := range []string{fileID, dirID, orphanID, goneID} {
+		res, _ := trash(t, "/files/"+id)
+		if !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+	}
+	req, err := http.NewRequest(http.MethodDelete, ts.URL+"/files/trash/"+goneID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res5, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) || !assert.Equal(t, 204, res5.StatusCode) {
+		return
+	}
+
+	res6, data6 := restore(t, "/files/trash/restore")
+	if !assert.Equal(t, 200, res6.StatusCode) {
+		return
+	}
+	results, ok := data6["data"].([]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	restored := make(map[string]bool)
+	for _, r := range results {
+		result := r.(map[string]interface{})
+		restored[result["id"].(string)] = true
+	}
+	assert.True(t, restored[fileID])
+	assert.True(t, restored[dirID])
+	assert.True(t, restored[orphanID])
+
+	for _, p := range []string{"/torestoreallfile", "/torestorealldir", "/torestoreallgone/orphan"} {
+		res, err := http.Get(ts.URL + "/files/metadata?Path=" + p)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 200, res.StatusCode, p)
+			res.Body.Close()
+		}
+	}
+}
+
 func TestTrashClear(t *testing.T) {
 	body := "foo,bar"
 	res1, data1 := upload(t, "/files/?Type=file&Name=tolistfile", "text/plain", body, "UmfjCVWct/albVkURcJJfg==")
@@ -1480,6 +2738,182 @@ func TestDestroyFile(t *testing.T) {
 
 }
 
+func TestContentNegotiation(t *testing.T) {
+	res1, data1 := createDir(t, "/files/?Name=negotiationdir&Type=directory")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	dirID, _ := extractDirData(t, data1)
+
+	attrs := `{"data": {"type": "io.cozy.files", "id": "` + dirID + `", "attributes": {"name": "negotiated"}}}`
+	req, err := http.NewRequest("PATCH", ts.URL+"/files/"+dirID, strings.NewReader(attrs))
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Set("Content-Type", "application/vnd.api+json; charset=utf-8")
+	res2, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 415, res2.StatusCode)
+		res2.Body.Close()
+	}
+
+	req, err = http.NewRequest("GET", ts.URL+"/files/"+dirID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.api+json; ext=bulk")
+	res3, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 406, res3.StatusCode)
+		res3.Body.Close()
+	}
+
+	req.Header.Set("Accept", "application/vnd.api+json")
+	res4, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 200, res4.StatusCode)
+		res4.Body.Close()
+	}
+}
+
+func TestUploadWithTrailerMD5(t *testing.T) {
+	upload := func(name, md5Sum string) *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name="+name, strings.NewReader("foo,bar"))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "text/plain")
+		req.Trailer = http.Header{}
+		req.Trailer.Set(TrailerMD5, md5Sum)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := upload("trailermatch", "UmfjCVWct/albVkURcJJfg==")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 201, res.StatusCode)
+	}
+
+	res = upload("trailermismatch", "3FbPlyXR6ua2tcRQIjTNHw==")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 412, res.StatusCode)
+	}
+	res, err := http.Get(ts.URL + "/files/metadata?Path=/trailermismatch")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
+func TestUsage(t *testing.T) {
+	getUsage := func() (used, trashed int64, classes map[string]int64) {
+		res, err := http.Get(ts.URL + "/files/usage")
+		if !assert.NoError(t, err) || !assert.Equal(t, 200, res.StatusCode) {
+			return
+		}
+		var result struct {
+			Data struct {
+				Attributes struct {
+					Used    int64            `json:"used,string"`
+					Classes map[string]int64 `json:"classes"`
+					Trashed int64            `json:"trashed,string"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if !assert.NoError(t, err) {
+			return
+		}
+		attrs := result.Data.Attributes
+		return attrs.Used, attrs.Trashed, attrs.Classes
+	}
+
+	used1, trashed1, classes1 := getUsage()
+
+	res1, _ := upload(t, "/files/?Type=file&Name=usagetext", "text/plain", "usage of a text", "")
+	if !assert.Equal(t, 201, res1.StatusCode) {
+		return
+	}
+	res2, _ := upload(t, "/files/?Type=file&Name=usageimage", "image/png", "not really a png", "")
+	if !assert.Equal(t, 201, res2.StatusCode) {
+		return
+	}
+	res3, data3 := upload(t, "/files/?Type=file&Name=usagetrashed", "image/png", "trashed", "")
+	if !assert.Equal(t, 201, res3.StatusCode) {
+		return
+	}
+	trashedID, _ := extractDirData(t, data3)
+	res4, _ := trash(t, "/files/"+trashedID)
+	if !assert.Equal(t, 200, res4.StatusCode) {
+		return
+	}
+
+	used2, trashed2, classes2 := getUsage()
+	assert.Equal(t, used1+15+16+7, used2)
+	assert.Equal(t, trashed1+7, trashed2)
+	assert.Equal(t, classes1["text"]+15, classes2["text"])
+	assert.Equal(t, classes1["image"]+16, classes2["image"])
+}
+
+func TestUploadChunked(t *testing.T) {
+	upload := func(name, content string) *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/files/?Type=file&Name="+name, strings.NewReader(content))
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "text/plain")
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		return res
+	}
+
+	res := upload("chunkedupload", "foo,bar,baz")
+	if !assert.NotNil(t, res) || !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	var obj map[string]interface{}
+	err := extractJSONRes(res, &obj)
+	res.Body.Close()
+	if assert.NoError(t, err) {
+		attrs := obj["data"].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, "11", attrs["size"])
+		assert.Equal(t, "WpNQGY+FTeSyq1bxh/h3Bw==", attrs["md5sum"])
+	}
+
+	used, err := vfs.DiskUsage(testInstance)
+	if !assert.NoError(t, err) {
+		return
+	}
+	testInstance.BytesDiskQuota = used + 5
+	defer func() { testInstance.BytesDiskQuota = 0 }()
+
+	res = upload("chunkedtoobig", "content larger than the quota")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 507, res.StatusCode)
+		res.Body.Close()
+	}
+	res, err = http.Get(ts.URL + "/files/metadata?Path=/chunkedtoobig")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, res.StatusCode)
+		res.Body.Close()
+	}
+
+	res = upload("chunkedsmall", "foo")
+	if assert.NotNil(t, res) {
+		assert.Equal(t, 201, res.StatusCode)
+		res.Body.Close()
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -1507,9 +2941,15 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	session, err := sessions.New(testInstance)
+	if err != nil {
+		fmt.Println("Could not create test session.", err)
+		os.Exit(1)
+	}
+
 	handler := echo.New()
 	handler.HTTPErrorHandler = errors.ErrorHandler
-	handler.Use(injectInstance(testInstance))
+	handler.Use(injectInstance(testInstance), injectSession(session), middlewares.LoadSession)
 	Routes(handler.Group("/files"))
 
 	ts = httptest.NewServer(handler)
@@ -0,0 +1,128 @@
+package files
+
+import (
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// checkSession validates that a request without a token is made by the
+// owner of the instance, from a browser with a session cookie. The other
+// requests without a token are not allowed on the files routes.
+func checkSession(c echo.Context) error {
+	if !middlewares.IsLoggedIn(c) {
+		return echo.NewHTTPError(http.StatusUnauthorized)
+	}
+	return nil
+}
+
+// checkPerm validates that the permissions of the request allow to use the
+// given verb on a file or directory, or on one of its parent directories.
+// A request without a token must have the session of the owner.
+func checkPerm(c echo.Context, v pkgperm.Verb, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	if !permissions.HasToken(c) {
+		return checkSession(c)
+	}
+
+	instance := middlewares.GetInstance(c)
+
+	var id, fullpath string
+	var err error
+	if dir != nil {
+		id = dir.ID()
+		fullpath, err = dir.Path(instance)
+	} else {
+		id = file.ID()
+		fullpath, err = file.Path(instance)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = permissions.AllowVFS(c, v, id, fullpath); err != nil {
+		return err
+	}
+
+	// A share link is revoked when the shared file or directory is put in
+	// the trash
+	claims := permissions.GetClaims(c)
+	if claims != nil && claims.Audience == pkgperm.ShareAudience {
+		if vfs.IsInTrash(instance, fullpath) {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+	}
+
+	return nil
+}
+
+// canReadReferences returns true if the request is allowed to know which
+// documents reference the files, ie if it can read the whole io.cozy.files
+// doctype.
+func canReadReferences(c echo.Context) bool {
+	if !permissions.HasToken(c) {
+		return middlewares.IsLoggedIn(c)
+	}
+	return permissions.AllowWholeType(c, pkgperm.GET, consts.Files) == nil
+}
+
+// checkPermOnDirID is the same as checkPerm, but for a directory given by its
+// id.
+func checkPermOnDirID(c echo.Context, v pkgperm.Verb, dirID string) error {
+	if !permissions.HasToken(c) {
+		return checkSession(c)
+	}
+
+	instance := middlewares.GetInstance(c)
+	if dirID == "" {
+		dirID = consts.RootDirID
+	}
+	dir, err := vfs.GetDirDoc(instance, dirID, false)
+	if err != nil {
+		return err
+	}
+	return checkPerm(c, v, dir, nil)
+}
+
+// checkPermOnParent is the same as checkPerm, but for the parent directory of
+// the given path. When this directory doesn't exist yet, like for a
+// recursive creation, the check is made on its closest existing ancestor.
+func checkPermOnParent(c echo.Context, v pkgperm.Verb, name string) error {
+	if !permissions.HasToken(c) {
+		return checkSession(c)
+	}
+
+	instance := middlewares.GetInstance(c)
+	parent := path.Dir(path.Clean(name))
+	for {
+		dir, err := vfs.GetDirDocFromPath(instance, parent, false)
+		if err == nil {
+			return checkPerm(c, v, dir, nil)
+		}
+		if !os.IsNotExist(err) || parent == "/" {
+			return err
+		}
+		parent = path.Dir(parent)
+	}
+}
+
+// checkPermOnPath is the same as checkPerm, but for a file or directory
+// given by its path.
+func checkPermOnPath(c echo.Context, v pkgperm.Verb, name string) error {
+	if !permissions.HasToken(c) {
+		return checkSession(c)
+	}
+
+	instance := middlewares.GetInstance(c)
+	dir, file, err := vfs.GetDirOrFileDocFromPath(instance, name, false)
+	if err != nil {
+		return err
+	}
+	return checkPerm(c, v, dir, file)
+}
@@ -0,0 +1,57 @@
+package files
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/jobs/workers"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// PreviewHandler handles GET requests on /files/:file-id/preview and sends
+// the image of the first page of a PDF or office document. It returns a 404
+// if the preview has not been generated.
+func PreviewHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+
+	err = vfs.ServePreview(instance, doc, c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return nil
+}
+
+// pushPreviewJob pushes a job to generate the preview of a file that has
+// just been written, if it is a document with a preview. A failure is only
+// logged: the file is written even without its preview.
+func pushPreviewJob(c echo.Context, doc *vfs.FileDoc) {
+	if config.GetConfig().Previews.Renderer == "" || !vfs.IsPreviewable(doc.Mime) {
+		return
+	}
+	instance := middlewares.GetInstance(c)
+	msg, err := jobs.NewMessage(jobs.JSONEncoding, &workers.PreviewOptions{
+		FileID: doc.ID(),
+	})
+	if err == nil {
+		_, _, err = instance.JobsBroker().PushJob(&jobs.JobRequest{
+			WorkerType: workers.PreviewWorkerType,
+			Message:    msg,
+		})
+	}
+	if err != nil {
+		log.Warnf("[preview] %s: Could not push the job: %s", doc.ID(), err)
+	}
+}
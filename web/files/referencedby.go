@@ -7,6 +7,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
@@ -27,6 +28,10 @@ func AddReferencedHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Cant add references to a folder")
 	}
 
+	if err = checkPerm(c, permissions.PATCH, nil, file); err != nil {
+		return err
+	}
+
 	references, err := jsonapi.BindRelations(c.Request())
 	if err != nil {
 		return wrapVfsError(err)
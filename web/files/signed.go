@@ -0,0 +1,121 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+)
+
+// ErrInvalidSignature is used when the signature of a signed URL does not
+// match its parameters
+var ErrInvalidSignature = errors.New("Invalid signature")
+
+// ErrExpiredSignature is used when a signed URL is used after its expiration
+var ErrExpiredSignature = errors.New("Expired signature")
+
+// signDownload computes the signature of a signed URL for the given file and
+// expiration date (as a unix timestamp). It is an HMAC-SHA256 keyed by the
+// OAuth secret of the instance.
+func signDownload(secret []byte, domain, fileID string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(domain + "\n" + fileID + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURLCreateHandler handles requests on /files/:file-id/signed and
+// creates an URL for downloading the file, valid for a limited time, that
+// can be used without a token.
+func SignedURLCreateHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, pkgperm.GET, nil, doc); err != nil {
+		return err
+	}
+
+	ttl := DefaultShareLinkTTL
+	if param := c.QueryParam("TTL"); param != "" {
+		ttl, err = time.ParseDuration(param)
+		if err != nil || ttl <= 0 || ttl > MaxShareLinkTTL {
+			return jsonapi.InvalidParameter("TTL", ErrInvalidTTL)
+		}
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{
+		"Expires":   {strconv.FormatInt(expires, 10)},
+		"Signature": {signDownload(instance.OAuthSecret, instance.Domain, doc.ID(), expires)},
+	}
+	links := &jsonapi.LinksList{
+		Related: "/files/signed/" + doc.ID() + "?" + q.Encode(),
+	}
+
+	return jsonapi.Data(c, http.StatusOK, hideFields(doc), links)
+}
+
+// checkSignedURL is a middleware that verifies the signature and the
+// expiration date of a signed URL, before serving the file. No token and no
+// permission are needed for these requests.
+func checkSignedURL(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		instance := middlewares.GetInstance(c)
+		expires, err := strconv.ParseInt(c.QueryParam("Expires"), 10, 64)
+		if err != nil {
+			return jsonapi.NewError(http.StatusForbidden, ErrInvalidSignature)
+		}
+		signature, err := hex.DecodeString(c.QueryParam("Signature"))
+		if err != nil {
+			return jsonapi.NewError(http.StatusForbidden, ErrInvalidSignature)
+		}
+		valid := false
+		for _, secret := range instance.OAuthSecrets() {
+			expected, _ := hex.DecodeString(signDownload(secret,
+				instance.Domain, c.Param("file-id"), expires))
+			if hmac.Equal(signature, expected) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return jsonapi.NewError(http.StatusForbidden, ErrInvalidSignature)
+		}
+		if time.Now().Unix() > expires {
+			return jsonapi.NewError(http.StatusGone, ErrExpiredSignature)
+		}
+		return next(c)
+	}
+}
+
+// SignedDownloadHandler handles the requests on /files/signed/:file-id,
+// after their signature has been checked, and serves the file in inline
+// mode.
+func SignedDownloadHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	doc, err := vfs.GetFileDoc(instance, c.Param("file-id"))
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	err = vfs.ServeFileContent(instance, doc, "inline", c.Request(), c.Response())
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package files
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+// usageID is the identifier of the jsonapi object for the disk usage
+const usageID = "usage"
+
+type apiUsage struct {
+	Used     int64            `json:"used,string"`
+	Classes  map[string]int64 `json:"classes"`
+	Trashed  int64            `json:"trashed,string"`
+	Versions int64            `json:"versions,string"`
+	Previews int64            `json:"previews,string"`
+	Quota    int64            `json:"quota,string,omitempty"`
+}
+
+func (u *apiUsage) ID() string                             { return usageID }
+func (u *apiUsage) Rev() string                            { return "" }
+func (u *apiUsage) DocType() string                        { return consts.Files }
+func (u *apiUsage) SetID(_ string)                         {}
+func (u *apiUsage) SetRev(_ string)                        {}
+func (u *apiUsage) Relationships() jsonapi.RelationshipMap { return nil }
+func (u *apiUsage) Included() []jsonapi.Object             { return nil }
+func (u *apiUsage) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/usage"}
+}
+
+// UsageHandler handles GET requests on /files/usage and returns the disk
+// usage of the files, with the details by class and for the trash.
+func UsageHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	root, err := vfs.GetDirDoc(instance, consts.RootDirID, false)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	if err = checkPerm(c, permissions.GET, root, nil); err != nil {
+		return err
+	}
+
+	usage, err := vfs.ComputeUsage(instance)
+	if err != nil {
+		return wrapVfsError(err)
+	}
+
+	result := &apiUsage{
+		Used:     usage.Used,
+		Classes:  usage.Classes,
+		Trashed:  usage.Trashed,
+		Versions: usage.Versions,
+		Previews: usage.Previews,
+		Quota:    instance.DiskQuota(),
+	}
+	return jsonapi.Data(c, http.StatusOK, result, nil)
+}
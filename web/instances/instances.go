@@ -1,30 +1,48 @@
 package instances
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/labstack/echo"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
 
 func createHandler(c echo.Context) error {
+	var diskQuota int64
+	if quota := c.QueryParam("DiskQuota"); quota != "" {
+		var err error
+		diskQuota, err = strconv.ParseInt(quota, 10, 64)
+		if err != nil || diskQuota < 0 {
+			return jsonapi.InvalidParameter("DiskQuota", errors.New("Invalid disk quota"))
+		}
+	}
 	in, err := instance.Create(&instance.Options{
-		Domain:   c.QueryParam("Domain"),
-		Locale:   c.QueryParam("Locale"),
-		Timezone: c.QueryParam("Timezone"),
-		Email:    c.QueryParam("Email"),
-		Apps:     strings.Split(c.QueryParam("Apps"), ","),
-		Dev:      (c.QueryParam("Dev") == "true"),
+		Domain:          c.QueryParam("Domain"),
+		Locale:          c.QueryParam("Locale"),
+		FallbackLocales: strings.Split(c.QueryParam("FallbackLocales"), ","),
+		Timezone:        c.QueryParam("Timezone"),
+		Email:           c.QueryParam("Email"),
+		DiskQuota:       diskQuota,
+		TrashName:       c.QueryParam("TrashName"),
+		Apps:            strings.Split(c.QueryParam("Apps"), ","),
+		Dev:             (c.QueryParam("Dev") == "true"),
 	})
 	if err != nil {
 		return wrapError(err)
 	}
 	in.OAuthSecret = nil
+	in.PreviousOAuthSecrets = nil
+	in.RegistrationSecret = nil
 	in.SessionSecret = nil
 	in.PassphraseHash = nil
 	return jsonapi.Data(c, http.StatusCreated, in, nil)
@@ -39,6 +57,8 @@ func listHandler(c echo.Context) error {
 	objs := make([]jsonapi.Object, len(is))
 	for i, in := range is {
 		in.OAuthSecret = nil
+		in.PreviousOAuthSecrets = nil
+		in.RegistrationSecret = nil
 		in.SessionSecret = nil
 		in.RegisterToken = nil
 		in.PassphraseHash = nil
@@ -48,13 +68,54 @@ func listHandler(c echo.Context) error {
 	return jsonapi.DataList(c, http.StatusOK, objs, nil)
 }
 
+// apiDestroyReport is the jsonapi object for the report of the destruction
+// of an instance, identified by its domain
+type apiDestroyReport struct {
+	*instance.DestroyReport
+}
+
+func (r *apiDestroyReport) ID() string                             { return r.Domain }
+func (r *apiDestroyReport) Rev() string                            { return "" }
+func (r *apiDestroyReport) DocType() string                        { return consts.Instances }
+func (r *apiDestroyReport) SetID(_ string)                         {}
+func (r *apiDestroyReport) SetRev(_ string)                        {}
+func (r *apiDestroyReport) Relationships() jsonapi.RelationshipMap { return nil }
+func (r *apiDestroyReport) Included() []jsonapi.Object             { return nil }
+func (r *apiDestroyReport) Links() *jsonapi.LinksList              { return nil }
+
 func deleteHandler(c echo.Context) error {
 	domain := c.Param("domain")
-	i, err := instance.Destroy(domain)
+	report, err := instance.Destroy(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiDestroyReport{report}, nil)
+}
+
+func exportHandler(c echo.Context) error {
+	domain := c.Param("domain")
+	in, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	w := c.Response()
+	header := w.Header()
+	header.Set("Content-Type", vfs.TarMime)
+	header.Set("Content-Disposition", vfs.ContentDisposition("attachment", domain+".tar"))
+	w.WriteHeader(http.StatusOK)
+	return vfs.Export(in, w)
+}
+
+func importHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	ids, err := vfs.Import(in, c.Request().Body)
 	if err != nil {
 		return wrapError(err)
 	}
-	return jsonapi.Data(c, http.StatusOK, i, nil)
+	return c.JSON(http.StatusOK, ids)
 }
 
 func getToken(c echo.Context) error {
@@ -92,6 +153,39 @@ func getToken(c echo.Context) error {
 	return c.String(http.StatusOK, token)
 }
 
+func rotateOAuthSecretHandler(c echo.Context) error {
+	window := instance.DefaultOAuthSecretRotationWindow
+	if w := c.QueryParam("Window"); w != "" {
+		var err error
+		window, err = time.ParseDuration(w)
+		if err != nil || window < 0 {
+			return jsonapi.InvalidParameter("Window", errors.New("Invalid window"))
+		}
+	}
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = in.RotateOAuthSecret(window); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// reindexHandler (re)defines the CouchDB indexes and views of the VFS of an
+// instance, and recreates its root and trash directories if they are missing.
+func reindexHandler(c echo.Context) error {
+	in, err := instance.Get(c.Param("domain"))
+	if err != nil {
+		return wrapError(err)
+	}
+	report, err := vfs.Reindex(in)
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
 func wrapError(err error) error {
 	switch err {
 	case instance.ErrNotFound:
@@ -100,10 +194,14 @@ func wrapError(err error) error {
 		return jsonapi.Conflict(err)
 	case instance.ErrIllegalDomain:
 		return jsonapi.InvalidParameter("domain", err)
+	case instance.ErrIllegalTrashName:
+		return jsonapi.InvalidParameter("TrashName", err)
 	case instance.ErrMissingToken:
 		return jsonapi.BadRequest(err)
 	case instance.ErrInvalidToken:
 		return jsonapi.BadRequest(err)
+	case vfs.ErrInvalidExport:
+		return jsonapi.BadRequest(err)
 	}
 	return err
 }
@@ -113,5 +211,9 @@ func Routes(router *echo.Group) {
 	router.GET("/", listHandler)
 	router.POST("/", createHandler)
 	router.DELETE("/:domain", deleteHandler)
+	router.GET("/:domain/export", exportHandler)
+	router.POST("/:domain/import", importHandler)
+	router.POST("/:domain/oauth_secret", rotateOAuthSecretHandler)
+	router.POST("/:domain/reindex", reindexHandler)
 	router.GET("/token", getToken)
 }
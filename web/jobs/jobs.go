@@ -7,9 +7,12 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/jobs"
-	_ "github.com/cozy/cozy-stack/pkg/jobs/workers" // import all workers
+	"github.com/cozy/cozy-stack/pkg/jobs/workers" // import all workers
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
 	"github.com/labstack/echo"
 )
 
@@ -37,6 +40,9 @@ type (
 		WorkerArguments json.RawMessage  `json:"worker_arguments"`
 		Options         *jobs.JobOptions `json:"options"`
 	}
+	apiTriggerPatch struct {
+		Disabled *bool `json:"disabled"`
+	}
 )
 
 func (j *apiJob) ID() string                             { return j.j.ID }
@@ -99,6 +105,9 @@ func pushJob(c echo.Context) error {
 	if _, err := jsonapi.Bind(c.Request(), &req); err != nil {
 		return wrapJobsError(err)
 	}
+	if err := checkMailAttachments(c, c.Param("worker-type"), req.Arguments); err != nil {
+		return err
+	}
 
 	job, ch, err := instance.JobsBroker().PushJob(&jobs.JobRequest{
 		WorkerType: c.Param("worker-type"),
@@ -131,6 +140,18 @@ func pushJob(c echo.Context) error {
 	return nil
 }
 
+func getJob(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	job, err := instance.JobsBroker().GetJobInfos(c.Param("job-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if job.WorkerType != c.Param("worker-type") {
+		return wrapJobsError(jobs.ErrNotFoundJob)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiJob{job}, nil)
+}
+
 func newTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	scheduler := instance.JobsScheduler()
@@ -138,6 +159,9 @@ func newTrigger(c echo.Context) error {
 	if _, err := jsonapi.Bind(c.Request(), &req); err != nil {
 		return wrapJobsError(err)
 	}
+	if err := checkMailAttachments(c, req.WorkerType, req.WorkerArguments); err != nil {
+		return err
+	}
 
 	t, err := jobs.NewTrigger(&jobs.TriggerInfos{
 		Type:       req.Type,
@@ -168,6 +192,32 @@ func getTrigger(c echo.Context) error {
 	return jsonapi.Data(c, http.StatusOK, &apiTrigger{t}, nil)
 }
 
+func patchTrigger(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	scheduler := instance.JobsScheduler()
+	patch := &apiTriggerPatch{}
+	if _, err := jsonapi.Bind(c.Request(), &patch); err != nil {
+		return wrapJobsError(err)
+	}
+	id := c.Param("trigger-id")
+	if patch.Disabled != nil {
+		var err error
+		if *patch.Disabled {
+			err = scheduler.Disable(id)
+		} else {
+			err = scheduler.Enable(id)
+		}
+		if err != nil {
+			return wrapJobsError(err)
+		}
+	}
+	t, err := scheduler.Get(id)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiTrigger{t}, nil)
+}
+
 func deleteTrigger(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	scheduler := instance.JobsScheduler()
@@ -199,7 +249,41 @@ func Routes(router *echo.Group) {
 	router.GET("/triggers", getAllTriggers)
 	router.POST("/triggers", newTrigger)
 	router.GET("/triggers/:trigger-id", getTrigger)
+	router.PATCH("/triggers/:trigger-id", patchTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
+
+	router.GET("/:worker-type/:job-id", getJob)
+}
+
+// checkMailAttachments checks that the permissions of the request allow to
+// read the files of the VFS attached to a mail, as the worker reads them
+// without any check.
+func checkMailAttachments(c echo.Context, workerType string, arguments json.RawMessage) error {
+	if workerType != workers.MailWorkerType || len(arguments) == 0 || !permissions.HasToken(c) {
+		return nil
+	}
+	var opts workers.MailOptions
+	if err := json.Unmarshal(arguments, &opts); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	instance := middlewares.GetInstance(c)
+	for _, attachment := range opts.Attachments {
+		if attachment.FileID == "" {
+			continue
+		}
+		doc, err := vfs.GetFileDoc(instance, attachment.FileID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusForbidden)
+		}
+		fullpath, err := doc.Path(instance)
+		if err != nil {
+			return err
+		}
+		if err = permissions.AllowVFS(c, pkgperm.GET, doc.ID(), fullpath); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func streamJob(job *jobs.JobInfos, w http.ResponseWriter) error {
@@ -224,6 +308,8 @@ func wrapJobsError(err error) error {
 		return jsonapi.NotFound(err)
 	case jobs.ErrNotFoundTrigger:
 		return jsonapi.NotFound(err)
+	case jobs.ErrNotFoundJob:
+		return jsonapi.NotFound(err)
 	case jobs.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
 	}
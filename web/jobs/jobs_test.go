@@ -14,16 +14,21 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/errors"
 	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
 
 const host = "cozy.io"
 
 var ts *httptest.Server
+var testInstance *instance.Instance
 
 type jobRequest struct {
 	Arguments interface{} `json:"arguments"`
@@ -50,6 +55,47 @@ func TestCreateJob(t *testing.T) {
 	assert.Equal(t, 202, res.StatusCode)
 }
 
+func TestGetJobState(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: &jobRequest{Arguments: "foobar"},
+		},
+	})
+	res1, err := http.Post(ts.URL+"/jobs/queue/print", "application/json", bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res1.Body.Close()
+	assert.Equal(t, 202, res1.StatusCode)
+	var v struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(res1.Body).Decode(&v)
+	assert.NoError(t, err)
+
+	res2, err := http.Get(ts.URL + "/jobs/print/" + v.Data.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res2.Body.Close()
+	assert.Equal(t, 200, res2.StatusCode)
+	var job map[string]interface{}
+	err = json.NewDecoder(res2.Body).Decode(&job)
+	assert.NoError(t, err)
+	data, _ := job["data"].(map[string]interface{})
+	attrs, _ := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "print", attrs["worker_type"])
+	assert.Contains(t, []interface{}{"queued", "running", "done"}, attrs["state"])
+
+	res3, err := http.Get(ts.URL + "/jobs/timeout/" + v.Data.ID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 404, res3.StatusCode)
+}
+
 func TestCreateJobNotExist(t *testing.T) {
 	body, _ := json.Marshal(&jsonapiReq{
 		Data: &jsonapiData{
@@ -268,6 +314,81 @@ func TestAddGetAndDeleteTriggerIn(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, res5.StatusCode)
 }
 
+func TestDisableAndEnableTriggerCron(t *testing.T) {
+	body, _ := json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: map[string]interface{}{
+				"type":             "@cron",
+				"arguments":        "@every 1h",
+				"worker":           "print",
+				"worker_arguments": "foo",
+			},
+		},
+	})
+	res1, err := http.Post(ts.URL+"/jobs/triggers", "application/json", bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res1.Body.Close()
+	assert.Equal(t, http.StatusCreated, res1.StatusCode)
+
+	var v struct {
+		Data struct {
+			ID         string             `json:"id"`
+			Attributes *jobs.TriggerInfos `json:"attributes"`
+		}
+	}
+	err = json.NewDecoder(res1.Body).Decode(&v)
+	if !assert.NoError(t, err) {
+		return
+	}
+	triggerID := v.Data.ID
+	assert.False(t, v.Data.Attributes.Disabled)
+
+	body, _ = json.Marshal(&jsonapiReq{
+		Data: &jsonapiData{
+			Attributes: map[string]interface{}{
+				"disabled": true,
+			},
+		},
+	})
+	req2, err := http.NewRequest("PATCH", ts.URL+"/jobs/triggers/"+triggerID, bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res2, err := http.DefaultClient.Do(req2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res2.Body.Close()
+	assert.Equal(t, http.StatusOK, res2.StatusCode)
+	err = json.NewDecoder(res2.Body).Decode(&v)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, v.Data.Attributes.Disabled)
+
+	req3, err := http.NewRequest("PATCH", ts.URL+"/jobs/triggers/unknown", bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res3, err := http.DefaultClient.Do(req3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusNotFound, res3.StatusCode)
+
+	req4, err := http.NewRequest("DELETE", ts.URL+"/jobs/triggers/"+triggerID, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res4, err := http.DefaultClient.Do(req4)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, http.StatusNoContent, res4.StatusCode)
+}
+
 func TestGetAllJobs(t *testing.T) {
 	var v struct {
 		Data []struct {
@@ -360,6 +481,67 @@ func parseEventStream(r *bufio.Reader, evch chan *event) error {
 	}
 }
 
+func TestPushMailJobWithAttachments(t *testing.T) {
+	createFile := func(name string) *vfs.FileDoc {
+		doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "", "", time.Now(), false, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		f, err := vfs.CreateFile(testInstance, doc, nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		assert.NoError(t, f.Close())
+		return doc
+	}
+	shared := createFile("shared-attachment.txt")
+	private := createFile("private-attachment.txt")
+	if shared == nil || private == nil {
+		return
+	}
+
+	token, err := crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   testInstance.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "test-jobs-app",
+		},
+		Scope: consts.Files + ":GET:" + shared.ID(),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	push := func(fileID string) int {
+		body, _ := json.Marshal(&jsonapiReq{
+			Data: &jsonapiData{
+				Attributes: &jobRequest{Arguments: map[string]interface{}{
+					"mode":    "noreply",
+					"subject": "Hey",
+					"parts":   []interface{}{map[string]string{"type": "text/plain", "body": "Hey"}},
+					"attachments": []interface{}{
+						map[string]string{"filename": "file.txt", "file_id": fileID},
+					},
+				}},
+			},
+		})
+		req, _ := http.NewRequest("POST", ts.URL+"/jobs/queue/sendmail", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, 403, push(private.ID()))
+	assert.Equal(t, 403, push("not-a-file"))
+	assert.Equal(t, 202, push(shared.ID()))
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -374,6 +556,8 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	testInstance = inst
+
 	if err = inst.StartJobSystem(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
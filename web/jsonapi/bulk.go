@@ -0,0 +1,61 @@
+package jsonapi
+
+import (
+	"encoding/json"
+
+	"github.com/labstack/echo"
+)
+
+// BulkResult is the result of a bulk operation for a single item: Object is
+// the item if the operation has succeeded for it, and Error the reason why
+// it has failed otherwise. ID is the identifier of the item, as given by the
+// client, and is used to reference it in the error.
+type BulkResult struct {
+	ID     string
+	Object Object
+	Error  *Error
+}
+
+// DataBulk can be called to send the results of a bulk operation with a
+// JSON-API document. The items for which the operation has succeeded are in
+// data, and the errors for the other items are in errors, with the
+// identifier of the item in their meta. The count in the meta of the
+// document is the total number of items.
+//
+// The operation may have only partially succeeded, so the status code is
+// given by the caller, and is usually 200 OK. Clients should look at both
+// data and errors.
+func DataBulk(c echo.Context, statusCode int, results []BulkResult) error {
+	objs := make([]json.RawMessage, 0, len(results))
+	var errs ErrorList
+	for _, res := range results {
+		if res.Error != nil {
+			e := *res.Error
+			e.Meta = &ErrorMeta{ID: res.ID}
+			errs = append(errs, &e)
+			continue
+		}
+		j, err := MarshalObject(res.Object)
+		if err != nil {
+			return InternalServerError(err)
+		}
+		objs = append(objs, j)
+	}
+
+	data, err := json.Marshal(objs)
+	if err != nil {
+		return InternalServerError(err)
+	}
+
+	count := len(results)
+	doc := Document{
+		Data:   (*json.RawMessage)(&data),
+		Errors: errs,
+		Meta:   &Meta{Count: &count},
+	}
+
+	resp := c.Response()
+	resp.Header().Set("Content-Type", ContentType)
+	resp.WriteHeader(statusCode)
+	return json.NewEncoder(resp).Encode(doc)
+}
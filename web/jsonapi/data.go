@@ -14,9 +14,13 @@ type Object interface {
 	Included() []Object
 }
 
-// Meta is a container for the couchdb revision, in JSON-API land
+// Meta is a container for the couchdb revision of an object, or the total
+// number of results of a paginated document, in JSON-API land. Token is the
+// opaque token to send back to an incremental sync endpoint.
 type Meta struct {
-	Rev string `json:"rev,omitempty"`
+	Rev   string `json:"rev,omitempty"`
+	Count *int   `json:"count,omitempty"`
+	Token string `json:"token,omitempty"`
 }
 
 // LinksList is the common links used in JSON-API for the top-level or a
@@ -12,6 +12,12 @@ type SourceError struct {
 	Parameter string `json:"parameter,omitempty"`
 }
 
+// ErrorMeta contains the meta-information of an error. For a bulk operation,
+// ID is the identifier of the item that has failed.
+type ErrorMeta struct {
+	ID string `json:"id,omitempty"`
+}
+
 // Error objects provide additional information about problems encountered
 // while performing an operation.
 // See http://jsonapi.org/format/#error-objects
@@ -20,6 +26,7 @@ type Error struct {
 	Title  string      `json:"title"`
 	Detail string      `json:"detail"`
 	Source SourceError `json:"source,omitempty"`
+	Meta   *ErrorMeta  `json:"meta,omitempty"`
 }
 
 // ErrorList is just an array of error objects
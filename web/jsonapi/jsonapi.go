@@ -5,6 +5,9 @@ package jsonapi
 import (
 	"encoding/json"
 	"net/http"
+	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/labstack/echo"
 )
@@ -19,12 +22,19 @@ type Document struct {
 	Data     *json.RawMessage `json:"data,omitempty"`
 	Errors   ErrorList        `json:"errors,omitempty"`
 	Links    *LinksList       `json:"links,omitempty"`
+	Meta     *Meta            `json:"meta,omitempty"`
 	Included []interface{}    `json:"included,omitempty"`
 }
 
 // Data can be called to send an answer with a JSON-API document containing a
 // single object as data
 func Data(c echo.Context, statusCode int, o Object, links *LinksList) error {
+	return DataWithMeta(c, statusCode, o, links, nil)
+}
+
+// DataWithMeta is like Data, with some meta-information added to the
+// document, like the total number of results for a paginated answer
+func DataWithMeta(c echo.Context, statusCode int, o Object, links *LinksList, meta *Meta) error {
 	var included []interface{}
 	for _, o := range o.Included() {
 		data, err := MarshalObject(o)
@@ -40,6 +50,7 @@ func Data(c echo.Context, statusCode int, o Object, links *LinksList) error {
 	doc := Document{
 		Data:     &data,
 		Links:    links,
+		Meta:     meta,
 		Included: included,
 	}
 
@@ -52,6 +63,12 @@ func Data(c echo.Context, statusCode int, o Object, links *LinksList) error {
 // DataList can be called to send an multiple-value answer with a
 // JSON-API document contains multiple objects.
 func DataList(c echo.Context, statusCode int, objs []Object, links *LinksList) error {
+	return DataListWithMeta(c, statusCode, objs, links, nil)
+}
+
+// DataListWithMeta is like DataList, with some meta-information added to the
+// document, like the total number of results for a paginated answer
+func DataListWithMeta(c echo.Context, statusCode int, objs []Object, links *LinksList, meta *Meta) error {
 	objsMarshaled := make([]json.RawMessage, len(objs))
 	for i, o := range objs {
 		j, err := MarshalObject(o)
@@ -69,6 +86,7 @@ func DataList(c echo.Context, statusCode int, objs []Object, links *LinksList) e
 	doc := Document{
 		Data:  (*json.RawMessage)(&data),
 		Links: links,
+		Meta:  meta,
 	}
 
 	resp := c.Response()
@@ -102,28 +120,83 @@ func DataErrorList(c echo.Context, errs ...*Error) error {
 }
 
 // Bind is used to unmarshal an input JSONApi document. It binds an
-// incoming request to a attribute type.
+// incoming request to a attribute type. The errors are 400 jsonapi.Error,
+// with a pointer to the offending member when it can be found.
 func Bind(req *http.Request, attrs interface{}) (*ObjectMarshalling, error) {
 	decoder := json.NewDecoder(req.Body)
 	var doc *Document
 	if err := decoder.Decode(&doc); err != nil {
-		return nil, err
+		return nil, bindError(err, "")
 	}
-	if doc.Data == nil {
+	if doc == nil || doc.Data == nil {
 		return nil, BadJSON()
 	}
 	var obj *ObjectMarshalling
 	if err := json.Unmarshal(*doc.Data, &obj); err != nil {
-		return nil, err
+		return nil, bindError(err, offendingMember(*doc.Data, &obj, "/data"))
+	}
+	if obj == nil {
+		return nil, BadJSON()
 	}
 	if obj.Attributes != nil {
 		if err := json.Unmarshal(*obj.Attributes, &attrs); err != nil {
-			return nil, err
+			pointer := offendingMember(*obj.Attributes, attrs, "/data/attributes")
+			return nil, bindError(err, pointer)
 		}
 	}
 	return obj, nil
 }
 
+// bindError returns the error for a JSON-API document that can't be bound.
+// The errors already formatted, like the one of a body too large, are kept.
+func bindError(err error, pointer string) *Error {
+	if je, ok := err.(*Error); ok {
+		return je
+	}
+	return &Error{
+		Status: http.StatusBadRequest,
+		Title:  "Bad request",
+		Detail: err.Error(),
+		Source: SourceError{
+			Pointer: pointer,
+		},
+	}
+}
+
+// offendingMember returns the JSON pointer of the member of a JSON object
+// that can't be unmarshaled in the value v, by trying its members one by
+// one. The prefix is returned when no member can be blamed, for example if
+// the raw JSON is not an object.
+func offendingMember(raw json.RawMessage, v interface{}, prefix string) string {
+	typ := reflect.TypeOf(v)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return prefix
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return prefix
+	}
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		single, err := json.Marshal(map[string]json.RawMessage{key: members[key]})
+		if err != nil {
+			continue
+		}
+		probe := reflect.New(typ.Elem()).Interface()
+		if err = json.Unmarshal(single, probe); err != nil {
+			return prefix + "/" + pointerEscaper.Replace(key)
+		}
+	}
+	return prefix
+}
+
+// pointerEscaper escapes a member name for a JSON pointer (RFC 6901)
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
 // BindRelations extracts a Relationships request ( a list of ResourceIdentifier)
 func BindRelations(req *http.Request) ([]ResourceIdentifier, error) {
 	var out []ResourceIdentifier
@@ -2,9 +2,11 @@ package jsonapi
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -142,6 +144,112 @@ func TestData(t *testing.T) {
 	assert.Equal(t, qux["id"], "qux")
 }
 
+func TestDataBulk(t *testing.T) {
+	res, err := http.Post(ts.URL+"/foos/_bulk", "application/vnd.api+json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "200 OK", res.Status, "should get a 200")
+	assert.Equal(t, "application/vnd.api+json", res.Header.Get("Content-Type"))
+	defer res.Body.Close()
+	var body map[string]interface{}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	data := body["data"].([]interface{})
+	assert.Len(t, data, 2)
+	courge := data[0].(map[string]interface{})
+	assert.Equal(t, "io.cozy.foos", courge["type"])
+	assert.Equal(t, "courge", courge["id"])
+	assert.Contains(t, courge, "attributes")
+	qux := data[1].(map[string]interface{})
+	assert.Equal(t, "qux", qux["id"])
+
+	errs := body["errors"].([]interface{})
+	assert.Len(t, errs, 1)
+	e := errs[0].(map[string]interface{})
+	assert.Equal(t, "404", e["status"])
+	assert.Equal(t, "Not Found", e["title"])
+	assert.Equal(t, map[string]interface{}{"id": "missing"}, e["meta"])
+
+	meta := body["meta"].(map[string]interface{})
+	assert.Equal(t, 3.0, meta["count"])
+}
+
+func TestCheckMediaType(t *testing.T) {
+	requests := []struct {
+		contentType string
+		accept      string
+		status      int
+	}{
+		{"", "", 200},
+		{ContentType, ContentType, 200},
+		{"application/json; charset=utf-8", "*/*", 200},
+		{ContentType + "; charset=utf-8", "", 415},
+		{"", ContentType + "; ext=bulk", 406},
+		{"", ContentType + "; ext=bulk, " + ContentType, 200},
+		{"", ContentType + "; q=0.8", 200},
+		{"", "application/json, " + ContentType + "; ext=bulk", 406},
+	}
+	for _, r := range requests {
+		req, _ := http.NewRequest("POST", ts.URL+"/foos", nil)
+		if r.contentType != "" {
+			req.Header.Set("Content-Type", r.contentType)
+		}
+		if r.accept != "" {
+			req.Header.Set("Accept", r.accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if assert.NoError(t, err) {
+			assert.Equal(t, r.status, res.StatusCode, "%s / %s", r.contentType, r.accept)
+			res.Body.Close()
+		}
+	}
+}
+
+func TestBindErrors(t *testing.T) {
+	type attributes struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+	bind := func(body string) (*attributes, error) {
+		req, _ := http.NewRequest("POST", "/foos", strings.NewReader(body))
+		var attrs attributes
+		_, err := Bind(req, &attrs)
+		return &attrs, err
+	}
+
+	attrs, err := bind(`{"data": {"type": "io.cozy.foos", "attributes": {"name": "foo", "count": 3}}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", attrs.Name)
+	assert.Equal(t, 3, attrs.Count)
+
+	// a type mismatch on an attribute
+	_, err = bind(`{"data": {"type": "io.cozy.foos", "attributes": {"name": "foo", "count": "three"}}}`)
+	if assert.IsType(t, &Error{}, err) {
+		je := err.(*Error)
+		assert.Equal(t, http.StatusBadRequest, je.Status)
+		assert.Equal(t, "/data/attributes/count", je.Source.Pointer)
+	}
+
+	// a type mismatch on a member of the resource object
+	_, err = bind(`{"data": {"type": "io.cozy.foos", "id": 42}}`)
+	if assert.IsType(t, &Error{}, err) {
+		je := err.(*Error)
+		assert.Equal(t, http.StatusBadRequest, je.Status)
+		assert.Equal(t, "/data/id", je.Source.Pointer)
+	}
+
+	// a malformed JSON document
+	_, err = bind(`{"data": `)
+	if assert.IsType(t, &Error{}, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*Error).Status)
+	}
+
+	// a missing data member
+	_, err = bind(`{"attributes": {"name": "foo"}}`)
+	assert.Equal(t, BadJSON(), err)
+	_, err = bind(`null`)
+	assert.Equal(t, BadJSON(), err)
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	router := echo.New()
@@ -149,6 +257,23 @@ func TestMain(m *testing.M) {
 		courge := &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}
 		return Data(c, 200, courge, nil)
 	})
+	router.POST("/foos/_bulk", func(c echo.Context) error {
+		return DataBulk(c, 200, []BulkResult{
+			{ID: "courge", Object: &Foo{FID: "courge", FRev: "1-abc", Bar: "baz"}},
+			{ID: "missing", Error: NotFound(errors.New("Foo not found"))},
+			{ID: "qux", Object: &Foo{FID: "qux", FRev: "2-def", Bar: "quux"}},
+		})
+	})
+	router.POST("/foos", func(c echo.Context) error {
+		return c.NoContent(200)
+	}, CheckMediaType)
+	router.HTTPErrorHandler = func(err error, c echo.Context) {
+		if je, ok := err.(*Error); ok {
+			DataError(c, je)
+			return
+		}
+		router.DefaultHTTPErrorHandler(err, c)
+	}
 	ts = httptest.NewServer(router)
 	defer ts.Close()
 	os.Exit(m.Run())
@@ -0,0 +1,54 @@
+package jsonapi
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// CheckMediaType is an echo middleware that enforces the content negotiation
+// rules of JSON-API for the requests with the JSON-API media type: a
+// Content-Type with media type parameters is rejected with a 415 error, and
+// an Accept header where all the instances of the JSON-API media type have
+// parameters is rejected with a 406 error. The requests with other media
+// types, like the content of a file, are not checked.
+// See http://jsonapi.org/format/#content-negotiation-servers
+func CheckMediaType(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		header := c.Request().Header
+		if contentType := header.Get("Content-Type"); contentType != "" {
+			mediaType, params, err := mime.ParseMediaType(contentType)
+			if err == nil && mediaType == ContentType && len(params) > 0 {
+				return NewError(http.StatusUnsupportedMediaType,
+					fmt.Sprintf("The media type %s must be used without parameters", ContentType))
+			}
+		}
+		if !acceptable(header.Get("Accept")) {
+			return NewError(http.StatusNotAcceptable,
+				fmt.Sprintf("The media type %s is only accepted with parameters", ContentType))
+		}
+		return next(c)
+	}
+}
+
+// acceptable returns false if the Accept header contains the JSON-API media
+// type and all its instances are modified with media type parameters. The
+// quality factor is not a media type parameter.
+func acceptable(accept string) bool {
+	found := false
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil || mediaType != ContentType {
+			continue
+		}
+		delete(params, "q")
+		if len(params) == 0 {
+			return true
+		}
+		found = true
+	}
+	return !found
+}
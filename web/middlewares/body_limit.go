@@ -0,0 +1,84 @@
+package middlewares
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/labstack/echo"
+)
+
+// limitedBody is the body of a request that fails with a 413 error when more
+// than limit bytes are read from it, or on the first read if the
+// Content-Length header is already over the limit.
+type limitedBody struct {
+	orig     io.ReadCloser
+	limit    int64
+	declared int64
+	read     int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.limit || b.declared > b.limit {
+		b.exceeded = true
+		return 0, errBodyTooLarge(b.limit)
+	}
+	if max := b.limit - b.read + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := b.orig.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		b.exceeded = true
+		return n - int(b.read-b.limit), errBodyTooLarge(b.limit)
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.orig.Close()
+}
+
+func errBodyTooLarge(limit int64) *jsonapi.Error {
+	return jsonapi.NewError(http.StatusRequestEntityTooLarge,
+		"The body of the request exceeds the limit of ", limit, " bytes")
+}
+
+// BodyLimit is an echo middleware that rejects the requests with a body
+// larger than limit bytes with a 413 error. The body is wrapped so that the
+// Content-Length header is checked before anything is read, like when the
+// body is bound, and the chunked requests fail when they go past the limit.
+//
+// The check is done on read, so that it can be used again on a route to
+// replace the limit of its group, like for the uploads of files. No limit is
+// applied when limit is zero. As the handlers can wrap the error of the read,
+// like echo does when binding a body, the error of a handler that went past
+// the limit is replaced by the 413 error.
+func BodyLimit(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if req.Body == nil {
+				return next(c)
+			}
+			if lb, ok := req.Body.(*limitedBody); ok {
+				req.Body = lb.orig
+			}
+			if limit <= 0 {
+				return next(c)
+			}
+			lb := &limitedBody{
+				orig:     req.Body,
+				limit:    limit,
+				declared: req.ContentLength,
+			}
+			req.Body = lb
+			err := next(c)
+			if err != nil && lb.exceeded {
+				return errBodyTooLarge(limit)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package middlewares
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func bindHandler(c echo.Context) error {
+	var attrs map[string]interface{}
+	if _, err := jsonapi.Bind(c.Request(), &attrs); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func echoBindHandler(c echo.Context) error {
+	// echo only binds the bodies of the plain JSON requests
+	c.Request().Header.Set("Content-Type", "application/json")
+	var attrs map[string]interface{}
+	if err := c.Bind(&attrs); err != nil {
+		return jsonapi.NewError(http.StatusBadRequest, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func readAllHandler(c echo.Context) error {
+	if _, err := ioutil.ReadAll(c.Request().Body); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func jsonBody(size int) string {
+	return `{"data": {"type": "io.cozy.foos", "attributes": {"text": "` +
+		strings.Repeat("a", size) + `"}}}`
+}
+
+func bodyLimitStatus(t *testing.T, mws []echo.MiddlewareFunc, h echo.HandlerFunc, body string, chunked bool) int {
+	e := echo.New()
+	req, _ := http.NewRequest(echo.POST, "http://cozy.local/foos", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	if chunked {
+		req.ContentLength = -1
+	}
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	if err := h(c); err != nil {
+		if je, ok := err.(*jsonapi.Error); ok {
+			return je.Status
+		}
+		return http.StatusInternalServerError
+	}
+	return rec.Code
+}
+
+func TestBodyLimit(t *testing.T) {
+	limit := []echo.MiddlewareFunc{BodyLimit(1000)}
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, limit, bindHandler, jsonBody(10), false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyLimitStatus(t, limit, bindHandler, jsonBody(2000), false))
+
+	// without a Content-Length, the body is checked while it is read
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, limit, bindHandler, jsonBody(10), true))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyLimitStatus(t, limit, bindHandler, jsonBody(2000), true))
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, limit, readAllHandler, strings.Repeat("a", 1000), true))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyLimitStatus(t, limit, readAllHandler, strings.Repeat("a", 1001), true))
+
+	// the error of the read is kept when it is wrapped by the handler
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, limit, echoBindHandler, jsonBody(10), false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyLimitStatus(t, limit, echoBindHandler, jsonBody(2000), false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyLimitStatus(t, limit, echoBindHandler, jsonBody(2000), true))
+
+	// a route can raise the limit of its group, or remove it
+	raised := []echo.MiddlewareFunc{BodyLimit(1000), BodyLimit(5000)}
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, raised, readAllHandler, strings.Repeat("a", 4000), true))
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, raised, readAllHandler, strings.Repeat("a", 4000), false))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, bodyLimitStatus(t, raised, readAllHandler, strings.Repeat("a", 6000), true))
+	unlimited := []echo.MiddlewareFunc{BodyLimit(1000), BodyLimit(0)}
+	assert.Equal(t, http.StatusNoContent, bodyLimitStatus(t, unlimited, readAllHandler, strings.Repeat("a", 10000), false))
+}
@@ -0,0 +1,35 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// CancelOnClose is an echo middleware that cancels the context of the request
+// when the client closes its connection. Before Go 1.8, net/http does not
+// cancel this context on disconnection, so the http.CloseNotifier of the
+// response writer is used for that. The handlers can then rely on the context
+// of the request to stop their work, like the uploads and downloads of files.
+func CancelOnClose(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cn, ok := c.Response().Writer.(http.CloseNotifier)
+		if !ok {
+			return next(c)
+		}
+		req := c.Request()
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		closed := cn.CloseNotify()
+		go func() {
+			select {
+			case <-closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		c.SetRequest(req.WithContext(ctx))
+		return next(c)
+	}
+}
@@ -0,0 +1,52 @@
+package middlewares
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+	closed chan bool
+}
+
+func (r *closeNotifyRecorder) CloseNotify() <-chan bool {
+	return r.closed
+}
+
+func TestCancelOnClose(t *testing.T) {
+	e := echo.New()
+	req, _ := http.NewRequest(echo.GET, "http://cozy.local/files/download", nil)
+	rec := &closeNotifyRecorder{httptest.NewRecorder(), make(chan bool, 1)}
+	c := e.NewContext(req, rec)
+
+	h := CancelOnClose(func(c echo.Context) error {
+		ctx := c.Request().Context()
+		assert.NoError(t, ctx.Err())
+		rec.closed <- true
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("the context of the request has not been canceled")
+		}
+		return c.NoContent(http.StatusNoContent)
+	})
+	assert.NoError(t, h(c))
+}
+
+func TestCancelOnCloseWithoutNotifier(t *testing.T) {
+	e := echo.New()
+	req, _ := http.NewRequest(echo.GET, "http://cozy.local/files/download", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	h := CancelOnClose(func(c echo.Context) error {
+		assert.NoError(t, c.Request().Context().Err())
+		return c.NoContent(http.StatusNoContent)
+	})
+	assert.NoError(t, h(c))
+}
@@ -61,6 +61,11 @@ func CORS(next echo.HandlerFunc) echo.HandlerFunc {
 
 		res.Header().Set(echo.HeaderAccessControlMaxAge, maxAge)
 
+		// the routes with an OPTIONS handler can add their own headers, like
+		// Allow
+		if hasOptionsRoute(c) {
+			return next(c)
+		}
 		return c.NoContent(http.StatusNoContent)
 	}
 }
@@ -31,3 +31,21 @@ func TestCORSMiddlewareNotAuth(t *testing.T) {
 	h(c)
 	assert.Equal(t, "", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
 }
+
+func TestCORSMiddlewareOptionsRoute(t *testing.T) {
+	e := echo.New()
+	e.Use(CORS)
+	e.OPTIONS("/files/:file-id", Options)
+	e.GET("/files/:file-id", echo.NotFoundHandler)
+	e.POST("/files/:dir-id", echo.NotFoundHandler)
+	e.DELETE("/files/:file-id", echo.NotFoundHandler)
+	e.GET("/files/:file-id/path", echo.NotFoundHandler)
+
+	req, _ := http.NewRequest(echo.OPTIONS, "http://cozy.local/files/123", nil)
+	req.Header.Set("Origin", "fakecozy.local")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "fakecozy.local", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "DELETE, GET, OPTIONS, POST", rec.Header().Get(echo.HeaderAllow))
+}
@@ -1,6 +1,7 @@
 package middlewares
 
 import (
+	"net"
 	"strings"
 
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -33,3 +34,49 @@ func SplitHost(host string) (instanceHost, appSlug string) {
 	}
 	return parts[0], ""
 }
+
+// ClientIP returns the IP address of the client of a request. It is the
+// remote address of the connection, except when it is a trusted proxy of the
+// configuration: the address is then the last one of the X-Forwarded-For
+// header that is not a trusted proxy, or the X-Real-IP header.
+func ClientIP(c echo.Context) string {
+	req := c.Request()
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	if forwarded := req.Header.Get(echo.HeaderXForwardedFor); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop == "" {
+				continue
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := req.Header.Get(echo.HeaderXRealIP); realIP != "" {
+		return strings.TrimSpace(realIP)
+	}
+	return ip
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range config.GetConfig().TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
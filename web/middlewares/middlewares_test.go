@@ -1,9 +1,13 @@
 package middlewares
 
 import (
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/labstack/echo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,3 +31,39 @@ func TestSplitHost(t *testing.T) {
 	assert.Equal(t, "joe.example.net", host)
 	assert.Equal(t, "calendar", app)
 }
+
+func TestClientIP(t *testing.T) {
+	config.UseTestFile()
+	cfg := config.GetConfig()
+	was := cfg.TrustedProxies
+	defer func() { cfg.TrustedProxies = was }()
+
+	clientIP := func(remote string, headers map[string]string) string {
+		req, _ := http.NewRequest("GET", "http://cozy.local/", nil)
+		req.RemoteAddr = remote
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		return ClientIP(c)
+	}
+	forwarded := map[string]string{echo.HeaderXForwardedFor: "203.0.113.7, 10.0.0.2"}
+	realIP := map[string]string{echo.HeaderXRealIP: "203.0.113.8"}
+
+	// without trusted proxies, the headers are ignored
+	cfg.TrustedProxies = nil
+	assert.Equal(t, "198.51.100.1", clientIP("198.51.100.1:4321", nil))
+	assert.Equal(t, "198.51.100.1", clientIP("198.51.100.1:4321", forwarded))
+	assert.Equal(t, "198.51.100.1", clientIP("198.51.100.1:4321", realIP))
+
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/24")
+	cfg.TrustedProxies = []*net.IPNet{proxies}
+	assert.Equal(t, "198.51.100.1", clientIP("198.51.100.1:4321", forwarded))
+	assert.Equal(t, "203.0.113.7", clientIP("10.0.0.1:4321", forwarded))
+	assert.Equal(t, "203.0.113.8", clientIP("10.0.0.1:4321", realIP))
+	assert.Equal(t, "10.0.0.1", clientIP("10.0.0.1:4321", nil))
+
+	// the addresses added by the client before the proxies are not trusted
+	spoofed := map[string]string{echo.HeaderXForwardedFor: "127.0.0.1, 203.0.113.7, 10.0.0.2"}
+	assert.Equal(t, "203.0.113.7", clientIP("10.0.0.1:4321", spoofed))
+}
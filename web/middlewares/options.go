@@ -0,0 +1,64 @@
+package middlewares
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// RouteMethods returns the sorted list of the HTTP methods of the routes
+// registered on the router for the given path. The names of the parameters
+// are ignored: /files/:file-id and /files/:dir-id are the same path for the
+// router.
+func RouteMethods(e *echo.Echo, path string) []string {
+	pattern := routePattern(path)
+	seen := make(map[string]bool)
+	var methods []string
+	for _, r := range e.Routes() {
+		if seen[r.Method] || routePattern(r.Path) != pattern {
+			continue
+		}
+		seen[r.Method] = true
+		methods = append(methods, r.Method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// routePattern returns the path of a route without the names of its
+// parameters.
+func routePattern(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = ":"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// AllowMethods responds to an OPTIONS request with an Allow header listing
+// the given methods.
+func AllowMethods(c echo.Context, methods []string) error {
+	c.Response().Header().Set(echo.HeaderAllow, strings.Join(methods, ", "))
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Options is a handler for the OPTIONS requests: the Allow header of the
+// response lists the methods of the routes registered for the same path.
+func Options(c echo.Context) error {
+	return AllowMethods(c, RouteMethods(c.Echo(), c.Path()))
+}
+
+// hasOptionsRoute returns true if an OPTIONS handler is registered for the
+// path of the request.
+func hasOptionsRoute(c echo.Context) bool {
+	for _, method := range RouteMethods(c.Echo(), c.Path()) {
+		if method == echo.OPTIONS {
+			return true
+		}
+	}
+	return false
+}
@@ -6,12 +6,16 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/labstack/echo"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
@@ -28,18 +32,38 @@ var (
 )
 
 // keyPicker choose the proper instance key depending on token audience
-func keyPicker(i *instance.Instance) jwt.Keyfunc {
+func keyPicker(i *instance.Instance, oauthSecret []byte) jwt.Keyfunc {
 	return func(token *jwt.Token) (interface{}, error) {
 		switch token.Claims.(*permissions.Claims).Audience {
-		case permissions.AppAudience:
+		case permissions.AppAudience, permissions.ShareAudience:
 			return i.SessionSecret, nil
 		case permissions.RefreshTokenAudience, permissions.AccessTokenAudience:
-			return i.OAuthSecret, nil
+			return oauthSecret, nil
 		}
 		return nil, permissions.ErrInvalidAudience
 	}
 }
 
+// parseJWT parses a token of the instance. After a rotation of the OAuth
+// secret, the OAuth tokens signed with a previous secret that has not
+// expired are still accepted.
+func parseJWT(i *instance.Instance, token string, claims *permissions.Claims) error {
+	var err error
+	for _, secret := range i.OAuthSecrets() {
+		*claims = permissions.Claims{}
+		err = crypto.ParseJWT(token, keyPicker(i, secret), claims)
+		if !isSignatureInvalid(err) || !isOAuthAudience(claims.Audience) {
+			return err
+		}
+	}
+	return err
+}
+
+func isOAuthAudience(audience string) bool {
+	return audience == permissions.RefreshTokenAudience ||
+		audience == permissions.AccessTokenAudience
+}
+
 const bearerAuthScheme = "Bearer "
 
 // ErrNoToken is returned whe the request has no token
@@ -65,6 +89,12 @@ func getQueryToken(c echo.Context) string {
 	return c.QueryParam("bearer_token")
 }
 
+// HasToken returns true if the request carries a token, either in the
+// Authorization header or in the query string
+func HasToken(c echo.Context) bool {
+	return getBearerToken(c) != "" || getQueryToken(c) != ""
+}
+
 // ContextPermissionSet is the key used in echo context to store permissions set
 const ContextPermissionSet = "permissions_set"
 
@@ -91,9 +121,9 @@ func extractJWTClaims(c echo.Context, instance *instance.Instance) (*permissions
 	var claims permissions.Claims
 	var err error
 	if token := getBearerToken(c); token != "" {
-		err = crypto.ParseJWT(token, keyPicker(instance), &claims)
+		err = parseJWT(instance, token, &claims)
 	} else if token := getQueryToken(c); token != "" {
-		err = crypto.ParseJWT(token, keyPicker(instance), &claims)
+		err = parseJWT(instance, token, &claims)
 	} else {
 		return nil, ErrNoToken
 	}
@@ -103,9 +133,58 @@ func extractJWTClaims(c echo.Context, instance *instance.Instance) (*permissions
 		return nil, permissions.ErrInvalidToken
 	}
 
+	if claims.Audience == permissions.ShareAudience && isExpired(err) {
+		return nil, permissions.ErrExpiredToken
+	}
+
 	return &claims, err
 }
 
+func isExpired(err error) bool {
+	verr, ok := err.(*jwt.ValidationError)
+	return ok && verr.Errors&jwt.ValidationErrorExpired != 0
+}
+
+func isSignatureInvalid(err error) bool {
+	verr, ok := err.(*jwt.ValidationError)
+	return ok && verr.Errors&jwt.ValidationErrorSignatureInvalid != 0
+}
+
+// GetClaims returns the claims of the token used for the request, or nil if
+// the request has no token
+func GetClaims(c echo.Context) *permissions.Claims {
+	claims, ok := c.Get(ContextClaims).(*permissions.Claims)
+	if !ok {
+		return nil
+	}
+	return claims
+}
+
+// CreateShareToken creates a token for a share link giving a read-only access
+// to a single file or directory, until the given expiration date
+func CreateShareToken(i *instance.Instance, id string, exp time.Time) (string, error) {
+	rule := permissions.Rule{
+		Type:   consts.Files,
+		Verbs:  permissions.Verbs(GET),
+		Values: []string{id},
+	}
+	scope, err := rule.MarshalScopeString()
+	if err != nil {
+		return "", err
+	}
+
+	return crypto.NewJWT(i.SessionSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  permissions.ShareAudience,
+			Issuer:    i.Domain,
+			IssuedAt:  crypto.Timestamp(),
+			ExpiresAt: exp.Unix(),
+			Subject:   id,
+		},
+		Scope: scope,
+	})
+}
+
 func extractPermissionSet(c echo.Context, instance *instance.Instance, claims *permissions.Claims) (*permissions.Set, error) {
 
 	if claims == nil && hasRegisterToken(c, instance) {
@@ -130,6 +209,11 @@ func extractPermissionSet(c echo.Context, instance *instance.Instance, claims *p
 		return permissions.UnmarshalScopeString(claims.Scope)
 	}
 
+	if claims.Audience == permissions.ShareAudience {
+		// share link, the permissions are also in the JWT-encoded scope
+		return permissions.UnmarshalScopeString(claims.Scope)
+	}
+
 	return nil, fmt.Errorf("Unrecognized token audience %v", claims.Audience)
 
 }
@@ -137,15 +221,29 @@ func extractPermissionSet(c echo.Context, instance *instance.Instance, claims *p
 func extract(c echo.Context) (*permissions.Claims, *permissions.Set, error) {
 	instance := middlewares.GetInstance(c)
 
+	key := authFailuresKey(c, instance.Domain)
+	if HasToken(c) && isThrottled(key) {
+		return nil, nil, errTooManyAuthFailures
+	}
+
 	claims, err := extractJWTClaims(c, instance)
 	if err != nil && err != ErrNoToken {
+		if reason := authFailureReason(err); reason != "" {
+			recordAuthFailure(c, instance.Domain, reason)
+		}
 		return nil, nil, err
 	}
 
 	pset, err := extractPermissionSet(c, instance, claims)
 	if err != nil {
+		if reason := authFailureReason(err); claims != nil && reason != "" {
+			recordAuthFailure(c, instance.Domain, reason)
+		}
 		return nil, nil, err
 	}
+	if claims != nil {
+		resetAuthFailures(key)
+	}
 
 	c.Set(ContextClaims, claims)
 	c.Set(ContextPermissionSet, pset)
@@ -161,6 +259,9 @@ func getPermission(c echo.Context) (*permissions.Set, error) {
 	}
 
 	_, set, err := extract(c)
+	if err == permissions.ErrExpiredToken || err == errTooManyAuthFailures {
+		return nil, err
+	}
 	if err != nil {
 		return nil, echo.NewHTTPError(http.StatusUnauthorized)
 	}
@@ -168,6 +269,14 @@ func getPermission(c echo.Context) (*permissions.Set, error) {
 	return set, nil
 }
 
+// AllowAuthenticated validates that the request has a valid permission set,
+// whatever its permissions. It is used for the informations that can be read
+// by any application.
+func AllowAuthenticated(c echo.Context) error {
+	_, err := getPermission(c)
+	return err
+}
+
 // AllowWholeType validates that the context permission set can use a verb on
 // the whold doctype
 func AllowWholeType(c echo.Context, v permissions.Verb, doctype string) error {
@@ -207,6 +316,102 @@ func AllowTypeAndID(c echo.Context, v permissions.Verb, doctype, id string) erro
 	return nil
 }
 
+// ViewKeys returns the keys of the rows of a view of a design doc of the
+// doctype, given as "ddoc/view", that the context permission set allows to
+// read with the verb, or nil if it allows the whole view. It returns a 403 if
+// the set allows no row of this view.
+func ViewKeys(c echo.Context, v permissions.Verb, doctype, view string) ([]string, error) {
+	pset, err := getPermission(c)
+	if err != nil {
+		return nil, err
+	}
+	keys, ok := pset.ViewKeys(v, doctype, view)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusForbidden)
+	}
+	return keys, nil
+}
+
+// RequireScope returns a middleware that checks that the context permission
+// set allows to use the verb on the whole doctype before calling the handler.
+// It can be used on any route or group of routes. The request is rejected
+// with a 401 if it has no valid token, and with a 403 if its permissions are
+// not enough.
+func RequireScope(doctype string, v permissions.Verb) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if err := AllowWholeType(c, v, doctype); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// ScopeSelector returns the mango selector of the documents of the doctype
+// on which the context permission set allows to apply the verb, or nil if it
+// allows the whole doctype. It returns a 403 if the set allows no document of
+// this doctype.
+func ScopeSelector(c echo.Context, v permissions.Verb, doctype string) (mango.Filter, error) {
+	pset, err := getPermission(c)
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := pset.ScopeSelector(v, doctype)
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusForbidden)
+	}
+	return selector, nil
+}
+
+// AllowVFS validates a file or a directory, given by its id and path, against
+// the context permission set. A rule with the id of a directory in its values
+// also gives access to the files and directories inside it. The path of the
+// granted directory is resolved on each request, so moving a document out of
+// this directory immediately revokes the access.
+func AllowVFS(c echo.Context, v permissions.Verb, id, fullpath string) error {
+	pset, err := getPermission(c)
+	if err != nil {
+		return err
+	}
+
+	instance := middlewares.GetInstance(c)
+	allowed := pset.Some(func(r permissions.Rule) bool {
+		if r.Type != consts.Files || !r.Verbs.Contains(v) {
+			return false
+		}
+		if len(r.Values) == 0 {
+			return true
+		}
+		if r.Selector != "" {
+			return false
+		}
+		return r.SomeValue(func(dirID string) bool {
+			if dirID == id {
+				return true
+			}
+			dir, err := vfs.GetDirDoc(instance, dirID, false)
+			if err != nil {
+				return false
+			}
+			return isInsideDir(dir.Fullpath, fullpath)
+		})
+	})
+
+	if !allowed {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return nil
+}
+
+func isInsideDir(dirpath, fullpath string) bool {
+	dirpath = path.Clean(dirpath)
+	if dirpath == "/" {
+		return true
+	}
+	return strings.HasPrefix(fullpath, dirpath+"/")
+}
+
 func displayPermissions(c echo.Context) error {
 	set, err := getPermission(c)
 	if err != nil {
@@ -215,6 +420,63 @@ func displayPermissions(c echo.Context) error {
 	return c.JSON(200, set)
 }
 
+// introspection is the response of the token introspection endpoint, with
+// the fields defined by RFC 7662
+type introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+}
+
+// introspectToken returns the informations about the token given in the
+// request, if the requester is allowed to read the permissions. As specified
+// in RFC 7662, an invalid or expired token is not an error: the response
+// just says that the token is not active.
+func introspectToken(c echo.Context) error {
+	if err := AllowWholeType(c, GET, consts.Permissions); err != nil {
+		return err
+	}
+
+	instance := middlewares.GetInstance(c)
+	inactive := &introspection{Active: false}
+
+	token := c.FormValue("token")
+	if token == "" {
+		return c.JSON(http.StatusOK, inactive)
+	}
+
+	var claims permissions.Claims
+	err := parseJWT(instance, token, &claims)
+	if err != nil || claims.Issuer != instance.Domain {
+		return c.JSON(http.StatusOK, inactive)
+	}
+
+	scope := claims.Scope
+	if claims.Audience == permissions.AppAudience {
+		pdoc, err := permissions.GetForApp(instance, claims.Subject)
+		if err != nil {
+			return c.JSON(http.StatusOK, inactive)
+		}
+		if scope, err = pdoc.Permissions.MarshalScopeString(); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, &introspection{
+		Active:    true,
+		Scope:     scope,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		IssuedAt:  claims.IssuedAt,
+		ExpiresAt: claims.ExpiresAt,
+	})
+}
+
 func hasRegisterToken(c echo.Context, i *instance.Instance) bool {
 	hexToken := c.QueryParam("registerToken")
 	expectedTok := i.RegisterToken
@@ -235,4 +497,5 @@ func hasRegisterToken(c echo.Context, i *instance.Instance) bool {
 func Routes(router *echo.Group) {
 	// API Routes
 	router.GET("/self", displayPermissions)
+	router.POST("/introspect", introspectToken)
 }
@@ -5,10 +5,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/permissions"
@@ -19,6 +23,7 @@ import (
 
 var ts *httptest.Server
 var token string
+var adminToken string
 var testInstance *instance.Instance
 
 func TestMain(m *testing.M) {
@@ -39,6 +44,16 @@ func TestMain(m *testing.M) {
 		Scope: "io.cozy.contacts io.cozy.files:GET",
 	})
 
+	adminToken, _ = crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   testInstance.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "adminapp",
+		},
+		Scope: "io.cozy.permissions:GET",
+	})
+
 	handler := echo.New()
 
 	group := handler.Group("/permissions")
@@ -46,6 +61,15 @@ func TestMain(m *testing.M) {
 	group.Use(Extractor)
 	Routes(group)
 
+	scoped := handler.Group("/scoped")
+	scoped.Use(injectInstance(testInstance))
+	scoped.GET("/contacts", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	}, RequireScope("io.cozy.contacts", permissions.GET))
+	scoped.POST("/files", func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	}, RequireScope(consts.Files, permissions.POST))
+
 	ts = httptest.NewServer(handler)
 	res := m.Run()
 	ts.Close()
@@ -92,6 +116,162 @@ func TestBadPermissionsBearer(t *testing.T) {
 	assert.Equal(t, res.StatusCode, http.StatusBadRequest)
 }
 
+func TestPreviousOAuthSecrets(t *testing.T) {
+	in := &instance.Instance{
+		OAuthSecret: []byte("newsecret"),
+		PreviousOAuthSecrets: []*instance.PreviousSecret{
+			{Secret: []byte("previoussecret"), ExpiresAt: time.Now().Add(time.Hour)},
+			{Secret: []byte("expiredsecret"), ExpiresAt: time.Now().Add(-time.Hour)},
+		},
+		Domain: "example.com",
+	}
+	claims := permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   in.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "fakeapp",
+		},
+		Scope: "io.cozy.contacts",
+	}
+
+	var parsed permissions.Claims
+	current, _ := crypto.NewJWT(in.OAuthSecret, claims)
+	assert.NoError(t, parseJWT(in, current, &parsed))
+	assert.Equal(t, "fakeapp", parsed.Subject)
+
+	previous, _ := crypto.NewJWT([]byte("previoussecret"), claims)
+	assert.NoError(t, parseJWT(in, previous, &parsed))
+	assert.Equal(t, "io.cozy.contacts", parsed.Scope)
+
+	expired, _ := crypto.NewJWT([]byte("expiredsecret"), claims)
+	err := parseJWT(in, expired, &parsed)
+	assert.True(t, isSignatureInvalid(err))
+}
+
+func TestRequireScope(t *testing.T) {
+	request := func(method, path, tok string) int {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if tok != "" {
+			req.Header.Add("Authorization", "Bearer "+tok)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/scoped/contacts", ""))
+	assert.Equal(t, http.StatusNoContent, request("GET", "/scoped/contacts", token))
+	assert.Equal(t, http.StatusForbidden, request("GET", "/scoped/contacts", adminToken))
+	assert.Equal(t, http.StatusForbidden, request("POST", "/scoped/files", token))
+}
+
+func TestThrottleBadPermissionsBearer(t *testing.T) {
+	resetAuthFailures("example.com 127.0.0.1")
+	defer resetAuthFailures("example.com 127.0.0.1")
+
+	get := func(bearer string) int {
+		req, _ := http.NewRequest("GET", ts.URL+"/permissions/self", nil)
+		req.Header.Add("Authorization", "Bearer "+bearer)
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// a valid token resets the counter
+	for i := 0; i < maxAuthFailures-1; i++ {
+		assert.Equal(t, http.StatusBadRequest, get("garbage"))
+	}
+	assert.Equal(t, http.StatusOK, get(token))
+
+	for i := 0; i < maxAuthFailures; i++ {
+		assert.Equal(t, http.StatusBadRequest, get("garbage"))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, get("garbage"))
+	assert.Equal(t, http.StatusTooManyRequests, get(token))
+
+	// until the delay has passed
+	authFailuresDelay = 10 * time.Millisecond
+	defer func() { authFailuresDelay = 1 * time.Minute }()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, get(token))
+}
+
+func TestAuthFailureReason(t *testing.T) {
+	assert.Equal(t, "expired", authFailureReason(permissions.ErrExpiredToken))
+	assert.Equal(t, "invalid token", authFailureReason(permissions.ErrInvalidToken))
+
+	var claims permissions.Claims
+	expired, _ := crypto.NewJWT([]byte("topsecret"), permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  permissions.AccessTokenAudience,
+			ExpiresAt: crypto.Timestamp() - 60,
+		},
+	})
+	err := crypto.ParseJWT(expired, func(_ *jwt.Token) (interface{}, error) {
+		return []byte("topsecret"), nil
+	}, &claims)
+	assert.Equal(t, "expired", authFailureReason(err))
+	err = crypto.ParseJWT(expired[:len(expired)-2], func(_ *jwt.Token) (interface{}, error) {
+		return []byte("topsecret"), nil
+	}, &claims)
+	assert.Equal(t, "bad signature", authFailureReason(err))
+
+	assert.Equal(t, "", authFailureReason(ErrNoToken))
+}
+
+func introspect(t *testing.T, bearer, tok string) (*http.Response, map[string]interface{}) {
+	form := url.Values{"token": {tok}}
+	req, _ := http.NewRequest("POST", ts.URL+"/permissions/introspect", strings.NewReader(form.Encode()))
+	req.Header.Add("Authorization", "Bearer "+bearer)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return nil, nil
+	}
+	defer res.Body.Close()
+	var out map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&out)
+	assert.NoError(t, err)
+	return res, out
+}
+
+func TestIntrospectActiveToken(t *testing.T) {
+	res, out := introspect(t, adminToken, token)
+	if res == nil {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, true, out["active"])
+	assert.Equal(t, "io.cozy.contacts io.cozy.files:GET", out["scope"])
+	assert.Equal(t, "fakeapp", out["sub"])
+	assert.Equal(t, permissions.AccessTokenAudience, out["aud"])
+	assert.Equal(t, "example.com", out["iss"])
+}
+
+func TestIntrospectGarbageToken(t *testing.T) {
+	res, out := introspect(t, adminToken, "garbage")
+	if res == nil {
+		return
+	}
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]interface{}{"active": false}, out)
+}
+
+func TestIntrospectWithoutPermission(t *testing.T) {
+	res, _ := introspect(t, token, adminToken)
+	if res == nil {
+		return
+	}
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
 func injectInstance(i *instance.Instance) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
@@ -0,0 +1,122 @@
+package permissions
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/labstack/echo"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The failed validations of the tokens are counted by instance and IP
+// address. After maxAuthFailures failures, the next requests with a token
+// from this address are rejected for authFailuresDelay. A valid token resets
+// the counter.
+var (
+	maxAuthFailures   = 10
+	authFailuresDelay = 1 * time.Minute
+)
+
+// maxAuthFailuresKeys is the number of counters above which the expired ones
+// are removed
+const maxAuthFailuresKeys = 10000
+
+// errTooManyAuthFailures is returned for the requests with a token from an
+// address that has sent too many invalid tokens
+var errTooManyAuthFailures = echo.NewHTTPError(http.StatusTooManyRequests,
+	"Too many invalid tokens, retry later")
+
+type authFailures struct {
+	count int
+	last  time.Time
+}
+
+var (
+	authFailuresMu   sync.Mutex
+	authFailuresByIP = make(map[string]*authFailures)
+)
+
+func authFailuresKey(c echo.Context, domain string) string {
+	return domain + " " + middlewares.ClientIP(c)
+}
+
+// isThrottled returns true if too many invalid tokens have been sent
+// recently for this key
+func isThrottled(key string) bool {
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+	f, ok := authFailuresByIP[key]
+	if !ok {
+		return false
+	}
+	if time.Since(f.last) > authFailuresDelay {
+		delete(authFailuresByIP, key)
+		return false
+	}
+	return f.count >= maxAuthFailures
+}
+
+// recordAuthFailure increments the counter of the failures for this key, and
+// writes the failure in the logs for the audit, with its reason
+func recordAuthFailure(c echo.Context, domain, reason string) {
+	log.Warnf("[permissions] %s: invalid token from %s (%s)", domain, middlewares.ClientIP(c), reason)
+
+	key := authFailuresKey(c, domain)
+	now := time.Now()
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+	if len(authFailuresByIP) > maxAuthFailuresKeys {
+		for k, f := range authFailuresByIP {
+			if now.Sub(f.last) > authFailuresDelay {
+				delete(authFailuresByIP, k)
+			}
+		}
+	}
+	f, ok := authFailuresByIP[key]
+	if !ok || now.Sub(f.last) > authFailuresDelay {
+		f = &authFailures{}
+		authFailuresByIP[key] = f
+	}
+	f.count++
+	f.last = now
+}
+
+// resetAuthFailures forgets the failures for this key, after a valid token
+func resetAuthFailures(key string) {
+	authFailuresMu.Lock()
+	defer authFailuresMu.Unlock()
+	delete(authFailuresByIP, key)
+}
+
+// authFailureReason returns the reason of the failed validation of a token,
+// or an empty string if the error is not caused by the token.
+func authFailureReason(err error) string {
+	switch err {
+	case permissions.ErrExpiredToken:
+		return "expired"
+	case permissions.ErrInvalidToken:
+		return "invalid token"
+	case permissions.ErrInvalidAudience:
+		return "invalid audience"
+	}
+	if verr, ok := err.(*jwt.ValidationError); ok {
+		switch {
+		case verr.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+			return "bad signature"
+		case verr.Errors&jwt.ValidationErrorExpired != 0:
+			return "expired"
+		case verr.Inner == permissions.ErrInvalidAudience:
+			return "invalid audience"
+		}
+		return "invalid token"
+	}
+	if couchdb.IsNotFoundError(err) {
+		return "revoked"
+	}
+	return ""
+}
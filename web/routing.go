@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/i18n"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web/apps"
 	"github.com/cozy/cozy-stack/web/auth"
@@ -25,6 +26,7 @@ import (
 	_ "github.com/cozy/cozy-stack/web/statik" // Generated file with the packed assets
 	"github.com/cozy/cozy-stack/web/status"
 	"github.com/cozy/cozy-stack/web/version"
+	"github.com/cozy/cozy-stack/web/webhooks"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/rakyll/statik/fs"
@@ -97,6 +99,20 @@ func newRenderer(assetsPath string) (*renderer, error) {
 	return r, nil
 }
 
+// loadLocales registers the strings of the locales, from the locales
+// directory of the assets.
+func loadLocales(assetsPath string) error {
+	// By default, use the assets packed in the binary
+	if assetsPath != "" {
+		return i18n.LoadLocales(http.Dir(assetsPath), "/locales")
+	}
+	statikFS, err := fs.New()
+	if err != nil {
+		return err
+	}
+	return i18n.LoadLocales(statikFS, "/locales")
+}
+
 // SetupAppsHandler adds all the necessary middlewares for the application
 // handler.
 func SetupAppsHandler(appsHandler echo.HandlerFunc) echo.HandlerFunc {
@@ -111,12 +127,15 @@ func SetupAppsHandler(appsHandler echo.HandlerFunc) echo.HandlerFunc {
 }
 
 // SetupAssets add assets routing and handling to the given router. It also
-// adds a Renderer to render templates.
+// adds a Renderer to render templates, and loads the locales.
 func SetupAssets(router *echo.Echo, assetsPath string) error {
 	r, err := newRenderer(assetsPath)
 	if err != nil {
 		return err
 	}
+	if err = loadLocales(assetsPath); err != nil {
+		return err
+	}
 
 	router.Renderer = r
 	router.GET("/assets/*", echo.WrapHandler(http.StripPrefix("/assets/", r.h)))
@@ -133,7 +152,9 @@ func SetupRoutes(router *echo.Echo) error {
 		XFrameOptions: middlewares.XFrameDeny,
 	})
 
+	router.Pre(data.RewriteCopyMethod)
 	router.Use(secure, middlewares.CORS)
+	router.Use(middlewares.BodyLimit(config.GetConfig().BodyLimits.MaxBodySize))
 
 	mws := []echo.MiddlewareFunc{
 		middlewares.NeedInstance,
@@ -148,6 +169,7 @@ func SetupRoutes(router *echo.Echo) error {
 	settings.Routes(router.Group("/settings", mws...))
 	status.Routes(router.Group("/status"))
 	version.Routes(router.Group("/version"))
+	webhooks.Routes(router.Group("/webhooks", mws...))
 
 	setupRecover(router)
 
@@ -184,6 +206,7 @@ func CreateSubdomainProxy(router *echo.Echo, serveApps echo.HandlerFunc) (*echo.
 	serveApps = SetupAppsHandler(serveApps)
 
 	main := echo.New()
+	main.Use(middlewares.CancelOnClose)
 	main.Any("/*", func(c echo.Context) error {
 		// TODO(optim): minimize the number of instance requests
 		if parent, slug := middlewares.SplitHost(c.Request().Host); slug != "" {
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -62,6 +63,64 @@ func TestSetupRoutes(t *testing.T) {
 	assert.Equal(t, 200, res.StatusCode)
 }
 
+func TestUnknownRoutes(t *testing.T) {
+	e := echo.New()
+	err := SetupRoutes(e)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+
+	res1, err := http.Get(ts.URL + "/i/do/not/exist")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res1.Body.Close()
+	assert.Equal(t, 404, res1.StatusCode)
+	assert.Equal(t, "application/vnd.api+json", res1.Header.Get("Content-Type"))
+	var body1 map[string][]map[string]interface{}
+	if assert.NoError(t, json.NewDecoder(res1.Body).Decode(&body1)) && assert.Len(t, body1["errors"], 1) {
+		assert.Equal(t, "404", body1["errors"][0]["status"])
+		assert.Equal(t, "Not Found", body1["errors"][0]["title"])
+	}
+
+	req2, _ := http.NewRequest("DELETE", ts.URL+"/files/_changes", nil)
+	res2, err := http.DefaultClient.Do(req2)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res2.Body.Close()
+	assert.Equal(t, 405, res2.StatusCode)
+	assert.Equal(t, "GET", res2.Header.Get("Allow"))
+	assert.Equal(t, "application/vnd.api+json", res2.Header.Get("Content-Type"))
+	var body2 map[string][]map[string]interface{}
+	if assert.NoError(t, json.NewDecoder(res2.Body).Decode(&body2)) && assert.Len(t, body2["errors"], 1) {
+		assert.Equal(t, "405", body2["errors"][0]["status"])
+	}
+
+	req4, _ := http.NewRequest("PUT", ts.URL+"/files/download/some-file-id", nil)
+	res4, err := http.DefaultClient.Do(req4)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res4.Body.Close()
+	assert.Equal(t, 405, res4.StatusCode)
+	assert.Equal(t, "GET, HEAD", res4.Header.Get("Allow"))
+
+	// the browsers still get a plain text error
+	req3, _ := http.NewRequest("GET", ts.URL+"/i/do/not/exist", nil)
+	req3.Header.Set("Accept", "text/html,application/xhtml+xml")
+	res3, err := http.DefaultClient.Do(req3)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res3.Body.Close()
+	assert.Equal(t, 404, res3.StatusCode)
+	assert.Equal(t, "text/plain; charset=UTF-8", res3.Header.Get("Content-Type"))
+}
+
 func TestParseHost(t *testing.T) {
 	apis := echo.New()
 
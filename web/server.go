@@ -4,24 +4,42 @@
 package web
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/web/apps"
 	"github.com/labstack/echo"
 )
 
+// drainPollInterval is the interval used to check if the in-flight requests
+// are finished when shutting down a server
+const drainPollInterval = 50 * time.Millisecond
+
+// Servers contains the HTTP servers of the stack
+type Servers struct {
+	main  *drainingServer
+	admin *drainingServer
+	errs  chan error
+}
+
 // ListenAndServe creates and setups all the necessary http endpoints and start
-// them.
-func ListenAndServe() error {
+// them. It does not block: the Wait method can be used to wait for the
+// servers to stop.
+func ListenAndServe() (*Servers, error) {
 	main, err := CreateSubdomainProxy(echo.New(), apps.Serve)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	admin := echo.New()
 	if err = SetupAdminRoutes(admin); err != nil {
-		return err
+		return nil, err
 	}
 
 	if config.IsDevRelease() {
@@ -31,8 +49,112 @@ security features. Please do not use this binary as your production server.
 `)
 	}
 
-	errs := make(chan error)
-	go func() { errs <- admin.Start(config.AdminServerAddr()) }()
-	go func() { errs <- main.Start(config.ServerAddr()) }()
-	return <-errs
+	s := &Servers{
+		main:  newDrainingServer(config.ServerAddr(), main),
+		admin: newDrainingServer(config.AdminServerAddr(), admin),
+		errs:  make(chan error, 2),
+	}
+	go func() { s.errs <- s.admin.ListenAndServe() }()
+	go func() { s.errs <- s.main.ListenAndServe() }()
+	return s, nil
+}
+
+// Wait returns a channel on which the error of the first server to stop is
+// sent.
+func (s *Servers) Wait() <-chan error {
+	return s.errs
+}
+
+// Shutdown gracefully stops the servers: they stop accepting new connections
+// and wait for the in-flight requests to finish, until the context is done.
+func (s *Servers) Shutdown(ctx context.Context) error {
+	errm := s.main.Shutdown(ctx)
+	erra := s.admin.Shutdown(ctx)
+	if errm != nil {
+		return errm
+	}
+	return erra
+}
+
+// drainingServer is an HTTP server that keeps track of its in-flight requests,
+// to be able to wait for them on shutdown.
+type drainingServer struct {
+	srv      *http.Server
+	handler  http.Handler
+	inflight int32
+
+	mu       sync.Mutex
+	listener net.Listener
+	closing  bool
+}
+
+func newDrainingServer(addr string, handler http.Handler) *drainingServer {
+	s := &drainingServer{handler: handler}
+	s.srv = &http.Server{Addr: addr, Handler: s}
+	return s
+}
+
+func (s *drainingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&s.inflight, 1)
+	defer atomic.AddInt32(&s.inflight, -1)
+	s.handler.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on the TCP address of the server and serves the
+// requests. It returns nil when the server is shut down.
+func (s *drainingServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve serves the requests accepted on the given listener. It returns nil
+// when the server is shut down.
+func (s *drainingServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ln.Close()
+	}
+	s.listener = ln
+	s.mu.Unlock()
+
+	err := s.srv.Serve(ln)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return nil
+	}
+	return err
+}
+
+// Shutdown closes the listener of the server, so that no new connection is
+// accepted, and waits for the in-flight requests to finish, until the context
+// is done.
+func (s *drainingServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	s.srv.SetKeepAlivesEnabled(false)
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&s.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
@@ -0,0 +1,39 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+type apiFlags struct {
+	flags map[string]bool
+}
+
+func (f *apiFlags) ID() string                             { return consts.FlagsSettingsID }
+func (f *apiFlags) Rev() string                            { return "" }
+func (f *apiFlags) DocType() string                        { return consts.Settings }
+func (f *apiFlags) SetID(_ string)                         {}
+func (f *apiFlags) SetRev(_ string)                        {}
+func (f *apiFlags) Relationships() jsonapi.RelationshipMap { return nil }
+func (f *apiFlags) Included() []jsonapi.Object             { return nil }
+func (f *apiFlags) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/flags"}
+}
+func (f *apiFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.flags)
+}
+
+// The feature flags can be read by any application, without a permission on
+// the io.cozy.settings doctype
+func getFlags(c echo.Context) error {
+	if err := permissions.AllowAuthenticated(c); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, &apiFlags{config.Flags()}, nil)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
@@ -36,13 +37,10 @@ func (i *apiInstance) MarshalJSON() ([]byte, error) {
 func getInstance(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
-	doc := &couchdb.JSONDoc{}
-	err := couchdb.GetDoc(instance, consts.Settings, consts.InstanceSettingsID, doc)
+	doc, err := instance.SettingsDocument()
 	if err != nil {
 		return err
 	}
-	doc.Type = consts.Settings
-	doc.M["locale"] = instance.Locale
 
 	if err = permissions.Allow(c, permissions.GET, doc); err != nil {
 		return err
@@ -52,7 +50,7 @@ func getInstance(c echo.Context) error {
 }
 
 func updateInstance(c echo.Context) error {
-	instance := middlewares.GetInstance(c)
+	inst := middlewares.GetInstance(c)
 
 	doc := &couchdb.JSONDoc{}
 	obj, err := jsonapi.Bind(c.Request(), doc)
@@ -64,22 +62,16 @@ func updateInstance(c echo.Context) error {
 	doc.SetID(consts.InstanceSettingsID)
 	doc.SetRev(obj.Meta.Rev)
 
-	if err := permissions.Allow(c, permissions.PUT, doc); err != nil {
+	if err = permissions.Allow(c, permissions.PUT, doc); err != nil {
 		return err
 	}
 
-	if locale, ok := doc.M["locale"].(string); ok {
-		delete(doc.M, "locale")
-		instance.Locale = locale
-		if err := couchdb.UpdateDoc(couchdb.GlobalDB, instance); err != nil {
-			return err
+	if err = inst.UpdateSettings(doc); err != nil {
+		if serr, ok := err.(*instance.SettingError); ok {
+			return jsonapi.InvalidAttribute(serr.Name, serr)
 		}
-	}
-
-	if err := couchdb.UpdateDoc(instance, doc); err != nil {
 		return err
 	}
 
-	doc.M["locale"] = instance.Locale
 	return jsonapi.Data(c, http.StatusOK, &apiInstance{doc}, nil)
 }
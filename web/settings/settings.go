@@ -9,6 +9,7 @@ import "github.com/labstack/echo"
 func Routes(router *echo.Group) {
 	router.GET("/theme.css", ThemeCSS)
 	router.GET("/disk-usage", diskUsage)
+	router.GET("/flags", getFlags)
 
 	router.POST("/passphrase", registerPassphrase)
 	router.PUT("/passphrase", updatePassphrase)
@@ -10,16 +10,20 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/errors"
 	"github.com/labstack/echo"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	jwt "gopkg.in/dgrijalva/jwt-go.v3"
 )
@@ -63,6 +67,43 @@ func TestDiskUsage(t *testing.T) {
 	assert.Equal(t, "0", used)
 }
 
+func TestFlags(t *testing.T) {
+	v := viper.New()
+	v.Set("flags", map[string]interface{}{
+		"sharing":    true,
+		"thumbnails": false,
+	})
+	assert.NoError(t, config.UpdateFlags(v))
+	defer config.UpdateFlags(viper.New())
+
+	res, err := http.Get(ts.URL + "/settings/flags")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	// an app without a permission on io.cozy.settings can read the flags
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/settings/flags", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+testClientsToken(testInstance))
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data, ok := result["data"].(map[string]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, "io.cozy.settings", data["type"])
+	assert.Equal(t, "io.cozy.settings.flags", data["id"])
+	attrs, ok := data["attributes"].(map[string]interface{})
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, true, attrs["sharing"])
+	assert.Equal(t, false, attrs["thumbnails"])
+}
+
 func TestRegisterPassphraseWrongToken(t *testing.T) {
 	args, _ := json.Marshal(&echo.Map{
 		"passphrase":     "MyFirstPassphrase",
@@ -227,6 +268,74 @@ func TestUpdateInstance(t *testing.T) {
 	checkResult(res)
 }
 
+func TestInstanceSettings(t *testing.T) {
+	// the values given on the creation, or updated by TestUpdateInstance
+	settings, err := testInstance.Settings()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "fr", settings.Locale)
+	assert.Equal(t, "Europe/London", settings.Timezone)
+	assert.Equal(t, "alice@example.org", settings.Email)
+	assert.Equal(t, int64(0), settings.DiskQuota)
+
+	doc, err := testInstance.SettingsDocument()
+	if !assert.NoError(t, err) {
+		return
+	}
+	putSettings := func(attrs string) *http.Response {
+		body := `{
+			"data": {
+				"type": "io.cozy.settings",
+				"id": "io.cozy.settings.instance",
+				"meta": { "rev": "` + doc.Rev() + `" },
+				"attributes": ` + attrs + `
+			}
+		}`
+		req, _ := http.NewRequest("PUT", ts.URL+"/settings/instance", bytes.NewBufferString(body))
+		req.Header.Add("Content-Type", "application/vnd.api+json")
+		req.Header.Add("Accept", "application/vnd.api+json")
+		req.Header.Add("Authorization", "Bearer "+testToken(testInstance))
+		res, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := putSettings(`{"email": "alice@example.org", "disk_quota": "big"}`)
+	assert.Equal(t, 422, res.StatusCode)
+	res = putSettings(`{"email": "alice@example.org", "tz": 42}`)
+	assert.Equal(t, 422, res.StatusCode)
+
+	res = putSettings(`{"email": "alice@example.org", "tz": "Europe/London", "disk_quota": 1024}`)
+	if !assert.Equal(t, 200, res.StatusCode) {
+		return
+	}
+	defer func() {
+		testInstance.BytesDiskQuota = 0
+		couchdb.UpdateDoc(couchdb.GlobalDB, testInstance)
+	}()
+
+	// the next requests use the new quota
+	inst, err := instance.Get(domain)
+	if !assert.NoError(t, err) {
+		return
+	}
+	settings, err = inst.Settings()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1024), settings.DiskQuota)
+	}
+	fileDoc, err := vfs.NewFileDoc("too-big", consts.RootDirID, 2048, nil,
+		"application/octet-stream", "application", time.Now(), false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = vfs.CreateFile(inst, fileDoc, nil)
+	assert.Equal(t, vfs.ErrFileTooBig, err)
+}
+
 func TestListClients(t *testing.T) {
 	res, err := http.Get(ts.URL + "/settings/clients")
 	assert.NoError(t, err)
@@ -0,0 +1,122 @@
+// Package webhooks is the HTTP API to register the URLs notified of the
+// changes made on the documents of a doctype.
+package webhooks
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	_ "github.com/cozy/cozy-stack/pkg/jobs/workers" // import the webhook worker
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/webhooks"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/labstack/echo"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type apiWebhookRequest struct {
+	URL      string                 `json:"url"`
+	DocType  string                 `json:"doctype"`
+	Selector map[string]interface{} `json:"selector"`
+}
+
+// registerWebhook creates a new webhook. The application must be able to
+// read the documents of the watched doctype.
+func registerWebhook(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	req := &apiWebhookRequest{}
+	if _, err := jsonapi.Bind(c.Request(), &req); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+
+	if err := permissions.AllowWholeType(c, pkgperm.POST, consts.Webhooks); err != nil {
+		return err
+	}
+	if req.DocType != "" {
+		if err := permissions.AllowWholeType(c, pkgperm.GET, req.DocType); err != nil {
+			return err
+		}
+	}
+
+	w, err := webhooks.Register(instance, req.URL, req.DocType, req.Selector)
+	if err != nil {
+		return wrapWebhooksError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, w, nil)
+}
+
+// listWebhooks returns a page of the webhooks, without their secrets. The
+// limit and bookmark parameters of the query-string can be used to go
+// through the pages.
+func listWebhooks(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	if err := permissions.AllowWholeType(c, pkgperm.GET, consts.Webhooks); err != nil {
+		return err
+	}
+
+	limit := defaultListLimit
+	if param := c.QueryParam("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			return jsonapi.InvalidParameter("limit", errors.New("Invalid limit"))
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	hooks, next, err := webhooks.ListPage(instance, c.QueryParam("bookmark"), limit)
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(hooks))
+	for i, w := range hooks {
+		objs[i] = w
+	}
+	var links *jsonapi.LinksList
+	if next != "" {
+		query := url.Values{"bookmark": {next}, "limit": {strconv.Itoa(limit)}}
+		links = &jsonapi.LinksList{Next: "/webhooks?" + query.Encode()}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func deleteWebhook(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	id := c.Param("webhook-id")
+	if err := permissions.AllowTypeAndID(c, pkgperm.DELETE, consts.Webhooks, id); err != nil {
+		return err
+	}
+
+	if err := webhooks.Delete(instance, id); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Routes sets the routing for the webhooks service
+func Routes(router *echo.Group) {
+	router.GET("", listWebhooks)
+	router.POST("", registerWebhook)
+	router.DELETE("/:webhook-id", deleteWebhook)
+}
+
+func wrapWebhooksError(err error) error {
+	switch err {
+	case webhooks.ErrInvalidURL, webhooks.ErrForbiddenURL:
+		return jsonapi.InvalidAttribute("url", err)
+	case webhooks.ErrMissingDocType:
+		return jsonapi.InvalidAttribute("doctype", err)
+	}
+	return err
+}
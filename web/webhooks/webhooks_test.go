@@ -0,0 +1,316 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/webhooks"
+	"github.com/cozy/cozy-stack/web/errors"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+const domain = "cozywebhooks.example.net"
+const eventsType = "io.cozy.events"
+
+var ts *httptest.Server
+var testInstance *instance.Instance
+var token string
+
+type received struct {
+	body      []byte
+	signature string
+}
+
+func registerRequest(attrs map[string]interface{}) (*http.Response, map[string]interface{}, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{"attributes": attrs},
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/webhooks", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/vnd.api+json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	var out map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&out)
+	return res, out, err
+}
+
+func TestRegisterInvalidWebhook(t *testing.T) {
+	res, _, err := registerRequest(map[string]interface{}{
+		"url":     "ftp://example.net/hook",
+		"doctype": eventsType,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 422, res.StatusCode)
+
+	res, _, err = registerRequest(map[string]interface{}{
+		"url":     "https://example.net/hook",
+		"doctype": "io.cozy.notallowed",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+}
+
+func TestRegisterLocalWebhook(t *testing.T) {
+	webhooks.AllowLocalURLs = false
+	defer func() { webhooks.AllowLocalURLs = true }()
+
+	admin := fmt.Sprintf("https://example.net:%d/hook", config.GetConfig().AdminPort)
+	for _, u := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://[::1]/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/hook",
+		"https://192.168.0.1/hook",
+		admin,
+	} {
+		res, _, err := registerRequest(map[string]interface{}{
+			"url":     u,
+			"doctype": eventsType,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 422, res.StatusCode, u)
+	}
+
+	// the address is checked again when the request is sent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("The local receiver has been called")
+	}))
+	defer receiver.Close()
+	w := &webhooks.Webhook{URL: receiver.URL + "/hook", Secret: "secret"}
+	err := w.Send(context.Background(), &webhooks.Payload{DocType: eventsType})
+	assert.Error(t, err)
+}
+
+func TestWebhookIsCalledOnMatchingChange(t *testing.T) {
+	calls := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		calls <- received{body, r.Header.Get(webhooks.SignatureHeader)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	err := couchdb.ResetDB(testInstance, eventsType)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, out, err := registerRequest(map[string]interface{}{
+		"url":      receiver.URL + "/hook",
+		"doctype":  eventsType,
+		"selector": map[string]interface{}{"kind": "meeting"},
+	})
+	if !assert.NoError(t, err) || !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	data := out["data"].(map[string]interface{})
+	attrs := data["attributes"].(map[string]interface{})
+	secret := attrs["secret"].(string)
+	assert.NotEmpty(t, secret)
+
+	other := couchdb.JSONDoc{Type: eventsType, M: map[string]interface{}{"kind": "birthday"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, other))
+	meeting := couchdb.JSONDoc{Type: eventsType, M: map[string]interface{}{"kind": "meeting"}}
+	assert.NoError(t, couchdb.CreateDoc(testInstance, meeting))
+
+	err = webhooks.Poll(testInstance, testInstance.JobsBroker())
+	assert.NoError(t, err)
+
+	select {
+	case call := <-calls:
+		assert.Equal(t, webhooks.Sign([]byte(secret), call.body), call.signature)
+		var payload webhooks.Payload
+		assert.NoError(t, json.Unmarshal(call.body, &payload))
+		assert.Equal(t, eventsType, payload.DocType)
+		assert.Equal(t, meeting.ID(), payload.DocID)
+		assert.Equal(t, meeting.Rev(), payload.DocRev)
+	case <-time.After(10 * time.Second):
+		t.Fatal("The webhook has not been called")
+	}
+	select {
+	case call := <-calls:
+		assert.NotContains(t, string(call.body), other.ID())
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestListAndDeleteWebhooks(t *testing.T) {
+	res, out, err := registerRequest(map[string]interface{}{
+		"url":     "https://example.net/hook",
+		"doctype": eventsType,
+	})
+	if !assert.NoError(t, err) || !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	id := out["data"].(map[string]interface{})["id"].(string)
+	secret := out["data"].(map[string]interface{})["attributes"].(map[string]interface{})["secret"].(string)
+	res, _, err = registerRequest(map[string]interface{}{
+		"url":     "https://example.net/other-hook",
+		"doctype": eventsType,
+	})
+	if !assert.NoError(t, err) || !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+
+	req, _ := http.NewRequest("GET", ts.URL+"/webhooks", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	assert.True(t, strings.Contains(string(body), id))
+	assert.False(t, strings.Contains(string(body), secret))
+	assert.False(t, strings.Contains(string(body), `"secret"`))
+
+	// the webhooks can be listed page by page
+	var ids []string
+	next := "/webhooks?limit=1"
+	for next != "" {
+		req, _ = http.NewRequest("GET", ts.URL+next, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err = http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return
+		}
+		var page struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+			Links struct {
+				Next string `json:"next"`
+			} `json:"links"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if !assert.NoError(t, err) || !assert.Len(t, page.Data, 1) {
+			return
+		}
+		ids = append(ids, page.Data[0].ID)
+		next = page.Links.Next
+	}
+	hooks, err := webhooks.List(testInstance)
+	if assert.NoError(t, err) && assert.Len(t, ids, len(hooks)) {
+		for i, w := range hooks {
+			assert.Equal(t, w.WID, ids[i])
+			assert.NotEmpty(t, w.Secret)
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", ts.URL+"/webhooks/"+id, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+	assert.Equal(t, 204, res.StatusCode)
+
+	_, err = webhooks.Get(testInstance, id)
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
+
+func TestPollingOnlyWithWebhooks(t *testing.T) {
+	hooks, err := webhooks.List(testInstance)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, w := range hooks {
+		assert.NoError(t, webhooks.Delete(testInstance, w.WID))
+	}
+	assert.False(t, webhooks.IsPolling(testInstance))
+
+	first, err := webhooks.Register(testInstance, "https://example.net/first", eventsType, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, webhooks.IsPolling(testInstance))
+	second, err := webhooks.Register(testInstance, "https://example.net/second", eventsType, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, webhooks.Delete(testInstance, first.WID))
+	assert.True(t, webhooks.IsPolling(testInstance))
+	assert.NoError(t, webhooks.Delete(testInstance, second.WID))
+	assert.False(t, webhooks.IsPolling(testInstance))
+
+	// on restart, the polling is started only if there are webhooks
+	w, err := webhooks.Register(testInstance, "https://example.net/restart", eventsType, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	webhooks.Stop(testInstance)
+	assert.False(t, webhooks.IsPolling(testInstance))
+	webhooks.Start(testInstance, testInstance.JobsBroker())
+	assert.True(t, webhooks.IsPolling(testInstance))
+	assert.NoError(t, webhooks.Delete(testInstance, w.WID))
+	assert.False(t, webhooks.IsPolling(testInstance))
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	instance.Destroy(domain)
+	var err error
+	testInstance, err = instance.Create(&instance.Options{
+		Domain: domain,
+		Locale: "en",
+	})
+	if err != nil {
+		fmt.Println("Could not create test instance.", err)
+		os.Exit(1)
+	}
+	token, _ = crypto.NewJWT(testInstance.OAuthSecret, permissions.Claims{
+		StandardClaims: jwt.StandardClaims{
+			Audience: permissions.AccessTokenAudience,
+			Issuer:   testInstance.Domain,
+			IssuedAt: crypto.Timestamp(),
+			Subject:  "testapp",
+		},
+		Scope: consts.Webhooks + " " + eventsType,
+	})
+
+	webhooks.AllowLocalURLs = true
+
+	r := echo.New()
+	r.HTTPErrorHandler = errors.ErrorHandler
+	Routes(r.Group("/webhooks", injectInstance(testInstance)))
+
+	ts = httptest.NewServer(r)
+	res := m.Run()
+	ts.Close()
+	instance.Destroy(domain)
+	os.Exit(res)
+}
+
+func injectInstance(i *instance.Instance) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("instance", i)
+			return next(c)
+		}
+	}
+}